@@ -0,0 +1,309 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// WinZip AES encryption, as read by 7-Zip, WinZip and libarchive. Entries
+// use AE-1, which keeps the CRC of the plain content since archive/zip always
+// writes it.
+const (
+	aesMethod       = 99     // Compression method of encrypted entries
+	aesExtraID      = 0x9901 // Extra field holding the real compression method
+	aesStrength256  = 3
+	aesSaltLen      = 16
+	aesKeyLen       = 32
+	aesVerifierLen  = 2
+	aesAuthCodeLen  = 10
+	aesKDFIteration = 1000
+)
+
+// aesExtra returns the extra field of an entry encrypted with AES-256 and
+// compressed with method.
+func aesExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 1) // AE-1
+	copy(extra[6:], "AE")
+	extra[8] = aesStrength256
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+// aesWriter encrypts the compressed content of one entry, which is written as
+// the salt, the password verifier, the encrypted content and an
+// authentication code over the encrypted content.
+type aesWriter struct {
+	out        io.Writer
+	prefix     []byte // Salt and verifier, archive/zip writes the entry header after creating its compressor
+	compressor io.WriteCloser
+	stream     cipher.Stream
+	mac        hash.Hash
+}
+
+// newAESWriter starts an entry encrypted with a key derived from password on
+// out. compress wraps the encrypting writer with the compression of the
+// entry, nil stores the content as is.
+func newAESWriter(out io.Writer, password string, compress func(io.Writer) (io.WriteCloser, error)) (*aesWriter, error) {
+	salt := make([]byte, aesSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keys, err := pbkdf2.Key(sha1.New, password, salt, aesKDFIteration, 2*aesKeyLen+aesVerifierLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:aesKeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	w := &aesWriter{out: out, prefix: append(salt, keys[2*aesKeyLen:]...), stream: newWinZipCTR(block), mac: hmac.New(sha1.New, keys[aesKeyLen:2*aesKeyLen])}
+	w.compressor = nopWriteCloser{encryptingWriter{w}}
+	if compress != nil {
+		if w.compressor, err = compress(encryptingWriter{w}); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+func (w *aesWriter) Write(p []byte) (int, error) {
+	return w.compressor.Write(p)
+}
+
+// Close flushes the compressor and writes the authentication code.
+func (w *aesWriter) Close() error {
+	if err := w.compressor.Close(); err != nil {
+		return err
+	}
+	if err := w.writePrefix(); err != nil {
+		return err
+	}
+	_, err := w.out.Write(w.mac.Sum(nil)[:aesAuthCodeLen])
+	return err
+}
+
+// writePrefix writes the salt and verifier ahead of the first output.
+func (w *aesWriter) writePrefix() error {
+	if w.prefix == nil {
+		return nil
+	}
+	_, err := w.out.Write(w.prefix)
+	w.prefix = nil
+	return err
+}
+
+// encryptingWriter encrypts the output of the compressor of an aesWriter.
+type encryptingWriter struct {
+	w *aesWriter
+}
+
+func (e encryptingWriter) Write(p []byte) (int, error) {
+	if err := e.w.writePrefix(); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, len(p))
+	e.w.stream.XORKeyStream(buf, p)
+	e.w.mac.Write(buf)
+	return e.w.out.Write(buf)
+}
+
+// winZipCTR is AES in counter mode with the little endian counter starting at
+// 1 used by WinZip, where cipher.NewCTR counts big endian.
+type winZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newWinZipCTR(block cipher.Block) *winZipCTR {
+	return &winZipCTR{block: block, used: aes.BlockSize}
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+// openAESEntry opens the content of the AES encrypted zip entry f with a key
+// derived from password, checking the authentication code and CRC of the
+// entry at its end.
+func openAESEntry(f *zip.File, password string) (io.ReadCloser, error) {
+	if password == "" {
+		return nil, errors.New("the entry is password protected, but no password is configured")
+	}
+	method, ok := aesMethodOf(f.Extra)
+	if !ok {
+		return nil, errors.New("the entry has no AES extra field")
+	}
+	if method != zip.Store && method != zip.Deflate && method != zstdMethod {
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+	if f.CompressedSize64 < aesSaltLen+aesVerifierLen+aesAuthCodeLen {
+		return nil, errors.New("the entry is truncated")
+	}
+
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, aesSaltLen+aesVerifierLen)
+	if _, err := io.ReadFull(raw, prefix); err != nil {
+		return nil, err
+	}
+	keys, err := pbkdf2.Key(sha1.New, password, prefix[:aesSaltLen], aesKDFIteration, 2*aesKeyLen+aesVerifierLen)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keys[2*aesKeyLen:], prefix[aesSaltLen:]) {
+		return nil, errors.New("wrong password")
+	}
+	block, err := aes.NewCipher(keys[:aesKeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &aesReader{
+		in:     io.LimitReader(raw, int64(f.CompressedSize64)-aesSaltLen-aesVerifierLen-aesAuthCodeLen),
+		raw:    raw,
+		stream: newWinZipCTR(block),
+		mac:    hmac.New(sha1.New, keys[aesKeyLen:2*aesKeyLen]),
+	}
+	var content io.Reader = r
+	switch method {
+	case zip.Deflate:
+		content = flate.NewReader(r)
+	case zstdMethod:
+		if content, err = newCommandReader(r, "zstd", "-q", "-d", "-c"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &crcReader{r: authenticatedReader{content, r}, crc: crc32.NewIEEE(), want: f.CRC32}, nil
+}
+
+// aesMethodOf returns the real compression method recorded in the AES extra
+// field of an entry, see aesExtra.
+func aesMethodOf(extra []byte) (uint16, bool) {
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == aesExtraID && size >= 7 {
+			return binary.LittleEndian.Uint16(extra[4+5:]), true
+		}
+		extra = extra[4+size:]
+	}
+	return 0, false
+}
+
+// aesReader decrypts the content of an entry written by aesWriter and checks
+// its authentication code once the content is read.
+type aesReader struct {
+	in     io.Reader // The encrypted content
+	raw    io.Reader // The whole entry, ending with the authentication code
+	stream cipher.Stream
+	mac    hash.Hash
+	done   bool // The authentication code was checked
+}
+
+func (r *aesReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	n, err := r.in.Read(p)
+	r.mac.Write(p[:n])
+	r.stream.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF {
+		code := make([]byte, aesAuthCodeLen)
+		if _, err := io.ReadFull(r.raw, code); err != nil {
+			return n, err
+		}
+		if !hmac.Equal(code, r.mac.Sum(nil)[:aesAuthCodeLen]) {
+			return n, errors.New("authentication failed, the entry is corrupted")
+		}
+		r.done = true
+	}
+	return n, err
+}
+
+// authenticatedReader reads the decompressed content of an entry and, once
+// it ends, the rest of the aesReader below it. Decompressors stop at the end
+// of their stream, before the aesReader reaches the authentication code.
+type authenticatedReader struct {
+	io.Reader
+	aes *aesReader
+}
+
+func (r authenticatedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, r.aes); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Close stops the decompressor of the entry.
+func (r authenticatedReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// crcReader checks the CRC of what it reads at the end.
+type crcReader struct {
+	r    io.Reader
+	crc  hash.Hash32
+	want uint32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF && r.crc.Sum32() != r.want {
+		return n, zip.ErrChecksum
+	}
+	return n, err
+}
+
+// Close stops the decompressor of the entry.
+func (r *crcReader) Close() error {
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
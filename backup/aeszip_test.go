@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// aesVector is the content of the known answer archives in testdata, written
+// by libarchive 3.7.7 with
+//
+//	bsdtar --format zip --options zip:encryption=aes256,zip:compression=store \
+//		--passphrase secret -cf aes-store.zip vector.txt
+//
+// and zip:compression=deflate for aes-deflate.zip. At 4700 bytes it spans
+// more than 256 AES blocks, so the low byte of the counter carries.
+func aesVector() string {
+	var b strings.Builder
+	for i := range 100 {
+		fmt.Fprintf(&b, "line %03d of the WinZip AES known answer vector\n", i)
+	}
+	return b.String()
+}
+
+// readAESEntries returns the content of every file in the zip at path, read
+// with openAESEntry.
+func readAESEntries(path, password string) (map[string]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := map[string]string{}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if f.Method != aesMethod {
+			return nil, fmt.Errorf("%s is not encrypted", f.Name)
+		}
+		content, err := openAESEntry(f, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files, nil
+}
+
+func TestOpenAESEntryKnownAnswer(t *testing.T) {
+	for _, name := range []string{"aes-store.zip", "aes-deflate.zip"} {
+		path := filepath.Join("testdata", name)
+		files, err := readAESEntries(path, "secret")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if files["vector.txt"] != aesVector() {
+			t.Errorf("%s: decrypted content differs from the vector", name)
+		}
+
+		if _, err := readAESEntries(path, "wrong"); err == nil {
+			t.Errorf("%s: opened with the wrong password", name)
+		}
+	}
+}
+
+// aesArchive archives files to a zip encrypted with password at level.
+func aesArchive(t *testing.T, files map[string]string, level int, password string) string {
+	t.Helper()
+	src := t.TempDir()
+	writeTree(t, src, files)
+	archive := filepath.Join(t.TempDir(), "src.zip")
+	if err := New(src, t.TempDir(), level, WithZipPassword(password)).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestAESZipRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"vector.txt": aesVector(),
+		"short.txt":  "short",
+		"empty.txt":  "",
+	}
+	for _, level := range []int{0, 6} {
+		archive := aesArchive(t, files, level, "secret")
+		got, err := readAESEntries(archive, "secret")
+		if err != nil {
+			t.Errorf("level %d: %v", level, err)
+			continue
+		}
+		for name, content := range files {
+			if got[name] != content {
+				t.Errorf("level %d: %s decrypted to %q, want %q", level, name, got[name], content)
+			}
+		}
+
+		if _, err := readAESEntries(archive, "wrong"); err == nil || !strings.Contains(err.Error(), "wrong password") {
+			t.Errorf("level %d: the wrong password returned %v", level, err)
+		}
+		if _, err := readAESEntries(archive, ""); err == nil {
+			t.Errorf("level %d: opened without a password", level)
+		}
+	}
+}
+
+// TestAESZipReadByLibarchive checks the archives written here against an
+// independent implementation.
+func TestAESZipReadByLibarchive(t *testing.T) {
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		t.Skip("bsdtar is not installed")
+	}
+	for _, level := range []int{0, 6} {
+		archive := aesArchive(t, map[string]string{"vector.txt": aesVector()}, level, "secret")
+		out, err := exec.Command("bsdtar", "--passphrase", "secret", "-xOf", archive, "vector.txt").Output()
+		if err != nil {
+			t.Errorf("level %d: bsdtar failed: %v", level, err)
+			continue
+		}
+		if string(out) != aesVector() {
+			t.Errorf("level %d: bsdtar decrypted different content", level)
+		}
+	}
+}
+
+func TestOpenAESEntryRejectsTampering(t *testing.T) {
+	for _, level := range []int{0, 6} {
+		archive := aesArchive(t, map[string]string{"vector.txt": aesVector()}, level, "secret")
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f *zip.File
+		for _, file := range r.File {
+			if file.Name == "vector.txt" {
+				f = file
+			}
+		}
+		start, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := start + int64(f.CompressedSize64)
+		r.Close()
+
+		for _, tt := range []struct {
+			name   string
+			offset int64
+		}{
+			{"authentication code", end - 1},
+			{"encrypted content", start + aesSaltLen + aesVerifierLen + 10},
+		} {
+			data, err := os.ReadFile(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[tt.offset] ^= 1
+			tampered := filepath.Join(t.TempDir(), "tampered.zip")
+			if err := os.WriteFile(tampered, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readAESEntries(tampered, "secret"); err == nil {
+				t.Errorf("level %d: a flipped byte in the %s was not detected", level, tt.name)
+			}
+		}
+	}
+}
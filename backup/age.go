@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// ErrNoDecryptionKey means archives can be encrypted but not decrypted on
+// this host, as with age when no identity is configured.
+var ErrNoDecryptionKey = errors.New("no key to decrypt the archive")
+
+const (
+	ageExtension = ".age"
+	ageHeader    = "age-encryption.org/v1"
+)
+
+// AgeEncryptor encrypts archives to one or more age recipients with the age
+// binary, which must be installed in the image. Only the holders of the
+// matching identities can decrypt them, so the backup host needs no secret.
+type AgeEncryptor struct {
+	recipients   []string
+	identityFile string // Optional, only used to verify archives
+}
+
+// NewAgeEncryptor creates an encryptor for the X25519 recipients, public keys
+// starting with "age1". identityFile holds a matching private key for
+// verifying archives, without it only their header is checked.
+func NewAgeEncryptor(recipients []string, identityFile string) (*AgeEncryptor, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no age recipient")
+	}
+	for _, r := range recipients {
+		if !strings.HasPrefix(r, "age1") || strings.ContainsAny(r, " \t") {
+			return nil, fmt.Errorf("invalid age recipient %q", r)
+		}
+	}
+
+	return &AgeEncryptor{recipients: slices.Sorted(slices.Values(recipients)), identityFile: identityFile}, nil
+}
+
+// KeyID lists the recipients, which are public.
+func (e *AgeEncryptor) KeyID() string     { return strings.Join(e.recipients, ",") }
+func (e *AgeEncryptor) Extension() string { return ageExtension }
+
+func (e *AgeEncryptor) Encrypt(out io.Writer) (io.WriteCloser, error) {
+	args := []string{"-e"}
+	for _, r := range e.recipients {
+		args = append(args, "-r", r)
+	}
+	return newCommandWriter(out, "age", args...)
+}
+
+// Decrypt decrypts in with the identity file. Without one it only checks the
+// age header and returns ErrNoDecryptionKey.
+func (e *AgeEncryptor) Decrypt(in io.Reader) (io.Reader, error) {
+	if e.identityFile == "" {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil || strings.TrimSuffix(line, "\n") != ageHeader {
+			return nil, errors.New("not an age encrypted archive")
+		}
+		return nil, ErrNoDecryptionKey
+	}
+	return newCommandReader(in, "age", "-d", "-i", e.identityFile)
+}
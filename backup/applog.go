@@ -0,0 +1,254 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// logMagic starts every entry in an append-only backup log.
+var logMagic = []byte("BKLOGv1\n")
+
+// LogEntry describes one archive stored in an append-only backup log. The
+// index file next to the log holds one JSON encoded LogEntry per line.
+type LogEntry struct {
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at"`
+	Offset    int64  `json:"offset"` // Position of the archive bytes inside the log
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// logIndexPath returns the path of the index that belongs to logPath.
+func logIndexPath(logPath string) string {
+	return logPath + ".idx"
+}
+
+// AppendToLog appends the archive at archivePath to the append-only log
+// configured with WithAppendLog. Each entry is written as a magic marker, a
+// length prefixed JSON header and the raw archive bytes, and is recorded in the
+// index once it is complete. Earlier entries are never touched.
+//
+// Progress is checkpointed while the archive is copied, so a large archive
+// whose append was interrupted is resumed by the next call for the same
+// archive rather than copied again from the start.
+func (b *backup) AppendToLog(name, archivePath string) (*LogEntry, error) {
+	b.logMu.Lock()
+	defer b.logMu.Unlock()
+
+	src, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %q: %w", archivePath, err)
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum archive %q: %w", archivePath, err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entry := &LogEntry{
+		Name:      name,
+		CreatedAt: time.Now().In(jkt).Format(time.RFC3339),
+		Size:      size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	logFile, err := os.OpenFile(b.AppendLogPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup log %q: %w", b.AppendLogPath, err)
+	}
+	defer logFile.Close()
+
+	ckptPath := b.AppendLogPath + ".ckpt"
+	ckpt, err := loadCheckpoint(ckptPath)
+	if err == nil {
+		if done, ok := indexedEntry(b.AppendLogPath, ckpt.Offset); ok {
+			// The entry was completed and indexed, only removing its
+			// checkpoint was interrupted. It must neither be cut off nor
+			// indexed twice.
+			if err := os.Remove(ckptPath); err != nil {
+				return nil, err
+			}
+			if ckpt.Key == name+"@"+entry.SHA256 {
+				return done, nil
+			}
+			ckpt, err = nil, os.ErrNotExist
+		}
+	}
+	var resumed *LogEntry
+	if err == nil && ckpt.Key == name+"@"+entry.SHA256 {
+		resumed, _ = readLogHeader(logFile, ckpt.Start)
+	}
+	if resumed != nil {
+		// The same archive was partially appended by an interrupted run. The
+		// index records the time its header was written with.
+		entry.CreatedAt = resumed.CreatedAt
+		entry.Offset = ckpt.Offset
+	} else {
+		if err == nil {
+			// A different archive was interrupted, or the header of its
+			// entry can't be read, so the incomplete entry is discarded.
+			// Completed entries before it are never touched.
+			if err := logFile.Truncate(ckpt.Start); err != nil {
+				return nil, fmt.Errorf("failed to discard incomplete backup log entry: %w", err)
+			}
+		}
+
+		start, err := logFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+
+		// The header records where the archive bytes begin, right after the
+		// header itself, so its length decides the offset it holds.
+		var header []byte
+		for entry.Offset = start; ; {
+			if header, err = json.Marshal(entry); err != nil {
+				return nil, err
+			}
+			offset := start + int64(len(logMagic)+4+len(header))
+			if offset == entry.Offset {
+				break
+			}
+			entry.Offset = offset
+		}
+		// The checkpoint is saved before the header is written, so a header
+		// left without its archive, whole or not, is found and discarded.
+		ckpt = &copyCheckpoint{Key: name + "@" + entry.SHA256, Start: start, Offset: entry.Offset}
+		if err := saveCheckpoint(ckptPath, ckpt); err != nil {
+			return nil, err
+		}
+		prefix := make([]byte, 0, len(logMagic)+4+len(header))
+		prefix = append(prefix, logMagic...)
+		prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(header)))
+		prefix = append(prefix, header...)
+		if _, err := logFile.Write(prefix); err != nil {
+			return nil, fmt.Errorf("failed to append %q to backup log: %w", archivePath, err)
+		}
+	}
+
+	if err := resumableCopy(logFile, src, ckptPath, ckpt, b.CheckpointInterval); err != nil {
+		return nil, fmt.Errorf("failed to append %q to backup log: %w", archivePath, err)
+	}
+
+	if err := appendLogIndex(b.AppendLogPath, entry); err != nil {
+		return nil, err
+	}
+	os.Remove(ckptPath)
+
+	return entry, nil
+}
+
+// readLogHeader returns the header of the log entry starting at start.
+func readLogHeader(r io.ReaderAt, start int64) (*LogEntry, error) {
+	prefix := make([]byte, len(logMagic)+4)
+	if _, err := r.ReadAt(prefix, start); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix[:len(logMagic)], logMagic) {
+		return nil, fmt.Errorf("no backup log entry at offset %d", start)
+	}
+	header := make([]byte, binary.BigEndian.Uint32(prefix[len(logMagic):]))
+	if _, err := r.ReadAt(header, start+int64(len(prefix))); err != nil {
+		return nil, err
+	}
+
+	var e LogEntry
+	if err := json.Unmarshal(header, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// indexedEntry returns the entry of the log at logPath whose archive bytes
+// begin at offset, if the index holds one.
+func indexedEntry(logPath string, offset int64) (*LogEntry, bool) {
+	entries, err := ReadLogIndex(logPath)
+	if err != nil {
+		return nil, false
+	}
+	for _, e := range entries {
+		if e.Offset == offset {
+			return &e, true
+		}
+	}
+	return nil, false
+}
+
+func appendLogIndex(logPath string, entry *LogEntry) error {
+	idx, err := os.OpenFile(logIndexPath(logPath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open backup log index: %w", err)
+	}
+	defer idx.Close()
+
+	line, _ := json.Marshal(entry)
+	if _, err := idx.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write backup log index: %w", err)
+	}
+
+	return idx.Sync()
+}
+
+// ReadLogIndex returns every complete entry of the append-only log at logPath,
+// oldest first.
+func ReadLogIndex(logPath string) ([]LogEntry, error) {
+	idx, err := os.Open(logIndexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	var entries []LogEntry
+	dec := json.NewDecoder(idx)
+	for {
+		var e LogEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read backup log index: %w", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// ExtractLogEntry copies the archive described by entry out of the log at
+// logPath into destPath, verifying its checksum on the way.
+func ExtractLogEntry(logPath string, entry LogEntry, destPath string) error {
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup log %q: %w", logPath, err)
+	}
+	defer logFile.Close()
+
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", destPath, err)
+	}
+	defer dst.Close()
+
+	hash := sha256.New()
+	section := io.NewSectionReader(logFile, entry.Offset, entry.Size)
+	if _, err := io.Copy(io.MultiWriter(dst, hash), section); err != nil {
+		return fmt.Errorf("failed to extract %q from backup log: %w", entry.Name, err)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.SHA256 {
+		return fmt.Errorf("checksum mismatch for %q in backup log: got %s, want %s", entry.Name, sum, entry.SHA256)
+	}
+
+	return nil
+}
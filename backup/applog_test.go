@@ -0,0 +1,286 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeArchive writes content to a file named name in dir and returns its
+// path.
+func writeArchive(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readLogHeaders parses the entry headers embedded in the log at path.
+func readLogHeaders(t *testing.T, path string) []LogEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var headers []LogEntry
+	for len(data) > 0 {
+		if !bytes.HasPrefix(data, logMagic) {
+			t.Fatalf("log entry does not start with the magic marker")
+		}
+		data = data[len(logMagic):]
+		n := binary.BigEndian.Uint32(data)
+		var e LogEntry
+		if err := json.Unmarshal(data[4:4+n], &e); err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, e)
+		data = data[4+int(n)+int(e.Size):]
+	}
+	return headers
+}
+
+func TestAppendToLogKeepsEveryEntryRestorable(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "backup.log")
+	b := New(t.TempDir(), dir, -1, WithAppendLog(logPath))
+
+	first := bytes.Repeat([]byte("first archive "), 1000)
+	if _, err := b.AppendToLog("app", writeArchive(t, dir, "a.zip", first)); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := bytes.Repeat([]byte("second "), 3000)
+	if _, err := b.AppendToLog("app", writeArchive(t, dir, "b.zip", second)); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(after, before) {
+		t.Fatal("appending the second archive changed the first entry")
+	}
+
+	entries, err := ReadLogIndex(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("index has %d entries, want 2", len(entries))
+	}
+	for i, want := range [][]byte{first, second} {
+		dest := filepath.Join(dir, "restored.zip")
+		if err := ExtractLogEntry(logPath, entries[i], dest); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		if got, _ := os.ReadFile(dest); !bytes.Equal(got, want) {
+			t.Errorf("entry %d restored %d bytes, want the %d appended", i, len(got), len(want))
+		}
+	}
+
+	for i, header := range readLogHeaders(t, logPath) {
+		if header.Offset != entries[i].Offset {
+			t.Errorf("header of entry %d records offset %d, the index %d", i, header.Offset, entries[i].Offset)
+		}
+	}
+}
+
+// interruptAppend turns the log at logPath, holding the single complete entry
+// of the archive name, into what an append interrupted after written bytes of
+// the archive leaves behind: a checkpoint, a partly copied archive followed
+// by bytes written after the checkpoint, and no index entry. With written 0
+// the append was interrupted right after writing the header, a negative
+// written cuts that many bytes off the header as well.
+func interruptAppend(t *testing.T, logPath, name string, written int64) {
+	t.Helper()
+	entries, err := ReadLogIndex(logPath)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("index: %v, %d entries", err, len(entries))
+	}
+	e := entries[0]
+
+	if err := os.Truncate(logPath, e.Offset+written); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("unsynced garbage")
+	f.Close()
+	os.Remove(logIndexPath(logPath))
+
+	ckpt := &copyCheckpoint{Key: name + "@" + e.SHA256, Start: 0, Offset: e.Offset, Written: max(written, 0)}
+	if err := saveCheckpoint(logPath+".ckpt", ckpt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendToLogResumesInterruptedArchive(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "backup.log")
+	b := New(t.TempDir(), dir, -1, WithAppendLog(logPath), WithCheckpointInterval(4096))
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096) // 64KiB, 16 checkpoints
+	archive := writeArchive(t, dir, "big.zip", content)
+	entry, err := b.AppendToLog("app", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The interrupted run started earlier than the one resuming it.
+	started := "2026-01-01T00:00:00+07:00"
+	complete, _ := os.ReadFile(logPath)
+	complete = bytes.Replace(complete, []byte(entry.CreatedAt), []byte(started), 1)
+	if err := os.WriteFile(logPath, complete, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	interruptAppend(t, logPath, "app", 5*4096)
+	if _, err := b.AppendToLog("app", archive); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, _ := os.ReadFile(logPath)
+	if !bytes.Equal(resumed, complete) {
+		t.Errorf("resumed log has %d bytes, differs from the uninterrupted %d", len(resumed), len(complete))
+	}
+	entries, err := ReadLogIndex(logPath)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("index after resuming: %v, %d entries, want 1", err, len(entries))
+	}
+	if entries[0].CreatedAt != started {
+		t.Errorf("index records the entry created at %s, its header at %s", entries[0].CreatedAt, started)
+	}
+	if err := ExtractLogEntry(logPath, entries[0], filepath.Join(dir, "out.zip")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(logPath + ".ckpt"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after the append completed: %v", err)
+	}
+}
+
+func TestAppendToLogDiscardsInterruptedOtherArchive(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "backup.log")
+	b := New(t.TempDir(), dir, -1, WithAppendLog(logPath), WithCheckpointInterval(4096))
+
+	if _, err := b.AppendToLog("app", writeArchive(t, dir, "a.zip", bytes.Repeat([]byte("a"), 20000))); err != nil {
+		t.Fatal(err)
+	}
+	interruptAppend(t, logPath, "app", 8192)
+
+	other := bytes.Repeat([]byte("b"), 5000)
+	if _, err := b.AppendToLog("web", writeArchive(t, dir, "b.zip", other)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadLogIndex(logPath)
+	if err != nil || len(entries) != 1 || entries[0].Name != "web" {
+		t.Fatalf("index: %v, %+v, want only the web entry", err, entries)
+	}
+	if entries[0].Offset >= 8192 {
+		t.Errorf("incomplete entry kept, the next one starts at %d", entries[0].Offset)
+	}
+	dest := filepath.Join(dir, "out.zip")
+	if err := ExtractLogEntry(logPath, entries[0], dest); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, other) {
+		t.Error("extracted archive differs from the appended one")
+	}
+}
+
+func TestAppendToLogAfterInterruptedHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		written int64
+		next    string // Directory of the archive appended next
+	}{
+		{"resumed after the header", 0, "app"},
+		{"other archive after the header", 0, "web"},
+		{"resumed within the header", -5, "app"},
+		{"other archive within the header", -5, "web"},
+	} {
+		dir := t.TempDir()
+		logPath := filepath.Join(dir, "backup.log")
+		b := New(t.TempDir(), dir, -1, WithAppendLog(logPath))
+		content := bytes.Repeat([]byte(tt.next), 5000)
+		if _, err := b.AppendToLog("app", writeArchive(t, dir, "app.zip", bytes.Repeat([]byte("app"), 5000))); err != nil {
+			t.Fatal(err)
+		}
+		interruptAppend(t, logPath, "app", tt.written)
+
+		if _, err := b.AppendToLog(tt.next, writeArchive(t, dir, tt.next+".zip", content)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		entries, err := ReadLogIndex(logPath)
+		if err != nil || len(entries) != 1 || entries[0].Name != tt.next {
+			t.Fatalf("%s: index %+v, %v, want only the %s entry", tt.name, entries, err, tt.next)
+		}
+		if headers := readLogHeaders(t, logPath); len(headers) != 1 || headers[0].Offset != entries[0].Offset {
+			t.Errorf("%s: log holds headers %+v, want only the indexed entry", tt.name, headers)
+		}
+		dest := filepath.Join(dir, "out.zip")
+		if err := ExtractLogEntry(logPath, entries[0], dest); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+			t.Errorf("%s: extracted archive differs from the appended one", tt.name)
+		}
+	}
+}
+
+// A crash after the index write but before the checkpoint is removed leaves
+// a checkpoint of a complete entry.
+func TestAppendToLogKeepsIndexedEntryOfStaleCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "backup.log")
+	b := New(t.TempDir(), dir, -1, WithAppendLog(logPath))
+
+	first := bytes.Repeat([]byte("a"), 20000)
+	archive := writeArchive(t, dir, "a.zip", first)
+	entry, err := b.AppendToLog("app", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := &copyCheckpoint{Key: "app@" + entry.SHA256, Start: 0, Offset: entry.Offset, Written: entry.Size}
+
+	// Retrying the same archive returns the indexed entry.
+	if err := saveCheckpoint(logPath+".ckpt", stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AppendToLog("app", archive); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ReadLogIndex(logPath); len(entries) != 1 {
+		t.Fatalf("retrying the indexed archive left %d index entries, want 1", len(entries))
+	}
+
+	// Another archive is appended after it instead of cutting it off.
+	if err := saveCheckpoint(logPath+".ckpt", stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AppendToLog("web", writeArchive(t, dir, "b.zip", []byte("other"))); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadLogIndex(logPath)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("index: %v, %d entries, want 2", err, len(entries))
+	}
+	dest := filepath.Join(dir, "out.zip")
+	if err := ExtractLogEntry(logPath, entries[0], dest); err != nil {
+		t.Fatalf("first entry cut off: %v", err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, first) {
+		t.Error("first entry changed")
+	}
+}
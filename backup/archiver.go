@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Archiver writes and checks the archives of one format. Walking the source
+// directory, excludes and file groups are shared by every format, see
+// ZipDirectoryGrouped, an Archiver only lays out the entries it is given.
+type Archiver interface {
+	// Create starts an archive of the directory src at dst.
+	Create(src, dst string) (ArchiveWriter, error)
+	// Extension returns the file extension of the archives, "" when they
+	// have none.
+	Extension() string
+	// Verify checks that the archive at path is complete and readable.
+	Verify(path string) error
+}
+
+// ArchiveWriter adds the entries of one archive.
+type ArchiveWriter interface {
+	// Add adds the file or directory described by info under the slash
+	// separated name, link being the target of a symlink. It returns the
+	// writer for the content of the entry, nil when it has none.
+	Add(name string, info fs.FileInfo, link string) (io.Writer, error)
+	Close() error
+}
+
+// ArchiverFor returns the Archiver of format, using the compression settings
+// of b. Unknown formats are written as zip.
+func (b *backup) ArchiverFor(format string) Archiver {
+	switch format {
+	case FormatTarGz, FormatTarZst, FormatTarXz, FormatTar:
+		return tarArchiver{b: b, format: format}
+	case FormatMirror:
+		return mirrorArchiver{}
+	case FormatDedup:
+		return dedupArchiver{b: b}
+	default:
+		return zipArchiver{b: b}
+	}
+}
+
+// zipArchiver writes zip archives, see zipWriter.
+type zipArchiver struct {
+	b *backup
+}
+
+func (a zipArchiver) Create(src, dst string) (ArchiveWriter, error) {
+	w, out, err := a.b.createArchiveFile(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	w.ArchiveWriter = a.b.newZipWriter(out)
+	if a.b.ForceZip64 {
+		w.finish = forceZip64
+	}
+	return w, nil
+}
+
+func (zipArchiver) Extension() string { return ".zip" }
+
+// Verify walks the central directory and checks that the local header of
+// every entry it lists can be read and that its data fits in the file. It is
+// much cheaper than checking every entry's CRC, see VerifyArchiveContent,
+// but catches truncated, unfinished or overwritten files.
+func (zipArchiver) Verify(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		offset, err := f.DataOffset()
+		if err != nil {
+			return fmt.Errorf("entry %q: %w", f.Name, err)
+		}
+		if offset+int64(f.CompressedSize64) > info.Size() {
+			return fmt.Errorf("entry %q: %w", f.Name, io.ErrUnexpectedEOF)
+		}
+	}
+	return nil
+}
+
+// tarArchiver writes tar archives, compressed as a whole unless format is
+// FormatTar, see tarWriter.
+type tarArchiver struct {
+	b      *backup
+	format string
+}
+
+func (a tarArchiver) Create(src, dst string) (ArchiveWriter, error) {
+	w, out, err := a.b.createArchiveFile(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if w.ArchiveWriter, err = a.b.newStreamWriter(a.format, out); err != nil {
+		w.file.Close()
+		os.Remove(dst)
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (a tarArchiver) Extension() string { return "." + a.format }
+
+// Verify reads the archive to the end, as tar has no central directory, which
+// also checks the checksum of its compression.
+func (a tarArchiver) Verify(path string) error {
+	switch a.format {
+	case FormatTarGz:
+		return verifyTarGz(path)
+	case FormatTarZst:
+		return readCompressed(path, "zstd", readTar)
+	case FormatTarXz:
+		return readCompressed(path, "xz", readTar)
+	default:
+		return verifyTar(path)
+	}
+}
+
+// mirrorArchiver copies the directory into a plain directory tree, see
+// mirrorWriter.
+type mirrorArchiver struct{}
+
+func (mirrorArchiver) Create(src, dst string) (ArchiveWriter, error) {
+	return newMirrorWriter(src, dst)
+}
+
+func (mirrorArchiver) Extension() string { return "" }
+
+// Verify only checks that the mirror exists.
+func (mirrorArchiver) Verify(path string) error {
+	info, err := os.Stat(path)
+	if err == nil && !info.IsDir() {
+		err = errors.New("not a directory")
+	}
+	return err
+}
+
+// createArchiveFile creates the file at dst an archive of the directory src
+// is written to. It returns the writer the archive goes to, which encrypts it
+// when src is encrypted, and the fileWriter to finish it with once the
+// ArchiveWriter is set.
+func (b *backup) createArchiveFile(src, dst string) (*fileWriter, io.Writer, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	encryption := b.encryptionForSource(src)
+	if encryption == nil {
+		return &fileWriter{file: file}, file, nil
+	}
+
+	encrypter, err := encryption.Encrypt(file)
+	if err != nil {
+		file.Close()
+		os.Remove(dst)
+		return nil, nil, err
+	}
+	return &fileWriter{file: file, encrypter: encrypter}, encrypter, nil
+}
+
+// fileWriter closes the file an archive is written to with the archive, and
+// runs finish on it once closed.
+type fileWriter struct {
+	ArchiveWriter
+	file      *os.File
+	encrypter io.WriteCloser // Between the archive and file when encrypting
+	finish    func(path string) error
+}
+
+func (w *fileWriter) Close() error {
+	err := w.ArchiveWriter.Close()
+	if w.encrypter != nil {
+		err = errors.Join(err, w.encrypter.Close())
+	}
+	if err := errors.Join(err, w.file.Close()); err != nil {
+		return err
+	}
+	if w.finish != nil {
+		if err := w.finish(w.file.Name()); err != nil {
+			return fmt.Errorf("failed to finish %q: %w", w.file.Name(), err)
+		}
+	}
+	return nil
+}
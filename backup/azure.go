@@ -0,0 +1,346 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBackend("azure", func(config func(string) string) (StorageBackend, error) {
+		container := config("AZURE_STORAGE_CONTAINER")
+		if container == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		retries, _ := strconv.Atoi(config("AZURE_RETRIES"))
+		return NewAzureBackend(AzureConfig{
+			Account:   config("AZURE_STORAGE_ACCOUNT"),
+			Container: container,
+			Prefix:    config("AZURE_STORAGE_PREFIX"),
+			SASToken:  config("AZURE_STORAGE_SAS_TOKEN"),
+			ClientID:  config("AZURE_CLIENT_ID"),
+			Endpoint:  config("AZURE_STORAGE_ENDPOINT"),
+			Retries:   retries,
+			Tier:      config("AZURE_ACCESS_TIER"),
+		}), nil
+	})
+}
+
+const (
+	azureVersion = "2021-08-06"
+	azureIMDS    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// Files up to azureMaxPutBlob are sent in a single request, larger ones
+	// are staged in blocks of azureBlockSize and committed as a block list.
+	azureMaxPutBlob = 256 << 20
+	azureBlockSize  = 64 << 20
+)
+
+// AzureConfig configures an Azure Blob Storage container. Requests
+// are authorized with SASToken when set, otherwise with a managed identity.
+type AzureConfig struct {
+	Account   string
+	Container string
+	Prefix    string // Prepended to every blob name
+	SASToken  string
+	ClientID  string // Selects a user-assigned managed identity
+	Endpoint  string // Defaults to https://<account>.blob.core.windows.net
+	Retries   int    // Attempts per request on transient errors
+	Tier      string // Access tier of new blobs: Hot, Cool, Cold or Archive, the account default when empty
+}
+
+// AzureBackend stores files in an Azure Blob Storage container.
+type AzureBackend struct {
+	cfg    AzureConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewAzureBackend creates a backend for the container described by cfg.
+func NewAzureBackend(cfg AzureConfig) *AzureBackend {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+	cfg.SASToken = strings.TrimPrefix(cfg.SASToken, "?")
+
+	return &AzureBackend{cfg: cfg, client: remoteClient}
+}
+
+// String names the destination in logs.
+func (a *AzureBackend) String() string {
+	return "azure://" + a.cfg.Account + "/" + a.cfg.Container + "/" + a.cfg.Prefix
+}
+
+// accessToken returns a cached managed identity token for blob storage.
+func (a *AzureBackend) accessToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Until(a.expiry) > 5*time.Minute {
+		return a.token, nil
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://storage.azure.com/"}}
+	if a.cfg.ClientID != "" {
+		query.Set("client_id", a.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureIMDS+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return "", &transientError{fmt.Errorf("failed to fetch managed identity token: %w", err)}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", responseError("failed to fetch managed identity token", res)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid managed identity token response: %w", err)
+	}
+	expiresOn, _ := strconv.ParseInt(token.ExpiresOn, 10, 64)
+
+	a.token = token.AccessToken
+	a.expiry = time.Unix(expiresOn, 0)
+	return a.token, nil
+}
+
+// do sends a request to the blob named key, or to the container when key is
+// empty, retrying transient failures, and hands a 2xx response to handle.
+// body is called once per attempt so every attempt gets a fresh reader.
+func (a *AzureBackend) do(ctx context.Context, method, key string, query url.Values, header http.Header, size int64, body func() (io.Reader, error), handle func(*http.Response) error) error {
+	target := strings.TrimSuffix(a.cfg.Endpoint, "/") + "/" + a.cfg.Container
+	if key != "" {
+		target += "/" + (&url.URL{Path: a.cfg.Prefix + key}).EscapedPath()
+	}
+	rawQuery := query.Encode()
+	if a.cfg.SASToken != "" {
+		rawQuery = strings.TrimPrefix(rawQuery+"&"+a.cfg.SASToken, "&")
+	}
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	return retryTransient(ctx, a.cfg.Retries, func() error {
+		var reader io.Reader
+		if body != nil {
+			var err error
+			if reader, err = body(); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("x-ms-version", azureVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		if a.cfg.SASToken == "" {
+			token, err := a.accessToken(ctx)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := a.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{err}
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode/100 != 2 {
+			return responseError(method+" "+a.String()+key, res)
+		}
+		if handle != nil {
+			return handle(res)
+		}
+		return nil
+	})
+}
+
+// Put stores the file at localPath as the blob key, in blocks when it is too
+// large for a single request.
+func (a *AzureBackend) Put(ctx context.Context, localPath, key string) error {
+	if err := a.put(ctx, localPath, key); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, a, err)
+	}
+	return nil
+}
+
+func (a *AzureBackend) put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if a.cfg.Tier != "" && useStorageClass(ctx) {
+		header.Set("x-ms-access-tier", a.cfg.Tier)
+	}
+	if info.Size() <= azureMaxPutBlob {
+		header.Set("x-ms-blob-type", "BlockBlob")
+		return a.do(ctx, http.MethodPut, key, nil, header, info.Size(), func() (io.Reader, error) {
+			_, err := file.Seek(0, io.SeekStart)
+			return io.NopCloser(file), err
+		}, nil)
+	}
+
+	var blocks []string
+	for offset := int64(0); offset < info.Size(); offset += azureBlockSize {
+		id := base64.StdEncoding.EncodeToString(fmt.Appendf(nil, "block-%08d", len(blocks)))
+		size := min(azureBlockSize, info.Size()-offset)
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		err := a.do(ctx, http.MethodPut, key, query, nil, size, func() (io.Reader, error) {
+			return io.NopCloser(io.NewSectionReader(file, offset, size)), nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, id)
+	}
+
+	list, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: blocks})
+	if err != nil {
+		return err
+	}
+	list = append([]byte(xml.Header), list...)
+
+	header.Set("x-ms-blob-content-type", "application/octet-stream")
+	header.Set("Content-Type", "application/xml")
+	return a.do(ctx, http.MethodPut, key, url.Values{"comp": {"blocklist"}}, header, int64(len(list)), func() (io.Reader, error) {
+		return bytes.NewReader(list), nil
+	}, nil)
+}
+
+// VerifyChecksum compares the Content-MD5 of the blob stored under key with
+// the file at localPath. Blobs committed from blocks carry no Content-MD5 and
+// are not verified.
+func (a *AzureBackend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	var remote string
+	err := a.do(ctx, http.MethodHead, key, nil, nil, 0, nil, func(res *http.Response) error {
+		remote = res.Header.Get("Content-MD5")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if remote == "" {
+		return errNoChecksum
+	}
+
+	sum, err := fileHash(localPath, md5.New())
+	if err != nil {
+		return err
+	}
+	if local := base64.StdEncoding.EncodeToString(sum); remote != local {
+		return checksumMismatch("Content-MD5", remote, local)
+	}
+	return nil
+}
+
+// Get writes the blob stored under key to w.
+func (a *AzureBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	err := a.do(ctx, http.MethodGet, key, nil, nil, 0, nil, func(res *http.Response) error {
+		_, err := io.Copy(w, res.Body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, a, err)
+	}
+	return nil
+}
+
+// List returns the blobs whose name starts with prefix.
+func (a *AzureBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	var objects []StoredObject
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {a.cfg.Prefix + prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		var page struct {
+			Blobs []struct {
+				Name       string `xml:"Name"`
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				} `xml:"Properties"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err := a.do(ctx, http.MethodGet, "", query, nil, 0, nil, func(res *http.Response) error {
+			return xml.NewDecoder(res.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", a, err)
+		}
+
+		for _, blob := range page.Blobs {
+			modTime, _ := http.ParseTime(blob.Properties.LastModified)
+			objects = append(objects, StoredObject{
+				Key:     strings.TrimPrefix(blob.Name, a.cfg.Prefix),
+				Size:    blob.Properties.ContentLength,
+				ModTime: modTime,
+			})
+		}
+
+		if page.NextMarker == "" {
+			return objects, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// Delete removes the blob stored under key.
+func (a *AzureBackend) Delete(ctx context.Context, key string) error {
+	if err := a.do(ctx, http.MethodDelete, key, nil, nil, 0, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, a, err)
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+func init() {
+	RegisterBackend("b2", func(config func(string) string) (StorageBackend, error) {
+		bucket := config("B2_BUCKET")
+		if bucket == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		partSize, _ := ParseSize(config("B2_PART_SIZE"))
+		return NewB2Backend(B2Config{
+			KeyID:          config("B2_KEY_ID"),
+			ApplicationKey: config("B2_APPLICATION_KEY"),
+			Bucket:         bucket,
+			Prefix:         config("B2_PREFIX"),
+			PartSize:       partSize,
+		}), nil
+	})
+}
+
+// B2Config configures a Backblaze B2 bucket accessed through the native API.
+type B2Config struct {
+	KeyID          string
+	ApplicationKey string
+	Bucket         string
+	Prefix         string // Prepended to every file name
+	PartSize       int64  // Large file part size, defaults to the account's recommendation
+	Retries        int    // Attempts per request on transient errors
+}
+
+// B2Backend stores files in a Backblaze B2 bucket. Files larger than the
+// part size are uploaded as B2 large files.
+type B2Backend struct {
+	cfg    B2Config
+	client *http.Client
+
+	mu       sync.Mutex
+	auth     *b2Auth
+	bucketID string
+}
+
+type b2Auth struct {
+	AccountID           string `json:"accountId"`
+	AuthorizationToken  string `json:"authorizationToken"`
+	APIURL              string `json:"apiUrl"`
+	DownloadURL         string `json:"downloadUrl"`
+	RecommendedPartSize int64  `json:"recommendedPartSize"`
+	Allowed             struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// b2UploadURL is where a single file or part is sent.
+type b2UploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// NewB2Backend creates a backend for the bucket described by cfg.
+func NewB2Backend(cfg B2Config) *B2Backend {
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+
+	return &B2Backend{cfg: cfg, client: remoteClient}
+}
+
+// String names the destination in logs.
+func (b *B2Backend) String() string {
+	return "b2://" + b.cfg.Bucket + "/" + b.cfg.Prefix
+}
+
+// authorize returns the cached account authorization and bucket ID, logging
+// in first when needed.
+func (b *B2Backend) authorize(ctx context.Context) (*b2Auth, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.auth != nil {
+		return b.auth, b.bucketID, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b2AuthorizeURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.SetBasicAuth(b.cfg.KeyID, b.cfg.ApplicationKey)
+
+	var auth b2Auth
+	if err := b.send(req, &auth); err != nil {
+		return nil, "", fmt.Errorf("failed to authorize B2 account: %w", err)
+	}
+
+	bucketID := auth.Allowed.BucketID
+	if bucketID == "" || auth.Allowed.BucketName != b.cfg.Bucket {
+		var buckets struct {
+			Buckets []struct {
+				BucketID string `json:"bucketId"`
+			} `json:"buckets"`
+		}
+		err := b.call(ctx, &auth, "b2_list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": b.cfg.Bucket}, &buckets)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up B2 bucket %q: %w", b.cfg.Bucket, err)
+		}
+		if len(buckets.Buckets) == 0 {
+			return nil, "", fmt.Errorf("B2 bucket %q not found", b.cfg.Bucket)
+		}
+		bucketID = buckets.Buckets[0].BucketID
+	}
+
+	b.auth, b.bucketID = &auth, bucketID
+	return b.auth, b.bucketID, nil
+}
+
+// reauthorize drops the cached authorization after it expired.
+func (b *B2Backend) reauthorize() {
+	b.mu.Lock()
+	b.auth = nil
+	b.mu.Unlock()
+}
+
+// send performs req and decodes the JSON reply into out. Expired tokens,
+// throttling and server errors are transient.
+func (b *B2Backend) send(req *http.Request, out any) error {
+	res, err := b.client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return err
+		}
+		return &transientError{err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized && req.URL.String() != b2AuthorizeURL {
+		b.reauthorize()
+		return &transientError{responseError(req.URL.Path, res)}
+	}
+	if res.StatusCode != http.StatusOK {
+		return responseError(req.URL.Path, res)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// call invokes a B2 API operation with a JSON request body.
+func (b *B2Backend) call(ctx context.Context, auth *b2Auth, operation string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.APIURL+"/b2api/v2/"+operation, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+
+	return b.send(req, out)
+}
+
+// invoke calls operation with the current authorization, retrying transient
+// errors.
+func (b *B2Backend) invoke(ctx context.Context, operation string, in, out any) error {
+	return retryTransient(ctx, b.cfg.Retries, func() error {
+		auth, _, err := b.authorize(ctx)
+		if err != nil {
+			return err
+		}
+		return b.call(ctx, auth, operation, in, out)
+	})
+}
+
+// upload sends section to an upload URL obtained from operation, retrying
+// with a fresh URL on transient errors as B2 requires. It returns the SHA-1
+// of the uploaded data.
+func (b *B2Backend) upload(ctx context.Context, operation string, params func(bucketID string) any, header http.Header, section *io.SectionReader) (string, error) {
+	digest := sha1.New()
+	if _, err := io.Copy(digest, section); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(digest.Sum(nil))
+	header.Set("X-Bz-Content-Sha1", sum)
+
+	return sum, retryTransient(ctx, b.cfg.Retries, func() error {
+		auth, bucketID, err := b.authorize(ctx)
+		if err != nil {
+			return err
+		}
+
+		var target b2UploadURL
+		if err := b.call(ctx, auth, operation, params(bucketID), &target); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.UploadURL, io.NopCloser(io.NewSectionReader(section, 0, section.Size())))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = section.Size()
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Authorization", target.AuthorizationToken)
+
+		return b.send(req, nil)
+	})
+}
+
+// Put stores the file at localPath under the file name key.
+func (b *B2Backend) Put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	auth, _, err := b.authorize(ctx)
+	if err != nil {
+		return err
+	}
+	partSize := b.cfg.PartSize
+	if partSize <= 0 {
+		partSize = auth.RecommendedPartSize
+	}
+
+	name := b.cfg.Prefix + key
+	if info.Size() <= partSize {
+		header := http.Header{
+			"X-Bz-File-Name": {awsEscapePath(name)},
+			"Content-Type":   {"b2/x-auto"},
+		}
+		params := func(bucketID string) any { return map[string]string{"bucketId": bucketID} }
+		if _, err := b.upload(ctx, "b2_get_upload_url", params, header, io.NewSectionReader(file, 0, info.Size())); err != nil {
+			return fmt.Errorf("failed to upload %q to %s: %w", localPath, b, err)
+		}
+		return nil
+	}
+
+	if err := b.uploadLarge(ctx, file, info.Size(), partSize, name); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, b, err)
+	}
+	return nil
+}
+
+// uploadLarge uploads file in parts as a B2 large file, cancelling the large
+// file when a part fails so no unfinished parts are billed.
+func (b *B2Backend) uploadLarge(ctx context.Context, file *os.File, size, partSize int64, name string) error {
+	_, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Large files have no contentSha1, the SHA-1 of the whole file is kept
+	// in its info instead so the upload can be verified.
+	digest := sha1.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(file, 0, size)); err != nil {
+		return err
+	}
+
+	var started struct {
+		FileID string `json:"fileId"`
+	}
+	err = b.invoke(ctx, "b2_start_large_file", map[string]any{
+		"bucketId":    bucketID,
+		"fileName":    name,
+		"contentType": "b2/x-auto",
+		"fileInfo":    map[string]string{"large_file_sha1": hex.EncodeToString(digest.Sum(nil))},
+	}, &started)
+	if err != nil {
+		return err
+	}
+
+	var sha1s []string
+	for offset := int64(0); offset < size; offset += partSize {
+		header := http.Header{"X-Bz-Part-Number": {strconv.Itoa(len(sha1s) + 1)}}
+		params := func(string) any { return map[string]string{"fileId": started.FileID} }
+		sum, err := b.upload(ctx, "b2_get_upload_part_url", params, header, io.NewSectionReader(file, offset, min(partSize, size-offset)))
+		if err != nil {
+			b.cancelLarge(ctx, started.FileID)
+			return err
+		}
+		sha1s = append(sha1s, sum)
+	}
+
+	if err := b.invoke(ctx, "b2_finish_large_file", map[string]any{"fileId": started.FileID, "partSha1Array": sha1s}, nil); err != nil {
+		b.cancelLarge(ctx, started.FileID)
+		return err
+	}
+
+	return nil
+}
+
+// cancelLarge discards the parts of an unfinished large file, see
+// cleanupContext, as the upload's ctx may be cancelled.
+func (b *B2Backend) cancelLarge(ctx context.Context, fileID string) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	if err := b.invoke(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil); err != nil {
+		fmt.Printf("Warning: failed to cancel unfinished B2 large file %s: %v\n", fileID, err)
+	}
+}
+
+// Get writes the file stored under key to w.
+func (b *B2Backend) Get(ctx context.Context, key string, w io.Writer) error {
+	err := retryTransient(ctx, b.cfg.Retries, func() error {
+		auth, _, err := b.authorize(ctx)
+		if err != nil {
+			return err
+		}
+
+		target := auth.DownloadURL + "/file/" + awsEscape(b.cfg.Bucket) + "/" + awsEscapePath(b.cfg.Prefix+key)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+
+		res, err := b.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{err}
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusUnauthorized {
+			b.reauthorize()
+			return &transientError{responseError(req.URL.Path, res)}
+		}
+		if res.StatusCode != http.StatusOK {
+			return responseError(req.URL.Path, res)
+		}
+
+		_, err = io.Copy(w, res.Body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, b, err)
+	}
+
+	return nil
+}
+
+// VerifyChecksum compares the SHA-1 B2 holds for the file stored under key
+// with the file at localPath.
+func (b *B2Backend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	_, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	var page struct {
+		Files []struct {
+			FileName    string            `json:"fileName"`
+			ContentSha1 string            `json:"contentSha1"`
+			FileInfo    map[string]string `json:"fileInfo"`
+		} `json:"files"`
+	}
+	params := map[string]any{"bucketId": bucketID, "startFileName": b.cfg.Prefix + key, "maxFileCount": 1}
+	if err := b.invoke(ctx, "b2_list_file_names", params, &page); err != nil {
+		return err
+	}
+	if len(page.Files) == 0 || page.Files[0].FileName != b.cfg.Prefix+key {
+		return fmt.Errorf("%q not found", key)
+	}
+
+	remote := strings.TrimPrefix(page.Files[0].ContentSha1, "unverified:")
+	if remote == "" || remote == "none" {
+		remote = page.Files[0].FileInfo["large_file_sha1"]
+	}
+	if remote == "" {
+		return errNoChecksum
+	}
+
+	sum, err := fileHash(localPath, sha1.New())
+	if err != nil {
+		return err
+	}
+	if local := hex.EncodeToString(sum); remote != local {
+		return checksumMismatch("SHA-1", remote, local)
+	}
+	return nil
+}
+
+// b2File is an entry of a file name or version listing.
+type b2File struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	ContentLength   int64  `json:"contentLength"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+	Action          string `json:"action"`
+}
+
+// List returns the files whose name starts with prefix.
+func (b *B2Backend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	_, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []StoredObject
+	params := map[string]any{"bucketId": bucketID, "prefix": b.cfg.Prefix + prefix, "maxFileCount": 1000}
+	for {
+		var page struct {
+			Files        []b2File `json:"files"`
+			NextFileName *string  `json:"nextFileName"`
+		}
+		if err := b.invoke(ctx, "b2_list_file_names", params, &page); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", b, err)
+		}
+
+		for _, file := range page.Files {
+			if file.Action != "upload" {
+				continue
+			}
+			objects = append(objects, StoredObject{
+				Key:     strings.TrimPrefix(file.FileName, b.cfg.Prefix),
+				Size:    file.ContentLength,
+				ModTime: time.UnixMilli(file.UploadTimestamp),
+			})
+		}
+
+		if page.NextFileName == nil {
+			return objects, nil
+		}
+		params["startFileName"] = *page.NextFileName
+	}
+}
+
+// Delete removes every version of the file stored under key, so it no longer
+// takes up space.
+func (b *B2Backend) Delete(ctx context.Context, key string) error {
+	_, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := b.cfg.Prefix + key
+	var versions struct {
+		Files []b2File `json:"files"`
+	}
+	params := map[string]any{"bucketId": bucketID, "prefix": name, "startFileName": name, "maxFileCount": 1000}
+	if err := b.invoke(ctx, "b2_list_file_versions", params, &versions); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, b, err)
+	}
+
+	for _, file := range versions.Files {
+		if file.FileName != name {
+			continue
+		}
+		if err := b.invoke(ctx, "b2_delete_file_version", map[string]string{"fileName": file.FileName, "fileId": file.FileID}, nil); err != nil {
+			return fmt.Errorf("failed to delete %q from %s: %w", key, b, err)
+		}
+	}
+
+	return nil
+}
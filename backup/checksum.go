@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// ErrChecksumMismatch is returned when the checksum a backend reports for an
+// uploaded file differs from the checksum of the local file.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// errNoChecksum is returned by VerifyChecksum when the backend has no
+// checksum to compare for an object, e.g. S3 objects encrypted with SSE-KMS.
+var errNoChecksum = errors.New("no checksum available")
+
+// ChecksumVerifier is implemented by backends that can compare the checksum
+// of a stored object with a local file.
+type ChecksumVerifier interface {
+	VerifyChecksum(ctx context.Context, localPath, key string) error
+}
+
+// verifyUpload compares the file uploaded to s under key with localPath when
+// s supports it.
+func (b *backup) verifyUpload(ctx context.Context, s StorageBackend, localPath, key string) error {
+	verifier, ok := s.(ChecksumVerifier)
+	if !b.VerifyUploads || !ok {
+		return nil
+	}
+
+	err := verifier.VerifyChecksum(ctx, localPath, key)
+	if errors.Is(err, errNoChecksum) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify %q on %s: %w", localPath, destinationName(s), err)
+	}
+	return nil
+}
+
+// fileHash returns the digest h computes over the file at path.
+func fileHash(path string, h hash.Hash) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, fmt.Errorf("failed to checksum %q: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// RecordChecksums stores the SHA-256 of every file of record, its archives
+// or their volumes once split, in record, as the reference later checks of
+// local and remote copies compare with. With ManifestFileChecksums the
+// checksums of the archived files are copied from the metadata sidecars as
+// well. Mirrors and streamed archives have no archive file to checksum.
+func (b *backup) RecordChecksums(record *ArchiveRecord) error {
+	record.SHA256 = nil
+	if archiveFormat(record.Path) != FormatMirror {
+		for _, path := range record.archives() {
+			sum, err := fileHash(path, sha256.New())
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if record.SHA256 == nil {
+				record.SHA256 = make(map[string]string)
+			}
+			record.SHA256[path] = hex.EncodeToString(sum)
+		}
+	}
+
+	if !b.ManifestFileChecksums {
+		return nil
+	}
+	record.FileSHA256 = nil
+	// The sidecar of the archive lists the files of its groups as well.
+	data, err := os.ReadFile(SidecarPath(record.Path))
+	if err != nil {
+		return err
+	}
+	var files []FileMetadata
+	if err := json.Unmarshal(data, &files); err != nil {
+		return fmt.Errorf("invalid metadata sidecar %q: %w", SidecarPath(record.Path), err)
+	}
+	for _, file := range files {
+		if file.SHA256 == "" {
+			continue
+		}
+		if record.FileSHA256 == nil {
+			record.FileSHA256 = make(map[string]string)
+		}
+		record.FileSHA256[file.Path] = file.SHA256
+	}
+	return nil
+}
+
+// checksumMismatch describes a remote checksum differing from the local one.
+func checksumMismatch(algorithm, remote, local string) error {
+	return fmt.Errorf("%w: %s is %s remotely and %s locally", ErrChecksumMismatch, algorithm, remote, local)
+}
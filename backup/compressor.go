@@ -0,0 +1,170 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultZstdLevel is the level of zstd itself, a good trade-off of speed
+	// and size for backups.
+	defaultZstdLevel = 3
+	// defaultXzLevel is the level of xz itself.
+	defaultXzLevel = 6
+)
+
+// zstdMethod is the zip compression method of zstd, picked per file by the
+// size rules, see ParseSizeRules.
+const zstdMethod = 93
+
+func init() {
+	zip.RegisterDecompressor(zstdMethod, func(in io.Reader) io.ReadCloser {
+		r, err := newCommandReader(in, "zstd", "-q", "-d", "-c")
+		if err != nil {
+			return io.NopCloser(failedReader{err})
+		}
+		return r
+	})
+}
+
+// commandWriter compresses its input by piping it through an external
+// compressor, which must be installed in the image.
+type commandWriter struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+// newCommandWriter starts the compressor name writing to out.
+func newCommandWriter(out io.Writer, name string, args ...string) (*commandWriter, error) {
+	w := &commandWriter{name: name, cmd: exec.Command(name, args...)}
+	w.cmd.Stdout = out
+	w.cmd.Stderr = &w.stderr
+	stdin, err := w.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.stdin = stdin
+	if err := w.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	return w, nil
+}
+
+// newZstdWriter starts zstd writing to out. Levels above 19 enable the ultra
+// levels up to 22, workers of 0 use one thread per core.
+func newZstdWriter(out io.Writer, level, workers int) (*commandWriter, error) {
+	args := []string{"-q", "-c", "-T" + strconv.Itoa(max(workers, 0))}
+	if level > 19 {
+		args = append(args, "--ultra")
+	}
+	return newCommandWriter(out, "zstd", append(args, "-"+strconv.Itoa(level))...)
+}
+
+// newXzWriter starts xz writing to out with one thread per core.
+func newXzWriter(out io.Writer, level int) (*commandWriter, error) {
+	return newCommandWriter(out, "xz", "-q", "-c", "-T0", "-"+strconv.Itoa(level))
+}
+
+func (w *commandWriter) Write(p []byte) (int, error) {
+	n, err := w.stdin.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%s: %w: %s", w.name, err, strings.TrimSpace(w.stderr.String()))
+	}
+	return n, nil
+}
+
+// Close ends the input and waits until the compressor has written everything.
+func (w *commandWriter) Close() error {
+	if w.cmd.ProcessState != nil {
+		return nil
+	}
+	w.stdin.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %w: %s", w.name, err, strings.TrimSpace(w.stderr.String()))
+	}
+	return nil
+}
+
+// readCompressed decompresses the file at path with the compressor name and
+// hands the output to read. It fails when the compressor finds the file
+// corrupted.
+func readCompressed(path, name string, read func(io.Reader) error) error {
+	cmd := exec.Command(name, "-q", "-d", "-c", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	readErr := read(stdout)
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return readErr
+}
+
+// commandReader reads the output of a command decoding its input, failing
+// at the end of the output when the command does.
+type commandReader struct {
+	name   string
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+}
+
+// newCommandReader starts name decoding in.
+func newCommandReader(in io.Reader, name string, args ...string) (*commandReader, error) {
+	r := &commandReader{name: name, cmd: exec.Command(name, args...)}
+	r.cmd.Stdin = in
+	r.cmd.Stderr = &r.stderr
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.stdout = stdout
+	if err := r.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	return r, nil
+}
+
+// Close stops the command when its output was not read to the end.
+func (r *commandReader) Close() error {
+	if r.cmd.ProcessState != nil {
+		return nil
+	}
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+	return nil
+}
+
+// failedReader fails every read with err.
+type failedReader struct {
+	err error
+}
+
+func (r failedReader) Read([]byte) (int, error) { return 0, r.err }
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF && r.cmd.ProcessState == nil {
+		if waitErr := r.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("%s: %w: %s", r.name, waitErr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return n, err
+}
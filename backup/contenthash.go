@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// HashContent sets the ContentHash of entry from what its archive would
+// hold: the path, mode and content of every file and directory below its
+// source directory that is not excluded, and the target of every symlink.
+// Each file is hashed on its own and the directory hash aggregates them in
+// walk order, so renames, additions and deletions change it while timestamps
+// do not. See ContentChangeDetection.
+func (b *backup) HashContent(entry *DirectoryEntry) error {
+	entry.ContentHash = ""
+	sourcePath := b.SourceDir(entry)
+
+	digest := sha256.New()
+	err := b.walkSource(sourcePath, func(path, relPath string, d fs.DirEntry, info fs.FileInfo) error {
+		var content string
+		var err error
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			if content, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink %q: %w", path, err)
+			}
+		case d.Type().IsRegular():
+			sum, err := fileHash(path, sha256.New())
+			if err != nil {
+				return err
+			}
+			content = hex.EncodeToString(sum)
+		}
+		fmt.Fprintf(digest, "%s\x00%o\x00%s\n", relPath, info.Mode(), content)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entry.ContentHash = hex.EncodeToString(digest.Sum(nil))
+	return nil
+}
+
+// RecordContents hashes every file below the source directory of entry for
+// the duplicates of the run report, see DetectDuplicates. Archiving records
+// the files it reads, this covers the directories not archived in the run.
+func (b *backup) RecordContents(entry *DirectoryEntry) error {
+	return b.walkSource(b.SourceDir(entry), func(path, relPath string, d fs.DirEntry, info fs.FileInfo) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return b.recordContent(path, info)
+	})
+}
+
+// recordContent hashes the file at path for the duplicates of the run report.
+func (b *backup) recordContent(path string, info fs.FileInfo) error {
+	sum, err := fileHash(path, sha256.New())
+	if err != nil {
+		return err
+	}
+	b.report.recordContent(hex.EncodeToString(sum), info.Size(), path)
+	return nil
+}
+
+// walkSource calls fn for every file and directory below sourcePath that an
+// archive of it holds, skipping excluded and reserved paths like
+// ZipDirectoryGrouped, with the slash separated path relative to
+// sourcePath.
+func (b *backup) walkSource(sourcePath string, fn func(path, relPath string, d fs.DirEntry, info fs.FileInfo) error) error {
+	excludes := b.newExcludeMatcher(sourcePath)
+	return filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if b.isReserved(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, excluded := excludes.match(path, d.IsDir()); excluded {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			excludes.enter(path)
+		}
+
+		relPath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path for %q: %w", path, err)
+		}
+		if relPath == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+		return fn(path, filepath.ToSlash(relPath), d, info)
+	})
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashContent(t *testing.T) {
+	src := t.TempDir()
+	app := filepath.Join(src, "app")
+	writeTree(t, app, map[string]string{"a.txt": "aaa", "sub/b.txt": "bbb"})
+	b := New(src, t.TempDir(), -1, WithExcludes("*.log"))
+	entry := &DirectoryEntry{Name: "app"}
+	hash := func() string {
+		t.Helper()
+		if err := b.HashContent(entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry.ContentHash
+	}
+	initial := hash()
+
+	for _, tt := range []struct {
+		name    string
+		change  func()
+		changed bool
+	}{
+		{"touched", func() {
+			at := time.Now().Add(time.Hour)
+			for _, name := range []string{"a.txt", "sub/b.txt", "sub"} {
+				if err := os.Chtimes(filepath.Join(app, name), at, at); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, false},
+		{"rewritten unchanged", func() { writeTree(t, app, map[string]string{"a.txt": "aaa"}) }, false},
+		{"excluded file added", func() { writeTree(t, app, map[string]string{"debug.log": "noise"}) }, false},
+		{"content changed, same size", func() { writeTree(t, app, map[string]string{"a.txt": "aab"}) }, true},
+		{"renamed", func() {
+			if err := os.Rename(filepath.Join(app, "sub", "b.txt"), filepath.Join(app, "sub", "c.txt")); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"file added", func() { writeTree(t, app, map[string]string{"new.txt": ""}) }, true},
+		{"mode changed", func() {
+			if err := os.Chmod(filepath.Join(app, "a.txt"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	} {
+		before := hash()
+		tt.change()
+		if after := hash(); (after != before) != tt.changed {
+			t.Errorf("%s: hash %s became %s, want changed %v", tt.name, before, after, tt.changed)
+		}
+	}
+	if hash() == initial {
+		t.Error("the content changed but hashes as it did at first")
+	}
+}
+
+func TestHashContentOfUnreadableSource(t *testing.T) {
+	b := New(t.TempDir(), t.TempDir(), -1)
+	entry := &DirectoryEntry{Name: "gone", ContentHash: "stale"}
+	if err := b.HashContent(entry); err == nil {
+		t.Error("hashing a missing directory succeeded")
+	}
+	if entry.ContentHash != "" {
+		t.Errorf("a failed hash left ContentHash %q, want it cleared so times are compared", entry.ContentHash)
+	}
+}
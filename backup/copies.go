@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	// ErrNoOffsiteBackend is returned when 3-2-1 mode has nowhere to keep
+	// the offsite copy.
+	ErrNoOffsiteBackend = errors.New("3-2-1 mode needs a storage backend other than local")
+	// ErrNoRemoteBackend is returned when remote-only mode has nowhere to
+	// keep the archives.
+	ErrNoRemoteBackend = errors.New("remote-only mode needs a storage backend")
+)
+
+// MissingCopy is an archive absent from one of the locations that should
+// hold it.
+type MissingCopy struct {
+	Archive  string `json:"archive"`
+	Location string `json:"location"` // "local" or the storage backend
+}
+
+// CheckStorage reports whether the configured backends can hold the copies
+// 3-2-1 and remote-only mode require, and can take streamed archives.
+func (b *backup) CheckStorage() error {
+	if b.RemoteOnly && b.ThreeTwoOne {
+		return errors.New("3-2-1 mode keeps a local copy of every archive and cannot be combined with remote-only mode")
+	}
+	if b.RemoteOnly && len(b.Backends) == 0 {
+		return ErrNoRemoteBackend
+	}
+	if b.StreamUploads {
+		if err := b.checkStreaming(); err != nil {
+			return err
+		}
+	}
+	if !b.ThreeTwoOne {
+		return nil
+	}
+
+	for _, s := range b.Backends {
+		if _, local := s.(*LocalBackend); !local {
+			return nil
+		}
+	}
+	return ErrNoOffsiteBackend
+}
+
+// VerifyCopies checks that every archive in the history of manifest exists
+// both in the output directory and on every backend. The outcome is recorded
+// in the archive records and the report, and the missing copies are
+// returned. A backend that cannot be listed is skipped with a warning.
+func (b *backup) VerifyCopies(ctx context.Context, manifest []*DirectoryEntry) []MissingCopy {
+	stored := make(map[string]map[string]bool, len(b.Backends))
+	for _, s := range b.Backends {
+		listCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.List)
+		objects, err := s.List(listCtx, "")
+		cancel()
+		if err != nil {
+			fmt.Printf("Warning: cannot verify copies on %s: %v\n", destinationName(s), err)
+			continue
+		}
+
+		keys := make(map[string]bool, len(objects))
+		for _, object := range objects {
+			keys[object.Key] = true
+		}
+		stored[destinationName(s)] = keys
+	}
+
+	verifiedAt := time.Now().In(jkt).Format(time.RFC3339)
+	var missing []MissingCopy
+	for _, entry := range manifest {
+		for i := range entry.History {
+			record := &entry.History[i]
+			archives := record.archives()
+
+			record.LocalMissing = false
+			for _, path := range archives {
+				if _, err := os.Stat(path); err != nil {
+					record.LocalMissing = true
+					missing = append(missing, MissingCopy{Archive: path, Location: "local"})
+				}
+			}
+
+			for name, keys := range stored {
+				status := DestinationStatus{OK: true, VerifiedAt: verifiedAt}
+				if previous, ok := record.Destinations[name]; ok {
+					status.UploadedAt = previous.UploadedAt
+				}
+				for _, path := range archives {
+					if !keys[b.remoteKey(path)] {
+						status.OK = false
+						status.Error = "missing at verification"
+						missing = append(missing, MissingCopy{Archive: path, Location: name})
+					}
+				}
+
+				if record.Destinations == nil {
+					record.Destinations = make(map[string]DestinationStatus)
+				}
+				record.Destinations[name] = status
+			}
+		}
+	}
+
+	for _, m := range missing {
+		fmt.Printf("Warning: archive %q is missing from %s\n", m.Archive, m.Location)
+	}
+	b.report.mu.Lock()
+	b.report.MissingCopies = missing
+	b.report.mu.Unlock()
+
+	return missing
+}
@@ -0,0 +1,545 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sizes of the chunks files are split into in dedup archives. A chunk ends
+// where the rolling hash of its last bytes has chunkMaskBits zero bits, so
+// chunks average about 1MiB and an insertion only changes the chunks around
+// it, not every chunk after it.
+const (
+	chunkMinSize  = 256 << 10
+	chunkMaxSize  = 8 << 20
+	chunkMaskBits = 20
+)
+
+// gearTable holds the random values of every byte the rolling hash adds in.
+// It is derived from a fixed seed, as changing it changes every chunk
+// boundary and so the chunks already stored.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.LittleEndian.Uint64(sum[:])
+	}
+	return table
+}()
+
+// ChunkStorePath returns the directory the chunks of dedup archives are
+// stored in, each once, as "<id[:2]>/<id>" with the SHA-256 of the chunk as
+// its id, compressed with deflate. See FormatDedup.
+func (b *backup) ChunkStorePath() string {
+	return filepath.Join(b.OutputPath, "chunks")
+}
+
+// chunkPath returns where the chunk with the given id is stored.
+func (b *backup) chunkPath(id string) string {
+	return filepath.Join(b.ChunkStorePath(), id[:2], id)
+}
+
+// dedupEntry is a file, directory or symlink in a dedup archive. The content
+// of a file is the concatenation of its chunks.
+type dedupEntry struct {
+	Name    string            `json:"name"`
+	Mode    fs.FileMode       `json:"mode"`
+	ModTime time.Time         `json:"mod_time"`
+	Size    int64             `json:"size,omitempty"`
+	UID     *int              `json:"uid,omitempty"`
+	GID     *int              `json:"gid,omitempty"`
+	Link    string            `json:"link,omitempty"`
+	Xattrs  map[string][]byte `json:"xattrs,omitempty"`
+	Chunks  []string          `json:"chunks,omitempty"`
+}
+
+// info returns the FileInfo of e for the ArchiveWriter of a restore.
+func (e *dedupEntry) info() fs.FileInfo {
+	var info fs.FileInfo = dedupInfo{e}
+	if e.UID != nil && e.GID != nil || len(e.Xattrs) > 0 {
+		a := attrInfo{FileInfo: info, xattrs: e.Xattrs}
+		if e.UID != nil && e.GID != nil {
+			a.uid, a.gid, a.hasOwner = *e.UID, *e.GID, true
+		}
+		info = a
+	}
+	return info
+}
+
+type dedupInfo struct {
+	e *dedupEntry
+}
+
+func (i dedupInfo) Name() string       { return path.Base(i.e.Name) }
+func (i dedupInfo) Size() int64        { return i.e.Size }
+func (i dedupInfo) Mode() fs.FileMode  { return i.e.Mode }
+func (i dedupInfo) ModTime() time.Time { return i.e.ModTime }
+func (i dedupInfo) IsDir() bool        { return i.e.Mode.IsDir() }
+func (i dedupInfo) Sys() any           { return nil }
+
+// dedupArchiver writes dedup archives, see dedupWriter.
+type dedupArchiver struct {
+	b *backup
+}
+
+func (a dedupArchiver) Create(src, dst string) (ArchiveWriter, error) {
+	file, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupWriter{b: a.b, file: file}, nil
+}
+
+func (dedupArchiver) Extension() string { return ".dedup" }
+
+// Verify checks that the archive lists its entries completely and that
+// every chunk it needs is in the local chunk store.
+func (a dedupArchiver) Verify(path string) error {
+	entries, err := readDedupEntries(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		for _, id := range e.Chunks {
+			if _, err := os.Stat(a.b.chunkPath(id)); err != nil {
+				return fmt.Errorf("entry %q: chunk %s: %w", e.Name, id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dedupWriter splits the content of every file into content-defined chunks,
+// stores the chunks not in the chunk store yet, and writes the list of
+// entries with the chunks of each as JSON to the archive file once closed.
+// Unchanged parts of files, and files in several archives, take no room
+// after the first archive holding them.
+type dedupWriter struct {
+	b       *backup
+	file    *os.File
+	entries []*dedupEntry
+	chunker *chunker // Of the file being written
+}
+
+func (w *dedupWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	if err := w.finishFile(); err != nil {
+		return nil, err
+	}
+
+	e := &dedupEntry{Name: name, Mode: info.Mode(), ModTime: info.ModTime(), Link: link, Xattrs: entryXattrs(info)}
+	if uid, gid, ok := entryOwner(info); ok {
+		e.UID, e.GID = &uid, &gid
+	}
+	w.entries = append(w.entries, e)
+	if link != "" || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	w.chunker = &chunker{entry: e, store: w.b.storeChunk}
+	return w.chunker, nil
+}
+
+// finishFile stores the last chunk of the file being written.
+func (w *dedupWriter) finishFile() error {
+	if w.chunker == nil {
+		return nil
+	}
+	c := w.chunker
+	w.chunker = nil
+	return c.flush()
+}
+
+func (w *dedupWriter) Close() error {
+	err := w.finishFile()
+	if err == nil {
+		err = json.NewEncoder(w.file).Encode(w.entries)
+	}
+	return errors.Join(err, w.file.Close())
+}
+
+// chunker cuts what is written to it into chunks with a gear rolling hash,
+// see chunkMaskBits, and records them in entry.
+type chunker struct {
+	entry *dedupEntry
+	store func(data []byte) (string, error)
+	buf   []byte
+	hash  uint64
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		cut := c.boundary(p)
+		if cut < 0 {
+			c.buf = append(c.buf, p...)
+			break
+		}
+		c.buf = append(c.buf, p[:cut]...)
+		p = p[cut:]
+		if err := c.flush(); err != nil {
+			return n - len(p), err
+		}
+	}
+	return n, nil
+}
+
+// boundary returns the length of p that ends the current chunk, or -1 when
+// the chunk goes on past p.
+func (c *chunker) boundary(p []byte) int {
+	const mask = 1<<chunkMaskBits - 1
+	size := len(c.buf)
+	for i, by := range p {
+		size++
+		c.hash = c.hash<<1 + gearTable[by]
+		if size >= chunkMaxSize || size >= chunkMinSize && c.hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// flush stores the current chunk.
+func (c *chunker) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	id, err := c.store(c.buf)
+	if err != nil {
+		return err
+	}
+	c.entry.Chunks = append(c.entry.Chunks, id)
+	c.entry.Size += int64(len(c.buf))
+	c.buf, c.hash = c.buf[:0], 0
+	return nil
+}
+
+// storeChunk adds data to the chunk store unless a chunk with the same
+// content is there already, and returns its id.
+func (b *backup) storeChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	path := b.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		b.report.recordChunk(false, int64(len(data)))
+		return id, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), id+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	zw, err := flate.NewWriter(tmp, b.CompressionLevel)
+	if err == nil {
+		_, err = zw.Write(data)
+		err = errors.Join(err, zw.Close())
+	}
+	if err = errors.Join(err, tmp.Close()); err != nil {
+		return "", fmt.Errorf("failed to store chunk %s: %w", id, err)
+	}
+	// Workers storing the same chunk at once replace it with the same content.
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	b.report.recordChunk(true, int64(len(data)))
+	return id, nil
+}
+
+// readChunk returns the content of the chunk with the given id, from a
+// backend when it is gone locally, and checks it against the id.
+func (b *backup) readChunk(id string) ([]byte, error) {
+	path := b.chunkPath(id)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && len(b.Backends) > 0 {
+		data, err = b.readRemote(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", id, err)
+	}
+
+	content, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk %s: %w", id, err)
+	}
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("chunk %s: %w", id, ErrChecksumMismatch)
+	}
+	return content, nil
+}
+
+// readDedupEntries reads the entries of the dedup archive at path.
+func readDedupEntries(path string) ([]*dedupEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDedupEntries(path, data)
+}
+
+func parseDedupEntries(path string, data []byte) ([]*dedupEntry, error) {
+	var entries []*dedupEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid dedup archive %q: %w", path, err)
+	}
+	for _, e := range entries {
+		for _, id := range e.Chunks {
+			if len(id) != sha256.Size*2 || strings.Trim(id, "0123456789abcdef") != "" {
+				return nil, fmt.Errorf("invalid dedup archive %q: entry %q lists invalid chunk %q", path, e.Name, id)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// readDedup adds every entry of the dedup archive in to w, reading the
+// content of files from their chunks.
+func (b *backup) readDedup(path string, in io.Reader, w ArchiveWriter) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	entries, err := parseDedupEntries(path, data)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		writer, err := w.Add(e.Name, e.info(), e.Link)
+		if err != nil {
+			return err
+		}
+		for _, id := range e.Chunks {
+			chunk, err := b.readChunk(id)
+			if err != nil {
+				return fmt.Errorf("failed to read %q: %w", e.Name, err)
+			}
+			if writer == nil {
+				continue
+			}
+			if _, err := writer.Write(chunk); err != nil {
+				return fmt.Errorf("failed to read %q: %w", e.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dedupChunks returns the ids of the chunks the dedup archives of manifest
+// use, reading archives gone locally from the backends.
+func (b *backup) dedupChunks(manifest []*DirectoryEntry) (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, entry := range manifest {
+		for _, r := range entry.History {
+			for _, path := range r.dedupArchives() {
+				ids, err := b.archiveChunks(path)
+				if err != nil {
+					return nil, err
+				}
+				for _, id := range ids {
+					used[id] = true
+				}
+			}
+		}
+	}
+	return used, nil
+}
+
+// dedupArchives lists the archive and group archives of r that are dedup
+// archives.
+func (r ArchiveRecord) dedupArchives() []string {
+	var archives []string
+	for _, path := range r.archives() {
+		if archiveFormat(path) == FormatDedup {
+			archives = append(archives, path)
+		}
+	}
+	return archives
+}
+
+// archiveChunks returns the ids of the chunks of the dedup archive at path.
+func (b *backup) archiveChunks(path string) ([]string, error) {
+	in, err := b.openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseDedupEntries(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.Chunks...)
+	}
+	return ids, nil
+}
+
+// uploadChunks sends the chunks of the dedup archives of record that a
+// backend does not hold yet to it, before the archives themselves, so a
+// stored archive never lacks a chunk. The result holds the outcome per
+// backend, see Upload.
+func (b *backup) uploadChunks(ctx context.Context, record *ArchiveRecord) map[string]error {
+	var ids []string
+	for _, path := range record.dedupArchives() {
+		archiveIDs, err := b.archiveChunks(path)
+		if err != nil {
+			results := make(map[string]error, len(b.Backends))
+			for _, s := range b.Backends {
+				results[destinationName(s)] = err
+			}
+			return results
+		}
+		ids = append(ids, archiveIDs...)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx = withUploadLimit(ctx, b.UploadBandwidthLimit)
+	results := make(map[string]error, len(b.Backends))
+	for _, s := range b.Backends {
+		name := destinationName(s)
+		stored, err := b.storedChunks(ctx, s)
+		if err != nil {
+			results[name] = err
+			continue
+		}
+
+		uploaded := 0
+		for _, id := range ids {
+			path := b.chunkPath(id)
+			if stored[b.remoteKey(path)] {
+				continue
+			}
+			err = b.put(ctx, s, path, b.remoteKey(path))
+			b.report.recordUpload(name, err)
+			if err != nil {
+				break
+			}
+			stored[b.remoteKey(path)] = true
+			uploaded++
+		}
+		results[name] = err
+		if err == nil {
+			fmt.Printf("Uploaded %d new chunk(s) of %q to %s\n", uploaded, record.Path, name)
+		}
+	}
+	return results
+}
+
+// storedChunks returns the keys of the chunks s holds. The chunks are in
+// subdirectories of the store, see chunkPath, which backends listing only
+// the directory holding the prefix leave out, so when listing the store
+// finds nothing each subdirectory is listed.
+func (b *backup) storedChunks(ctx context.Context, s StorageBackend) (map[string]bool, error) {
+	store := b.remoteKey(b.ChunkStorePath()) + "/"
+	prefixes := []string{store}
+	stored := make(map[string]bool)
+	for i := 0; i < len(prefixes); i++ {
+		listCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.List)
+		objects, err := s.List(listCtx, prefixes[i])
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			stored[object.Key] = true
+		}
+
+		if i == 0 && len(stored) == 0 {
+			for n := 0; n < 256; n++ {
+				prefixes = append(prefixes, fmt.Sprintf("%s%02x/", store, n))
+			}
+		}
+	}
+	return stored, nil
+}
+
+// PruneChunks deletes the chunks no dedup archive in manifest uses any more
+// from the chunk store and the backends, once pruning removed the archives
+// using them. When an archive cannot be read nothing is deleted, as its
+// chunks are not known. In safe mode and retention dry runs the chunks are
+// only counted.
+func (b *backup) PruneChunks(ctx context.Context, manifest []*DirectoryEntry) error {
+	used, err := b.dedupChunks(manifest)
+	if err != nil {
+		return fmt.Errorf("not pruning chunks: %w", err)
+	}
+	if _, err := os.Stat(b.ChunkStorePath()); err != nil && len(used) == 0 {
+		return nil
+	}
+
+	unused := make(map[string]bool)
+	filepath.WalkDir(b.ChunkStorePath(), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() && !used[d.Name()] && !strings.HasSuffix(d.Name(), ".tmp") {
+			unused[b.remoteKey(path)] = true
+		}
+		return nil
+	})
+	remote := make(map[StorageBackend][]string)
+	for _, s := range b.Backends {
+		stored, err := b.storedChunks(ctx, s)
+		if err != nil {
+			return fmt.Errorf("not pruning chunks: %w", err)
+		}
+		for key := range stored {
+			if !used[path.Base(key)] {
+				remote[s] = append(remote[s], key)
+				unused[key] = true
+			}
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+	if b.RetentionDryRun {
+		fmt.Printf("Dry run: would prune %d chunk(s) no archive uses\n", len(unused))
+		return nil
+	}
+	if b.SafeMode {
+		fmt.Printf("Safe mode: would prune %d chunk(s) no archive uses\n", len(unused))
+		return nil
+	}
+
+	var errs []error
+	for s, keys := range remote {
+		for _, key := range keys {
+			deleteCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.Delete)
+			err := s.Delete(deleteCtx, key)
+			cancel()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", destinationName(s), err))
+			}
+		}
+	}
+	for key := range unused {
+		path := filepath.Join(b.OutputPath, filepath.FromSlash(key))
+		if err := b.removeFile(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	fmt.Printf("Pruned %d chunk(s) no archive uses\n", len(unused))
+	return errors.Join(errs...)
+}
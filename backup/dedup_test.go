@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// shallowBackend keeps objects in memory and, like the SFTP, SMB, FTP and
+// WebDAV backends, only lists the directory holding the prefix.
+type shallowBackend struct {
+	objects map[string][]byte
+	puts    int
+}
+
+func (s *shallowBackend) Put(ctx context.Context, localPath, key string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = data
+	s.puts++
+	return nil
+}
+
+func (s *shallowBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	data, ok := s.objects[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *shallowBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	dir := path.Dir(prefix + "x")
+	var objects []StoredObject
+	for key, data := range s.objects {
+		if path.Dir(key) == dir && strings.HasPrefix(key, prefix) {
+			objects = append(objects, StoredObject{Key: key, Size: int64(len(data))})
+		}
+	}
+	return objects, nil
+}
+
+func (s *shallowBackend) Delete(ctx context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func TestStoredChunksListsEachChunkDirectory(t *testing.T) {
+	remote := &shallowBackend{objects: map[string][]byte{
+		"chunks/ab/ab01": nil,
+		"chunks/ff/ff02": nil,
+		"dir.dedup":      nil,
+	}}
+	b := New(t.TempDir(), t.TempDir(), -1)
+
+	stored, err := b.storedChunks(context.Background(), remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || !stored["chunks/ab/ab01"] || !stored["chunks/ff/ff02"] {
+		t.Errorf("stored chunks are %v, want the two in chunks/ab and chunks/ff", stored)
+	}
+}
+
+func TestUploadChunksSkipsChunksOnShallowBackend(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(strings.Repeat(name, 1000)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remote := &shallowBackend{objects: make(map[string][]byte)}
+	out := t.TempDir()
+	b := New(src, out, -1, WithBackends(remote))
+	archive := filepath.Join(out, "dir.dedup")
+	if err := b.ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	record := &ArchiveRecord{Path: archive}
+
+	for _, err := range b.uploadChunks(context.Background(), record) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if remote.puts == 0 {
+		t.Fatal("no chunks were uploaded")
+	}
+	uploaded := remote.puts
+	for _, err := range b.uploadChunks(context.Background(), record) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if remote.puts != uploaded {
+		t.Errorf("uploaded %d chunk(s) the backend already holds", remote.puts-uploaded)
+	}
+}
+
+func TestPruneChunksOnlyCounts(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"dry run", []Option{WithSafeMode(false), WithRetentionDryRun(true)}, "Dry run: would prune 1 chunk(s)"},
+		{"safe mode", []Option{WithSafeMode(true)}, "Safe mode: would prune 1 chunk(s)"},
+		{"safe mode dry run", []Option{WithSafeMode(true), WithRetentionDryRun(true)}, "Dry run: would prune 1 chunk(s)"},
+	} {
+		b := New(t.TempDir(), t.TempDir(), -1, tt.opts...)
+		chunk := filepath.Join(b.ChunkStorePath(), "ab", "abcdef")
+		if err := os.MkdirAll(filepath.Dir(chunk), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(chunk, []byte("unused"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		out := captureStdout(t, func() { err = b.PruneChunks(context.Background(), nil) })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%s: printed %q, want %q", tt.name, out, tt.want)
+		}
+		if _, err := os.Stat(chunk); err != nil {
+			t.Errorf("%s: the unused chunk was deleted: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"time"
+)
+
+// SourceDiff is how the source directory of an entry differs from its latest
+// archive, by the slash separated paths of the files below it.
+type SourceDiff struct {
+	Archive  string   `json:"archive"`
+	Added    []string `json:"added,omitempty"`    // In the source only
+	Removed  []string `json:"removed,omitempty"`  // In the archive only
+	Modified []string `json:"modified,omitempty"` // In both with a different type, content or symlink target
+}
+
+// Empty reports whether the source matches the archive.
+func (d SourceDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// DiffSource compares the files and symlinks below the source directory of
+// entry with those in its latest archive, by type, size and SHA-256 of the
+// content, ignoring times, owners and permissions. The archive is read like
+// for a restore, from a backend when the local copy is gone, along with the
+// archives it builds on when it is incremental. Directories are
+// not compared, only what they hold.
+func (b *backup) DiffSource(entry *DirectoryEntry) (SourceDiff, error) {
+	record, err := entry.recordAsOf(time.Now())
+	if err != nil {
+		return SourceDiff{}, err
+	}
+	diff := SourceDiff{Archive: record.Path}
+
+	chain := []ArchiveRecord{record}
+	var only *chainFilter
+	if record.Partial {
+		if chain, err = b.recordChain(record); err != nil {
+			return diff, err
+		}
+		catalog, err := b.loadCatalog(record.Path)
+		if err != nil {
+			return diff, fmt.Errorf("failed to read the catalog of %q: %w", record.Path, err)
+		}
+		only = newChainFilter(catalog)
+	}
+
+	defer func() { b.restoreSums = nil }()
+	archived := &contentWriter{files: make(map[string]*archivedFile)}
+	for _, r := range chain {
+		b.restoreSums = r.SHA256
+		for _, archive := range append([]string{r.Path}, slices.Sorted(maps.Values(r.GroupArchives))...) {
+			if err := b.readArchive(archive, only.wrap(archived, true)); err != nil {
+				return diff, fmt.Errorf("failed to read %q: %w", archive, err)
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(archived.files))
+	err = b.walkSource(b.SourceDir(entry), func(file, relPath string, d fs.DirEntry, info fs.FileInfo) error {
+		if d.IsDir() || (!d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0) {
+			return nil
+		}
+		a, ok := archived.files[relPath]
+		if !ok {
+			diff.Added = append(diff.Added, relPath)
+			return nil
+		}
+		seen[relPath] = true
+
+		modified, err := a.differs(file, info)
+		if err != nil {
+			return err
+		}
+		if modified {
+			diff.Modified = append(diff.Modified, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return diff, err
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(archived.files)) {
+		if !seen[name] {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	return diff, nil
+}
+
+// archivedFile is a file or symlink as an archive holds it.
+type archivedFile struct {
+	link   string
+	size   int64
+	digest hash.Hash // Of the content, nil for a symlink
+}
+
+// differs reports whether the file at path, described by info, has another
+// type, content or symlink target than a.
+func (a *archivedFile) differs(path string, info fs.FileInfo) (bool, error) {
+	symlink := info.Mode()&fs.ModeSymlink != 0
+	switch {
+	case symlink && a.digest == nil:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to read symlink %q: %w", path, err)
+		}
+		return link != a.link, nil
+	case a.digest == nil:
+		return true, nil
+	case !symlink && info.Size() != a.size:
+		// Zip keeps a symlink as the content of its target, but with the
+		// size of the link, see zipWriter, so only files compare by size.
+		return true, nil
+	}
+
+	sum, err := fileHash(path, sha256.New())
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(sum, a.digest.Sum(nil)), nil
+}
+
+// contentWriter takes the files of an archive and keeps the SHA-256 of their
+// content, see DiffSource.
+type contentWriter struct {
+	files map[string]*archivedFile
+}
+
+func (w *contentWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	name = path.Clean(name)
+	if name == MetadataEntryName || info.IsDir() {
+		return nil, nil
+	}
+	if link != "" {
+		w.files[name] = &archivedFile{link: link}
+		return nil, nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	f := &archivedFile{size: info.Size(), digest: sha256.New()}
+	w.files[name] = f
+	return f.digest, nil
+}
+
+func (w *contentWriter) Close() error { return nil }
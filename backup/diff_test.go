@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiffSource(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	app := filepath.Join(src, "app")
+	writeTree(t, app, map[string]string{"kept.txt": "same", "changed.txt": "v1", "removed.txt": "gone soon", "sub/kept.txt": "same"})
+	b := New(src, out, -1)
+	entry := &DirectoryEntry{Name: "app", Kind: KindFull}
+	if _, err := b.DiffSource(entry); !errors.Is(err, ErrNoArchive) {
+		t.Errorf("DiffSource without an archive = %v, want ErrNoArchive", err)
+	}
+
+	archive := filepath.Join(out, "app.zip")
+	if err := b.ZipDirectory(app, archive); err != nil {
+		t.Fatal(err)
+	}
+	entry.RecordArchive(archive, nil, time.Now())
+	if diff, err := b.DiffSource(entry); err != nil || !diff.Empty() {
+		t.Errorf("DiffSource right after the backup = %+v, %v, want no difference", diff, err)
+	}
+
+	// Times alone are no change.
+	at := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(app, "kept.txt"), at, at); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, app, map[string]string{"changed.txt": "v2", "added.txt": "new"})
+	if err := os.Remove(filepath.Join(app, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := b.DiffSource(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Archive != archive || !slices.Equal(diff.Added, []string{"added.txt"}) || !slices.Equal(diff.Removed, []string{"removed.txt"}) || !slices.Equal(diff.Modified, []string{"changed.txt"}) {
+		t.Errorf("DiffSource = %+v, want added.txt added, removed.txt removed and changed.txt modified", diff)
+	}
+}
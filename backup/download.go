@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// downloadProgressInterval is how often a running download reports its
+// progress.
+const downloadProgressInterval = 10 * time.Second
+
+// openRemote streams the file at path from the first backend holding it, or
+// the volumes it was split into, so an archive is restored without a local
+// copy. The download fails when it stalls for the download timeout and
+// reports its progress while it runs. Files whose SHA-256 the manifest records are
+// checked against it. The error wraps fs.ErrNotExist when no backend has
+// the file.
+func (b *backup) openRemote(path string) (io.ReadCloser, error) {
+	s, objects, err := b.findRemote(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, pw := io.Pipe()
+	ctx, w, cancel := downloadContext(context.Background(), b.RemoteTimeouts.Download, pw)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		progress := newDownloadProgress(path, destinationName(s), objects)
+		for i, object := range objects {
+			local := path
+			if object.Key != b.remoteKey(path) {
+				local = VolumePath(path, i+1)
+			}
+			digest := sha256.New()
+			if err := s.Get(ctx, object.Key, io.MultiWriter(w, progress, digest)); err != nil {
+				pw.CloseWithError(fmt.Errorf("failed to download %q from %s: %w", object.Key, destinationName(s), downloadError(ctx, err)))
+				return
+			}
+			// The archive is read while it downloads, a mismatch stops the
+			// restore before it finishes.
+			if want, ok := b.restoreSums[local]; ok && hex.EncodeToString(digest.Sum(nil)) != want {
+				pw.CloseWithError(fmt.Errorf("%w: SHA-256 of %q on %s is %x, the manifest records %s", ErrChecksumMismatch, object.Key, destinationName(s), digest.Sum(nil), want))
+				return
+			}
+		}
+		progress.done()
+		pw.Close()
+	}()
+
+	return readCloser{r, closerFunc(func() error {
+		r.Close()
+		cancel()
+		wg.Wait()
+		return nil
+	})}, nil
+}
+
+// readRemote returns the content of the small file at path, such as a
+// metadata sidecar, from the first backend holding it.
+func (b *backup) readRemote(path string) ([]byte, error) {
+	s, objects, err := b.findRemote(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	ctx, w, cancel := downloadContext(context.Background(), b.RemoteTimeouts.Download, &buf)
+	defer cancel()
+	for _, object := range objects {
+		if err := s.Get(ctx, object.Key, w); err != nil {
+			return nil, fmt.Errorf("failed to download %q from %s: %w", object.Key, destinationName(s), downloadError(ctx, err))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// findRemote returns the first backend holding the file at path whole or as
+// volumes, with the objects to download in order.
+func (b *backup) findRemote(path string) (StorageBackend, []StoredObject, error) {
+	if len(b.Backends) == 0 {
+		return nil, nil, fmt.Errorf("%q: %w", path, fs.ErrNotExist)
+	}
+
+	key := b.remoteKey(path)
+	var errs []error
+	for _, s := range b.Backends {
+		ctx, cancel := withTimeout(context.Background(), b.RemoteTimeouts.List)
+		objects, err := s.List(ctx, key)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		found := make(map[string]StoredObject, len(objects))
+		for _, object := range objects {
+			found[object.Key] = object
+		}
+		if object, ok := found[key]; ok {
+			return s, []StoredObject{object}, nil
+		}
+		var volumes []StoredObject
+		for i := 1; i <= maxVolumes; i++ {
+			object, ok := found[VolumePath(key, i)]
+			if !ok {
+				break
+			}
+			volumes = append(volumes, object)
+		}
+		if len(volumes) > 0 {
+			return s, volumes, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return nil, nil, fmt.Errorf("%q is on no remote storage: %w", path, fs.ErrNotExist)
+}
+
+// downloadProgress counts the bytes of a download and reports them every
+// downloadProgressInterval.
+type downloadProgress struct {
+	path, from string
+	total, n   int64
+	started    time.Time
+	reported   time.Time
+}
+
+func newDownloadProgress(path, from string, objects []StoredObject) *downloadProgress {
+	p := &downloadProgress{path: path, from: from, started: time.Now()}
+	for _, object := range objects {
+		p.total += object.Size
+	}
+	p.reported = p.started
+	fmt.Printf("Downloading %q (%.1f MiB) from %s\n", path, mib(p.total), from)
+	return p
+}
+
+func (p *downloadProgress) Write(data []byte) (int, error) {
+	p.n += int64(len(data))
+	if time.Since(p.reported) >= downloadProgressInterval {
+		p.reported = time.Now()
+		if p.total > 0 {
+			fmt.Printf("Downloaded %.1f of %.1f MiB (%d%%) of %q\n", mib(p.n), mib(p.total), p.n*100/p.total, p.path)
+		} else {
+			fmt.Printf("Downloaded %.1f MiB of %q\n", mib(p.n), p.path)
+		}
+	}
+	return len(data), nil
+}
+
+// done reports the finished download.
+func (p *downloadProgress) done() {
+	elapsed := time.Since(p.started)
+	fmt.Printf("Downloaded %q from %s, %.1f MiB in %s\n", p.path, p.from, mib(p.n), elapsed.Round(time.Second))
+}
+
+// mib converts bytes to mebibytes.
+func mib(n int64) float64 {
+	return float64(n) / (1 << 20)
+}
@@ -0,0 +1,388 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dropboxAPI     = "https://api.dropboxapi.com"
+	dropboxContent = "https://content.dropboxapi.com"
+	// Files up to dropboxMaxUpload are sent in one request, larger ones in an
+	// upload session.
+	dropboxMaxUpload = 150 << 20
+)
+
+func init() {
+	RegisterBackend("dropbox", func(config func(string) string) (StorageBackend, error) {
+		accessToken, refreshToken := config("DROPBOX_ACCESS_TOKEN"), config("DROPBOX_REFRESH_TOKEN")
+		if accessToken == "" && refreshToken == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		chunkSize, _ := ParseSize(config("DROPBOX_CHUNK_SIZE"))
+		retries, _ := strconv.Atoi(config("DROPBOX_RETRIES"))
+		return NewDropboxBackend(DropboxConfig{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			AppKey:       config("DROPBOX_APP_KEY"),
+			AppSecret:    config("DROPBOX_APP_SECRET"),
+			RemoteDir:    config("DROPBOX_REMOTE_DIR"),
+			ChunkSize:    chunkSize,
+			Retries:      retries,
+		}), nil
+	})
+}
+
+// DropboxConfig configures a Dropbox folder. A refresh token with the app key
+// and secret keeps working after the short-lived AccessToken expires.
+type DropboxConfig struct {
+	AccessToken  string
+	RefreshToken string
+	AppKey       string
+	AppSecret    string
+	RemoteDir    string // Folder the archives are uploaded to, e.g. /Backups
+	ChunkSize    int64  // Upload session chunk size, a multiple of 4MiB, defaults to 64MiB
+	Retries      int    // Attempts per request on transient errors
+}
+
+// DropboxBackend stores files in a Dropbox folder.
+type DropboxBackend struct {
+	cfg    DropboxConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // Zero for a static access token
+}
+
+// NewDropboxBackend creates a backend for the folder described by cfg.
+func NewDropboxBackend(cfg DropboxConfig) *DropboxBackend {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 64 << 20
+	}
+	cfg.ChunkSize = max(cfg.ChunkSize/(4<<20), 1) * (4 << 20)
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+	cfg.RemoteDir = "/" + strings.Trim(cfg.RemoteDir, "/")
+
+	d := &DropboxBackend{cfg: cfg, client: remoteClient}
+	if cfg.RefreshToken == "" {
+		d.token = cfg.AccessToken
+	}
+	return d
+}
+
+// String names the destination in logs.
+func (d *DropboxBackend) String() string {
+	return "dropbox://" + strings.TrimPrefix(d.cfg.RemoteDir, "/")
+}
+
+// accessToken returns the static access token, or a cached one obtained with
+// the refresh token.
+func (d *DropboxBackend) accessToken(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.token != "" && (d.expiry.IsZero() || time.Until(d.expiry) > time.Minute) {
+		return d.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {d.cfg.RefreshToken},
+		"client_id":     {d.cfg.AppKey},
+		"client_secret": {d.cfg.AppSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxAPI+"/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return "", &transientError{fmt.Errorf("failed to refresh Dropbox token: %w", err)}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", responseError("failed to refresh Dropbox token", res)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid Dropbox token response: %w", err)
+	}
+
+	d.token = token.AccessToken
+	d.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return d.token, nil
+}
+
+// dropboxArg encodes the Dropbox-API-Arg header, which must be ASCII.
+func dropboxArg(arg any) (string, error) {
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < 0x80 {
+			b.WriteRune(r)
+		} else if r > 0xFFFF {
+			r1, r2 := (r-0x10000)>>10+0xD800, (r-0x10000)&0x3FF+0xDC00
+			fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+		} else {
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String(), nil
+}
+
+// call invokes an endpoint, retrying transient failures. Content endpoints
+// take arg in the Dropbox-API-Arg header and the data as body, RPC endpoints
+// take arg as JSON body. A 2xx response is handed to handle.
+func (d *DropboxBackend) call(ctx context.Context, endpoint string, arg any, body *io.SectionReader, handle func(*http.Response) error) error {
+	var header, payload string
+	var err error
+	content := strings.HasPrefix(endpoint, dropboxContent)
+	if content {
+		header, err = dropboxArg(arg)
+	} else {
+		var data []byte
+		data, err = json.Marshal(arg)
+		payload = string(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return retryTransient(ctx, d.cfg.Retries, func() error {
+		token, err := d.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		var reader io.Reader = strings.NewReader(payload)
+		size := int64(len(payload))
+		if content {
+			reader, size = nil, 0
+			if body != nil {
+				reader, size = io.NewSectionReader(body, 0, body.Size()), body.Size()
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, reader)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("Authorization", "Bearer "+token)
+		if content {
+			req.Header.Set("Dropbox-API-Arg", header)
+			if body != nil {
+				req.Header.Set("Content-Type", "application/octet-stream")
+			}
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := d.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{err}
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusUnauthorized && d.cfg.RefreshToken != "" {
+			d.mu.Lock()
+			d.token = ""
+			d.mu.Unlock()
+			return &transientError{responseError(endpoint, res)}
+		}
+		if res.StatusCode/100 != 2 {
+			return responseError(endpoint, res)
+		}
+		if handle != nil {
+			return handle(res)
+		}
+		return nil
+	})
+}
+
+// Put stores the file at localPath as key below the remote folder, using an
+// upload session for files over 150MB.
+func (d *DropboxBackend) Put(ctx context.Context, localPath, key string) error {
+	if err := d.put(ctx, localPath, key); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, d, err)
+	}
+	return nil
+}
+
+func (d *DropboxBackend) put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	commit := map[string]any{"path": path.Join(d.cfg.RemoteDir, key), "mode": "overwrite", "mute": true}
+	if info.Size() <= dropboxMaxUpload {
+		return d.call(ctx, dropboxContent+"/2/files/upload", commit, io.NewSectionReader(file, 0, info.Size()), nil)
+	}
+
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	err = d.call(ctx, dropboxContent+"/2/files/upload_session/start", map[string]any{"close": false}, io.NewSectionReader(file, 0, d.cfg.ChunkSize), func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&session)
+	})
+	if err != nil {
+		return err
+	}
+
+	offset := d.cfg.ChunkSize
+	for ; info.Size()-offset > d.cfg.ChunkSize; offset += d.cfg.ChunkSize {
+		cursor := map[string]any{"session_id": session.SessionID, "offset": offset}
+		err := d.call(ctx, dropboxContent+"/2/files/upload_session/append_v2", map[string]any{"cursor": cursor, "close": false}, io.NewSectionReader(file, offset, d.cfg.ChunkSize), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	cursor := map[string]any{"session_id": session.SessionID, "offset": offset}
+	return d.call(ctx, dropboxContent+"/2/files/upload_session/finish", map[string]any{"cursor": cursor, "commit": commit}, io.NewSectionReader(file, offset, info.Size()-offset), nil)
+}
+
+// dropboxBlockSize is the block size of the Dropbox content hash.
+const dropboxBlockSize = 4 << 20
+
+// VerifyChecksum compares the content hash of the file stored under key with
+// the file at localPath. The content hash is the SHA-256 of the SHA-256
+// digests of every 4MiB block.
+func (d *DropboxBackend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	var metadata struct {
+		ContentHash string `json:"content_hash"`
+	}
+	err := d.call(ctx, dropboxAPI+"/2/files/get_metadata", map[string]string{"path": path.Join(d.cfg.RemoteDir, key)}, nil, func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&metadata)
+	})
+	if err != nil {
+		return err
+	}
+	if metadata.ContentHash == "" {
+		return errNoChecksum
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	blocks := sha256.New()
+	for {
+		block := sha256.New()
+		n, err := io.CopyN(block, file, dropboxBlockSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to checksum %q: %w", localPath, err)
+		}
+		if n > 0 {
+			blocks.Write(block.Sum(nil))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	if local := hex.EncodeToString(blocks.Sum(nil)); metadata.ContentHash != local {
+		return checksumMismatch("content hash", metadata.ContentHash, local)
+	}
+	return nil
+}
+
+// Get writes the file stored under key to w.
+func (d *DropboxBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	err := d.call(ctx, dropboxContent+"/2/files/download", map[string]string{"path": path.Join(d.cfg.RemoteDir, key)}, nil, func(res *http.Response) error {
+		_, err := io.Copy(w, res.Body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, d, err)
+	}
+	return nil
+}
+
+// List returns the files whose key starts with prefix.
+func (d *DropboxBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	root := d.cfg.RemoteDir
+	if root == "/" {
+		root = "" // Dropbox names the root folder ""
+	}
+
+	var objects []StoredObject
+	endpoint, arg := dropboxAPI+"/2/files/list_folder", any(map[string]any{"path": root, "recursive": true})
+	for {
+		var page struct {
+			Entries []struct {
+				Tag            string    `json:".tag"`
+				PathDisplay    string    `json:"path_display"`
+				Size           int64     `json:"size"`
+				ServerModified time.Time `json:"server_modified"`
+			} `json:"entries"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		err := d.call(ctx, endpoint, arg, nil, func(res *http.Response) error {
+			return json.NewDecoder(res.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", d, err)
+		}
+
+		for _, entry := range page.Entries {
+			key := strings.TrimPrefix(strings.TrimPrefix(entry.PathDisplay, root), "/")
+			if entry.Tag == "file" && strings.HasPrefix(key, prefix) {
+				objects = append(objects, StoredObject{Key: key, Size: entry.Size, ModTime: entry.ServerModified})
+			}
+		}
+
+		if !page.HasMore {
+			return objects, nil
+		}
+		endpoint, arg = dropboxAPI+"/2/files/list_folder/continue", map[string]string{"cursor": page.Cursor}
+	}
+}
+
+// Delete removes the file stored under key.
+func (d *DropboxBackend) Delete(ctx context.Context, key string) error {
+	if err := d.call(ctx, dropboxAPI+"/2/files/delete_v2", map[string]string{"path": path.Join(d.cfg.RemoteDir, key)}, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, d, err)
+	}
+	return nil
+}
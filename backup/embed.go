@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// MetadataEntryName is the name of the entry describing an archive inside it,
+// see EmbedMetadata. Restores skip it.
+const MetadataEntryName = ".backup-meta.json"
+
+// Version is the version of the tool recorded in embedded metadata. Release
+// builds set it with
+// -ldflags "-X github.com/nicodwik/backup-tools-go/backup.Version=1.2.0",
+// others report the VCS revision they were built from.
+var Version = "dev"
+
+// ArchiveMetadata describes an archive from inside it, so an archive found
+// on its own can be traced back to the run and directory it came from.
+type ArchiveMetadata struct {
+	RunID     string `json:"run_id,omitempty"` // Omitted from reproducible archives
+	Source    string `json:"source"`
+	Archive   string `json:"archive"` // Base name the archive was written as
+	Group     string `json:"group,omitempty"`
+	Format    string `json:"format"`
+	CreatedAt string `json:"created_at"`
+	Tool      string `json:"tool"`
+	Version   string `json:"version"`
+	FileCount int    `json:"file_count"` // Entries that are not directories
+}
+
+// newRunID returns an identifier for a run started at now, unique enough to
+// tell runs apart across hosts.
+func newRunID(now time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return now.In(jkt).Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// toolVersion returns Version, or the VCS revision of development builds.
+func toolVersion() string {
+	if Version != "dev" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				return "dev-" + setting.Value[:12]
+			}
+		}
+	}
+	return Version
+}
+
+// embedMetadata adds the metadata entry to the archive of group written by w
+// to path, holding files non-directory entries of sourcePath.
+func (b *backup) embedMetadata(w ArchiveWriter, sourcePath, path, group, format string, files int) error {
+	meta := ArchiveMetadata{
+		RunID:     b.report.RunID,
+		Source:    sourcePath,
+		Archive:   filepath.Base(path),
+		Group:     group,
+		Format:    format,
+		CreatedAt: time.Now().In(jkt).Format(time.RFC3339),
+		Tool:      "backup-tools-go",
+		Version:   toolVersion(),
+		FileCount: files,
+	}
+	modTime := time.Now()
+	if b.Reproducible {
+		meta.RunID = ""
+		meta.CreatedAt = b.ReproducibleTime.Format(time.RFC3339)
+		modTime = b.ReproducibleTime
+	}
+	data, _ := json.MarshalIndent(meta, "", "\t")
+
+	writer, err := w.Add(MetadataEntryName, metadataInfo{size: int64(len(data)), modTime: modTime}, "")
+	if err != nil {
+		return err
+	}
+	if writer != nil {
+		if _, err := writer.Write(data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", MetadataEntryName, err)
+		}
+	}
+	return nil
+}
+
+// metadataInfo describes the metadata entry, which has no file behind it.
+type metadataInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (i metadataInfo) Name() string       { return MetadataEntryName }
+func (i metadataInfo) Size() int64        { return i.size }
+func (i metadataInfo) Mode() fs.FileMode  { return 0o644 }
+func (i metadataInfo) ModTime() time.Time { return i.modTime }
+func (i metadataInfo) IsDir() bool        { return false }
+func (i metadataInfo) Sys() any           { return nil }
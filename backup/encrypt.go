@@ -0,0 +1,392 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encryptor encrypts archives while they are written, see Encryption.
+type Encryptor interface {
+	// Encrypt returns a writer encrypting what is written to it onto out.
+	// The output is only complete once the writer is closed.
+	Encrypt(out io.Writer) (io.WriteCloser, error)
+	// Decrypt returns a reader of the plain content of in. Reading fails
+	// when in was modified or truncated.
+	Decrypt(in io.Reader) (io.Reader, error)
+	// KeyID identifies the key, it is recorded with every archive.
+	KeyID() string
+	// Extension is appended to the names of encrypted archives.
+	Extension() string
+}
+
+// encryptionExtensions are the extensions encrypted archives end with, after
+// the extension of their format.
+var encryptionExtensions = []string{gcmExtension, ageExtension, gpgExtension}
+
+// encryptionExt returns the encryption extension path ends with, if any.
+func encryptionExt(path string) string {
+	for _, ext := range encryptionExtensions {
+		if strings.HasSuffix(path, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// Archives encrypted by GCMEncryptor start with gcmMagic, a version, the
+// length of the key ID, the key ID and a random nonce prefix. Version 2
+// headers, see EnvelopeEncryptor, hold the length and bytes of the wrapped
+// data key between the key ID and the prefix. The content
+// follows in chunks of gcmChunkSize bytes, each sealed on its own with the
+// header as additional data, so archives of any size can be encrypted and
+// decrypted as streams. The nonce of a chunk is the prefix, the chunk number
+// and whether it is the last chunk, so chunks can neither be reordered nor
+// dropped from the end unnoticed.
+const (
+	gcmExtension   = ".enc"
+	gcmMagic       = "BTENC"
+	gcmVersion     = 1
+	gcmEnvelope    = 2
+	gcmPrefixLen   = 7
+	gcmChunkSize   = 64 << 10
+	gcmKeyLen      = 32
+	gcmMaxKeyIDLen = 255
+)
+
+// GCMEncryptor encrypts archives with AES-256-GCM. It may hold several keys
+// to decrypt archives written before a key rotation, see NewGCMKeyring.
+type GCMEncryptor struct {
+	aead  cipher.AEAD
+	keyID string
+	keys  map[string]cipher.AEAD // Every key by ID, for decrypting
+}
+
+// NewGCMEncryptor creates an encryptor for the 32 byte key, given as 64 hex
+// digits or in base64. keyID names the key in the manifest and the archive
+// header, an empty one is derived from the key.
+func NewGCMEncryptor(key, keyID string) (*GCMEncryptor, error) {
+	aead, keyID, err := newGCMKey(key, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &GCMEncryptor{aead: aead, keyID: keyID, keys: map[string]cipher.AEAD{keyID: aead}}, nil
+}
+
+// NewGCMKeyring creates an encryptor for several keys listed as "id:key",
+// separated by commas or newlines, see NewGCMEncryptor. New archives are
+// encrypted with the key activeID, the first one when empty, the others only
+// decrypt archives written before it.
+func NewGCMKeyring(keys, activeID string) (*GCMEncryptor, error) {
+	var e *GCMEncryptor
+	for _, item := range strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(item, ":")
+		if id = strings.TrimSpace(id); !ok || id == "" {
+			return nil, errors.New(`encryption keys must be listed as "id:key"`)
+		}
+		aead, _, err := newGCMKey(key, id)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+
+		if e == nil {
+			e = &GCMEncryptor{aead: aead, keyID: id, keys: make(map[string]cipher.AEAD)}
+		}
+		if _, ok := e.keys[id]; ok {
+			return nil, fmt.Errorf("key %q is listed twice", id)
+		}
+		e.keys[id] = aead
+		if id == activeID {
+			e.aead, e.keyID = aead, id
+		}
+	}
+
+	if e == nil {
+		return nil, errors.New("no encryption key")
+	}
+	if activeID != "" && e.keyID != activeID {
+		return nil, fmt.Errorf("key %q is not listed", activeID)
+	}
+	return e, nil
+}
+
+// newGCMKey parses key and returns its cipher and ID, derived from the key
+// when keyID is empty.
+func newGCMKey(key, keyID string) (cipher.AEAD, string, error) {
+	raw, err := parseKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if keyID == "" {
+		sum := sha256.Sum256(raw)
+		keyID = hex.EncodeToString(sum[:8])
+	}
+	if len(keyID) > gcmMaxKeyIDLen {
+		return nil, "", fmt.Errorf("key ID %q is longer than %d bytes", keyID, gcmMaxKeyIDLen)
+	}
+
+	aead, err := newAEAD(raw)
+	return aead, keyID, err
+}
+
+// parseKey decodes a 32 byte key from hex or base64.
+func parseKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if raw, err := hex.DecodeString(key); err == nil && len(raw) == gcmKeyLen {
+		return raw, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(key); err == nil && len(raw) == gcmKeyLen {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes, given as hex or base64", gcmKeyLen)
+}
+
+func (e *GCMEncryptor) KeyID() string     { return e.keyID }
+func (e *GCMEncryptor) Extension() string { return gcmExtension }
+
+func (e *GCMEncryptor) Encrypt(out io.Writer) (io.WriteCloser, error) {
+	header, err := newGCMHeader(e.keyID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return header.encrypt(e.aead, out)
+}
+
+func (e *GCMEncryptor) Decrypt(in io.Reader) (io.Reader, error) {
+	r := bufio.NewReaderSize(in, gcmChunkSize+e.aead.Overhead()+1)
+	header, err := readGCMHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.wrapped != nil {
+		return nil, fmt.Errorf("encrypted with a data key wrapped by %q, configure the KMS key to decrypt it", header.keyID)
+	}
+	aead, ok := e.keys[header.keyID]
+	if !ok {
+		return nil, fmt.Errorf("encrypted with key %q, which is not configured", header.keyID)
+	}
+
+	return header.decrypt(aead, r), nil
+}
+
+// gcmHeader is the header of an archive encrypted with AES-256-GCM.
+type gcmHeader struct {
+	raw     []byte // As written, the additional data of every chunk
+	keyID   string
+	wrapped []byte // The wrapped data key of version 2 headers
+	prefix  []byte
+}
+
+// newGCMHeader creates the header of a new archive with a random prefix, a
+// version 2 header when wrapped is set.
+func newGCMHeader(keyID string, wrapped []byte) (*gcmHeader, error) {
+	h := &gcmHeader{keyID: keyID, wrapped: wrapped, prefix: make([]byte, gcmPrefixLen)}
+	if _, err := rand.Read(h.prefix); err != nil {
+		return nil, err
+	}
+	if len(wrapped) > 0xffff {
+		return nil, errors.New("wrapped data key is too long")
+	}
+
+	version := byte(gcmVersion)
+	if wrapped != nil {
+		version = gcmEnvelope
+	}
+	h.raw = append([]byte(gcmMagic), version, byte(len(keyID)))
+	h.raw = append(h.raw, keyID...)
+	if wrapped != nil {
+		h.raw = binary.BigEndian.AppendUint16(h.raw, uint16(len(wrapped)))
+		h.raw = append(h.raw, wrapped...)
+	}
+	h.raw = append(h.raw, h.prefix...)
+	return h, nil
+}
+
+// readGCMHeader reads the header of an archive encrypted by GCMEncryptor or
+// EnvelopeEncryptor.
+func readGCMHeader(r io.Reader) (*gcmHeader, error) {
+	h := &gcmHeader{}
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("no encryption header: %w", err)
+		}
+		h.raw = append(h.raw, buf...)
+		return buf, nil
+	}
+
+	start, err := read(len(gcmMagic) + 2)
+	if err != nil {
+		return nil, err
+	}
+	version := start[len(gcmMagic)]
+	if string(start[:len(gcmMagic)]) != gcmMagic || (version != gcmVersion && version != gcmEnvelope) {
+		return nil, errors.New("not an archive encrypted with AES-256-GCM")
+	}
+	keyID, err := read(int(start[len(gcmMagic)+1]))
+	if err != nil {
+		return nil, err
+	}
+	h.keyID = string(keyID)
+	if version == gcmEnvelope {
+		size, err := read(2)
+		if err != nil {
+			return nil, err
+		}
+		if h.wrapped, err = read(int(binary.BigEndian.Uint16(size))); err != nil {
+			return nil, err
+		}
+	}
+	if h.prefix, err = read(gcmPrefixLen); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// encrypt writes the header to out and returns the writer encrypting the
+// content after it with aead.
+func (h *gcmHeader) encrypt(aead cipher.AEAD, out io.Writer) (io.WriteCloser, error) {
+	if _, err := out.Write(h.raw); err != nil {
+		return nil, err
+	}
+	return &gcmWriter{aead: aead, out: out, header: h.raw, prefix: h.prefix, buf: make([]byte, 0, gcmChunkSize)}, nil
+}
+
+// decrypt returns the reader of the content following the header in r.
+func (h *gcmHeader) decrypt(aead cipher.AEAD, r *bufio.Reader) io.Reader {
+	return &gcmReader{aead: aead, in: r, header: h.raw, prefix: h.prefix}
+}
+
+// gcmNonce returns the nonce of chunk n.
+func gcmNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, n)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// gcmWriter seals full chunks once more content follows them, the last
+// chunk, which may be empty, on Close.
+type gcmWriter struct {
+	aead   cipher.AEAD
+	out    io.Writer
+	header []byte
+	prefix []byte
+	buf    []byte
+	n      uint32
+	closed bool
+}
+
+func (w *gcmWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == gcmChunkSize {
+			if err := w.seal(false); err != nil {
+				return written - len(p), err
+			}
+		}
+		n := copy(w.buf[len(w.buf):gcmChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *gcmWriter) seal(last bool) error {
+	if w.n == 1<<32-1 {
+		return errors.New("archive too large to encrypt")
+	}
+	sealed := w.aead.Seal(nil, gcmNonce(w.prefix, w.n, last), w.buf, w.header)
+	w.n++
+	w.buf = w.buf[:0]
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk. Closing it again does nothing.
+func (w *gcmWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// gcmReader opens one chunk at a time, a chunk being the last when nothing
+// follows it.
+type gcmReader struct {
+	aead   cipher.AEAD
+	in     *bufio.Reader
+	header []byte
+	prefix []byte
+	plain  []byte
+	n      uint32
+	done   bool
+}
+
+func (r *gcmReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *gcmReader) open() error {
+	sealed := make([]byte, gcmChunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.in, sealed)
+	if err == io.EOF {
+		return fmt.Errorf("encrypted archive is truncated: %w", io.ErrUnexpectedEOF)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		_, err := r.in.Peek(1)
+		last = err == io.EOF
+	}
+
+	plain, err := r.aead.Open(sealed[:0], gcmNonce(r.prefix, r.n, last), sealed[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("encrypted archive is corrupted or truncated at chunk %d: %w", r.n, err)
+	}
+	r.n++
+	r.plain, r.done = plain, last
+	return nil
+}
+
+// verifyEncrypted decrypts the archive read from in to the end, which checks
+// that it is complete and unmodified. Archives that can't be decrypted here
+// pass when e accepts their header.
+func verifyEncrypted(e Encryptor, in io.Reader) error {
+	plain, err := e.Decrypt(in)
+	if errors.Is(err, ErrNoDecryptionKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, plain)
+	return err
+}
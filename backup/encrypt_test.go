@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// testKey returns a random key as hex.
+func testKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, gcmKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+// encryptBytes encrypts plain with e.
+func encryptBytes(t *testing.T, e Encryptor, plain []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := e.Encrypt(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decryptBytes decrypts the whole of sealed with e.
+func decryptBytes(e Encryptor, sealed []byte) ([]byte, error) {
+	plain, err := e.Decrypt(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plain)
+}
+
+func TestGCMEncryptorRoundTrip(t *testing.T) {
+	e, err := NewGCMEncryptor(testKey(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, gcmChunkSize - 1, gcmChunkSize, gcmChunkSize + 1, 3*gcmChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		sealed := encryptBytes(t, e, plain)
+		got, err := decryptBytes(e, sealed)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted content differs", size)
+		}
+	}
+}
+
+func TestGCMEncryptorRejectsTampering(t *testing.T) {
+	key := testKey(t)
+	// Both IDs name the same key, so only the header tells them apart.
+	e, err := NewGCMKeyring("a:"+key+",b:"+key, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 3*gcmChunkSize+5)
+	rand.Read(plain)
+	sealed := encryptBytes(t, e, plain)
+
+	header, err := readGCMHeader(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLen := len(header.raw)
+	chunkLen := gcmChunkSize + 16 // GCM tag
+	chunk := func(n int) []byte { return sealed[headerLen+n*chunkLen : headerLen+(n+1)*chunkLen] }
+	modified := func(change func(b []byte) []byte) []byte {
+		return change(append([]byte(nil), sealed...))
+	}
+
+	other, err := NewGCMEncryptor(testKey(t), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptBytes(other, sealed); err == nil {
+		t.Error("decrypting with the wrong key succeeded")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		sealed []byte
+	}{
+		{"flipped ciphertext byte", modified(func(b []byte) []byte {
+			b[headerLen+gcmChunkSize+100] ^= 1
+			return b
+		})},
+		{"flipped tag byte", modified(func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		})},
+		{"dropped final chunk", sealed[:headerLen+3*chunkLen]},
+		{"truncated final chunk", sealed[:len(sealed)-1]},
+		{"swapped chunks", modified(func(b []byte) []byte {
+			copy(b[headerLen:], chunk(1))
+			copy(b[headerLen+chunkLen:], chunk(0))
+			return b
+		})},
+		{"changed key ID", modified(func(b []byte) []byte {
+			b[len(gcmMagic)+2] = 'b'
+			return b
+		})},
+		{"changed nonce prefix", modified(func(b []byte) []byte {
+			b[headerLen-1] ^= 1
+			return b
+		})},
+		{"header only", sealed[:headerLen]},
+	} {
+		if _, err := decryptBytes(e, tt.sealed); err == nil {
+			t.Errorf("%s: decrypting succeeded", tt.name)
+		}
+	}
+
+	if got, err := decryptBytes(e, sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("the untouched archive no longer decrypts: %v", err)
+	}
+}
+
+func TestGCMKeyringDecryptsRotatedKeys(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	before, err := NewGCMKeyring("old:"+oldKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := encryptBytes(t, before, []byte("written before the rotation"))
+
+	after, err := NewGCMKeyring("old:"+oldKey+",new:"+newKey, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.KeyID() != "new" {
+		t.Errorf("active key is %q, want new", after.KeyID())
+	}
+	if got, err := decryptBytes(after, sealed); err != nil || string(got) != "written before the rotation" {
+		t.Errorf("decrypting with the rotated keyring returned %q, %v", got, err)
+	}
+
+	dropped, err := NewGCMKeyring("new:"+newKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptBytes(dropped, sealed); err == nil {
+		t.Error("decrypting with a keyring missing the key succeeded")
+	}
+}
@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// kmsTimeout bounds every call to a key management service.
+const kmsTimeout = 30 * time.Second
+
+// KeyWrapper encrypts the data keys of envelope encryption with a master key
+// held by a key management service, which never leaves it.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, key []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+	// KeyID names the master key.
+	KeyID() string
+}
+
+// EnvelopeEncryptor encrypts every archive with AES-256-GCM under a fresh
+// random data key, which is wrapped by a KeyWrapper and stored in the header
+// of the archive. Whoever controls the master key controls every archive,
+// and no long-lived key is kept on the backup host.
+type EnvelopeEncryptor struct {
+	wrapper KeyWrapper
+}
+
+// NewEnvelopeEncryptor creates an encryptor wrapping its data keys with w.
+func NewEnvelopeEncryptor(w KeyWrapper) *EnvelopeEncryptor {
+	return &EnvelopeEncryptor{wrapper: w}
+}
+
+func (e *EnvelopeEncryptor) KeyID() string     { return e.wrapper.KeyID() }
+func (e *EnvelopeEncryptor) Extension() string { return gcmExtension }
+
+func (e *EnvelopeEncryptor) Encrypt(out io.Writer) (io.WriteCloser, error) {
+	key := make([]byte, gcmKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	wrapped, err := e.wrapper.Wrap(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap the data key: %w", err)
+	}
+
+	header, err := newGCMHeader(e.wrapper.KeyID(), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return header.encrypt(aead, out)
+}
+
+func (e *EnvelopeEncryptor) Decrypt(in io.Reader) (io.Reader, error) {
+	r := bufio.NewReaderSize(in, gcmChunkSize+gcmOverhead+1)
+	header, err := readGCMHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.wrapped == nil {
+		return nil, fmt.Errorf("encrypted with key %q, not with a data key wrapped by KMS", header.keyID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	key, err := e.wrapper.Unwrap(ctx, header.wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key with %q: %w", header.keyID, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return header.decrypt(aead, r), nil
+}
+
+// gcmOverhead is the size of the tag AES-GCM adds to every chunk.
+const gcmOverhead = 16
+
+// newAEAD returns AES-GCM with the raw key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AWSKMS wraps data keys with a key in AWS KMS.
+type AWSKMS struct {
+	keyID    string // Key ID, ARN or alias
+	region   string
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// NewAWSKMS creates a KeyWrapper for the KMS key keyID. region defaults to
+// the one in keyID when it is an ARN, endpoint to the regional AWS endpoint.
+func NewAWSKMS(keyID, region, endpoint, accessKey, secretKey, sessionToken string) (*AWSKMS, error) {
+	if region == "" {
+		// arn:aws:kms:<region>:<account>:key/<id>
+		if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+			region = parts[3]
+		}
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no region for KMS key %q", keyID)
+	}
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("no AWS credentials for KMS key %q", keyID)
+	}
+
+	return &AWSKMS{
+		keyID:    keyID,
+		region:   region,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    awsCredentials{AccessKey: accessKey, SecretKey: secretKey, SessionToken: sessionToken},
+		client:   remoteClient,
+	}, nil
+}
+
+func (k *AWSKMS) KeyID() string { return k.keyID }
+
+func (k *AWSKMS) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	var res struct{ CiphertextBlob []byte }
+	err := k.call(ctx, "Encrypt", map[string]any{"KeyId": k.keyID, "Plaintext": key}, &res)
+	return res.CiphertextBlob, err
+}
+
+func (k *AWSKMS) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var res struct{ Plaintext []byte }
+	err := k.call(ctx, "Decrypt", map[string]any{"KeyId": k.keyID, "CiphertextBlob": wrapped}, &res)
+	return res.Plaintext, err
+}
+
+// call sends a signed request for the KMS action and decodes the response
+// into res. Byte slices travel base64 encoded both ways, as encoding/json
+// does on its own.
+func (k *AWSKMS) call(ctx context.Context, action string, params, res any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(req, k.creds, k.region, "kms", sha256Hex(body), time.Now())
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError("KMS "+action, resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+const gcpKMSScope = "https://www.googleapis.com/auth/cloudkms"
+
+// GCPKMS wraps data keys with a key in Google Cloud KMS.
+type GCPKMS struct {
+	name     string // projects/<p>/locations/<l>/keyRings/<r>/cryptoKeys/<k>
+	endpoint string
+	creds    *googleCredentials
+	client   *http.Client
+}
+
+// NewGCPKMS creates a KeyWrapper for the crypto key name, authenticating
+// with the service account key in credentialsFile. endpoint defaults to
+// https://cloudkms.googleapis.com.
+func NewGCPKMS(name, credentialsFile, endpoint string) (*GCPKMS, error) {
+	if endpoint == "" {
+		endpoint = "https://cloudkms.googleapis.com"
+	}
+	creds, err := loadGoogleServiceAccount(credentialsFile, gcpKMSScope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCPKMS{name: name, endpoint: strings.TrimSuffix(endpoint, "/"), creds: creds, client: remoteClient}, nil
+}
+
+func (k *GCPKMS) KeyID() string { return k.name }
+
+func (k *GCPKMS) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	var res struct{ Ciphertext []byte }
+	err := k.call(ctx, "encrypt", map[string]any{"plaintext": key}, &res)
+	return res.Ciphertext, err
+}
+
+func (k *GCPKMS) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var res struct{ Plaintext []byte }
+	err := k.call(ctx, "decrypt", map[string]any{"ciphertext": wrapped}, &res)
+	return res.Plaintext, err
+}
+
+// call sends a request for the method of the crypto key and decodes the
+// response into res.
+func (k *GCPKMS) call(ctx context.Context, method string, params, res any) error {
+	token, err := k.creds.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	target := k.endpoint + "/v1/" + (&url.URL{Path: k.name}).EscapedPath() + ":" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError("Cloud KMS "+method, resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeKMS serves the Encrypt and Decrypt actions of AWS KMS, sealing data
+// keys with AES-GCM under a random master key per key ID.
+func fakeKMS(t *testing.T) *httptest.Server {
+	t.Helper()
+	masters := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			KeyId          string
+			Plaintext      []byte
+			CiphertextBlob []byte
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if masters[req.KeyId] == nil {
+			masters[req.KeyId] = make([]byte, gcmKeyLen)
+			rand.Read(masters[req.KeyId])
+		}
+		aead, err := newAEAD(masters[req.KeyId])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			nonce := make([]byte, aead.NonceSize())
+			rand.Read(nonce)
+			json.NewEncoder(w).Encode(map[string]any{"CiphertextBlob": aead.Seal(nonce, nonce, req.Plaintext, nil)})
+		case "TrentService.Decrypt":
+			blob := req.CiphertextBlob
+			if len(blob) < aead.NonceSize() {
+				http.Error(w, "InvalidCiphertextException", http.StatusBadRequest)
+				return
+			}
+			plain, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], nil)
+			if err != nil {
+				http.Error(w, "InvalidCiphertextException", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"Plaintext": plain})
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestKMS(t *testing.T, srv *httptest.Server, keyID string) *EnvelopeEncryptor {
+	t.Helper()
+	kms, err := NewAWSKMS(keyID, "eu-west-1", srv.URL, "AKID", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEnvelopeEncryptor(kms)
+}
+
+func TestEnvelopeEncryptorRoundTrip(t *testing.T) {
+	e := newTestKMS(t, fakeKMS(t), "alias/backups")
+	plain := make([]byte, 2*gcmChunkSize+7)
+	rand.Read(plain)
+
+	first := encryptBytes(t, e, plain)
+	second := encryptBytes(t, e, plain)
+	header, err := readGCMHeader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.keyID != "alias/backups" || len(header.wrapped) == 0 {
+		t.Errorf("header holds key %q and a wrapped key of %d bytes", header.keyID, len(header.wrapped))
+	}
+	if bytes.Equal(first[len(header.raw):], second[len(header.raw):]) {
+		t.Error("two archives were encrypted with the same data key")
+	}
+
+	for _, sealed := range [][]byte{first, second} {
+		if got, err := decryptBytes(e, sealed); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("decrypting returned %d bytes, %v", len(got), err)
+		}
+	}
+}
+
+func TestEnvelopeEncryptorWrongKey(t *testing.T) {
+	srv := fakeKMS(t)
+	e := newTestKMS(t, srv, "alias/backups")
+	sealed := encryptBytes(t, e, []byte("content"))
+
+	if _, err := decryptBytes(newTestKMS(t, srv, "alias/other"), sealed); err == nil {
+		t.Error("decrypting with another master key succeeded")
+	}
+	if _, err := decryptBytes(newTestKMS(t, fakeKMS(t), "alias/backups"), sealed); err == nil {
+		t.Error("decrypting with another KMS holding a key of the same name succeeded")
+	}
+
+	// The wrapped key is the additional data of every chunk, so a key that
+	// unwraps but was swapped in is refused as well.
+	header, err := readGCMHeader(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := encryptBytes(t, e, []byte("content"))
+	otherHeader, err := readGCMHeader(bytes.NewReader(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := append(append([]byte(nil), otherHeader.raw...), sealed[len(header.raw):]...)
+	if _, err := decryptBytes(e, swapped); err == nil {
+		t.Error("decrypting with the data key of another archive succeeded")
+	}
+
+	gcm, err := NewGCMEncryptor(testKey(t), "alias/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptBytes(gcm, sealed); err == nil {
+		t.Error("a static key decrypted an envelope encrypted archive")
+	}
+	if _, err := decryptBytes(e, encryptBytes(t, gcm, []byte("content"))); err == nil {
+		t.Error("KMS decrypted an archive encrypted with a static key")
+	}
+}
@@ -0,0 +1,360 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Archive formats new archives can be written in.
+const (
+	FormatZip    = "zip"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+	FormatTarXz  = "tar.xz"
+	FormatTar    = "tar"    // Uncompressed, for directories of already compressed media
+	FormatMirror = "mirror" // A plain copy of the directory tree, see mirrorWriter
+	FormatDedup  = "dedup"  // A list of files with their chunks in the chunk store, see dedupWriter
+)
+
+// archiveExtensions maps the file extension of every archive format to it.
+var archiveExtensions = map[string]string{
+	".zip":     FormatZip,
+	".tar.gz":  FormatTarGz,
+	".tar.zst": FormatTarZst,
+	".tar.xz":  FormatTarXz,
+	".tar":     FormatTar,
+	".dedup":   FormatDedup,
+}
+
+// ParseArchiveFormat parses the name of an archive format, "zip" when empty.
+// "tgz" is accepted for tar.gz, "zstd" for tar.zst, "xz" for tar.xz, "store"
+// for an uncompressed tar, "copy" for a mirror and "chunks" for dedup.
+func ParseArchiveFormat(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", FormatZip:
+		return FormatZip, nil
+	case FormatTarGz, "tgz":
+		return FormatTarGz, nil
+	case FormatTarZst, "zstd":
+		return FormatTarZst, nil
+	case FormatTarXz, "xz", "txz":
+		return FormatTarXz, nil
+	case FormatTar, "store":
+		return FormatTar, nil
+	case FormatMirror, "copy":
+		return FormatMirror, nil
+	case FormatDedup, "chunks":
+		return FormatDedup, nil
+	default:
+		return "", fmt.Errorf("unknown archive format %q", value)
+	}
+}
+
+// FormatRule selects the archive format of the directories matching Pattern.
+type FormatRule struct {
+	Pattern string // Glob matched against the directory name, or its full path when absolute
+	Format  string
+}
+
+// ParseFormatRules parses rules in the form "logs-*=tar.xz;/data/media/*=store".
+// The first matching rule wins.
+func ParseFormatRules(value string) ([]FormatRule, error) {
+	var rules []FormatRule
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		pattern, name, ok := strings.Cut(item, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid format rule %q", item)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid format rule %q: %w", item, err)
+		}
+		format, err := ParseArchiveFormat(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format rule %q: %w", item, err)
+		}
+
+		rules = append(rules, FormatRule{Pattern: pattern, Format: format})
+	}
+
+	return rules, nil
+}
+
+// FormatFor returns the archive format of entry: the format of the first
+// matching rule in FormatRules, ArchiveFormat otherwise.
+func (b *backup) FormatFor(entry *DirectoryEntry) string {
+	for _, rule := range b.FormatRules {
+		name := entry.Name
+		if filepath.IsAbs(rule.Pattern) {
+			name = b.SourceDir(entry)
+		}
+		if ok, _ := filepath.Match(rule.Pattern, name); ok {
+			return rule.Format
+		}
+	}
+	return b.ArchiveFormat
+}
+
+// archiveFormat returns the format of the archive at path from its extension,
+// which may be followed by the extension of its encryption. Mirrors are
+// directories without one.
+func archiveFormat(path string) string {
+	_, ext := splitArchiveExt(path)
+	if format := archiveExtensions[strings.TrimSuffix(ext, encryptionExt(ext))]; format != "" {
+		return format
+	}
+	return FormatMirror
+}
+
+// writesMirrors reports whether ArchiveFormat or one of FormatRules is
+// FormatMirror. Only then is a path without an archive extension written as
+// a mirror, instead of taking e.g. "out.bak" for one.
+func (b *backup) writesMirrors() bool {
+	if b.ArchiveFormat == FormatMirror {
+		return true
+	}
+	for _, rule := range b.FormatRules {
+		if rule.Format == FormatMirror {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveLevel returns the compression level of archives in format.
+func (b *backup) archiveLevel(format string) int {
+	switch format {
+	case FormatTarZst:
+		return b.ZstdLevel
+	case FormatTarXz:
+		return b.XzLevel
+	case FormatTar, FormatMirror:
+		return 0
+	default:
+		return b.CompressionLevel
+	}
+}
+
+// splitArchiveExt splits path into the part before its extension and the
+// extension, which may span several dots for archive formats like tar.gz and
+// encrypted archives like zip.enc.
+func splitArchiveExt(path string) (string, string) {
+	encExt := encryptionExt(path)
+	for ext := range archiveExtensions {
+		if strings.HasSuffix(path, ext+encExt) {
+			return strings.TrimSuffix(path, ext+encExt), ext + encExt
+		}
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext), ext
+}
+
+// newStreamWriter starts an archive in format on out.
+func (b *backup) newStreamWriter(format string, out io.Writer) (ArchiveWriter, error) {
+	switch format {
+	case FormatTarGz:
+		if b.CompressionWorkers > 1 {
+			gz, err := newParallelGzip(out, b.CompressionLevel, b.CompressionWorkers)
+			if err != nil {
+				return nil, err
+			}
+			return newTarWriter(gz), nil
+		}
+		gz, err := gzip.NewWriterLevel(out, b.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		return newTarWriter(gz), nil
+	case FormatTarZst:
+		zst, err := newZstdWriter(out, b.ZstdLevel, b.ZstdWorkers)
+		if err != nil {
+			return nil, err
+		}
+		return newTarWriter(zst), nil
+	case FormatTarXz:
+		xz, err := newXzWriter(out, b.XzLevel)
+		if err != nil {
+			return nil, err
+		}
+		return newTarWriter(xz), nil
+	case FormatTar:
+		return newTarWriter(nopWriteCloser{out}), nil
+	default:
+		return b.newZipWriter(out), nil
+	}
+}
+
+// zipWriter writes zip archives, choosing the compression of every entry
+// with the size rules, and encrypts them with AES when ZipPassword is set.
+// The owner and extended attributes of entries go in extra fields.
+// archive/zip switches to Zip64 by itself for entries, offsets and archives
+// reaching 4GiB or 65535 entries, see also ForceZip64.
+type zipWriter struct {
+	*zip.Writer
+	b *backup
+
+	// method, level and size describe the entry being written, so the
+	// registered compressors can pick a level per entry, compress large
+	// files on several cores and encrypt with the right method.
+	method uint16
+	level  int
+	size   int64
+}
+
+func (b *backup) newZipWriter(out io.Writer) *zipWriter {
+	w := &zipWriter{Writer: zip.NewWriter(out), b: b, level: b.CompressionLevel}
+	w.RegisterCompressor(zip.Deflate, w.deflate)
+	w.RegisterCompressor(zstdMethod, w.zstd)
+	if b.ZipPassword != "" {
+		w.RegisterCompressor(aesMethod, func(out io.Writer) (io.WriteCloser, error) {
+			switch w.method {
+			case zip.Store:
+				return newAESWriter(out, b.ZipPassword, nil)
+			case zstdMethod:
+				return newAESWriter(out, b.ZipPassword, w.zstd)
+			}
+			return newAESWriter(out, b.ZipPassword, w.deflate)
+		})
+	}
+
+	return w
+}
+
+// deflate compresses the entry being written.
+func (w *zipWriter) deflate(out io.Writer) (io.WriteCloser, error) {
+	if w.b.CompressionWorkers > 1 && w.size > 2*parallelBlockSize {
+		d, err := newParallelDeflater(out, w.level, w.b.CompressionWorkers)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return flate.NewWriter(out, w.level)
+}
+
+// zstd compresses the entry being written with the zstd binary.
+func (w *zipWriter) zstd(out io.Writer) (io.WriteCloser, error) {
+	return newZstdWriter(out, w.level, w.b.ZstdWorkers)
+}
+
+func (w *zipWriter) Add(name string, info fs.FileInfo, _ string) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file info header for %q: %w", name, err)
+	}
+
+	header.Name = name
+	if uid, gid, ok := entryOwner(info); ok {
+		header.Extra = append(header.Extra, unixOwnerExtra(uid, gid)...)
+	}
+	if xattrs := entryXattrs(info); len(xattrs) > 0 {
+		extra, err := xattrExtra(xattrs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record the extended attributes of %q: %w", name, err)
+		}
+		header.Extra = append(header.Extra, extra...)
+	}
+	if info.IsDir() {
+		header.Name += "/"        // Add trailing slash for directories
+		header.Method = zip.Store // Directories are usually stored, not compressed
+	} else {
+		// Deflate uses our registered compressor, the extension or size rules may pick Store instead
+		header.Method, w.level = w.b.compressionFor(name, info.Size())
+		w.method, w.size = header.Method, info.Size()
+		if w.b.ZipPassword != "" {
+			header.Extra = append(header.Extra, aesExtra(header.Method)...)
+			header.Method = aesMethod
+			header.Flags |= 0x1 // Encrypted
+		}
+	}
+
+	writer, err := w.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zip header for %q: %w", header.Name, err)
+	}
+	return writer, nil
+}
+
+// tarWriter writes compressed tar archives. Unlike zip, tar keeps symlinks;
+// the owner and permissions of every entry are in its header and extended
+// attributes in PAX records. The whole archive is compressed as one stream,
+// so size rules don't apply.
+type tarWriter struct {
+	*tar.Writer
+	compressor io.WriteCloser
+}
+
+func newTarWriter(compressor io.WriteCloser) *tarWriter {
+	return &tarWriter{Writer: tar.NewWriter(compressor), compressor: compressor}
+}
+
+func (w *tarWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file info header for %q: %w", name, err)
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// PAX headers keep sub-second modification times and long names.
+	header.Format = tar.FormatPAX
+	for xattr, value := range entryXattrs(info) {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[tarXattrPrefix+xattr] = string(value)
+	}
+
+	if err := w.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to create tar header for %q: %w", header.Name, err)
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil, nil
+	}
+	return &tarEntry{w: w.Writer, left: header.Size}, nil
+}
+
+func (w *tarWriter) Close() error {
+	return errors.Join(w.Writer.Close(), w.compressor.Close())
+}
+
+// nopWriteCloser is the compressor of uncompressed tar archives.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// tarEntry writes the content of a tar entry, dropping whatever a file grew
+// by since its header was written, as tar fails on writing past its size.
+type tarEntry struct {
+	w    io.Writer
+	left int64
+}
+
+func (e *tarEntry) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > e.left {
+		p = p[:e.left]
+	}
+	written, err := e.w.Write(p)
+	e.left -= int64(written)
+	if err != nil {
+		return written, err
+	}
+	return n, nil
+}
@@ -0,0 +1,413 @@
+package backup
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterBackend("ftp", func(config func(string) string) (StorageBackend, error) {
+		host := config("FTP_HOST")
+		if host == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		port, _ := strconv.Atoi(config("FTP_PORT"))
+		return NewFTPBackend(FTPConfig{
+			Host:               host,
+			Port:               port,
+			User:               config("FTP_USER"),
+			Password:           config("FTP_PASSWORD"),
+			RemoteDir:          config("FTP_REMOTE_DIR"),
+			TLS:                config("FTP_TLS"),
+			InsecureSkipVerify: config("FTP_TLS_INSECURE") == "true",
+		})
+	})
+}
+
+// FTP TLS modes.
+const (
+	FTPTLSExplicit = "explicit" // AUTH TLS on the plain control port
+	FTPTLSImplicit = "implicit" // TLS from the first byte, usually port 990
+)
+
+// FTPConfig configures an FTP or FTPS server. Transfers always use
+// passive mode, so only outgoing connections are needed.
+type FTPConfig struct {
+	Host               string
+	Port               int
+	User               string
+	Password           string
+	RemoteDir          string // Directory the archives are uploaded to
+	TLS                string // Empty for plain FTP, FTPTLSExplicit or FTPTLSImplicit
+	InsecureSkipVerify bool   // Accept any server certificate
+}
+
+// FTPBackend stores files on an FTP or FTPS server.
+type FTPBackend struct {
+	cfg       FTPConfig
+	tlsConfig *tls.Config
+}
+
+// NewFTPBackend creates a backend for the server described by cfg.
+func NewFTPBackend(cfg FTPConfig) (*FTPBackend, error) {
+	switch cfg.TLS {
+	case "", FTPTLSExplicit, FTPTLSImplicit:
+	default:
+		return nil, fmt.Errorf("unknown FTP TLS mode %q", cfg.TLS)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 21
+		if cfg.TLS == FTPTLSImplicit {
+			cfg.Port = 990
+		}
+	}
+
+	// Servers commonly require data connections to resume the TLS session
+	// of the control connection, hence the shared session cache.
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.Host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	return &FTPBackend{cfg: cfg, tlsConfig: tlsConfig}, nil
+}
+
+// String names the destination in logs.
+func (f *FTPBackend) String() string {
+	scheme := "ftp"
+	if f.cfg.TLS != "" {
+		scheme = "ftps"
+	}
+	return scheme + "://" + net.JoinHostPort(f.cfg.Host, strconv.Itoa(f.cfg.Port)) + "/" + strings.TrimPrefix(f.cfg.RemoteDir, "/")
+}
+
+// ftpConn is a logged in FTP control connection.
+type ftpConn struct {
+	conn      net.Conn
+	text      *textproto.Conn
+	tlsConfig *tls.Config // Protects data connections when set
+}
+
+// cmd sends a command and reads its reply, which must start with expect.
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+
+	return c.text.ReadResponse(expect)
+}
+
+// dial connects and logs in to the server. The connection is closed when ctx
+// is done.
+func (f *FTPBackend) dial(ctx context.Context) (*ftpConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(f.cfg.Host, strconv.Itoa(f.cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if f.cfg.TLS == FTPTLSImplicit {
+		conn = tls.Client(conn, f.tlsConfig)
+	}
+
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if f.cfg.TLS != "" {
+		c.tlsConfig = f.tlsConfig
+	}
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	fail := func(err error) (*ftpConn, error) {
+		stop()
+		c.conn.Close()
+		return nil, err
+	}
+
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return fail(err)
+	}
+
+	if f.cfg.TLS == FTPTLSExplicit {
+		if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return fail(err)
+		}
+		tlsConn := tls.Client(c.conn, f.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fail(err)
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+
+	user := f.cfg.User
+	if user == "" {
+		user = "anonymous"
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if code == 331 {
+		_, _, err = c.cmd(230, "PASS %s", f.cfg.Password)
+	} else if err == nil && code != 230 {
+		err = fmt.Errorf("unexpected reply %d to USER", code)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("login failed: %w", err))
+	}
+
+	if c.tlsConfig != nil {
+		if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return fail(err)
+		}
+		if _, _, err := c.cmd(200, "PROT P"); err != nil {
+			return fail(err)
+		}
+	}
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return fail(err)
+	}
+
+	return c, nil
+}
+
+// passive opens a data connection, preferring EPSV over PASV. The address in
+// a PASV reply is ignored in favour of the control host, which keeps servers
+// behind NAT working.
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+
+	var port int
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("malformed EPSV reply %q", msg)
+		}
+		if port, err = strconv.Atoi(msg[start+4 : end]); err != nil {
+			return nil, fmt.Errorf("malformed EPSV reply %q", msg)
+		}
+	} else {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		start, end := strings.Index(msg, "("), strings.Index(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("malformed PASV reply %q", msg)
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed PASV reply %q", msg)
+		}
+		hi, err1 := strconv.Atoi(fields[4])
+		lo, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("malformed PASV reply %q", msg)
+		}
+		port = hi<<8 | lo
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// transfer runs command over a new passive data connection, handing the
+// connection to fn, and waits for the server to confirm the transfer.
+func (c *ftpConn) transfer(ctx context.Context, command string, fn func(io.ReadWriter) error) error {
+	data, err := c.passive(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open data connection: %w", err)
+	}
+	defer data.Close()
+
+	if _, _, err := c.cmd(1, "%s", command); err != nil {
+		return err
+	}
+
+	var conn io.ReadWriteCloser = data
+	if c.tlsConfig != nil {
+		conn = tls.Client(data, c.tlsConfig)
+	}
+	if err := fn(conn); err != nil {
+		return err
+	}
+	if err := conn.Close(); err != nil {
+		return err
+	}
+
+	_, _, err = c.text.ReadResponse(2)
+	return err
+}
+
+// session logs in, runs fn and logs out.
+func (f *FTPBackend) session(ctx context.Context, fn func(c *ftpConn) error) error {
+	c, err := f.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer c.conn.Close()
+
+	if err := fn(c); err != nil {
+		return err
+	}
+	c.cmd(0, "QUIT")
+
+	return nil
+}
+
+// Put stores the file at localPath as key below the remote directory,
+// creating missing directories first. The file is uploaded under a
+// temporary name and renamed once complete, so an interrupted upload never
+// leaves a truncated file under key.
+func (f *FTPBackend) Put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	remotePath := path.Join(f.cfg.RemoteDir, key)
+	tmp := remotePath + ".tmp"
+	var dirs []string
+	for dir := path.Dir(remotePath); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	err = f.session(ctx, func(c *ftpConn) error {
+		for _, dir := range dirs {
+			// Servers reply 550 for directories that already exist.
+			if _, _, err := c.cmd(257, "MKD %s", dir); err != nil && ftpCode(err) != 550 {
+				return fmt.Errorf("failed to create %q: %w", dir, err)
+			}
+		}
+
+		err := c.transfer(ctx, "STOR "+tmp, func(conn io.ReadWriter) error {
+			_, err := io.Copy(conn, throttle(ctx, file))
+			return err
+		})
+		if err == nil {
+			err = c.rename(tmp, remotePath)
+		}
+		if err != nil {
+			c.cmd(0, "DELE %s", tmp)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, f, err)
+	}
+
+	return nil
+}
+
+// rename moves the file from to the name to, replacing it on servers that
+// refuse to rename over an existing file.
+func (c *ftpConn) rename(from, to string) error {
+	move := func() error {
+		if _, _, err := c.cmd(350, "RNFR %s", from); err != nil {
+			return err
+		}
+		_, _, err := c.cmd(250, "RNTO %s", to)
+		return err
+	}
+
+	err := move()
+	if code := ftpCode(err); code == 550 || code == 553 {
+		if _, _, err := c.cmd(250, "DELE %s", to); err == nil {
+			return move()
+		}
+	}
+	return err
+}
+
+// ftpCode returns the reply code of a failed command, 0 for other errors.
+func ftpCode(err error) int {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code
+	}
+	return 0
+}
+
+// Get writes the file stored under key to w.
+func (f *FTPBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	err := f.session(ctx, func(c *ftpConn) error {
+		return c.transfer(ctx, "RETR "+path.Join(f.cfg.RemoteDir, key), func(conn io.ReadWriter) error {
+			_, err := io.Copy(w, conn)
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, f, err)
+	}
+
+	return nil
+}
+
+// List returns the files whose key starts with prefix, using MLSD. Only the
+// directory holding the prefix is listed, not its subdirectories.
+func (f *FTPBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	// The "x" stops a prefix ending in "/" from naming its parent.
+	dir := path.Dir(path.Join(f.cfg.RemoteDir, prefix+"x"))
+
+	var listing []byte
+	err := f.session(ctx, func(c *ftpConn) error {
+		return c.transfer(ctx, "MLSD "+dir, func(conn io.ReadWriter) error {
+			var err error
+			listing, err = io.ReadAll(conn)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", f, err)
+	}
+
+	var objects []StoredObject
+	for _, line := range strings.Split(string(listing), "\n") {
+		// type=file;size=518;modify=20261016001600; name
+		facts, name, ok := strings.Cut(strings.TrimRight(line, "\r"), " ")
+		if !ok {
+			continue
+		}
+
+		var object StoredObject
+		isFile := false
+		for _, fact := range strings.Split(facts, ";") {
+			key, value, _ := strings.Cut(fact, "=")
+			switch strings.ToLower(key) {
+			case "type":
+				isFile = strings.EqualFold(value, "file")
+			case "size":
+				object.Size, _ = strconv.ParseInt(value, 10, 64)
+			case "modify":
+				object.ModTime, _ = time.Parse("20060102150405", value[:min(len(value), 14)])
+			}
+		}
+
+		object.Key = strings.TrimPrefix(path.Join(dir, name), strings.TrimSuffix(f.cfg.RemoteDir, "/")+"/")
+		// Uploads in progress or interrupted are not stored yet, see Put.
+		if isFile && strings.HasPrefix(object.Key, prefix) && !strings.HasSuffix(object.Key, ".tmp") {
+			objects = append(objects, object)
+		}
+	}
+
+	return objects, nil
+}
+
+// Delete removes the file stored under key.
+func (f *FTPBackend) Delete(ctx context.Context, key string) error {
+	err := f.session(ctx, func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "DELE %s", path.Join(f.cfg.RemoteDir, key))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, f, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeFTP is an FTP server keeping files in memory. It replies mkdErr to MKD
+// of a new directory when set, and aborts uploads when abortStor is set,
+// keeping what it received.
+type fakeFTP struct {
+	mu        sync.Mutex
+	files     map[string][]byte
+	dirs      map[string]bool
+	mkdErr    int
+	abortStor bool
+}
+
+func newFakeFTP(t *testing.T) (*fakeFTP, *FTPBackend) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeFTP{files: map[string][]byte{}, dirs: map[string]bool{"/": true}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	s, err := NewFTPBackend(FTPConfig{Host: "127.0.0.1", Port: addr.Port, RemoteDir: "/backups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+// file returns the stored file named name.
+func (f *fakeFTP) file(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.files[name]
+	return content, ok
+}
+
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 ready")
+
+	var data net.Listener
+	var from string
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+
+		f.mu.Lock()
+		switch command {
+		case "USER":
+			text.PrintfLine("230 logged in")
+		case "TYPE":
+			text.PrintfLine("200 ok")
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				text.PrintfLine("425 %v", err)
+				break
+			}
+			text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "MKD":
+			switch {
+			case f.dirs[arg]:
+				text.PrintfLine("550 %s: File exists", arg)
+			case f.mkdErr != 0:
+				text.PrintfLine("%d %s: Permission denied", f.mkdErr, arg)
+			default:
+				f.dirs[arg] = true
+				text.PrintfLine("257 %q created", arg)
+			}
+		case "STOR", "RETR", "MLSD":
+			f.mu.Unlock()
+			f.transfer(text, data, command, arg)
+			f.mu.Lock()
+		case "RNFR":
+			if _, ok := f.files[arg]; !ok {
+				text.PrintfLine("550 %s: No such file", arg)
+				break
+			}
+			from = arg
+			text.PrintfLine("350 ready for RNTO")
+		case "RNTO":
+			f.files[arg] = f.files[from]
+			delete(f.files, from)
+			text.PrintfLine("250 renamed")
+		case "DELE":
+			if _, ok := f.files[arg]; !ok {
+				text.PrintfLine("550 %s: No such file", arg)
+				break
+			}
+			delete(f.files, arg)
+			text.PrintfLine("250 deleted")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			f.mu.Unlock()
+			return
+		default:
+			text.PrintfLine("502 %s not implemented", command)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeFTP) transfer(text *textproto.Conn, data net.Listener, command, arg string) {
+	if data == nil {
+		text.PrintfLine("425 use EPSV first")
+		return
+	}
+	defer data.Close()
+	text.PrintfLine("150 opening data connection")
+	conn, err := data.Accept()
+	if err != nil {
+		text.PrintfLine("425 %v", err)
+		return
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch command {
+	case "STOR":
+		var buf bytes.Buffer
+		if f.abortStor {
+			io.CopyN(&buf, conn, 10)
+			f.files[arg] = buf.Bytes()
+			conn.Close()
+			text.PrintfLine("426 transfer aborted")
+			return
+		}
+		io.Copy(&buf, conn)
+		f.files[arg] = buf.Bytes()
+	case "RETR":
+		content, ok := f.files[arg]
+		if !ok {
+			conn.Close()
+			text.PrintfLine("550 %s: No such file", arg)
+			return
+		}
+		conn.Write(content)
+	case "MLSD":
+		for name, content := range f.files {
+			if path.Dir(name) == arg {
+				fmt.Fprintf(conn, "type=file;size=%d; %s\r\n", len(content), path.Base(name))
+			}
+		}
+	}
+	conn.Close()
+	text.PrintfLine("226 transfer complete")
+}
+
+func TestFTPPutRenamesCompleteUpload(t *testing.T) {
+	f, s := newFakeFTP(t)
+	ctx := context.Background()
+	path1, v1 := randomFile(t, 1000)
+	if err := s.Put(ctx, path1, "app/app.zip"); err != nil {
+		t.Fatal(err)
+	}
+	// The directories exist now, MKD fails with 550 and is ignored.
+	path2, v2 := randomFile(t, 1000)
+	if err := s.Put(ctx, path2, "app/app.zip"); err != nil {
+		t.Fatalf("uploading again over existing directories: %v", err)
+	}
+	if stored, _ := f.file("/backups/app/app.zip"); !bytes.Equal(stored, v2) || bytes.Equal(v1, v2) {
+		t.Error("the second upload did not replace the first")
+	}
+
+	f.mu.Lock()
+	f.abortStor = true
+	f.mu.Unlock()
+	path3, _ := randomFile(t, 1000)
+	if err := s.Put(ctx, path3, "app/app.zip"); err == nil {
+		t.Fatal("an aborted upload succeeded")
+	}
+	if stored, _ := f.file("/backups/app/app.zip"); !bytes.Equal(stored, v2) {
+		t.Error("an aborted upload replaced the stored file")
+	}
+	if _, ok := f.file("/backups/app/app.zip.tmp"); ok {
+		t.Error("an aborted upload left its temporary file")
+	}
+
+	var buf bytes.Buffer
+	if err := s.Get(ctx, "app/app.zip", &buf); err != nil || !bytes.Equal(buf.Bytes(), v2) {
+		t.Errorf("Get returned %d bytes, %v, want the complete upload", buf.Len(), err)
+	}
+}
+
+func TestFTPListSkipsUnfinishedUploads(t *testing.T) {
+	f, s := newFakeFTP(t)
+	f.files["/backups/app/app.zip"] = []byte("archive")
+	f.files["/backups/app/app-2.zip.tmp"] = []byte("arch")
+
+	objects, err := s.List(context.Background(), "app/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "app/app.zip" {
+		t.Errorf("List = %+v, want only app/app.zip", objects)
+	}
+}
+
+func TestFTPPutFailsWhenDirectoryCannotBeCreated(t *testing.T) {
+	f, s := newFakeFTP(t)
+	f.mkdErr = 553
+	path, _ := randomFile(t, 100)
+	err := s.Put(context.Background(), path, "app/app.zip")
+	if ftpCode(err) != 553 {
+		t.Errorf("Put = %v, want the 553 reply to MKD", err)
+	}
+	if _, ok := f.file("/backups/app/app.zip.tmp"); ok {
+		t.Error("a file was stored without its directory")
+	}
+}
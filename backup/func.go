@@ -1,59 +1,474 @@
 package backup
 
 import (
-	"archive/zip"
 	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	jkt, _ = time.LoadLocation("Asia/Jakarta")
+
+	// ErrEmptySource is returned when the source has no directories to back
+	// up and FailOnEmptySource is set.
+	ErrEmptySource = errors.New("source has no directories to back up")
 )
 
 type backup struct {
 	SourcePath       string
 	OutputPath       string
 	CompressionLevel int
+	MaxWorkers       int
+	MemoryPerWorker  uint64
+	RampUp           time.Duration
+	AppendLogPath    string
+	// MinCompressionLevel is the lowest compression level allowed. A lower
+	// CompressionLevel is raised to it by New, flate.DefaultCompression
+	// (-1) counting as level 6.
+	MinCompressionLevel int
+	// Excludes are glob patterns skipped when walking the source, on top of
+	// the .backupignore files found in the tree.
+	Excludes []string
+	// FailOnUnreadable aborts collecting a parent's children, and archiving
+	// the parent, when one of its subdirectories can't be read instead of
+	// skipping that subtree.
+	FailOnUnreadable bool
+	// SizeRules pick the compression method and level per file size.
+	SizeRules []SizeRule
+
+	// StoreExtensions are lower case extensions (".jpg") of files stored in
+	// zip archives without compression, defaultStoreExtensions when nil.
+	StoreExtensions map[string]bool
+	// CheckpointInterval is the number of bytes copied between checkpoints of
+	// resumable copies.
+	CheckpointInterval int64
+	// SafeMode turns every delete of existing backup data, by pruning and
+	// cleanup, into a log message. It is on unless explicitly disabled. It
+	// turns on LabelArchives so every run writes a new archive, and an
+	// archive that exists already is never replaced.
+	SafeMode bool
+	// Sources lists directories to back up instead of the directories
+	// found directly in SourcePath.
+	Sources []string
+	// ArchiveNaming is the naming scheme for archives of listed sources,
+	// either "base" or "path".
+	ArchiveNaming string
+	// MetadataSidecar stores the size, time, mode, owner and checksum of
+	// every archived file in a JSON file next to the archive.
+	MetadataSidecar bool
+	// FailOnEmptySource makes an empty source an error instead of a warning.
+	FailOnEmptySource bool
+	// CompressionWorkers is the number of goroutines compressing a single
+	// large zip entry or a whole tar.gz archive. Values below 2 compress on
+	// one core.
+	CompressionWorkers int
+	// DetectDuplicates hashes every file of the sources, archived in this run
+	// or not, and reports the files with identical content in the run
+	// report, see RecordContents.
+	DetectDuplicates bool
+	// LabelArchives names archives "<name>-full-<time>.zip" and
+	// "<name>-incr-<time>.zip" instead of "<name>.zip".
+	LabelArchives bool
+	// ArchiveNameTemplate names archives after a template such as
+	// "{dir}_{date}_{runid}" instead, see ParseArchiveNameTemplate.
+	ArchiveNameTemplate string
+	// RemoteTimeouts limit the duration of remote storage operations.
+	RemoteTimeouts RemoteTimeouts
+	// FileGroups maps lower case file extensions (".jpg") to a group name.
+	// Files of a group are written to their own archive.
+	FileGroups map[string]string
+	// ReservedPaths are never backed up, in addition to the output path.
+	ReservedPaths []string
+	// MaxArchivesPerSource caps the number of archives kept per directory,
+	// the oldest is deleted locally and remotely right after a new one is
+	// written. It turns on LabelArchives, as archives of the same name would
+	// replace each other.
+	MaxArchivesPerSource int
+	// Retention prunes archives in grandfather-father-son rotation after
+	// every run, locally and on the backends. Enabling it turns on
+	// LabelArchives.
+	Retention RetentionPolicy
+	// MaxStoreSize caps the bytes taken by the archives in the output path, 0
+	// for no limit. The oldest archives are evicted locally and remotely to
+	// stay below it, and no backup is made when that can't free enough room.
+	// It turns on LabelArchives. See EnforceStoreCap.
+	MaxStoreSize int64
+	// RetentionDryRun lists the archives pruning would delete in the report
+	// and the log instead of deleting them.
+	RetentionDryRun bool
+	// RestorePatterns restricts restores to the files matching them, see
+	// patternWriter.
+	RestorePatterns []string
+	// RestoreDryRun lists the files a restore would write, and which of
+	// them exist already, instead of writing them. See listWriter.
+	RestoreDryRun bool
+	// RestoreConflict is the policy for files a restore finds in the target
+	// already, ConflictOverwrite when empty. See ParseRestoreConflict.
+	RestoreConflict string
+	// RestoreConfirm is asked with the number of existing files before a
+	// restore overwrites any of them under ConflictOverwrite, the restore
+	// stops with ErrRestoreAborted unless it returns true. It is asked once
+	// per restore, with the existing files of every archive it reads, before
+	// any is written. nil restores without asking.
+	RestoreConfirm func(overwrites int) bool
+	// PreserveXattrs records the extended attributes of every file in its
+	// archive, to be restored with it. The owner and mode are always kept.
+	PreserveXattrs bool
+	// Backends receive every finished archive and the manifest.
+	Backends []StorageBackend
+	// UploadBandwidthLimit caps the combined upload rate to the backends in
+	// bytes per second, 0 for no limit.
+	UploadBandwidthLimit int64
+	// ManifestFileChecksums records the SHA-256 of every archived file in
+	// the manifest next to the checksums of the archives. It turns on
+	// MetadataSidecar, which they are taken from. See RecordChecksums.
+	ManifestFileChecksums bool
+	// VerifyArchiveContent reads back every entry of a new archive before it
+	// is recorded, checking its CRC or the checksum of its compression,
+	// instead of only the structure of the archive. See
+	// VerifyArchiveReadable.
+	VerifyArchiveContent bool
+	// ContentChangeDetection backs up a directory when the content of its
+	// files changed, see HashContent, instead of when a modification time
+	// did, so touched but unchanged files are skipped and files restored
+	// with an old modification time are not. Every file is read on every
+	// run.
+	ContentChangeDetection bool
+	// IncrementalBackups archives only the files that changed since the
+	// previous archive of a directory, by size, modification time, mode and
+	// owner, recorded in a catalog of every file next to each archive, see
+	// CatalogPath. A restore takes every file from the newest archive of the
+	// chain back to the full backup holding it. It turns on LabelArchives,
+	// as the archives of a chain must not replace each other. See
+	// FullBackupEvery.
+	IncrementalBackups bool
+	// DifferentialBackups archives the files that changed since the last
+	// full backup instead of since the previous archive, so a restore reads
+	// at most two archives at the cost of larger ones. It turns on
+	// IncrementalBackups.
+	DifferentialBackups bool
+	// FullBackupEvery starts a new chain with a full backup once this many
+	// incremental or differential archives follow the last one, 7 when
+	// unset.
+	FullBackupEvery int
+	// ParityRedundancy writes Reed-Solomon parity data of this percentage of
+	// the archive size next to every archive file and volume, see
+	// ParityPath, so a scrub repairs damaged copies instead of waiting for a
+	// new backup. 0 writes none.
+	ParityRedundancy int
+	// VerifyUploads compares the checksum of every uploaded file with the
+	// local file on backends that report one.
+	VerifyUploads bool
+	// ThreeTwoOne keeps every archive locally and offsite, verifying after
+	// each run that both copies of every archive in the manifest exist.
+	ThreeTwoOne bool
+	// RemoteOnly writes archives to StagingDir and deletes them once every
+	// backend holds them, keeping only the manifest and report locally.
+	RemoteOnly bool
+	// StagingDir holds archives in remote-only mode until they are uploaded.
+	StagingDir string
+	// MaxStagingSize limits the bytes staged at once in remote-only mode, 0
+	// for no limit. See ReserveStaging.
+	MaxStagingSize int64
+	// ArchiveFormat is the format of new archives, FormatZip, FormatTarGz,
+	// FormatTarZst, FormatTarXz, FormatTar, FormatMirror or FormatDedup.
+	ArchiveFormat string
+	// ZstdLevel is the compression level of tar.zst archives, 1 to 22.
+	ZstdLevel int
+	// ZstdWorkers is the number of threads zstd compresses with, 0 for one
+	// per core.
+	ZstdWorkers int
+	// XzLevel is the compression level of tar.xz archives, 1 to 9.
+	XzLevel int
+	// ZipPassword encrypts the files in zip archives with WinZip AES-256
+	// using a key derived from it. Other formats are refused while it is set.
+	ZipPassword string
+	// ForceZip64 writes Zip64 records for every entry of zip archives, not
+	// only for those over 4GiB.
+	ForceZip64 bool
+	// VolumeSize splits archives larger than it into volumes of this many
+	// bytes, 0 keeps archives whole.
+	VolumeSize int64
+	// FormatRules pick the archive format per directory, overriding
+	// ArchiveFormat.
+	FormatRules []FormatRule
+	// Reproducible writes archives that are byte for byte the same for the
+	// same content, names and permissions, see reproducibleInfo. Entries are
+	// always written in lexical order.
+	Reproducible bool
+	// ReproducibleTime is the modification time of every entry of a
+	// reproducible archive.
+	ReproducibleTime time.Time
+	// Encryption encrypts every archive as it is written, nil leaves them
+	// readable. The key ID is recorded with each archive.
+	Encryption Encryptor
+	// EncryptManifest encrypts the manifest with Encryption too, as it names
+	// every directory that is backed up.
+	EncryptManifest bool
+	// ManifestSigningKey signs the manifest with HMAC-SHA256 in a file next
+	// to it, see SignaturePath, and a manifest that is not signed with it is
+	// refused, so a tampered manifest cannot hide changed directories from
+	// the next backup. Nil leaves the manifest unsigned.
+	ManifestSigningKey []byte
+	// EncryptionRules select other encryption than Encryption for some source
+	// directories, the first matching rule wins.
+	EncryptionRules []EncryptionRule
+	// EmbedMetadata adds a MetadataEntryName entry describing the archive to
+	// every archive, see ArchiveMetadata.
+	EmbedMetadata bool
+	// StreamUploads writes archives straight to the storage backends
+	// instead of a local file, see StreamingBackend. Sidecars and the
+	// manifest are still written locally and uploaded afterwards.
+	StreamUploads bool
+
+	reserved []string
+	report   *Report
+	staging  stagingBudget
+	logMu    sync.Mutex
+	// restoreSums are the SHA-256 of the archive files of the record being
+	// restored, see openRemote.
+	restoreSums map[string]string
 }
 
-func New(sourcePath, outputPath string, compressionLevel int) *backup {
-	return &backup{
+func New(sourcePath, outputPath string, compressionLevel int, opts ...Option) *backup {
+	b := &backup{
 		SourcePath:       sourcePath,
 		OutputPath:       outputPath,
 		CompressionLevel: compressionLevel,
+		SafeMode:         true,
+		RemoteTimeouts:   DefaultRemoteTimeouts,
+		VerifyUploads:    true,
+	}
+	now := time.Now()
+	b.report = &Report{RunID: newRunID(now), StartedAt: now.In(jkt).Format(time.RFC3339), started: now}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	b.SourcePath = normalizePath(b.SourcePath)
+	b.OutputPath = normalizePath(b.OutputPath)
+	if b.ArchiveFormat == "" {
+		b.ArchiveFormat = FormatZip
+	}
+	if b.StoreExtensions == nil {
+		b.StoreExtensions = make(map[string]bool)
+		for _, ext := range defaultStoreExtensions {
+			b.StoreExtensions[ext] = true
+		}
+	}
+	if b.ReproducibleTime.IsZero() {
+		b.ReproducibleTime = defaultReproducibleTime
+	}
+	if b.ZstdLevel <= 0 {
+		b.ZstdLevel = defaultZstdLevel
+	}
+	if b.XzLevel <= 0 {
+		b.XzLevel = defaultXzLevel
+	}
+	if b.StagingDir == "" {
+		b.StagingDir = defaultStagingDir
+	}
+	b.StagingDir = normalizePath(b.StagingDir)
+	for i, source := range b.Sources {
+		b.Sources[i] = normalizePath(source)
+	}
+	b.reserved = b.reservedPaths()
+
+	if b.DifferentialBackups {
+		b.IncrementalBackups = true
+	}
+	if b.MaxArchivesPerSource > 0 || b.Retention.Enabled() || b.MaxStoreSize > 0 || b.IncrementalBackups || b.SafeMode {
+		b.LabelArchives = true
+	}
+	if b.ManifestFileChecksums {
+		b.MetadataSidecar = true
+	}
+	if b.FullBackupEvery <= 0 {
+		b.FullBackupEvery = defaultFullBackupEvery
+	}
+
+	// flate.DefaultCompression is -1, but stands for level 6, which is what
+	// is compared with the minimum.
+	level := b.CompressionLevel
+	if level == flate.DefaultCompression {
+		level = 6
+	}
+	if b.MinCompressionLevel > 0 && level < b.MinCompressionLevel {
+		fmt.Printf("Compression level %d is below the minimum of %d, using %d\n", b.CompressionLevel, b.MinCompressionLevel, b.MinCompressionLevel)
+		b.CompressionLevel = b.MinCompressionLevel
 	}
+
+	return b
 }
 
 // zipDirectory zips the contents of sourceDir into a new zip file at destZipPath.
 // It now accepts a compressionLevel (e.g., flate.DefaultCompression, flate.BestSpeed, flate.BestCompression, or 1-9).
+// The archive is written to a temporary file first and only moves to
+// destZipPath once it is complete and verified, see VerifyArchiveReadable.
 func (b *backup) ZipDirectory(sourcePath, destZipPath string) error {
-	zipFile, err := os.Create(destZipPath)
-	if err != nil {
-		return fmt.Errorf("failed to create zip file %q: %w", destZipPath, err)
+	_, err := b.ZipDirectoryGrouped(sourcePath, destZipPath)
+	return err
+}
+
+// ArchiveWritten is called with the temporary file of every archive once it
+// is written. It is a variable so tests, here and in programs using the
+// package, can damage the archive before it is verified.
+var ArchiveWritten = func(tmp string) {}
+
+// walkDir walks the source directories when building the manifest and
+// archiving. It is a variable so tests can fail reading a directory whatever
+// the permissions of the user running them.
+var walkDir = filepath.WalkDir
+
+// zipTarget is one archive being written by ZipDirectoryGrouped.
+type zipTarget struct {
+	path   string
+	tmp    string // Empty when the archive is streamed, see StreamUploads
+	writer ArchiveWriter
+	files  int // Entries written that are not directories
+}
+
+// ZipDirectoryGrouped works like ZipDirectory, but files whose extension is
+// mapped to a group in FileGroups go to a separate archive per group, see
+// GroupArchivePath. It returns the group archives that were written.
+// Archives are written in the format matching the extension of destZipPath,
+// a path without one is written as a mirror when mirrors are configured, see
+// writesMirrors, and refused otherwise. Mirrors have no group archives.
+// With StreamUploads the archives are uploaded while they are written and
+// never stored locally.
+func (b *backup) ZipDirectoryGrouped(sourcePath, destZipPath string) (map[string]string, error) {
+	return b.ZipDirectoryChanged(sourcePath, destZipPath, nil)
+}
+
+// ZipDirectoryChanged works like ZipDirectoryGrouped, but only archives the
+// files that changed since the catalog since was written, see
+// IncrementalBackups, along with every directory and symlink, as a zip holds
+// the content of the symlink target. A nil catalog archives every file. With
+// IncrementalBackups the catalog of the directory is written next to the
+// archive, see CatalogPath.
+func (b *backup) ZipDirectoryChanged(sourcePath, destZipPath string, since []FileMetadata) (map[string]string, error) {
+	sourcePath = normalizePath(sourcePath)
+
+	format := archiveFormat(destZipPath)
+	if format == FormatMirror && !b.writesMirrors() {
+		return nil, fmt.Errorf("cannot write %q: unknown archive extension, mirrors are only written with the mirror format", destZipPath)
+	}
+	archiver := b.ArchiverFor(format)
+	if b.ZipPassword != "" && format != FormatZip {
+		return nil, fmt.Errorf("cannot write %q: password protection needs the zip format", destZipPath)
+	}
+	encryption := b.encryptionForSource(sourcePath)
+	if b.Reproducible && (b.ZipPassword != "" || encryption != nil) {
+		return nil, fmt.Errorf("cannot write %q: encrypted archives are never reproducible, their salt is random", destZipPath)
 	}
-	defer zipFile.Close()
+	if encryption != nil && format == FormatMirror {
+		return nil, fmt.Errorf("cannot write %q: mirrors cannot be encrypted", destZipPath)
+	}
+	if encryption != nil && format == FormatDedup {
+		return nil, fmt.Errorf("cannot write %q: the chunks of dedup archives cannot be encrypted", destZipPath)
+	}
+	if encryption != nil && b.ForceZip64 {
+		return nil, fmt.Errorf("cannot write %q: forcing Zip64 rewrites the finished archive and cannot be combined with encryption", destZipPath)
+	}
+	targets := make(map[string]*zipTarget)
+	defer func() {
+		for _, t := range targets {
+			// Archives that were closed already are not closed again.
+			if t.writer != nil {
+				if w, ok := t.writer.(*streamWriter); ok {
+					w.stream.Abort(errors.New("archive not finished"))
+				}
+				t.writer.Close()
+			}
+			os.RemoveAll(t.tmp)
+		}
+	}()
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	// writerFor opens the archive of group on first use, "" is the main archive.
+	writerFor := func(group string) (ArchiveWriter, error) {
+		if t, ok := targets[group]; ok {
+			return t.writer, nil
+		}
 
-	// Register a custom Deflate compressor with the specified compression level
-	zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, b.CompressionLevel)
-	})
-	if err != nil {
-		return fmt.Errorf("failed to register compressor for zip writer: %w", err)
+		path := destZipPath
+		if group != "" {
+			path = GroupArchivePath(destZipPath, group)
+		}
+		if b.StreamUploads {
+			writer, err := b.streamArchive(format, sourcePath, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stream archive %q: %w", path, err)
+			}
+			targets[group] = &zipTarget{path: path, writer: writer}
+			return writer, nil
+		}
+
+		if b.SafeMode {
+			if _, err := os.Lstat(path); err == nil {
+				return nil, fmt.Errorf("archive %q already exists, safe mode never replaces archives", path)
+			}
+		}
+		writer, err := archiver.Create(sourcePath, path+".tmp")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create archive %q: %w", path, err)
+		}
+		targets[group] = &zipTarget{path: path, tmp: path + ".tmp", writer: writer}
+
+		return writer, nil
+	}
+
+	if _, err := writerFor(""); err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Zipping contents of %q to %q with level %d...\n", sourcePath, destZipPath, b.CompressionLevel)
+	fmt.Printf("Archiving contents of %q to %q with level %d...\n", sourcePath, destZipPath, b.archiveLevel(format))
 
-	err = filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
+	var files, catalog []FileMetadata
+	previous := make(map[string]FileMetadata, len(since))
+	for _, meta := range since {
+		previous[meta.Path] = meta
+	}
+	excludes := b.newExcludeMatcher(sourcePath)
+	err := walkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return err
+			// Skipped like when the manifest was built, which lists it as
+			// unreadable, so the rest of the directory is still archived.
+			fmt.Printf("Error accessing path %q: %v\n", path, err)
+			if path == sourcePath || b.FailOnUnreadable {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if b.isReserved(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if pattern, excluded := excludes.match(path, d.IsDir()); excluded {
+			b.report.recordExclude(pattern, path, d)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			excludes.enter(path)
 		}
 
 		// Skip the base directory itself if we don't want it as the root entry in the zip
@@ -67,84 +482,199 @@ func (b *backup) ZipDirectory(sourcePath, destZipPath string) error {
 		if relPath == "." {
 			return nil
 		}
-		// Determine the name to use inside the zip file
-		zipEntryName := relPath
-		// if relPath == "." { // This is the root directory being zipped
-		// 	zipEntryName = filepath.Base(sourcePath) // Use the base name of the source directory
-		// }
-
-		info, _ := d.Info()
 
-		header, err := zip.FileInfoHeader(info)
+		info, err := d.Info()
 		if err != nil {
-			return fmt.Errorf("failed to create file info header for %q: %w", path, err)
+			return fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+		if b.IncrementalBackups {
+			meta := newFileMetadata(filepath.ToSlash(relPath), info)
+			catalog = append(catalog, meta)
+			if prev, ok := previous[meta.Path]; ok && d.Type().IsRegular() && meta.unchangedSince(prev) {
+				if b.DetectDuplicates {
+					return b.recordContent(path, info)
+				}
+				return nil
+			}
 		}
 
-		header.Name = zipEntryName
-		if d.IsDir() {
-			header.Name += "/"        // Add trailing slash for directories
-			header.Method = zip.Store // Directories are usually stored, not compressed
-		} else {
-			header.Method = zip.Deflate // Use Deflate for files, which will use our registered compressor
+		group, link := "", ""
+		if !d.IsDir() && format != FormatMirror {
+			group = b.FileGroups[strings.ToLower(filepath.Ext(path))]
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink %q: %w", path, err)
+			}
 		}
 
-		writer, err := zipWriter.CreateHeader(header)
+		archiveWriter, err := writerFor(group)
 		if err != nil {
-			return fmt.Errorf("failed to create zip header for %q: %w", header.Name, err)
+			return err
 		}
-
 		if !d.IsDir() {
+			targets[group].files++
+		}
+
+		entryInfo := info
+		if b.Reproducible && format != FormatMirror {
+			entryInfo = reproducibleInfo{FileInfo: info, modTime: b.ReproducibleTime}
+		}
+		if b.PreserveXattrs && link == "" {
+			xattrs, err := readXattrs(path)
+			if err != nil {
+				fmt.Printf("Warning: failed to read the extended attributes of %q: %v\n", path, err)
+			}
+			if len(xattrs) > 0 {
+				entryInfo = attrInfo{FileInfo: entryInfo, xattrs: xattrs}
+			}
+		}
+		writer, err := archiveWriter.Add(filepath.ToSlash(relPath), entryInfo, link)
+		if err != nil {
+			return err
+		}
+
+		meta := newFileMetadata(filepath.ToSlash(relPath), info)
+		if writer != nil && !d.IsDir() {
 			file, err := os.Open(path)
 			if err != nil {
 				return fmt.Errorf("failed to open file %q: %w", path, err)
 			}
 			defer file.Close()
 
+			var digest hash.Hash
+			if b.MetadataSidecar || b.DetectDuplicates {
+				digest = sha256.New()
+				writer = io.MultiWriter(writer, digest)
+			}
+
 			_, err = io.Copy(writer, file)
 			if err != nil {
-				return fmt.Errorf("failed to copy file contents %q to zip: %w", path, err)
+				return fmt.Errorf("failed to copy file contents %q to archive: %w", path, err)
+			}
+			if digest != nil {
+				meta.SHA256 = hex.EncodeToString(digest.Sum(nil))
 			}
+			if b.DetectDuplicates {
+				b.report.recordContent(meta.SHA256, info.Size(), path)
+			}
+		}
+		if b.MetadataSidecar {
+			files = append(files, meta)
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		return fmt.Errorf("error walking directory for zipping %q: %w", sourcePath, err)
+		return nil, fmt.Errorf("error walking directory for archiving %q: %w", sourcePath, err)
+	}
+
+	groups := make(map[string]string)
+	for group, t := range targets {
+		if b.EmbedMetadata {
+			if err := b.embedMetadata(t.writer, sourcePath, t.path, group, format, t.files); err != nil {
+				return nil, fmt.Errorf("failed to finish archive %q: %w", t.path, err)
+			}
+		}
+		err := t.writer.Close()
+		t.writer = nil
+		if err != nil {
+			return nil, fmt.Errorf("failed to finish archive %q: %w", t.path, err)
+		}
+		if t.tmp != "" {
+			// Verified before it replaces the previous archive, which is
+			// kept when the new one is broken.
+			ArchiveWritten(t.tmp)
+			if err := b.verifyArchiveFile(t.tmp, t.path); err != nil {
+				return nil, err
+			}
+			if err := os.Rename(t.tmp, t.path); err != nil {
+				return nil, err
+			}
+		}
+		if group != "" {
+			groups[group] = t.path
+		}
+	}
+
+	if b.IncrementalBackups {
+		if err := b.writeCatalog(destZipPath, catalog); err != nil {
+			return nil, err
+		}
+	}
+	if b.MetadataSidecar {
+		return groups, b.writeSidecar(destZipPath, files)
 	}
 
-	return nil
+	return groups, nil
 }
 
 // DirectoryEntry represents a single directory in the flat JSON array.
 type DirectoryEntry struct {
-	Name         string            `json:"name"` // Will be the full relative path
-	Type         string            `json:"type"` // "file" or "directory"
-	ModTime      string            `json:"mod_time"`
-	Children     []*DirectoryEntry `json:"children,omitempty"` // Only for directories
-	ZipPath      string            `json:"zip_path,omitempty"` // New: Path to the generated zip file
-	IsNeedBackup bool              `json:"-"`
+	Name          string               `json:"name"` // Will be the full relative path
+	Type          string               `json:"type"` // "file" or "directory"
+	ModTime       string               `json:"mod_time"`
+	Children      []*DirectoryEntry    `json:"children,omitempty"`       // Only for directories
+	ZipPath       string               `json:"zip_path,omitempty"`       // New: Path to the generated zip file
+	Unreadable    []string             `json:"unreadable,omitempty"`     // Subdirectories skipped because they could not be read
+	Source        string               `json:"source,omitempty"`         // Full source path when built from a source list
+	Kind          string               `json:"kind,omitempty"`           // KindFull or KindIncremental, for the latest archive
+	BaseArchive   string               `json:"base_archive,omitempty"`   // Full backup the latest archive builds on
+	Compression   *CompressionSettings `json:"compression,omitempty"`    // Settings the latest archive was written with
+	GroupArchives map[string]string    `json:"group_archives,omitempty"` // Archives holding the files of each file type group
+	History       []ArchiveRecord      `json:"history,omitempty"`        // Every archive written for this directory, oldest first
+	ContentHash   string               `json:"content_hash,omitempty"`   // Of the files below the directory, see HashContent
+	IsNeedBackup  bool                 `json:"need_backup,omitempty"`    // Still set after a failed backup so the next run retries it
 }
 
 // collectAllDescendantDirectoriesFlat walks a given directory (targetPath)
 // and collects all its subdirectories (children, grandchildren, etc.) into a flat slice.
 // The 'name' field in the returned entries will be relative to 'targetPath'.
-func (b *backup) collectAllDescendantDirectoriesFlat(targetPath string) ([]*DirectoryEntry, error) {
+// Subdirectories that cannot be read are skipped and returned as unreadable,
+// unless FailOnUnreadable is set.
+func (b *backup) collectAllDescendantDirectoriesFlat(targetPath string) ([]*DirectoryEntry, []string, error) {
 	var descendants []*DirectoryEntry
+	var unreadable []string
 
-	err := filepath.WalkDir(targetPath, func(path string, d fs.DirEntry, err error) error {
+	excludes := b.newExcludeMatcher(targetPath)
+	err := walkDir(targetPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			fmt.Printf("Error accessing path %q: %v\n", path, err)
-			return err
+			if path == targetPath || b.FailOnUnreadable {
+				return err
+			}
+
+			rel, _ := filepath.Rel(targetPath, path)
+			unreadable = append(unreadable, rel)
+			// A directory is visited before it is read, so it was collected
+			// already.
+			if n := len(descendants); n > 0 && descendants[n-1].Name == rel {
+				descendants = descendants[:n-1]
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
 		// Skip the targetPath itself (the parent) as it will be handled at the top level.
 		// We are only interested in its descendants.
 		if path == targetPath {
+			excludes.enter(path)
+			return nil
+		}
+
+		if _, excluded := excludes.match(path, d.IsDir()); excluded || b.isReserved(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
 		if d.IsDir() {
+			excludes.enter(path)
+
 			info, err := d.Info()
 			if err != nil {
 				fmt.Printf("Error getting info for directory %q: %v\n", path, err)
@@ -169,15 +699,43 @@ func (b *backup) collectAllDescendantDirectoriesFlat(targetPath string) ([]*Dire
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return descendants, nil
+	return descendants, unreadable, nil
 }
 
 // buildHybridOneLevelNestedJSON creates the specific hybrid structure requested.
 // It lists parent directories and then a flat list of all their descendants.
+// When a source list is configured, every listed path is a parent instead of
+// the immediate directories of SourcePath.
+//
+// A source without any directory to back up is reported with a warning, or
+// fails with ErrEmptySource when FailOnEmptySource is set.
 func (b *backup) BuildHybridOneLevelNestedJSON() ([]*DirectoryEntry, error) {
+	build := b.buildFromSourcePath
+	if len(b.Sources) > 0 {
+		build = b.buildFromSourceList
+	}
+
+	result, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		if b.FailOnEmptySource {
+			return nil, fmt.Errorf("%w: %q", ErrEmptySource, b.SourcePath)
+		}
+		fmt.Printf("Warning: Source %q has no directories to back up, check that the source volume is mounted\n", b.SourcePath)
+	}
+
+	return result, nil
+}
+
+// buildFromSourcePath creates a parent entry for every directory directly
+// inside SourcePath.
+func (b *backup) buildFromSourcePath() ([]*DirectoryEntry, error) {
 	var result []*DirectoryEntry
 
 	// Read immediate entries within the rootPath
@@ -186,35 +744,84 @@ func (b *backup) BuildHybridOneLevelNestedJSON() ([]*DirectoryEntry, error) {
 		return nil, fmt.Errorf("error reading root directory %q: %w", b.SourcePath, err)
 	}
 
+	excludes := b.newExcludeMatcher(b.SourcePath)
 	for _, entry := range entries {
 		// Only consider immediate directories at the root level as "parents"
 		if entry.IsDir() {
 			parentFullPath := filepath.Join(b.SourcePath, entry.Name())
+			if b.isReserved(parentFullPath) {
+				continue
+			}
+			if pattern, excluded := excludes.match(parentFullPath, true); excluded {
+				b.report.recordExclude(pattern, parentFullPath, entry)
+				continue
+			}
+
 			parentInfo, err := entry.Info()
 			if err != nil {
 				fmt.Printf("Warning: Could not get info for parent directory %q: %v\n", parentFullPath, err)
 				continue
 			}
 
-			parentEntry := DirectoryEntry{
-				Name:    entry.Name(), // Use base name for the top-level parent
-				Type:    "directory",
-				ModTime: parentInfo.ModTime().In(jkt).Format(time.RFC3339),
-			}
+			// Use base name for the top-level parent
+			result = append(result, b.newParentEntry(entry.Name(), parentFullPath, parentInfo))
+		}
+	}
 
-			// Collect all descendants (children, grandchildren, etc.) for this parent
-			descendants, err := b.collectAllDescendantDirectoriesFlat(parentFullPath)
-			if err != nil {
-				fmt.Printf("Warning: Could not collect descendants for %q: %v\n", parentFullPath, err)
-				// Continue without populating children for this specific parent
-			} else {
-				// Assign the flat list of descendants to the Children field
-				parentEntry.Children = descendants
-			}
+	return result, nil
+}
+
+// buildFromSourceList creates a parent entry for every path of the source list.
+func (b *backup) buildFromSourceList() ([]*DirectoryEntry, error) {
+	var result []*DirectoryEntry
 
-			result = append(result, &parentEntry)
+	names := archiveNames(b.Sources, b.ArchiveNaming)
+	for i, source := range b.Sources {
+		info, err := os.Stat(source)
+		if err != nil || !info.IsDir() {
+			fmt.Printf("Warning: Skipping source %q, it is not a readable directory: %v\n", source, err)
+			continue
 		}
+
+		entry := b.newParentEntry(names[i], source, info)
+		entry.Source = source
+		result = append(result, entry)
 	}
 
 	return result, nil
 }
+
+// newParentEntry builds the manifest entry of a top-level parent directory
+// together with the flat list of its descendants.
+func (b *backup) newParentEntry(name, parentFullPath string, parentInfo fs.FileInfo) *DirectoryEntry {
+	parentEntry := DirectoryEntry{
+		Name:    name,
+		Type:    "directory",
+		ModTime: parentInfo.ModTime().In(jkt).Format(time.RFC3339),
+	}
+
+	// Collect all descendants (children, grandchildren, etc.) for this parent
+	descendants, unreadable, err := b.collectAllDescendantDirectoriesFlat(parentFullPath)
+	if err != nil {
+		fmt.Printf("Warning: Could not collect descendants for %q: %v\n", parentFullPath, err)
+		// Continue without populating children for this specific parent
+	} else {
+		// Assign the flat list of descendants to the Children field
+		parentEntry.Children = descendants
+		parentEntry.Unreadable = unreadable
+		if len(unreadable) > 0 {
+			fmt.Printf("Warning: Skipped %d unreadable path(s) in %q\n", len(unreadable), parentFullPath)
+		}
+	}
+
+	return &parentEntry
+}
+
+// SourceDir returns the directory on disk that entry was built from.
+func (b *backup) SourceDir(entry *DirectoryEntry) string {
+	if entry.Source != "" {
+		return entry.Source
+	}
+
+	return filepath.Join(b.SourcePath, entry.Name)
+}
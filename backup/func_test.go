@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// truncateEOCD cuts the end of central directory record off the zip at path.
+func truncateEOCD(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eocd := bytes.LastIndex(data, []byte("PK\x05\x06"))
+	if eocd < 0 {
+		t.Fatalf("%q has no end of central directory record", path)
+	}
+	if err := os.Truncate(path, int64(eocd)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZipDirectoryKeepsPreviousArchiveWhenBroken(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	dest := filepath.Join(out, "dir.zip")
+	b := New(src, out, -1)
+	if err := b.ZipDirectory(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(written func(string)) { ArchiveWritten = written }(ArchiveWritten)
+	ArchiveWritten = func(tmp string) { truncateEOCD(t, tmp) }
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ZipDirectory(src, dest); err == nil {
+		t.Fatal("a broken archive was accepted, the directory would not be backed up again")
+	}
+
+	if got, err := os.ReadFile(dest); err != nil || !bytes.Equal(got, previous) {
+		t.Errorf("the previous archive was replaced: %v", err)
+	}
+	if err := b.VerifyArchiveReadable(dest); err != nil {
+		t.Errorf("the previous archive is no longer readable: %v", err)
+	}
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("output holds %d files, want only the previous archive", len(entries))
+	}
+}
+
+func TestNewMinCompressionLevel(t *testing.T) {
+	for _, tt := range []struct {
+		level, min, want int
+	}{
+		{-1, 6, -1},
+		{-1, 7, 7},
+		{-1, 9, 9},
+		{0, 6, 6},
+		{3, 6, 6},
+		{9, 6, 9},
+		{1, 0, 1},
+	} {
+		b := New(t.TempDir(), t.TempDir(), tt.level, WithMinCompressionLevel(tt.min))
+		if b.CompressionLevel != tt.want {
+			t.Errorf("level %d with minimum %d became %d, want %d", tt.level, tt.min, b.CompressionLevel, tt.want)
+		}
+	}
+}
+
+// lockDir makes reading the directory at locked fail while the test runs, the
+// way walking a directory without permission does, even as root.
+func lockDir(t *testing.T, locked string) {
+	t.Helper()
+	walk := walkDir
+	walkDir = func(root string, fn fs.WalkDirFunc) error {
+		return walk(root, func(path string, d fs.DirEntry, err error) error {
+			if path != locked || err != nil {
+				return fn(path, d, err)
+			}
+			if err := fn(path, d, nil); err != nil {
+				return err
+			}
+			if err := fn(path, d, &fs.PathError{Op: "open", Path: path, Err: fs.ErrPermission}); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		})
+	}
+	t.Cleanup(func() { walkDir = walk })
+}
+
+func TestZipDirectorySkipsUnreadableSubdirectory(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"keep.txt":        "",
+		"locked/file.txt": "",
+	})
+	lockDir(t, filepath.Join(src, "locked"))
+
+	b := New(src, t.TempDir(), -1)
+	got := zipEntries(t, b, src)
+	if want := []string{"keep.txt"}; !slices.Equal(got, want) {
+		t.Errorf("archived %q, want %q", got, want)
+	}
+
+	b = New(src, t.TempDir(), -1, WithFailOnUnreadable(true))
+	if err := b.ZipDirectory(src, filepath.Join(t.TempDir(), "src.zip")); err == nil {
+		t.Error("archiving an unreadable subdirectory succeeded with FailOnUnreadable")
+	}
+}
+
+func TestManifestRecordsUnreadableSubdirectory(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"app/a/file.txt":        "",
+		"app/locked/x/file.txt": "",
+		"app/z/y/file.txt":      "",
+	})
+	lockDir(t, filepath.Join(src, "app", "locked"))
+
+	manifest, err := New(src, t.TempDir(), -1).BuildHybridOneLevelNestedJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("manifest holds %d directories, want app", len(manifest))
+	}
+	var children []string
+	for _, child := range manifest[0].Children {
+		children = append(children, filepath.ToSlash(child.Name))
+	}
+	if want := []string{"a", "z", "z/y"}; !slices.Equal(children, want) {
+		t.Errorf("app has children %q, want the readable ones %q", children, want)
+	}
+	if want := []string{"locked"}; !slices.Equal(manifest[0].Unreadable, want) {
+		t.Errorf("app lists %q as unreadable, want %q", manifest[0].Unreadable, want)
+	}
+
+	manifest, err = New(src, t.TempDir(), -1, WithFailOnUnreadable(true)).BuildHybridOneLevelNestedJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || manifest[0].Children != nil || manifest[0].Unreadable != nil {
+		t.Errorf("with FailOnUnreadable app holds %+v, want no children", manifest)
+	}
+}
+
+func TestZipDirectoryUnknownExtension(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"file.txt": "content"})
+	out := t.TempDir()
+
+	b := New(src, out, -1)
+	if err := b.ZipDirectory(src, filepath.Join(out, "out.bak")); err == nil {
+		t.Error("out.bak was written as a mirror without the mirror format")
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 0 {
+		t.Errorf("output holds %d entries, want none", len(entries))
+	}
+
+	b = New(src, out, -1, WithArchiveFormat(FormatMirror))
+	if err := b.ZipDirectory(src, filepath.Join(out, "app-20261016T150000")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "app-20261016T150000", "file.txt")); err != nil {
+		t.Errorf("mirror was not written: %v", err)
+	}
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+func TestBuildManifestOfEmptySource(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"file-at-the-root.txt": ""})
+
+	var manifest []*DirectoryEntry
+	var err error
+	out := captureStdout(t, func() {
+		manifest, err = New(src, t.TempDir(), -1).BuildHybridOneLevelNestedJSON()
+	})
+	if err != nil || len(manifest) != 0 {
+		t.Errorf("BuildHybridOneLevelNestedJSON = %d entries, %v, want none", len(manifest), err)
+	}
+	if !strings.Contains(out, "has no directories to back up") {
+		t.Errorf("no warning about the empty source, printed %q", out)
+	}
+
+	if _, err := New(src, t.TempDir(), -1, WithFailOnEmptySource(true)).BuildHybridOneLevelNestedJSON(); !errors.Is(err, ErrEmptySource) {
+		t.Errorf("BuildHybridOneLevelNestedJSON returned %v, want ErrEmptySource", err)
+	}
+
+	writeTree(t, src, map[string]string{"app/file.txt": ""})
+	out = captureStdout(t, func() {
+		manifest, err = New(src, t.TempDir(), -1, WithFailOnEmptySource(true)).BuildHybridOneLevelNestedJSON()
+	})
+	if err != nil || len(manifest) != 1 || strings.Contains(out, "has no directories") {
+		t.Errorf("source with a directory: %d entries, %v, printed %q", len(manifest), err, out)
+	}
+}
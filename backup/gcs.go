@@ -0,0 +1,415 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsChunkGranularity is the multiple every chunk of a resumable upload but
+// the last must be.
+const gcsChunkGranularity = 256 << 10
+
+func init() {
+	RegisterBackend("gcs", func(config func(string) string) (StorageBackend, error) {
+		bucket := config("GCS_BUCKET")
+		if bucket == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		retries, _ := strconv.Atoi(config("GCS_RETRIES"))
+		chunkSize, _ := ParseSize(config("GCS_CHUNK_SIZE"))
+		return NewGCSBackend(GCSConfig{
+			Bucket:          bucket,
+			Prefix:          config("GCS_PREFIX"),
+			CredentialsFile: firstNonEmpty(config("GCS_CREDENTIALS_FILE"), config("GOOGLE_APPLICATION_CREDENTIALS")),
+			Endpoint:        config("GCS_ENDPOINT"),
+			Retries:         retries,
+			ChunkSize:       chunkSize,
+			StorageClass:    config("GCS_STORAGE_CLASS"),
+		})
+	})
+}
+
+// GCSConfig configures a Google Cloud Storage bucket.
+type GCSConfig struct {
+	Bucket          string
+	Prefix          string // Prepended to every object name
+	CredentialsFile string // Service account key in JSON format
+	Endpoint        string // Defaults to https://storage.googleapis.com
+	Retries         int    // Attempts per request on transient errors
+	ChunkSize       int64  // Files larger than this are sent as a resumable upload in chunks of this size
+	StorageClass    string // e.g. NEARLINE, COLDLINE or ARCHIVE, the bucket default when empty
+}
+
+// GCSBackend stores files in a Google Cloud Storage bucket.
+type GCSBackend struct {
+	cfg    GCSConfig
+	client *http.Client
+	creds  *googleCredentials
+}
+
+// NewGCSBackend creates a backend authenticating with the service account
+// key in cfg.CredentialsFile.
+func NewGCSBackend(cfg GCSConfig) (*GCSBackend, error) {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://storage.googleapis.com"
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 64 << 20
+	}
+	cfg.ChunkSize = max(cfg.ChunkSize/gcsChunkGranularity, 1) * gcsChunkGranularity
+
+	creds, err := loadGoogleServiceAccount(cfg.CredentialsFile, gcsScope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCSBackend{cfg: cfg, client: remoteClient, creds: creds}, nil
+}
+
+// String names the destination in logs.
+func (g *GCSBackend) String() string {
+	return "gs://" + g.cfg.Bucket + "/" + g.cfg.Prefix
+}
+
+// do sends a request to the JSON API, retrying transient failures, and hands
+// a 2xx response to handle. body is called once per attempt.
+func (g *GCSBackend) do(ctx context.Context, method, target string, header http.Header, size int64, body func() (io.Reader, error), handle func(*http.Response) error) error {
+	return retryTransient(ctx, g.cfg.Retries, func() error {
+		token, err := g.creds.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		var reader io.Reader
+		if body != nil {
+			if reader, err = body(); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		res, err := g.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{err}
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode/100 != 2 {
+			return responseError(method+" "+g.String(), res)
+		}
+		if handle != nil {
+			return handle(res)
+		}
+		return nil
+	})
+}
+
+// objectURL returns the JSON API URL of the object stored under key.
+func (g *GCSBackend) objectURL(key string) string {
+	return strings.TrimSuffix(g.cfg.Endpoint, "/") + "/storage/v1/b/" + url.PathEscape(g.cfg.Bucket) + "/o/" + url.PathEscape(g.cfg.Prefix+key)
+}
+
+// metadata returns the metadata of a new object stored under key.
+func (g *GCSBackend) metadata(ctx context.Context, key string) []byte {
+	metadata := map[string]string{"name": g.cfg.Prefix + key}
+	if g.cfg.StorageClass != "" && useStorageClass(ctx) {
+		metadata["storageClass"] = g.cfg.StorageClass
+	}
+	data, _ := json.Marshal(metadata)
+	return data
+}
+
+// uploadURL returns the URL that starts an upload of the given type.
+func (g *GCSBackend) uploadURL(uploadType string) string {
+	return strings.TrimSuffix(g.cfg.Endpoint, "/") + "/upload/storage/v1/b/" + url.PathEscape(g.cfg.Bucket) + "/o?uploadType=" + uploadType
+}
+
+// Put stores the file at localPath as the object key. The metadata and the
+// content are sent together as a multipart upload.
+func (g *GCSBackend) Put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var head bytes.Buffer
+	parts := multipart.NewWriter(&head)
+	metadata, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	metadata.Write(g.metadata(ctx, key))
+	parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}})
+	tail := "\r\n--" + parts.Boundary() + "--\r\n"
+
+	header := http.Header{"Content-Type": {"multipart/related; boundary=" + parts.Boundary()}}
+	size := int64(head.Len()) + info.Size() + int64(len(tail))
+	err = g.do(ctx, http.MethodPost, g.uploadURL("multipart"), header, size, func() (io.Reader, error) {
+		_, err := file.Seek(0, io.SeekStart)
+		return io.MultiReader(bytes.NewReader(head.Bytes()), file, strings.NewReader(tail)), err
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, g, err)
+	}
+	return nil
+}
+
+// PutResumable stores the file at localPath as the object key. Files larger
+// than the chunk size are sent through a resumable upload session whose URI is
+// saved to statePath, so an interrupted upload asks the session how much it
+// received and continues from there when it is retried.
+func (g *GCSBackend) PutResumable(ctx context.Context, localPath, key, statePath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= g.cfg.ChunkSize {
+		ctx, cancel := requestContext(ctx)
+		defer cancel()
+		return g.Put(ctx, localPath, key)
+	}
+
+	state := loadUploadState(statePath, key, info)
+	if err := g.putResumable(ctx, localPath, key, info.Size(), state, statePath); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, g, err)
+	}
+
+	return os.Remove(statePath)
+}
+
+func (g *GCSBackend) putResumable(ctx context.Context, localPath, key string, size int64, state *uploadState, statePath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(0)
+	if state.Session != "" {
+		var done bool
+		offset, done, err = g.sendChunk(ctx, state.Session, fmt.Sprintf("bytes */%d", size), nil)
+		if err != nil {
+			// Sessions expire after a week, start a new one.
+			fmt.Printf("Warning: resumable upload of %q to %s is gone, restarting it: %v\n", key, g, err)
+			state.Session = ""
+			offset = 0
+		} else if done {
+			return nil
+		} else {
+			fmt.Printf("Resuming upload of %q to %s at byte %d\n", key, g, offset)
+		}
+	}
+
+	if state.Session == "" {
+		metadata := g.metadata(ctx, key)
+		header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}, "X-Upload-Content-Length": {strconv.FormatInt(size, 10)}}
+		startCtx, cancel := requestContext(ctx)
+		defer cancel()
+		err := g.do(startCtx, http.MethodPost, g.uploadURL("resumable"), header, int64(len(metadata)), func() (io.Reader, error) {
+			return bytes.NewReader(metadata), nil
+		}, func(res *http.Response) error {
+			state.Session = res.Header.Get("Location")
+			if state.Session == "" {
+				return fmt.Errorf("no session URI in response")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	for {
+		chunk := io.NewSectionReader(file, offset, min(g.cfg.ChunkSize, size-offset))
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+chunk.Size()-1, size)
+		next, done, err := g.sendChunk(ctx, state.Session, contentRange, chunk)
+		if err != nil || done {
+			return err
+		}
+		if next <= offset {
+			return fmt.Errorf("upload session made no progress at byte %d", offset)
+		}
+		offset = next
+	}
+}
+
+// sendChunk sends chunk to a resumable upload session, or only asks for its
+// status when chunk is nil. It returns the number of bytes the session has
+// received and whether the upload is complete.
+func (g *GCSBackend) sendChunk(ctx context.Context, session, contentRange string, chunk *io.SectionReader) (int64, bool, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	var received int64
+	var done bool
+	err := retryTransient(ctx, g.cfg.Retries, func() error {
+		var body io.Reader
+		size := int64(0)
+		if chunk != nil {
+			if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			body, size = io.NopCloser(chunk), chunk.Size()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Range", contentRange)
+
+		res, err := g.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{err}
+		}
+		defer res.Body.Close()
+
+		switch {
+		case res.StatusCode/100 == 2:
+			done = true
+			return nil
+		case res.StatusCode == http.StatusPermanentRedirect:
+			// The Range header holds the bytes received so far, "bytes=0-N".
+			received = 0
+			if _, last, ok := strings.Cut(res.Header.Get("Range"), "-"); ok {
+				n, err := strconv.ParseInt(last, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid Range header %q", res.Header.Get("Range"))
+				}
+				received = n + 1
+			}
+			return nil
+		default:
+			return responseError("PUT "+g.String(), res)
+		}
+	})
+
+	return received, done, err
+}
+
+// VerifyChecksum compares the CRC32C of the object stored under key with the
+// file at localPath.
+func (g *GCSBackend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	var object struct {
+		CRC32C string `json:"crc32c"`
+	}
+	err := g.do(ctx, http.MethodGet, g.objectURL(key)+"?fields=crc32c", nil, 0, nil, func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&object)
+	})
+	if err != nil {
+		return err
+	}
+	if object.CRC32C == "" {
+		return errNoChecksum
+	}
+
+	sum, err := fileHash(localPath, crc32.New(crc32.MakeTable(crc32.Castagnoli)))
+	if err != nil {
+		return err
+	}
+	if local := base64.StdEncoding.EncodeToString(sum); object.CRC32C != local {
+		return checksumMismatch("CRC32C", object.CRC32C, local)
+	}
+	return nil
+}
+
+// Get writes the object stored under key to w.
+func (g *GCSBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	err := g.do(ctx, http.MethodGet, g.objectURL(key)+"?alt=media", nil, 0, nil, func(res *http.Response) error {
+		_, err := io.Copy(w, res.Body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, g, err)
+	}
+	return nil
+}
+
+// List returns the objects whose key starts with prefix.
+func (g *GCSBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	var objects []StoredObject
+	token := ""
+	for {
+		query := url.Values{"prefix": {g.cfg.Prefix + prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		target := strings.TrimSuffix(g.cfg.Endpoint, "/") + "/storage/v1/b/" + url.PathEscape(g.cfg.Bucket) + "/o?" + query.Encode()
+
+		var page struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    int64     `json:"size,string"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err := g.do(ctx, http.MethodGet, target, nil, 0, nil, func(res *http.Response) error {
+			return json.NewDecoder(res.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", g, err)
+		}
+
+		for _, item := range page.Items {
+			objects = append(objects, StoredObject{
+				Key:     strings.TrimPrefix(item.Name, g.cfg.Prefix),
+				Size:    item.Size,
+				ModTime: item.Updated,
+			})
+		}
+
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// Delete removes the object stored under key.
+func (g *GCSBackend) Delete(ctx context.Context, key string) error {
+	if err := g.do(ctx, http.MethodDelete, g.objectURL(key), nil, 0, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, g, err)
+	}
+	return nil
+}
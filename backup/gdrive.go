@@ -0,0 +1,327 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const driveScope = "https://www.googleapis.com/auth/drive"
+
+func init() {
+	RegisterBackend("gdrive", func(config func(string) string) (StorageBackend, error) {
+		folderID := config("GDRIVE_FOLDER_ID")
+		if folderID == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		retries, _ := strconv.Atoi(config("GDRIVE_RETRIES"))
+		return NewDriveBackend(DriveConfig{
+			FolderID:        folderID,
+			CredentialsFile: config("GDRIVE_CREDENTIALS_FILE"),
+			ClientID:        config("GDRIVE_CLIENT_ID"),
+			ClientSecret:    config("GDRIVE_CLIENT_SECRET"),
+			RefreshToken:    config("GDRIVE_REFRESH_TOKEN"),
+			Retries:         retries,
+		})
+	})
+}
+
+// DriveConfig configures a Google Drive folder. Requests are authorized with
+// the service account key in CredentialsFile when set, otherwise with the
+// OAuth client refresh token.
+type DriveConfig struct {
+	FolderID        string // ID of the folder, the last part of its URL
+	CredentialsFile string
+	ClientID        string
+	ClientSecret    string
+	RefreshToken    string
+	Endpoint        string // Defaults to https://www.googleapis.com
+	Retries         int    // Attempts per request on transient errors
+}
+
+// DriveBackend stores files in a Google Drive folder. Drive has no paths, so
+// a key is used as the file name as is.
+type DriveBackend struct {
+	cfg    DriveConfig
+	client *http.Client
+	creds  *googleCredentials
+}
+
+// NewDriveBackend creates a backend for the folder described by cfg.
+func NewDriveBackend(cfg DriveConfig) (*DriveBackend, error) {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://www.googleapis.com"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+
+	var creds *googleCredentials
+	switch {
+	case cfg.CredentialsFile != "":
+		var err error
+		if creds, err = loadGoogleServiceAccount(cfg.CredentialsFile, driveScope); err != nil {
+			return nil, err
+		}
+	case cfg.RefreshToken != "":
+		creds = googleOAuthClient(cfg.ClientID, cfg.ClientSecret, cfg.RefreshToken)
+	default:
+		return nil, errors.New("a service account key or an OAuth refresh token is needed for Google Drive")
+	}
+
+	return &DriveBackend{cfg: cfg, client: remoteClient, creds: creds}, nil
+}
+
+// String names the destination in logs.
+func (d *DriveBackend) String() string {
+	return "gdrive://" + d.cfg.FolderID
+}
+
+// do sends a request to the Drive API, retrying transient failures, and hands
+// a 2xx response to handle. body is called once per attempt.
+func (d *DriveBackend) do(ctx context.Context, method, target string, header http.Header, size int64, body func() (io.Reader, error), handle func(*http.Response) error) error {
+	return retryTransient(ctx, d.cfg.Retries, func() error {
+		token, err := d.creds.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		var reader io.Reader
+		if body != nil {
+			if reader, err = body(); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		res, err := d.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{err}
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode/100 != 2 {
+			return responseError(method+" "+d.String(), res)
+		}
+		if handle != nil {
+			return handle(res)
+		}
+		return nil
+	})
+}
+
+// driveFile is an entry of a Drive file listing.
+type driveFile struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	MimeType     string    `json:"mimeType"`
+	Size         int64     `json:"size,string"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+}
+
+// driveQuote quotes a string literal of a Drive search query.
+func driveQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// search returns the files in the folder matching the extra query condition.
+func (d *DriveBackend) search(ctx context.Context, condition string) ([]driveFile, error) {
+	var files []driveFile
+	query := url.Values{
+		"q":                         {driveQuote(d.cfg.FolderID) + " in parents and trashed = false" + condition},
+		"fields":                    {"nextPageToken,files(id,name,mimeType,size,modifiedTime)"},
+		"pageSize":                  {"1000"},
+		"supportsAllDrives":         {"true"},
+		"includeItemsFromAllDrives": {"true"},
+	}
+	for {
+		var page struct {
+			Files         []driveFile `json:"files"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err := d.do(ctx, http.MethodGet, d.cfg.Endpoint+"/drive/v3/files?"+query.Encode(), nil, 0, nil, func(res *http.Response) error {
+			return json.NewDecoder(res.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, page.Files...)
+		if page.NextPageToken == "" {
+			return files, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// find returns the ID of the file named key, or "" when there is none.
+func (d *DriveBackend) find(ctx context.Context, key string) (string, error) {
+	files, err := d.search(ctx, " and name = "+driveQuote(key))
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+	return files[0].ID, nil
+}
+
+// Put stores the file at localPath as key, replacing the content of an
+// existing file of that name so its sharing settings are kept.
+func (d *DriveBackend) Put(ctx context.Context, localPath, key string) error {
+	if err := d.put(ctx, localPath, key); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, d, err)
+	}
+	return nil
+}
+
+func (d *DriveBackend) put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	id, err := d.find(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// A resumable session is started with the metadata and then receives
+	// the content in a single request.
+	method, target, metadata := http.MethodPost, d.cfg.Endpoint+"/upload/drive/v3/files", []byte("{}")
+	if id != "" {
+		method, target = http.MethodPatch, target+"/"+url.PathEscape(id)
+	} else if metadata, err = json.Marshal(map[string]any{"name": key, "parents": []string{d.cfg.FolderID}}); err != nil {
+		return err
+	}
+
+	var session string
+	header := http.Header{"Content-Type": {"application/json; charset=UTF-8"}, "X-Upload-Content-Length": {strconv.FormatInt(info.Size(), 10)}}
+	err = d.do(ctx, method, target+"?uploadType=resumable&supportsAllDrives=true", header, int64(len(metadata)), func() (io.Reader, error) {
+		return bytes.NewReader(metadata), nil
+	}, func(res *http.Response) error {
+		session = res.Header.Get("Location")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if session == "" {
+		return errors.New("no upload session returned")
+	}
+
+	return d.do(ctx, http.MethodPut, session, nil, info.Size(), func() (io.Reader, error) {
+		_, err := file.Seek(0, io.SeekStart)
+		return io.NopCloser(file), err
+	}, nil)
+}
+
+// VerifyChecksum compares the MD5 Drive holds for the file named key with
+// the file at localPath.
+func (d *DriveBackend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	id, err := d.find(ctx, key)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("%q not found", key)
+	}
+
+	var file struct {
+		MD5Checksum string `json:"md5Checksum"`
+	}
+	err = d.do(ctx, http.MethodGet, d.cfg.Endpoint+"/drive/v3/files/"+url.PathEscape(id)+"?fields=md5Checksum&supportsAllDrives=true", nil, 0, nil, func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&file)
+	})
+	if err != nil {
+		return err
+	}
+	if file.MD5Checksum == "" {
+		return errNoChecksum
+	}
+
+	sum, err := fileHash(localPath, md5.New())
+	if err != nil {
+		return err
+	}
+	if local := hex.EncodeToString(sum); file.MD5Checksum != local {
+		return checksumMismatch("MD5", file.MD5Checksum, local)
+	}
+	return nil
+}
+
+// Get writes the file named key to w.
+func (d *DriveBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	id, err := d.find(ctx, key)
+	if err == nil && id == "" {
+		err = os.ErrNotExist
+	}
+	if err == nil {
+		err = d.do(ctx, http.MethodGet, d.cfg.Endpoint+"/drive/v3/files/"+url.PathEscape(id)+"?alt=media&supportsAllDrives=true", nil, 0, nil, func(res *http.Response) error {
+			_, err := io.Copy(w, res.Body)
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, d, err)
+	}
+
+	return nil
+}
+
+// List returns the files whose name starts with prefix.
+func (d *DriveBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	files, err := d.search(ctx, " and mimeType != 'application/vnd.google-apps.folder'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", d, err)
+	}
+
+	var objects []StoredObject
+	for _, file := range files {
+		if strings.HasPrefix(file.Name, prefix) {
+			objects = append(objects, StoredObject{Key: file.Name, Size: file.Size, ModTime: file.ModifiedTime})
+		}
+	}
+
+	return objects, nil
+}
+
+// Delete removes the file named key.
+func (d *DriveBackend) Delete(ctx context.Context, key string) error {
+	id, err := d.find(ctx, key)
+	if err == nil && id != "" {
+		err = d.do(ctx, http.MethodDelete, d.cfg.Endpoint+"/drive/v3/files/"+url.PathEscape(id)+"?supportsAllDrives=true", nil, 0, nil, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, d, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const googleTokenURI = "https://oauth2.googleapis.com/token"
+
+// googleCredentials mint OAuth access tokens for Google APIs, either from a
+// service account key or from the refresh token of an OAuth client.
+type googleCredentials struct {
+	scope    string
+	tokenURI string
+	client   *http.Client
+
+	// Service account
+	email string
+	key   *rsa.PrivateKey
+
+	// OAuth client
+	clientID     string
+	clientSecret string
+	refreshToken string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// loadGoogleServiceAccount reads a service account key in JSON format.
+func loadGoogleServiceAccount(file, scope string) (*googleCredentials, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Google credentials: %w", err)
+	}
+
+	var creds struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid Google credentials: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid Google credentials: no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Google private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid Google private key: not an RSA key")
+	}
+
+	return &googleCredentials{
+		scope:    scope,
+		tokenURI: firstNonEmpty(creds.TokenURI, googleTokenURI),
+		client:   remoteClient,
+		email:    creds.ClientEmail,
+		key:      key,
+	}, nil
+}
+
+// googleOAuthClient uses the refresh token an OAuth client obtained when the
+// user granted it access.
+func googleOAuthClient(clientID, clientSecret, refreshToken string) *googleCredentials {
+	return &googleCredentials{
+		tokenURI:     googleTokenURI,
+		client:       remoteClient,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refreshToken: refreshToken,
+	}
+}
+
+// assertion returns a signed JWT asserting the service account identity.
+func (c *googleCredentials) assertion(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   c.email,
+		"scope": c.scope,
+		"aud":   c.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign Google token request: %w", err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// accessToken returns a cached access token, fetching a new one shortly
+// before the old one expires.
+func (c *googleCredentials) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expiry) > time.Minute {
+		return c.token, nil
+	}
+
+	now := time.Now()
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {c.clientID},
+		"client_secret": {c.clientSecret},
+		"refresh_token": {c.refreshToken},
+	}
+	if c.key != nil {
+		assertion, err := c.assertion(now)
+		if err != nil {
+			return "", err
+		}
+		form = url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", &transientError{fmt.Errorf("failed to fetch Google access token: %w", err)}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", responseError("failed to fetch Google access token", res)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid Google token response: %w", err)
+	}
+
+	c.token = token.AccessToken
+	c.expiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.token, nil
+}
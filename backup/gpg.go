@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+const gpgExtension = ".gpg"
+
+// GPGEncryptor encrypts archives to OpenPGP public keys with the gpg binary,
+// which must be installed in the image, so they can be decrypted with the
+// usual gpg tooling, including keys held on a smartcard or hardware token.
+type GPGEncryptor struct {
+	homeDir      string
+	args         []string // Options selecting the recipients
+	fingerprints []string
+	decrypt      bool
+}
+
+// NewGPGEncryptor creates an encryptor for recipients, either names of keys
+// in the keyring of homeDir, such as a fingerprint or email address, or paths
+// of exported public key files, starting with "/" or ".". An empty homeDir
+// means gpg's default. When decrypt is set, archives are verified by
+// decrypting them with the secret keys known to gpg, otherwise only their
+// first packet is checked.
+func NewGPGEncryptor(recipients []string, homeDir string, decrypt bool) (*GPGEncryptor, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no gpg recipient")
+	}
+
+	e := &GPGEncryptor{homeDir: homeDir, decrypt: decrypt}
+	for _, r := range recipients {
+		var fingerprint string
+		var err error
+		if strings.HasPrefix(r, "/") || strings.HasPrefix(r, ".") {
+			fingerprint, err = e.fingerprint("--show-keys", r)
+			e.args = append(e.args, "--recipient-file", r)
+		} else {
+			fingerprint, err = e.fingerprint("--list-keys", r)
+			e.args = append(e.args, "--recipient", r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid gpg recipient %q: %w", r, err)
+		}
+		e.fingerprints = append(e.fingerprints, fingerprint)
+	}
+
+	return e, nil
+}
+
+// fingerprint returns the fingerprint of the first public key gpg lists with
+// command for key.
+func (e *GPGEncryptor) fingerprint(command, key string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", append(e.gpgArgs(command, "--with-colons"), key)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("gpg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	inKey := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		switch {
+		case fields[0] == "pub":
+			inKey = true
+		case fields[0] == "fpr" && inKey && len(fields) > 9:
+			return fields[9], nil
+		}
+	}
+	return "", errors.New("no public key found")
+}
+
+// gpgArgs returns the arguments of every gpg call followed by args.
+func (e *GPGEncryptor) gpgArgs(args ...string) []string {
+	common := []string{"--batch", "--no-tty", "--quiet"}
+	if e.homeDir != "" {
+		common = append(common, "--homedir", e.homeDir)
+	}
+	return append(common, args...)
+}
+
+// KeyID lists the fingerprints of the recipients.
+func (e *GPGEncryptor) KeyID() string     { return strings.Join(e.fingerprints, ",") }
+func (e *GPGEncryptor) Extension() string { return gpgExtension }
+
+// Encrypt trusts the configured keys as they are, and doesn't compress again
+// as the archive format already decides on compression.
+func (e *GPGEncryptor) Encrypt(out io.Writer) (io.WriteCloser, error) {
+	args := e.gpgArgs("--trust-model", "always", "--compress-algo", "none", "--encrypt")
+	args = append(args, e.args...)
+	return newCommandWriter(out, "gpg", args...)
+}
+
+// Decrypt decrypts in when decrypting was enabled. Otherwise it only checks
+// that in starts with a packet holding an encrypted session key and returns
+// ErrNoDecryptionKey.
+func (e *GPGEncryptor) Decrypt(in io.Reader) (io.Reader, error) {
+	if e.decrypt {
+		return newCommandReader(in, "gpg", e.gpgArgs("--decrypt")...)
+	}
+
+	var first [1]byte
+	if _, err := io.ReadFull(in, first[:]); err != nil || first[0]&0x80 == 0 {
+		return nil, errors.New("not an OpenPGP encrypted archive")
+	}
+	tag := first[0] & 0x3f // New packet format
+	if first[0]&0x40 == 0 {
+		tag = first[0] >> 2 & 0x0f // Old packet format
+	}
+	if tag != 1 && tag != 3 { // Public or symmetric key encrypted session key
+		return nil, errors.New("not an OpenPGP encrypted archive")
+	}
+	return nil, ErrNoDecryptionKey
+}
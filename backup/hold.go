@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SetHold places the archives in manifest matching any of selectors under a
+// legal hold, or releases them when held is false. Held archives are never
+// pruned, see pruneHistory. A selector matches an archive by its path, file
+// name or the ID of the run that wrote it, or a prefix of its creation time,
+// so "2026-10-16" selects the archives of every run that day. It returns the
+// number of archives changed, and an error naming the selectors that matched
+// nothing.
+func SetHold(manifest []*DirectoryEntry, selectors []string, held bool) (int, error) {
+	changed := 0
+	matched := make(map[string]bool)
+	for _, entry := range manifest {
+		for i := range entry.History {
+			record := &entry.History[i]
+			for _, selector := range selectors {
+				if !record.matches(selector) {
+					continue
+				}
+				matched[selector] = true
+				if record.Held != held {
+					record.Held = held
+					changed++
+				}
+			}
+		}
+	}
+
+	var missing []string
+	for _, selector := range selectors {
+		if !matched[selector] {
+			missing = append(missing, selector)
+		}
+	}
+	if len(missing) > 0 {
+		return changed, fmt.Errorf("no archive matches %s", strings.Join(missing, ", "))
+	}
+
+	return changed, nil
+}
+
+// matches reports whether selector selects r, see SetHold.
+func (r ArchiveRecord) matches(selector string) bool {
+	if selector == "" {
+		return false
+	}
+	return r.Path == selector || filepath.Base(r.Path) == selector || r.RunID == selector || strings.HasPrefix(r.CreatedAt, selector)
+}
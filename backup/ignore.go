@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the per-directory file holding exclude patterns that apply
+// to that directory's subtree, similar to .gitignore.
+const ignoreFileName = ".backupignore"
+
+// ignoreRules holds exclude patterns scoped to the directory they apply under.
+type ignoreRules struct {
+	dir      string
+	patterns []string
+}
+
+// excludeMatcher decides whether a path is excluded during a walk. It layers
+// the global Excludes with every .backupignore found along the tree.
+type excludeMatcher struct {
+	rules []ignoreRules
+}
+
+// newExcludeMatcher prepares a matcher for a walk starting at root. Ignore
+// files of the directories between SourcePath and root are loaded up front so
+// their patterns also apply below root. The global Excludes are anchored at
+// SourcePath, or at root when it is outside of it, like a source of the
+// source list.
+func (b *backup) newExcludeMatcher(root string) *excludeMatcher {
+	m := &excludeMatcher{}
+	rel, err := filepath.Rel(b.SourcePath, root)
+	inside := err == nil && !strings.HasPrefix(rel, "..")
+	if len(b.Excludes) > 0 {
+		dir := root
+		if inside {
+			dir = b.SourcePath
+		}
+		m.rules = append(m.rules, ignoreRules{dir: dir, patterns: b.Excludes})
+	}
+
+	if inside {
+		dir := b.SourcePath
+		m.enter(dir)
+		if rel != "." {
+			for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+				if part == "." {
+					continue
+				}
+				dir = filepath.Join(dir, part)
+				m.enter(dir)
+			}
+		}
+	}
+
+	return m
+}
+
+// enter loads the .backupignore of dir, if there is one.
+func (m *excludeMatcher) enter(dir string) {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if len(patterns) > 0 {
+		m.rules = append(m.rules, ignoreRules{dir: dir, patterns: patterns})
+	}
+}
+
+// match reports the pattern that excludes path, if any. Like gitignore, the
+// last matching pattern decides, those of deeper ignore files coming after
+// the outer ones, and a pattern starting with "!" includes again what an
+// earlier one excluded. Files below an excluded directory stay excluded, as
+// the walk never enters it.
+// Patterns ending in "/" only match directories. Patterns containing a "/" are
+// matched against the path relative to the directory they were declared in,
+// other patterns against the base name.
+func (m *excludeMatcher) match(path string, isDir bool) (string, bool) {
+	matched, excluded := "", false
+	for _, r := range m.rules {
+		rel, err := filepath.Rel(r.dir, path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		for _, p := range r.patterns {
+			pattern, negated := strings.CutPrefix(p, "!")
+			if strings.HasSuffix(pattern, "/") {
+				if !isDir {
+					continue
+				}
+				pattern = strings.TrimSuffix(pattern, "/")
+			}
+
+			target := filepath.Base(path)
+			if strings.Contains(pattern, "/") {
+				pattern = strings.TrimPrefix(pattern, "/")
+				target = rel
+			}
+
+			if ok, _ := filepath.Match(pattern, target); ok {
+				matched, excluded = p, !negated
+			}
+		}
+	}
+
+	if !excluded {
+		return "", false
+	}
+	return matched, true
+}
@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeTree creates the files in dir, named by slash separated paths, with
+// their content.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// zipEntries archives src to a zip with b and returns the sorted names of
+// the files in it.
+func zipEntries(t *testing.T, b *backup, src string) []string {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "src.zip")
+	if err := b.ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	return archiveFiles(t, archive)
+}
+
+// archiveFiles returns the sorted names of the files in the zip at path.
+func archiveFiles(t *testing.T, path string) []string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var names []string
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() {
+			names = append(names, f.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestBackupIgnoreFiles(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		".backupignore":                 "*.log\n# comment\n\ncache/\n",
+		"app.log":                       "",
+		"app.txt":                       "",
+		"cache/data.bin":                "",
+		"web/.backupignore":             "!access.log\n/build/*.js\n",
+		"web/access.log":                "",
+		"web/error.log":                 "",
+		"web/build/app.js":              "",
+		"web/build/app.css":             "",
+		"web/src/build/app.js":          "",
+		"web/cache":                     "a file, not the cache/ directory",
+		"other/access.log":              "",
+		"other/.backupignore":           "*.txt\n!keep.txt\n",
+		"other/notes.txt":               "",
+		"other/keep.txt":                "",
+		"other/sub/more.txt":            "",
+		"other/sub/.backupignore":       "!more.txt\n",
+		"other/sub/cache/nested.bin":    "",
+		"other/sub/cache/.backupignore": "!*\n",
+	})
+
+	b := New(src, t.TempDir(), -1)
+	got := zipEntries(t, b, src)
+	want := []string{
+		".backupignore",
+		"app.txt",
+		"other/.backupignore",
+		"other/keep.txt",
+		"other/sub/.backupignore",
+		"other/sub/more.txt",
+		"web/.backupignore",
+		"web/access.log",
+		"web/build/app.css",
+		"web/cache",
+		"web/src/build/app.js",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("archived\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestBackupIgnoreFilesAboveTheWalkRoot(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		".backupignore":     "*.log\n",
+		"app/app.log":       "",
+		"app/app.txt":       "",
+		"app/.backupignore": "!debug.log\n",
+		"app/sub/debug.log": "",
+		"app/sub/other.log": "",
+	})
+
+	b := New(src, t.TempDir(), -1)
+	got := zipEntries(t, b, filepath.Join(src, "app"))
+	want := []string{".backupignore", "app.txt", "sub/debug.log"}
+	if !slices.Equal(got, want) {
+		t.Errorf("archived %q, want %q", got, want)
+	}
+}
+
+func TestExcludeMatcherReportsDecidingPattern(t *testing.T) {
+	src := t.TempDir()
+	b := New(src, t.TempDir(), -1, WithExcludes("*.tmp", "!keep.tmp", "*"))
+	m := b.newExcludeMatcher(src)
+
+	if pattern, excluded := m.match(filepath.Join(src, "keep.tmp"), false); !excluded || pattern != "*" {
+		t.Errorf("keep.tmp matched %q, %v, want the last pattern *", pattern, excluded)
+	}
+	b = New(src, t.TempDir(), -1, WithExcludes("*.tmp", "!keep.tmp"))
+	if pattern, excluded := b.newExcludeMatcher(src).match(filepath.Join(src, "keep.tmp"), false); excluded {
+		t.Errorf("keep.tmp is excluded by %q, want it included again", pattern)
+	}
+}
+
+func TestExcludesApplyToSourceListOutsideSourcePath(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, map[string]string{
+		"keep.txt":     "",
+		"drop.tmp":     "",
+		"sub/drop.tmp": "",
+		"sub/cache/x":  "",
+	})
+
+	b := New(t.TempDir(), t.TempDir(), -1, WithSources([]string{source}, ""), WithExcludes("*.tmp", "sub/cache/"))
+	got := zipEntries(t, b, source)
+	want := []string{"keep.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("archived %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"time"
+)
+
+// defaultFullBackupEvery is FullBackupEvery when it is not set.
+const defaultFullBackupEvery = 7
+
+// CatalogPath returns where the catalog of the directory archived to
+// archivePath is stored: the metadata of every file and directory it held at
+// the time, archived or not, see IncrementalBackups.
+func CatalogPath(archivePath string) string {
+	return archivePath + ".catalog.json"
+}
+
+// unchangedSince reports whether m describes the same file as prev, by size,
+// modification time, mode and owner.
+func (m FileMetadata) unchangedSince(prev FileMetadata) bool {
+	return m.Size == prev.Size && m.ModTime == prev.ModTime && m.Mode == prev.Mode &&
+		equalID(m.UID, prev.UID) && equalID(m.GID, prev.GID)
+}
+
+func equalID(a, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// writeCatalog stores catalog next to the archive at archivePath.
+func (b *backup) writeCatalog(archivePath string, catalog []FileMetadata) error {
+	data, _ := json.Marshal(catalog)
+
+	path := CatalogPath(archivePath)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("failed to write catalog %q: %w", path, err)
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// loadCatalog reads the catalog of the archive at archivePath, from a
+// backend when it is gone locally.
+func (b *backup) loadCatalog(archivePath string) ([]FileMetadata, error) {
+	data, err := os.ReadFile(CatalogPath(archivePath))
+	if errors.Is(err, fs.ErrNotExist) && len(b.Backends) > 0 {
+		data, err = b.readRemote(CatalogPath(archivePath))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog []FileMetadata
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("invalid catalog %q: %w", CatalogPath(archivePath), err)
+	}
+	return catalog, nil
+}
+
+// PlanIncremental decides whether the next archive of entry, marked
+// KindIncremental when it was backed up before, only holds the files that
+// changed since its latest archive, or since its last full backup with
+// DifferentialBackups, setting entry.Kind to KindDifferential. It returns
+// the catalog of that archive to compare with, or nil for a full backup,
+// setting entry.Kind to KindFull, as always without IncrementalBackups. A
+// full backup is taken when FullBackupEvery partial archives follow the last
+// one, or when the archive to compare with has no catalog.
+func (b *backup) PlanIncremental(entry *DirectoryEntry) []FileMetadata {
+	if !b.IncrementalBackups || entry.Kind != KindIncremental || len(entry.History) == 0 {
+		// Every file is archived again, the archive holds them all.
+		entry.Kind = KindFull
+		return nil
+	}
+
+	base := len(entry.History) - 1
+	for base >= 0 && entry.History[base].Partial {
+		base--
+	}
+	if chain := len(entry.History) - 1 - base; chain >= b.FullBackupEvery {
+		fmt.Printf("Taking a full backup of %q after %d partial backups\n", entry.Name, chain)
+		entry.Kind = KindFull
+		return nil
+	}
+
+	since := entry.History[len(entry.History)-1]
+	if b.DifferentialBackups {
+		if base < 0 {
+			fmt.Printf("Taking a full backup of %q, the full backup its archives build on was pruned\n", entry.Name)
+			entry.Kind = KindFull
+			return nil
+		}
+		since = entry.History[base]
+		entry.Kind = KindDifferential
+	}
+	catalog, err := b.loadCatalog(since.Path)
+	if err != nil {
+		fmt.Printf("Taking a full backup of %q, the catalog of %q cannot be read: %v\n", entry.Name, since.Path, err)
+		entry.Kind = KindFull
+		return nil
+	}
+	if catalog == nil {
+		catalog = []FileMetadata{}
+	}
+	return catalog
+}
+
+// ArchiveChain returns the paths of the archives a restore of the directory
+// named sourceName to its latest backed up state reads, the full backup
+// first followed by the partial archives built on it, see recordChain.
+func (b *backup) ArchiveChain(sourceName string) ([]string, error) {
+	return b.ArchiveChainAsOf(sourceName, time.Now())
+}
+
+// ArchiveChainAsOf works like ArchiveChain for the state of the directory at
+// asOf, see recordAsOf.
+func (b *backup) ArchiveChainAsOf(sourceName string, asOf time.Time) ([]string, error) {
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest: %w", err)
+	}
+	i := slices.IndexFunc(manifest, func(e *DirectoryEntry) bool { return e.Name == sourceName })
+	if i < 0 {
+		return nil, fmt.Errorf("%w for %q", ErrNoArchive, sourceName)
+	}
+	record, err := manifest[i].recordAsOf(asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := b.recordChain(record)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(chain))
+	for i, r := range chain {
+		paths[len(chain)-1-i] = r.Path
+	}
+	return paths, nil
+}
+
+// recordChain returns the archives a restore of the partial archive record
+// reads, newest first: record and every archive it builds on back to the
+// last one holding all files, see buildsOn. It fails when an archive of the
+// chain is no longer in the manifest.
+func (b *backup) recordChain(record ArchiveRecord) ([]ArchiveRecord, error) {
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest: %w", err)
+	}
+
+	for _, entry := range manifest {
+		i := slices.IndexFunc(entry.History, func(r ArchiveRecord) bool { return r.Path == record.Path })
+		if i < 0 {
+			continue
+		}
+		chain := []ArchiveRecord{entry.History[i]}
+		for entry.History[i].Partial {
+			if i = entry.buildsOn(i); i < 0 {
+				return nil, fmt.Errorf("%w: the full backup %q builds on was pruned", ErrNoArchive, record.Path)
+			}
+			chain = append(chain, entry.History[i])
+		}
+		return chain, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q is not in the manifest, its incremental chain is unknown", ErrNoArchive, record.Path)
+}
+
+// buildsOn returns the index of the archive the partial archive at index i of
+// entry's history holds the changes since: the previous one, or the last full
+// backup before it for a differential. It returns -1 when there is none.
+func (e *DirectoryEntry) buildsOn(i int) int {
+	if e.History[i].Kind != KindDifferential {
+		return i - 1
+	}
+	j := i - 1
+	for j >= 0 && e.History[j].Partial {
+		j--
+	}
+	return j
+}
+
+// chainFilter restores every file of a catalog once, from the newest archive
+// of a chain holding it, see recordChain.
+type chainFilter struct {
+	want map[string]bool
+	done map[string]bool
+	took map[string]bool // Taken from the archive being read
+}
+
+func newChainFilter(catalog []FileMetadata) *chainFilter {
+	f := &chainFilter{want: make(map[string]bool, len(catalog)), done: make(map[string]bool)}
+	for _, meta := range catalog {
+		f.want[meta.Path] = true
+	}
+	return f
+}
+
+// wrap limits w to the files f still wants, recording them as restored when
+// mark is set.
+func (f *chainFilter) wrap(w ArchiveWriter, mark bool) ArchiveWriter {
+	if f == nil {
+		return w
+	}
+	return chainWriter{ArchiveWriter: w, filter: f, mark: mark}
+}
+
+type chainWriter struct {
+	ArchiveWriter
+	filter *chainFilter
+	mark   bool
+}
+
+func (w chainWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	clean := path.Clean(name)
+	if clean == MetadataEntryName || !w.filter.want[clean] || w.filter.done[clean] {
+		return nil, nil
+	}
+	if w.mark {
+		w.filter.done[clean] = true
+		if w.filter.took != nil {
+			w.filter.took[clean] = true
+		}
+	}
+	return w.ArchiveWriter.Add(name, info, link)
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// catalogHistory returns an entry whose history holds an archive with a
+// catalog in dir for every kind, the first being full, marked for an
+// incremental backup. Each catalog lists one file named after its archive.
+func catalogHistory(t *testing.T, b *backup, dir string, kinds ...string) *DirectoryEntry {
+	t.Helper()
+	entry := &DirectoryEntry{Name: "app"}
+	for i, kind := range kinds {
+		path := filepath.Join(dir, "app-"+strconv.Itoa(i)+".zip")
+		if err := b.writeCatalog(path, []FileMetadata{{Path: filepath.Base(path)}}); err != nil {
+			t.Fatal(err)
+		}
+		entry.History = append(entry.History, ArchiveRecord{Path: path, Kind: kind, Partial: kind != KindFull})
+	}
+	entry.Kind = KindIncremental
+	return entry
+}
+
+func TestPlanIncremental(t *testing.T) {
+	out := t.TempDir()
+	incremental := New(t.TempDir(), out, -1, WithIncrementalBackups(true, 3))
+
+	for _, tt := range []struct {
+		name    string
+		b       *backup
+		kinds   []string
+		prepare func(entry *DirectoryEntry)
+		want    string // Kind planned
+		since   string // Archive whose catalog is returned, none for a full backup
+	}{
+		{"incremental after a full backup", incremental, []string{KindFull}, nil, KindIncremental, "app-0.zip"},
+		{"incremental after an incremental", incremental, []string{KindFull, KindIncremental}, nil, KindIncremental, "app-1.zip"},
+		{"incremental below the limit", incremental, []string{KindFull, KindIncremental, KindIncremental}, nil, KindIncremental, "app-2.zip"},
+		{"full after FullBackupEvery partial archives", incremental, []string{KindFull, KindIncremental, KindIncremental, KindIncremental}, nil, KindFull, ""},
+		{"chain counted from the last full backup", incremental, []string{KindFull, KindIncremental, KindIncremental, KindIncremental, KindFull, KindIncremental}, nil, KindIncremental, "app-5.zip"},
+		{"first backup", incremental, nil, nil, KindFull, ""},
+		{"directory marked full", incremental, []string{KindFull}, func(entry *DirectoryEntry) {
+			entry.Kind = KindFull
+		}, KindFull, ""},
+		{"missing catalog", incremental, []string{KindFull, KindIncremental}, func(entry *DirectoryEntry) {
+			entry.History[1].Path = filepath.Join(out, "gone.zip")
+		}, KindFull, ""},
+		{"incremental backups off", New(t.TempDir(), out, -1), []string{KindFull}, nil, KindFull, ""},
+	} {
+		entry := catalogHistory(t, tt.b, t.TempDir(), tt.kinds...)
+		if tt.prepare != nil {
+			tt.prepare(entry)
+		}
+
+		catalog := tt.b.PlanIncremental(entry)
+		if entry.Kind != tt.want {
+			t.Errorf("%s: planned a %s backup, want %s", tt.name, entry.Kind, tt.want)
+		}
+		switch {
+		case tt.since == "" && catalog != nil:
+			t.Errorf("%s: a full backup compares with %v", tt.name, catalog)
+		case tt.since != "" && (len(catalog) != 1 || catalog[0].Path != tt.since):
+			t.Errorf("%s: compares with %v, want the catalog of %s", tt.name, catalog, tt.since)
+		}
+	}
+}
+
+func TestPlanDifferentialComparesWithLastFullBackup(t *testing.T) {
+	b := New(t.TempDir(), t.TempDir(), -1, WithIncrementalBackups(true, 5), WithDifferentialBackups(true))
+	for _, tt := range []struct {
+		kinds []string
+		since string
+	}{
+		{[]string{KindFull}, "app-0.zip"},
+		{[]string{KindFull, KindDifferential}, "app-0.zip"},
+		{[]string{KindFull, KindDifferential, KindDifferential}, "app-0.zip"},
+		{[]string{KindFull, KindDifferential, KindFull, KindDifferential}, "app-2.zip"},
+	} {
+		entry := catalogHistory(t, b, t.TempDir(), tt.kinds...)
+		catalog := b.PlanIncremental(entry)
+		if entry.Kind != KindDifferential {
+			t.Errorf("after %q planned a %s backup, want differential", tt.kinds, entry.Kind)
+		}
+		if len(catalog) != 1 || catalog[0].Path != tt.since {
+			t.Errorf("after %q compares with %v, want the catalog of %s", tt.kinds, catalog, tt.since)
+		}
+	}
+
+	// Without the full backup the differentials build on, a new one is taken.
+	entry := catalogHistory(t, b, t.TempDir(), KindFull, KindDifferential)
+	entry.History = entry.History[1:]
+	entry.Kind = KindIncremental
+	if catalog := b.PlanIncremental(entry); catalog != nil || entry.Kind != KindFull {
+		t.Errorf("with the full backup pruned planned a %s backup comparing with %v, want a full one", entry.Kind, catalog)
+	}
+}
@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("local", func(config func(string) string) (StorageBackend, error) {
+		dir := config("LOCAL_BACKEND_DIR")
+		if dir == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		return NewLocalBackend(dir), nil
+	})
+}
+
+// LocalBackend stores files in a directory, e.g. a second disk or a mounted
+// network share.
+type LocalBackend struct {
+	dir string
+}
+
+// NewLocalBackend creates a backend storing files below dir.
+func NewLocalBackend(dir string) *LocalBackend {
+	return &LocalBackend{dir: dir}
+}
+
+// String names the destination in logs.
+func (l *LocalBackend) String() string {
+	return l.dir
+}
+
+// path returns the local path of key, refusing keys that escape the
+// directory.
+func (l *LocalBackend) path(key string) (string, error) {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(l.dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %q is outside %s", key, l.dir)
+	}
+	return path, nil
+}
+
+// Put copies the file at localPath to key, replacing it atomically.
+func (l *LocalBackend) Put(ctx context.Context, localPath, key string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := l.PutStream(ctx, key, src); err != nil {
+		return fmt.Errorf("failed to copy %q to %s: %w", localPath, l, err)
+	}
+	return nil
+}
+
+// PutStream writes what is read from r to key, replacing it atomically once
+// r is read to the end.
+func (l *LocalBackend) PutStream(ctx context.Context, key string, r io.Reader) error {
+	dest, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(dest + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dest)
+}
+
+// VerifyChecksum compares the SHA-256 of the copy stored under key with the
+// file at localPath.
+func (l *LocalBackend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	dest, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	remote, err := fileHash(dest, sha256.New())
+	if err != nil {
+		return err
+	}
+	local, err := fileHash(localPath, sha256.New())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(remote, local) {
+		return checksumMismatch("SHA-256", hex.EncodeToString(remote), hex.EncodeToString(local))
+	}
+	return nil
+}
+
+// Get writes the file stored under key to w.
+func (l *LocalBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// List returns the files whose key starts with prefix.
+func (l *LocalBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	var objects []StoredObject
+	err := filepath.WalkDir(l.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, StoredObject{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+
+	return objects, err
+}
+
+// Delete removes the file stored under key.
+func (l *LocalBackend) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
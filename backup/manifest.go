@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNoArchive is returned when a directory has no archive to restore from.
+var ErrNoArchive = errors.New("no archive found")
+
+// ErrChainOverwritten is returned when archives of a chain were written to
+// the same path, so the older ones are gone. Unlabelled archives are named
+// after the directory alone, see LabelArchives.
+var ErrChainOverwritten = errors.New("archives of the chain overwrote each other")
+
+// ArchiveRecord is one archive in the history of a directory.
+type ArchiveRecord struct {
+	Path          string                       `json:"path"`
+	Kind          string                       `json:"kind"`
+	CreatedAt     string                       `json:"created_at"`
+	GroupArchives map[string]string            `json:"group_archives,omitempty"`
+	Destinations  map[string]DestinationStatus `json:"destinations,omitempty"`  // Keyed by storage backend
+	LocalMissing  bool                         `json:"local_missing,omitempty"` // The local copy was gone at the last verification
+	Volumes       map[string]int               `json:"volumes,omitempty"`       // Number of volumes of each split archive, see VolumePath
+	KeyID         string                       `json:"key_id,omitempty"`        // Key the archives are encrypted with, see Encryptor
+	Held          bool                         `json:"held,omitempty"`          // Under a legal hold, never pruned, see SetHold
+	RunID         string                       `json:"run_id,omitempty"`        // Of the run that wrote the archive, see Report
+	SHA256        map[string]string            `json:"sha256,omitempty"`        // Of every archive file and volume by path, see RecordChecksums
+	FileSHA256    map[string]string            `json:"file_sha256,omitempty"`   // Of every archived file by its name in the archive, see ManifestFileChecksums
+	Corruption    []CorruptionEvent            `json:"corruption,omitempty"`    // Copies found corrupt, oldest first, see RecordCorruption
+	Partial       bool                         `json:"partial,omitempty"`       // Holds only the files changed since the archive it builds on, see IncrementalBackups
+}
+
+// CorruptionEvent is a copy of an archive found corrupt by a scrub or a
+// verification.
+type CorruptionEvent struct {
+	Archive    string `json:"archive"`  // The archive file or volume
+	Location   string `json:"location"` // "local" or the storage backend
+	Error      string `json:"error"`
+	DetectedAt string `json:"detected_at"`
+	RunID      string `json:"run_id,omitempty"` // Of the run that found it, see Report
+}
+
+// DestinationStatus is the outcome of copying an archive to one storage
+// backend.
+type DestinationStatus struct {
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	UploadedAt string `json:"uploaded_at,omitempty"`
+	VerifiedAt string `json:"verified_at,omitempty"`
+}
+
+// ManifestPath returns where the manifest of this backup is stored, with the
+// extension of Encryption when EncryptManifest is set.
+func (b *backup) ManifestPath() string {
+	if b.EncryptManifest && b.Encryption != nil {
+		return b.plainManifestPath() + b.Encryption.Extension()
+	}
+	return b.plainManifestPath()
+}
+
+func (b *backup) plainManifestPath() string {
+	return filepath.Join(b.OutputPath, "manifest.json")
+}
+
+// LoadManifest reads the manifest written by the previous run. Once
+// EncryptManifest is turned on, the plain manifest of earlier runs is read
+// until the first encrypted one is saved.
+func (b *backup) LoadManifest() ([]*DirectoryEntry, error) {
+	manifest, err := b.loadManifest(b.ManifestPath())
+	if errors.Is(err, os.ErrNotExist) && b.ManifestPath() != b.plainManifestPath() {
+		if err := b.verifyManifest(b.plainManifestPath()); err != nil {
+			return nil, err
+		}
+		return loadManifest(b.plainManifestPath(), nil)
+	}
+	return manifest, err
+}
+
+// loadManifest reads the manifest at path, checking its signature when
+// ManifestSigningKey is set and decrypting it when EncryptManifest is.
+func (b *backup) loadManifest(path string) ([]*DirectoryEntry, error) {
+	if err := b.verifyManifest(path); err != nil {
+		return nil, err
+	}
+	if b.EncryptManifest {
+		return loadManifest(path, b.Encryption)
+	}
+	return loadManifest(path, nil)
+}
+
+func loadManifest(path string, e Encryptor) ([]*DirectoryEntry, error) {
+	var fileSystemTree []*DirectoryEntry
+
+	m, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	var r io.Reader = m
+	if e != nil {
+		if r, err = e.Decrypt(m); err != nil {
+			return nil, fmt.Errorf("failed to decrypt manifest: %w", err)
+		}
+	}
+	if err := json.NewDecoder(r).Decode(&fileSystemTree); err != nil {
+		return nil, err
+	}
+	if e != nil {
+		// Decryption only authenticates the last chunk once it is read.
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, fmt.Errorf("failed to decrypt manifest: %w", err)
+		}
+	}
+
+	return fileSystemTree, nil
+}
+
+// SaveManifest replaces the manifest with manifest, encrypting it when
+// EncryptManifest is set and signing it when ManifestSigningKey is. The new
+// manifest is written next to the old one and renamed over it, so a failed
+// write leaves the old one intact. The plain manifest of earlier runs is
+// removed once the encrypted one is saved.
+func (b *backup) SaveManifest(manifest []*DirectoryEntry) error {
+	m, _ := json.MarshalIndent(manifest, "", "\t")
+	path := b.manifestFile()
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	var w io.Writer = file
+	var encrypter io.WriteCloser
+	if b.ManifestPath() != b.plainManifestPath() {
+		if encrypter, err = b.Encryption.Encrypt(file); err != nil {
+			return err
+		}
+		w = encrypter
+	}
+	if _, err := w.Write(m); err != nil {
+		return err
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// The signature is replaced after the manifest, a save stopped between
+	// the two leaves it pending, see verifyManifest.
+	pending := pendingSignaturePath(b.ManifestPath())
+	if len(b.ManifestSigningKey) > 0 {
+		if err := b.signManifest(tmp, pending); err != nil {
+			return fmt.Errorf("failed to sign manifest: %w", err)
+		}
+		defer os.Remove(pending)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if len(b.ManifestSigningKey) > 0 {
+		if err := os.Rename(pending, SignaturePath(b.ManifestPath())); err != nil {
+			return err
+		}
+	}
+
+	if b.ManifestPath() != b.plainManifestPath() {
+		if err := os.Remove(b.plainManifestPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Warning: failed to remove the unencrypted manifest: %v\n", err)
+		}
+		os.Remove(SignaturePath(b.plainManifestPath()))
+	}
+	return nil
+}
+
+// manifestFile returns the file SaveManifest replaces: ManifestPath, or the
+// file it links to, so a manifest linked to from elsewhere stays linked.
+func (b *backup) manifestFile() string {
+	path := b.ManifestPath()
+	target, err := os.Readlink(path)
+	if err != nil {
+		return path
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return target
+}
+
+// RecordArchive adds the archive just written for entry to its history.
+func (e *DirectoryEntry) RecordArchive(path string, groups map[string]string, createdAt time.Time) {
+	e.History = append(e.History, ArchiveRecord{
+		Path:          path,
+		Kind:          e.Kind,
+		CreatedAt:     createdAt.In(jkt).Format(time.RFC3339),
+		GroupArchives: groups,
+	})
+}
+
+// RecordCorruption logs that the copy of path at location, an archive of
+// record in the history of e, was found corrupt, and marks e for backup so
+// the next run writes a sound archive of it.
+func (e *DirectoryEntry) RecordCorruption(record *ArchiveRecord, path, location string, err error, runID string, detectedAt time.Time) {
+	e.IsNeedBackup = true
+	record.recordCorruption(path, location, err, runID, detectedAt)
+}
+
+func (r *ArchiveRecord) recordCorruption(path, location string, err error, runID string, detectedAt time.Time) {
+	r.Corruption = append(r.Corruption, CorruptionEvent{
+		Archive:    path,
+		Location:   location,
+		Error:      err.Error(),
+		DetectedAt: detectedAt.In(jkt).Format(time.RFC3339),
+		RunID:      runID,
+	})
+}
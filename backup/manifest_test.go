@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chainHistory returns catalogHistory with a record an hour apart from
+// start for each of kinds.
+func chainHistory(t *testing.T, b *backup, dir string, start time.Time, kinds ...string) *DirectoryEntry {
+	t.Helper()
+	entry := catalogHistory(t, b, dir, kinds...)
+	for i := range entry.History {
+		entry.History[i].CreatedAt = start.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)
+	}
+	return entry
+}
+
+func TestArchiveChain(t *testing.T) {
+	for _, tt := range []struct {
+		kinds []string
+		want  string // Archives restoring the directory, full backup first
+	}{
+		{[]string{KindFull, KindIncremental, KindIncremental}, "app-0.zip app-1.zip app-2.zip"},
+		{[]string{KindFull, KindDifferential, KindDifferential}, "app-0.zip app-2.zip"},
+		{[]string{KindFull, KindIncremental, KindFull, KindIncremental}, "app-2.zip app-3.zip"},
+	} {
+		out := t.TempDir()
+		b := New(t.TempDir(), out, -1)
+		entry := chainHistory(t, b, out, time.Now().Add(-time.Duration(len(tt.kinds))*time.Hour), tt.kinds...)
+		if err := b.SaveManifest([]*DirectoryEntry{entry}); err != nil {
+			t.Fatal(err)
+		}
+
+		chain, err := b.ArchiveChain("app")
+		if err != nil {
+			t.Fatalf("%v: %v", tt.kinds, err)
+		}
+		if got := chainNames(chain); got != tt.want {
+			t.Errorf("%v: chain %s, want %s", tt.kinds, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveChainAsOf(t *testing.T) {
+	out := t.TempDir()
+	b := New(t.TempDir(), out, -1)
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	entry := chainHistory(t, b, out, start, KindFull, KindIncremental, KindIncremental, KindFull)
+	if err := b.SaveManifest([]*DirectoryEntry{entry}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		asOf time.Time
+		want string
+	}{
+		{start, "app-0.zip"},
+		{start.Add(90 * time.Minute), "app-0.zip app-1.zip"},
+		{start.Add(2 * time.Hour), "app-0.zip app-1.zip app-2.zip"},
+		{start.Add(3 * time.Hour), "app-3.zip"},
+	} {
+		chain, err := b.ArchiveChainAsOf("app", tt.asOf)
+		if err != nil {
+			t.Fatalf("as of %s: %v", tt.asOf, err)
+		}
+		if got := chainNames(chain); got != tt.want {
+			t.Errorf("as of %s: chain %s, want %s", tt.asOf, got, tt.want)
+		}
+	}
+
+	if chain, err := b.ArchiveChainAsOf("app", start.Add(-time.Hour)); !errors.Is(err, ErrNoArchive) {
+		t.Errorf("chain before the first backup = %v, %v, want ErrNoArchive", chain, err)
+	}
+	if chain, err := b.ArchiveChain("docs"); !errors.Is(err, ErrNoArchive) {
+		t.Errorf("chain of an unknown directory = %v, %v, want ErrNoArchive", chain, err)
+	}
+}
+
+// chainNames returns the file names of the archives of chain.
+func chainNames(chain []string) string {
+	var names []string
+	for _, path := range chain {
+		names = append(names, filepath.Base(path))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestArchiveChainWithPrunedFullBackup(t *testing.T) {
+	out := t.TempDir()
+	b := New(t.TempDir(), out, -1)
+	entry := chainHistory(t, b, out, time.Now().Add(-3*time.Hour), KindFull, KindIncremental, KindIncremental)
+	entry.History = entry.History[1:]
+	if err := b.SaveManifest([]*DirectoryEntry{entry}); err != nil {
+		t.Fatal(err)
+	}
+
+	if chain, err := b.ArchiveChain("app"); !errors.Is(err, ErrNoArchive) {
+		t.Errorf("ArchiveChain = %v, %v, want ErrNoArchive", chain, err)
+	}
+}
+
+func TestSaveManifestKeepsOldManifestOnFailure(t *testing.T) {
+	b := New(t.TempDir(), t.TempDir(), -1)
+	if err := b.SaveManifest([]*DirectoryEntry{{Name: "app"}}); err != nil {
+		t.Fatal(err)
+	}
+	// The new manifest cannot be written where it is staged.
+	if err := os.MkdirAll(filepath.Join(b.ManifestPath()+".tmp", "busy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.SaveManifest([]*DirectoryEntry{{Name: "app"}, {Name: "docs"}}); err == nil {
+		t.Fatal("SaveManifest succeeded without a place to stage the manifest")
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil || len(manifest) != 1 || manifest[0].Name != "app" {
+		t.Errorf("LoadManifest after a failed save = %v, %v, want the old manifest", manifest, err)
+	}
+}
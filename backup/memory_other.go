@@ -0,0 +1,9 @@
+//go:build !linux
+
+package backup
+
+// availableMemory is not implemented outside Linux, so the worker pool is never
+// shrunk there.
+func availableMemory() (uint64, bool) {
+	return 0, false
+}
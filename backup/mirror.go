@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// mirrorWriter copies the entries of an archive into a directory tree instead
+// of packing them, keeping permissions, modification times, symlinks and
+// extended attributes, and the owner where the process may set it.
+type mirrorWriter struct {
+	root string
+	file *os.File    // Regular file being written
+	info fs.FileInfo // Of the source of file
+	dirs []mirrorDir
+}
+
+// mirrorDir is a directory whose mode and time are set once its content is
+// written, as writing the content changes them.
+type mirrorDir struct {
+	path string
+	info fs.FileInfo
+}
+
+// newMirrorWriter creates the directory root for a mirror of src, which gets
+// the mode and time of src once closed.
+func newMirrorWriter(src, root string) (*mirrorWriter, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &mirrorWriter{root: root, dirs: []mirrorDir{{path: root, info: info}}}, nil
+}
+
+func (w *mirrorWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	if err := w.finishFile(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(w.root, filepath.FromSlash(name))
+	switch {
+	case info.IsDir():
+		if err := os.Mkdir(path, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create %q: %w", path, err)
+		}
+		w.dirs = append(w.dirs, mirrorDir{path: path, info: info})
+		return nil, nil
+	case link != "":
+		if err := os.Symlink(link, path); err != nil {
+			return nil, fmt.Errorf("failed to create %q: %w", path, err)
+		}
+		setOwner(path, info)
+		return nil, nil
+	case info.Mode().IsRegular():
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %q: %w", path, err)
+		}
+		w.file, w.info = file, info
+		return file, nil
+	default:
+		// Devices, sockets and pipes have no content to copy.
+		return nil, nil
+	}
+}
+
+// finishFile closes the file being written and copies the time, owner and
+// extended attributes of its source.
+func (w *mirrorWriter) finishFile() error {
+	if w.file == nil {
+		return nil
+	}
+	file, info := w.file, w.info
+	w.file, w.info = nil, nil
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// Changing the owner clears the setuid and setgid bits.
+	setOwner(file.Name(), info)
+	copyXattrs(file.Name(), info)
+	if err := os.Chmod(file.Name(), restoredMode(info)); err != nil {
+		return err
+	}
+	return os.Chtimes(file.Name(), time.Time{}, info.ModTime())
+}
+
+// Close finishes the last file and the directories, innermost first.
+func (w *mirrorWriter) Close() error {
+	err := w.finishFile()
+	for i := len(w.dirs) - 1; i >= 0; i-- {
+		dir := w.dirs[i]
+		setOwner(dir.path, dir.info)
+		copyXattrs(dir.path, dir.info)
+		err = errors.Join(err, os.Chmod(dir.path, restoredMode(dir.info)), os.Chtimes(dir.path, time.Time{}, dir.info.ModTime()))
+	}
+	w.dirs = nil
+
+	return err
+}
+
+// copyXattrs gives path the extended attributes recorded in info, warning
+// when the file system refuses them.
+func copyXattrs(path string, info fs.FileInfo) {
+	if err := writeXattrs(path, entryXattrs(info)); err != nil {
+		fmt.Printf("Warning: failed to copy the extended attributes of %q: %v\n", path, err)
+	}
+}
+
+// setOwner gives path the owner of info where that is allowed, which usually
+// needs root.
+func setOwner(path string, info fs.FileInfo) {
+	if uid, gid, ok := fileOwner(info); ok {
+		os.Lchown(path, uid, gid)
+	}
+}
@@ -0,0 +1,224 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveNames derives a unique archive name for every source path.
+// With the "path" scheme names always come from the sanitized full path.
+// The default "base" scheme uses the base name and only falls back to the
+// sanitized full path for sources sharing a base name, e.g. /a/logs and
+// /b/logs become a_logs and b_logs. Sources whose names still clash, as
+// sanitizing maps /a/b_c and /a_b/c both to a_b_c, get a short hash of their
+// path appended.
+func archiveNames(sources []string, scheme string) []string {
+	count := make(map[string]int)
+	for _, source := range sources {
+		count[filepath.Base(source)]++
+	}
+
+	names := make([]string, len(sources))
+	taken := make(map[string]int)
+	for i, source := range sources {
+		base := filepath.Base(source)
+		if scheme == "path" || count[base] > 1 {
+			names[i] = sanitizePath(source)
+		} else {
+			names[i] = base
+		}
+		taken[names[i]]++
+	}
+
+	for i, source := range sources {
+		if taken[names[i]] > 1 {
+			sum := sha256.Sum256([]byte(filepath.Clean(source)))
+			names[i] += "-" + hex.EncodeToString(sum[:4])
+		}
+	}
+
+	return names
+}
+
+// sanitizePath turns a path into a single file name component.
+func sanitizePath(path string) string {
+	path = strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, path)
+}
+
+// Kinds of backup recorded in the manifest.
+const (
+	KindFull         = "full"         // Every file of a directory
+	KindIncremental  = "incremental"  // Files changed since the previous archive, see IncrementalBackups
+	KindDifferential = "differential" // Files changed since the last full backup, see DifferentialBackups
+)
+
+// ArchiveName returns the file name of the archive created for entry at the
+// given time. Labelled names carry the backup kind and a timestamp, so the full
+// backup a chain starts from is never overwritten by later runs.
+// Mirrors are always timestamped.
+func (b *backup) ArchiveName(entry *DirectoryEntry, now time.Time) string {
+	format := b.FormatFor(entry)
+	if b.ArchiveNameTemplate != "" {
+		return b.templateName(entry, now, format)
+	}
+	if !b.LabelArchives {
+		if format == FormatMirror {
+			return entry.Name + "-" + now.In(jkt).Format("20060102T150405")
+		}
+		return entry.Name + b.archiveExt(format, b.EncryptionFor(entry))
+	}
+
+	return fmt.Sprintf("%s-%s-%s%s", entry.Name, kindLabel(entry.Kind), now.In(jkt).Format("20060102T150405"), b.archiveExt(format, b.EncryptionFor(entry)))
+}
+
+// kindLabel returns the short form of a backup kind used in archive names.
+func kindLabel(kind string) string {
+	switch kind {
+	case KindFull:
+		return "full"
+	case KindDifferential:
+		return "diff"
+	default:
+		return "incr"
+	}
+}
+
+// nameFields are the placeholders of archive name templates.
+var nameFields = []string{"{dir}", "{kind}", "{date}", "{time}", "{timestamp}", "{runid}"}
+
+// ParseArchiveNameTemplate checks an archive name template such as
+// "{dir}_{date}_{runid}". {dir} is the name of the directory, {kind} "full",
+// "incr" or "diff", {date}, {time} and {timestamp} the time of the backup as
+// 20060102, 150405 and 20060102T150405, and {runid} the ID of the run. The
+// extension of the archive is appended, a template may end with it already.
+// A template has to name the directory and the time or run, so no archive
+// overwrites another.
+func ParseArchiveNameTemplate(value string) (string, error) {
+	template := strings.TrimSpace(value)
+	if template == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return "", fmt.Errorf("archive name template %q must not contain path separators", template)
+	}
+
+	rest := template
+	for _, field := range nameFields {
+		rest = strings.ReplaceAll(rest, field, "")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return "", fmt.Errorf("archive name template %q has unknown placeholders, use %s", template, strings.Join(nameFields, " "))
+	}
+
+	if !strings.Contains(template, "{dir}") {
+		return "", fmt.Errorf("archive name template %q must contain {dir}", template)
+	}
+	if !strings.Contains(template, "{time}") && !strings.Contains(template, "{timestamp}") && !strings.Contains(template, "{runid}") {
+		return "", fmt.Errorf("archive name template %q must contain {time}, {timestamp} or {runid}, or later backups overwrite earlier ones", template)
+	}
+
+	return template, nil
+}
+
+// templateName returns the file name ArchiveNameTemplate gives the archive of
+// entry in format created at now.
+func (b *backup) templateName(entry *DirectoryEntry, now time.Time, format string) string {
+	kind := kindLabel(entry.Kind)
+	t := now.In(jkt)
+	name := strings.NewReplacer(
+		"{dir}", entry.Name,
+		"{kind}", kind,
+		"{date}", t.Format("20060102"),
+		"{time}", t.Format("150405"),
+		"{timestamp}", t.Format("20060102T150405"),
+		"{runid}", b.report.RunID,
+	).Replace(b.ArchiveNameTemplate)
+
+	name = strings.TrimSuffix(name, b.ArchiverFor(format).Extension())
+	return name + b.archiveExt(format, b.EncryptionFor(entry))
+}
+
+// archiveExt returns the extension of new archives in format, followed by
+// the extension of their encryption when encryption is set.
+func (b *backup) archiveExt(format string, encryption Encryptor) string {
+	ext := b.ArchiverFor(format).Extension()
+	if encryption != nil && format != FormatMirror {
+		ext += encryption.Extension()
+	}
+	return ext
+}
+
+// CarryArchiveFrom copies what is known about the latest archive from the
+// previous manifest entry of the same directory.
+func (e *DirectoryEntry) CarryArchiveFrom(previous *DirectoryEntry) {
+	e.ZipPath = previous.ZipPath
+	e.Kind = previous.Kind
+	e.BaseArchive = previous.BaseArchive
+	e.Compression = previous.Compression
+	e.GroupArchives = previous.GroupArchives
+	e.History = previous.History
+}
+
+// GroupArchivePath returns the archive that holds the files of group for the
+// directory archived to destZipPath, e.g. "photos-images.zip".
+func GroupArchivePath(destZipPath, group string) string {
+	base, ext := splitArchiveExt(destZipPath)
+	return base + "-" + group + ext
+}
+
+// ParseFileGroups parses groups in the form "images=.jpg .png;docs=.pdf .txt"
+// into a map of lower case extension to group name.
+func ParseFileGroups(value string) (map[string]string, error) {
+	groups := make(map[string]string)
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		group, exts, ok := strings.Cut(item, "=")
+		group = strings.TrimSpace(group)
+		if !ok || group == "" || sanitizePath(group) != group {
+			return nil, fmt.Errorf("invalid file group %q", item)
+		}
+
+		for _, ext := range strings.Fields(exts) {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			groups[strings.ToLower(ext)] = group
+		}
+	}
+
+	return groups, nil
+}
+
+// normalizePath returns a stable form of path: absolute, cleaned, without a
+// trailing slash and with symlinks resolved when the path exists. Archive
+// entry names are derived from it, so they don't depend on how it was typed.
+func normalizePath(path string) string {
+	if path == "" {
+		return path
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	return filepath.Clean(path)
+}
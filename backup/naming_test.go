@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveNames(t *testing.T) {
+	for _, tt := range []struct {
+		sources []string
+		scheme  string
+		want    []string
+	}{
+		{[]string{"/srv/app", "/srv/db"}, "base", []string{"app", "db"}},
+		{[]string{"/a/logs", "/b/logs"}, "base", []string{"a_logs", "b_logs"}},
+		{[]string{"/srv/app", "/srv/db"}, "path", []string{"srv_app", "srv_db"}},
+	} {
+		got := archiveNames(tt.sources, tt.scheme)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("archiveNames(%q, %q) = %q, want %q", tt.sources, tt.scheme, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveNamesSeparateSanitizedClashes(t *testing.T) {
+	for _, tt := range []struct {
+		sources []string
+		scheme  string
+	}{
+		{[]string{"/a/b_c", "/a_b/c"}, "path"},
+		{[]string{"/a/b", "/c/b", "/x/a_b"}, "base"},
+	} {
+		names := archiveNames(tt.sources, tt.scheme)
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if seen[name] {
+				t.Errorf("archiveNames(%q, %q) = %q, %q is used twice", tt.sources, tt.scheme, names, name)
+			}
+			seen[name] = true
+		}
+		if again := archiveNames(tt.sources, tt.scheme); strings.Join(again, " ") != strings.Join(names, " ") {
+			t.Errorf("archiveNames(%q, %q) changed from %q to %q", tt.sources, tt.scheme, names, again)
+		}
+	}
+}
+
+func TestArchiveNameKind(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 0, 0, 0, jkt)
+	for _, tt := range []struct {
+		incremental bool
+		catalog     bool
+		want        string
+	}{
+		{false, false, "app-full-20261016T150000.zip"},
+		{true, false, "app-full-20261016T150000.zip"},
+		{true, true, "app-incr-20261016T150000.zip"},
+	} {
+		out := t.TempDir()
+		previous := filepath.Join(out, "app-full-20261015T150000.zip")
+		if tt.catalog {
+			writeTree(t, out, map[string]string{filepath.Base(CatalogPath(previous)): "[]"})
+		}
+		entry := &DirectoryEntry{Name: "app", Kind: KindFull}
+		entry.RecordArchive(previous, nil, now.AddDate(0, 0, -1))
+		// Backed up before, so it is a candidate for an incremental backup.
+		entry.Kind = KindIncremental
+
+		b := New(t.TempDir(), out, -1, WithLabelArchives(true), WithIncrementalBackups(tt.incremental, 0))
+		since := b.PlanIncremental(entry)
+		if got := b.ArchiveName(entry, now); got != tt.want {
+			t.Errorf("incremental %v, catalog %v: ArchiveName = %q, want %q", tt.incremental, tt.catalog, got, tt.want)
+		}
+		if partial := since != nil; partial != (entry.Kind == KindIncremental) {
+			t.Errorf("incremental %v, catalog %v: archive of kind %q is partial %v", tt.incremental, tt.catalog, entry.Kind, partial)
+		}
+	}
+}
+
+func TestZipDirectoryGroupsFilesByType(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"photo.JPG":      "",
+		"sub/icon.png":   "",
+		"notes.txt":      "",
+		"docs/guide.pdf": "",
+		"app.bin":        "",
+	})
+	groups, err := ParseFileGroups("images=.jpg .png;docs=.pdf .txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "app.zip")
+	got, err := New(src, t.TempDir(), -1, WithFileGroups(groups)).ZipDirectoryGrouped(src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"images": filepath.Join(filepath.Dir(dest), "app-images.zip"),
+		"docs":   filepath.Join(filepath.Dir(dest), "app-docs.zip"),
+	}
+	if !maps.Equal(got, want) {
+		t.Fatalf("group archives %q, want %q", got, want)
+	}
+
+	for path, files := range map[string][]string{
+		dest:           {"app.bin"},
+		want["images"]: {"photo.JPG", "sub/icon.png"},
+		want["docs"]:   {"docs/guide.pdf", "notes.txt"},
+	} {
+		if names := archiveFiles(t, path); !slices.Equal(names, files) {
+			t.Errorf("%s holds %q, want %q", filepath.Base(path), names, files)
+		}
+	}
+}
+
+func TestSourcePathNormalization(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "data")
+	writeTree(t, src, map[string]string{"app/file.txt": "", "top.txt": ""})
+	link := filepath.Join(root, "link")
+	if err := os.Symlink(src, link); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(root)
+
+	want := zipEntries(t, New(src, t.TempDir(), -1), src)
+	resolved, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, form := range []string{src + "/", src + "//", filepath.Join(root, "data", "app") + "/../", "data", "./data/", link, link + "/"} {
+		b := New(form, t.TempDir(), -1, WithSources([]string{form}, ""))
+		if b.SourcePath != resolved || b.Sources[0] != resolved {
+			t.Errorf("%q is normalized to %q and %q, want %q", form, b.SourcePath, b.Sources[0], resolved)
+		}
+		if got := zipEntries(t, b, form); !slices.Equal(got, want) {
+			t.Errorf("archive of %q holds %q, want %q", form, got, want)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package backup
+
+import "time"
+
+// Option configures optional behaviour of a backup created with New.
+type Option func(*backup)
+
+// WithMaxWorkers caps how many directories are archived in parallel.
+// Zero means one worker per directory that needs a backup.
+func WithMaxWorkers(n int) Option {
+	return func(b *backup) {
+		b.MaxWorkers = n
+	}
+}
+
+// WithMemoryPerWorker sets the amount of free memory (in bytes) each archiving
+// worker is expected to need. When set, the worker pool is shrunk before
+// dispatch so the running workers fit in the memory currently available.
+func WithMemoryPerWorker(bytes uint64) Option {
+	return func(b *backup) {
+		b.MemoryPerWorker = bytes
+	}
+}
+
+// WithRampUp grows the worker pool gradually over d at the start of a run,
+// smoothing the initial IO load on shared storage.
+func WithRampUp(d time.Duration) Option {
+	return func(b *backup) {
+		b.RampUp = d
+	}
+}
+
+// WithAppendLog enables the append-only backup log at path. Every archive that
+// is produced is also appended to this file so earlier runs stay available
+// byte for byte.
+func WithAppendLog(path string) Option {
+	return func(b *backup) {
+		b.AppendLogPath = path
+	}
+}
+
+// WithMinCompressionLevel enforces a minimum compression level (1-9). Any
+// configured level below it is raised to the minimum, the default level -1
+// counting as 6.
+func WithMinCompressionLevel(level int) Option {
+	return func(b *backup) {
+		b.MinCompressionLevel = level
+	}
+}
+
+// WithExcludes sets glob patterns that are skipped when walking the source.
+// They apply everywhere, while patterns from .backupignore files only apply
+// to the subtree of the directory holding the file.
+func WithExcludes(patterns ...string) Option {
+	return func(b *backup) {
+		b.Excludes = append(b.Excludes, patterns...)
+	}
+}
+
+// WithFailOnUnreadable makes an unreadable subdirectory abort the manifest
+// build of its parent instead of only skipping the unreadable subtree.
+func WithFailOnUnreadable(fail bool) Option {
+	return func(b *backup) {
+		b.FailOnUnreadable = fail
+	}
+}
+
+// WithSizeRules selects the compression of each file by its size, so tiny
+// files can be stored as-is and large files compressed harder.
+func WithSizeRules(rules []SizeRule) Option {
+	return func(b *backup) {
+		b.SizeRules = rules
+	}
+}
+
+// WithCheckpointInterval sets how many bytes a resumable copy writes between
+// checkpoints. Smaller values lose less progress on interruption at the cost
+// of more syncs.
+func WithCheckpointInterval(bytes int64) Option {
+	return func(b *backup) {
+		b.CheckpointInterval = bytes
+	}
+}
+
+// WithSafeMode controls safe mode, which is on by default. While it is on,
+// pruning and cleanup only log what they would delete, so
+// MaxArchivesPerSource, Retention and MaxStoreSize keep every archive, archives
+// are labelled and never replaced, and ReencryptArchives refuses to run.
+func WithSafeMode(safe bool) Option {
+	return func(b *backup) {
+		b.SafeMode = safe
+	}
+}
+
+// WithSources backs up the listed directories instead of the directories
+// found directly in the source path. scheme picks how their archives are
+// named, see archiveNames.
+func WithSources(sources []string, scheme string) Option {
+	return func(b *backup) {
+		b.Sources = sources
+		b.ArchiveNaming = scheme
+	}
+}
+
+// WithMetadataSidecar records the metadata of every archived file, as it was
+// when it was read, in a "<archive>.meta.json" file next to each archive.
+func WithMetadataSidecar(enabled bool) Option {
+	return func(b *backup) {
+		b.MetadataSidecar = enabled
+	}
+}
+
+// WithFailOnEmptySource treats a source without any directory to back up as
+// an error, which usually means the source volume isn't mounted.
+func WithFailOnEmptySource(fail bool) Option {
+	return func(b *backup) {
+		b.FailOnEmptySource = fail
+	}
+}
+
+// WithCompressionWorkers splits the compression of large zip entries and of
+// tar.gz archives across n goroutines. The archives stay readable by any zip
+// or gzip tool.
+func WithCompressionWorkers(n int) Option {
+	return func(b *backup) {
+		b.CompressionWorkers = n
+	}
+}
+
+// WithDetectDuplicates reports files with identical content across the
+// sources, to help decide whether deduplication is worth enabling.
+func WithDetectDuplicates(enabled bool) Option {
+	return func(b *backup) {
+		b.DetectDuplicates = enabled
+	}
+}
+
+// WithLabelArchives puts the backup kind and time in archive names, e.g.
+// "photos-full-20240501T150000.zip" for the first backup of a directory.
+func WithLabelArchives(enabled bool) Option {
+	return func(b *backup) {
+		b.LabelArchives = enabled
+	}
+}
+
+// WithRemoteTimeouts replaces the per-operation timeouts of remote storage,
+// DefaultRemoteTimeouts by default. Zero fields disable their limit.
+func WithRemoteTimeouts(t RemoteTimeouts) Option {
+	return func(b *backup) {
+		b.RemoteTimeouts = t
+	}
+}
+
+// WithFileGroups routes files into a separate archive per group based on their
+// extension, see ParseFileGroups.
+func WithFileGroups(groups map[string]string) Option {
+	return func(b *backup) {
+		b.FileGroups = groups
+	}
+}
+
+// WithReservedPaths adds paths that must never be backed up, e.g. the output
+// roots of other jobs whose manifests, reports and logs live inside this
+// job's source.
+func WithReservedPaths(paths ...string) Option {
+	return func(b *backup) {
+		b.ReservedPaths = append(b.ReservedPaths, paths...)
+	}
+}
+
+// WithMaxArchivesPerSource keeps at most n archives per directory, deleting
+// the oldest locally and on the backends right after each new archive is
+// written, and gives archives versioned names. Safe mode only logs the
+// deletions.
+func WithMaxArchivesPerSource(n int) Option {
+	return func(b *backup) {
+		b.MaxArchivesPerSource = n
+	}
+}
+
+// WithBackends copies finished archives and the manifest to backends.
+func WithBackends(backends ...StorageBackend) Option {
+	return func(b *backup) {
+		b.Backends = append(b.Backends, backends...)
+	}
+}
+
+// WithUploadBandwidthLimit limits uploads to the backends to bytesPerSecond.
+func WithUploadBandwidthLimit(bytesPerSecond int64) Option {
+	return func(b *backup) {
+		b.UploadBandwidthLimit = bytesPerSecond
+	}
+}
+
+// WithVerifyUploads sets whether uploaded files are checked against the
+// checksum reported by the backend. It is on by default.
+func WithVerifyUploads(enabled bool) Option {
+	return func(b *backup) {
+		b.VerifyUploads = enabled
+	}
+}
+
+// WithThreeTwoOne enables 3-2-1 mode, see CheckStorage and VerifyCopies.
+func WithThreeTwoOne(enabled bool) Option {
+	return func(b *backup) {
+		b.ThreeTwoOne = enabled
+	}
+}
+
+// WithRemoteOnly enables remote-only mode, staging archives in stagingDir, or
+// a directory below the system temp directory when empty, and holding at most
+// maxStagingSize bytes there at once.
+func WithRemoteOnly(enabled bool, stagingDir string, maxStagingSize int64) Option {
+	return func(b *backup) {
+		b.RemoteOnly = enabled
+		b.StagingDir = stagingDir
+		b.MaxStagingSize = maxStagingSize
+	}
+}
+
+// WithArchiveFormat writes new archives in format, FormatZip, FormatTarGz,
+// FormatTarZst, FormatTarXz, FormatTar, FormatMirror or FormatDedup.
+func WithArchiveFormat(format string) Option {
+	return func(b *backup) {
+		b.ArchiveFormat = format
+	}
+}
+
+// WithZstd sets the level and thread count of tar.zst compression.
+func WithZstd(level, workers int) Option {
+	return func(b *backup) {
+		b.ZstdLevel = level
+		b.ZstdWorkers = workers
+	}
+}
+
+// WithXzLevel sets the level of tar.xz compression.
+func WithXzLevel(level int) Option {
+	return func(b *backup) {
+		b.XzLevel = level
+	}
+}
+
+// WithFormatRules picks the archive format per directory with rules.
+func WithFormatRules(rules []FormatRule) Option {
+	return func(b *backup) {
+		b.FormatRules = rules
+	}
+}
+
+// WithVolumeSize splits archives larger than size bytes into volumes.
+func WithVolumeSize(size int64) Option {
+	return func(b *backup) {
+		b.VolumeSize = size
+	}
+}
+
+// WithForceZip64 writes Zip64 records for every entry of zip archives.
+func WithForceZip64(enabled bool) Option {
+	return func(b *backup) {
+		b.ForceZip64 = enabled
+	}
+}
+
+// WithZipPassword encrypts the files in zip archives with password.
+func WithZipPassword(password string) Option {
+	return func(b *backup) {
+		b.ZipPassword = password
+	}
+}
+
+// WithStoreExtensions stores files with one of the lower case extensions in
+// exts uncompressed in zip archives, as they are compressed already. An empty
+// set compresses every file, nil keeps the defaults.
+func WithStoreExtensions(exts map[string]bool) Option {
+	return func(b *backup) {
+		b.StoreExtensions = exts
+	}
+}
+
+// WithStreamUploads writes archives straight to the storage backends, which
+// must all support it, so no local disk space is needed for them.
+func WithStreamUploads(enabled bool) Option {
+	return func(b *backup) {
+		b.StreamUploads = enabled
+	}
+}
+
+// WithReproducible writes archives that only change when the archived content
+// does, with modTime as the time of every entry, or 1980-01-01 when zero.
+func WithReproducible(enabled bool, modTime time.Time) Option {
+	return func(b *backup) {
+		b.Reproducible = enabled
+		b.ReproducibleTime = modTime
+	}
+}
+
+// WithEmbedMetadata adds an entry describing the run, source and tool to
+// every archive, so archives are self-describing without the manifest.
+func WithEmbedMetadata(enabled bool) Option {
+	return func(b *backup) {
+		b.EmbedMetadata = enabled
+	}
+}
+
+// WithEncryption encrypts every archive with e as it is written, nil keeps
+// archives unencrypted.
+func WithEncryption(e Encryptor) Option {
+	return func(b *backup) {
+		b.Encryption = e
+	}
+}
+
+// WithEncryptManifest encrypts the manifest with the encryption of the
+// archives, see WithEncryption.
+func WithEncryptManifest(enabled bool) Option {
+	return func(b *backup) {
+		b.EncryptManifest = enabled
+	}
+}
+
+// WithEncryptionRules encrypts the archives of the source directories
+// matching rules with their own keys instead, see ParseEncryptionRules.
+func WithEncryptionRules(rules []EncryptionRule) Option {
+	return func(b *backup) {
+		b.EncryptionRules = rules
+	}
+}
+
+// WithRetention prunes archives in grandfather-father-son rotation after
+// every run, see RetentionPolicy. Safe mode only logs the deletions.
+func WithRetention(p RetentionPolicy) Option {
+	return func(b *backup) {
+		b.Retention = p
+	}
+}
+
+// WithMaxStoreSize keeps the archives in the output path below maxBytes by
+// evicting the oldest first, and refuses to back up when they can't fit. Safe
+// mode only logs the evictions.
+func WithMaxStoreSize(maxBytes int64) Option {
+	return func(b *backup) {
+		b.MaxStoreSize = maxBytes
+	}
+}
+
+// WithRetentionDryRun only lists what MaxArchivesPerSource, Retention and
+// MaxStoreSize would prune, to tune them without losing archives.
+func WithRetentionDryRun(enabled bool) Option {
+	return func(b *backup) {
+		b.RetentionDryRun = enabled
+	}
+}
+
+// WithArchiveNameTemplate names archives after template, see
+// ParseArchiveNameTemplate, instead of "<name>.zip" or the labelled names.
+func WithArchiveNameTemplate(template string) Option {
+	return func(b *backup) {
+		b.ArchiveNameTemplate = template
+	}
+}
+
+// WithRestorePatterns restores only the files matching patterns, see
+// ParseRestorePatterns.
+func WithRestorePatterns(patterns ...string) Option {
+	return func(b *backup) {
+		b.RestorePatterns = append(b.RestorePatterns, patterns...)
+	}
+}
+
+// WithRestoreDryRun only lists what a restore would write, see
+// RestoreDryRun.
+func WithRestoreDryRun(enabled bool) Option {
+	return func(b *backup) {
+		b.RestoreDryRun = enabled
+	}
+}
+
+// WithRestoreConflict treats files a restore finds in the target after
+// policy, ConflictOverwrite, ConflictSkip, ConflictKeepBoth or ConflictFail.
+func WithRestoreConflict(policy string) Option {
+	return func(b *backup) {
+		b.RestoreConflict = policy
+	}
+}
+
+// WithRestoreConfirm asks confirm before a restore overwrites existing
+// files, see RestoreConfirm.
+func WithRestoreConfirm(confirm func(overwrites int) bool) Option {
+	return func(b *backup) {
+		b.RestoreConfirm = confirm
+	}
+}
+
+// WithPreserveXattrs records the extended attributes of every file in the
+// archives and restores them, see PreserveXattrs.
+func WithPreserveXattrs(enabled bool) Option {
+	return func(b *backup) {
+		b.PreserveXattrs = enabled
+	}
+}
+
+// WithVerifyArchiveContent reads back every entry of new archives before
+// recording them, see VerifyArchiveContent.
+func WithVerifyArchiveContent(enabled bool) Option {
+	return func(b *backup) {
+		b.VerifyArchiveContent = enabled
+	}
+}
+
+// WithManifestFileChecksums records the SHA-256 of every archived file in the
+// manifest, see ManifestFileChecksums.
+func WithManifestFileChecksums(enabled bool) Option {
+	return func(b *backup) {
+		b.ManifestFileChecksums = enabled
+	}
+}
+
+// WithContentChangeDetection detects changed directories by the content of
+// their files, see ContentChangeDetection.
+func WithContentChangeDetection(enabled bool) Option {
+	return func(b *backup) {
+		b.ContentChangeDetection = enabled
+	}
+}
+
+// WithManifestSigningKey signs the manifest with key and refuses manifests
+// not signed with it, see ManifestSigningKey.
+func WithManifestSigningKey(key []byte) Option {
+	return func(b *backup) {
+		b.ManifestSigningKey = key
+	}
+}
+
+// WithParityRedundancy writes parity data of percent of the size of every
+// archive, see ParityRedundancy.
+func WithParityRedundancy(percent int) Option {
+	return func(b *backup) {
+		b.ParityRedundancy = percent
+	}
+}
+
+// WithIncrementalBackups archives only the files changed since the previous
+// archive, with a full backup after fullEvery incrementals, see
+// IncrementalBackups and FullBackupEvery.
+func WithIncrementalBackups(enabled bool, fullEvery int) Option {
+	return func(b *backup) {
+		b.IncrementalBackups = enabled
+		b.FullBackupEvery = fullEvery
+	}
+}
+
+// WithDifferentialBackups archives the files changed since the last full
+// backup instead of since the previous archive, see DifferentialBackups.
+func WithDifferentialBackups(enabled bool) Option {
+	return func(b *backup) {
+		b.DifferentialBackups = enabled
+	}
+}
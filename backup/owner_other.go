@@ -0,0 +1,10 @@
+//go:build !unix
+
+package backup
+
+import "io/fs"
+
+// fileOwner is not available on this platform.
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,447 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrParityExhausted is returned when an archive has more damaged blocks
+// than parity blocks to rebuild them from.
+var ErrParityExhausted = errors.New("too much damage to repair")
+
+const (
+	parityMagic        = "BTGPAR1\n"
+	parityMinBlockSize = 4 << 10
+	parityChunkSize    = 64 << 10
+)
+
+// ParityPath returns where the parity data of the archive file or volume at
+// path is stored, see ParityRedundancy.
+func ParityPath(path string) string {
+	return path + ".par"
+}
+
+// ParseRedundancy parses the size of the parity data relative to the
+// archive, a percentage from 1 to 100 with or without "%". Empty means no
+// parity data.
+func ParseRedundancy(value string) (int, error) {
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "%"))
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.Atoi(value)
+	if err != nil || percent < 1 || percent > 100 {
+		return 0, fmt.Errorf("invalid redundancy %q, expected a percentage from 1 to 100", value)
+	}
+	return percent, nil
+}
+
+// parityHeader describes the parity file of an archive. The archive is cut
+// into DataBlocks blocks of BlockSize bytes, the last one padded with zeros,
+// and ParityBlocks Reed-Solomon blocks are computed over them, so any
+// ParityBlocks damaged blocks can be rebuilt. The checksums find the damaged
+// ones.
+type parityHeader struct {
+	Size         int64    `json:"size"`
+	BlockSize    int64    `json:"block_size"`
+	DataBlocks   int      `json:"data_blocks"`
+	ParityBlocks int      `json:"parity_blocks"`
+	DataSHA256   [][]byte `json:"data_sha256"`
+	ParitySHA256 [][]byte `json:"parity_sha256"`
+}
+
+// parityLayout returns how an archive of size bytes is cut for percent
+// redundancy: as many blocks of at least parityMinBlockSize bytes as the 255
+// blocks a Reed-Solomon code over GF(256) holds allow, with at least one
+// parity block.
+func parityLayout(size int64, percent int) (blockSize int64, data, parity int) {
+	data = max(1, min(int((size+parityMinBlockSize-1)/parityMinBlockSize), 255*100/(100+percent)))
+	parity = max(1, (data*percent+99)/100)
+	blockSize = max(1, (size+int64(data)-1)/int64(data))
+	return blockSize, data, parity
+}
+
+// WriteParity writes the parity file of every archive file or volume of
+// record when ParityRedundancy is set, see RepairArchive. Mirrors and
+// streamed archives have no archive file to protect.
+func (b *backup) WriteParity(record *ArchiveRecord) error {
+	if b.ParityRedundancy <= 0 || archiveFormat(record.Path) == FormatMirror {
+		return nil
+	}
+	for _, path := range record.archives() {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := b.writeParity(path); err != nil {
+			return fmt.Errorf("failed to write parity data of %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (b *backup) writeParity(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := parityHeader{Size: info.Size()}
+	header.BlockSize, header.DataBlocks, header.ParityBlocks = parityLayout(info.Size(), b.ParityRedundancy)
+	matrix := cauchyMatrix(header.DataBlocks, header.ParityBlocks)
+
+	tmp := ParityPath(path) + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	dataSums := newDigests(header.DataBlocks)
+	paritySums := newDigests(header.ParityBlocks)
+	data := make([]byte, parityChunkSize)
+	parity := make([][]byte, header.ParityBlocks)
+	for j := range parity {
+		parity[j] = make([]byte, parityChunkSize)
+	}
+	for off := int64(0); off < header.BlockSize; off += parityChunkSize {
+		n := min(parityChunkSize, header.BlockSize-off)
+		for j := range parity {
+			clear(parity[j][:n])
+		}
+		for i := range header.DataBlocks {
+			if err := readBlockAt(in, data[:n], int64(i)*header.BlockSize+off); err != nil {
+				return err
+			}
+			dataSums[i].Write(data[:n])
+			for j := range parity {
+				gfMulAdd(parity[j][:n], data[:n], matrix[j][i])
+			}
+		}
+		for j := range parity {
+			paritySums[j].Write(parity[j][:n])
+			if _, err := out.WriteAt(parity[j][:n], int64(j)*header.BlockSize+off); err != nil {
+				return err
+			}
+		}
+	}
+	header.DataSHA256, header.ParitySHA256 = sums(dataSums), sums(paritySums)
+
+	// The header follows the parity blocks, its length and the magic close
+	// the file.
+	h, _ := json.Marshal(header)
+	trailer := binary.LittleEndian.AppendUint64(h, uint64(len(h)))
+	if _, err := out.WriteAt(append(trailer, parityMagic...), int64(header.ParityBlocks)*header.BlockSize); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ParityPath(path))
+}
+
+// RepairArchive rebuilds the damaged blocks of the archive file or volume at
+// path from its parity file and returns how many it rebuilt, 0 when the
+// archive is intact. Truncated and extended archives are restored to their
+// original size. The error wraps ErrParityExhausted when more blocks are
+// damaged than the parity data can rebuild, and fs.ErrNotExist when the
+// archive has no parity file.
+func (b *backup) RepairArchive(path string) (int, error) {
+	par, err := os.Open(ParityPath(path))
+	if err != nil {
+		return 0, err
+	}
+	defer par.Close()
+	header, err := readParityHeader(par)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parity file %q: %w", ParityPath(path), err)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var damaged, survivors []int // Survivors index data blocks, then parity blocks
+	for i := range header.DataBlocks {
+		ok, err := blockIntact(in, int64(i)*header.BlockSize, header.BlockSize, header.DataSHA256[i])
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			survivors = append(survivors, i)
+		} else {
+			damaged = append(damaged, i)
+		}
+	}
+	if len(damaged) == 0 && info.Size() == header.Size {
+		return 0, nil
+	}
+	for j := 0; j < header.ParityBlocks && len(survivors) < header.DataBlocks; j++ {
+		ok, err := blockIntact(par, int64(j)*header.BlockSize, header.BlockSize, header.ParitySHA256[j])
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			survivors = append(survivors, header.DataBlocks+j)
+		}
+	}
+	if len(survivors) < header.DataBlocks {
+		return 0, fmt.Errorf("%w: %d of %d blocks of %q are damaged, more than the %d intact parity blocks", ErrParityExhausted, len(damaged), header.DataBlocks, path, len(survivors)-header.DataBlocks+len(damaged))
+	}
+
+	// Every surviving block is a known combination of the data blocks,
+	// inverting those combinations gives the damaged blocks back.
+	matrix := cauchyMatrix(header.DataBlocks, header.ParityBlocks)
+	rows := make([][]byte, header.DataBlocks)
+	for r, s := range survivors {
+		if s < header.DataBlocks {
+			rows[r] = make([]byte, header.DataBlocks)
+			rows[r][s] = 1
+		} else {
+			rows[r] = append([]byte(nil), matrix[s-header.DataBlocks]...)
+		}
+	}
+	inverse, err := gfInvert(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := path + ".repair"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	if _, err := io.Copy(out, io.NewSectionReader(in, 0, header.Size)); err != nil {
+		return 0, err
+	}
+	if err := out.Truncate(header.Size); err != nil {
+		return 0, err
+	}
+
+	block := make([]byte, parityChunkSize)
+	rebuilt := make([][]byte, len(damaged))
+	for k := range rebuilt {
+		rebuilt[k] = make([]byte, parityChunkSize)
+	}
+	for off := int64(0); off < header.BlockSize; off += parityChunkSize {
+		n := min(parityChunkSize, header.BlockSize-off)
+		for k := range rebuilt {
+			clear(rebuilt[k][:n])
+		}
+		for r, s := range survivors {
+			src, at := io.ReaderAt(in), int64(s)*header.BlockSize+off
+			if s >= header.DataBlocks {
+				src, at = par, int64(s-header.DataBlocks)*header.BlockSize+off
+			}
+			if err := readBlockAt(src, block[:n], at); err != nil {
+				return 0, err
+			}
+			for k, d := range damaged {
+				gfMulAdd(rebuilt[k][:n], block[:n], inverse[d][r])
+			}
+		}
+		for k, d := range damaged {
+			at := int64(d)*header.BlockSize + off
+			if at >= header.Size {
+				continue
+			}
+			if _, err := out.WriteAt(rebuilt[k][:min(n, header.Size-at)], at); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	in.Close()
+
+	return len(damaged), os.Rename(tmp, path)
+}
+
+// readParityHeader reads the header at the end of a parity file.
+func readParityHeader(par io.ReadSeeker) (parityHeader, error) {
+	var header parityHeader
+	end, err := par.Seek(-int64(8+len(parityMagic)), io.SeekEnd)
+	if err != nil {
+		return header, err
+	}
+	trailer := make([]byte, 8+len(parityMagic))
+	if _, err := io.ReadFull(par, trailer); err != nil {
+		return header, err
+	}
+	if string(trailer[8:]) != parityMagic {
+		return header, errors.New("not a parity file")
+	}
+	n := int64(binary.LittleEndian.Uint64(trailer))
+	if n > end {
+		return header, errors.New("truncated header")
+	}
+	if _, err := par.Seek(end-n, io.SeekStart); err != nil {
+		return header, err
+	}
+	if err := json.NewDecoder(io.LimitReader(par, n)).Decode(&header); err != nil {
+		return header, err
+	}
+	if header.DataBlocks < 1 || header.ParityBlocks < 1 || header.DataBlocks+header.ParityBlocks > 256 || header.BlockSize < 1 ||
+		len(header.DataSHA256) != header.DataBlocks || len(header.ParitySHA256) != header.ParityBlocks {
+		return header, errors.New("inconsistent header")
+	}
+	return header, nil
+}
+
+// blockIntact reports whether the block of size bytes at off in r, padded
+// with zeros past its end, has the SHA-256 want.
+func blockIntact(r io.ReaderAt, off, size int64, want []byte) (bool, error) {
+	digest := sha256.New()
+	buf := make([]byte, parityChunkSize)
+	for done := int64(0); done < size; done += parityChunkSize {
+		n := min(parityChunkSize, size-done)
+		if err := readBlockAt(r, buf[:n], off+done); err != nil {
+			return false, err
+		}
+		digest.Write(buf[:n])
+	}
+	return bytes.Equal(digest.Sum(nil), want), nil
+}
+
+// readBlockAt fills buf from r at off, with zeros past the end of r.
+func readBlockAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	clear(buf[n:])
+	return nil
+}
+
+func newDigests(n int) []hash.Hash {
+	digests := make([]hash.Hash, n)
+	for i := range digests {
+		digests[i] = sha256.New()
+	}
+	return digests
+}
+
+func sums(digests []hash.Hash) [][]byte {
+	sums := make([][]byte, len(digests))
+	for i, d := range digests {
+		sums[i] = d.Sum(nil)
+	}
+	return sums
+}
+
+// GF(256) arithmetic with the polynomial x^8+x^4+x^3+x^2+1, as used by
+// Reed-Solomon codes.
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := range 255 {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	for v := range table {
+		table[v] = gfMul(c, byte(v))
+	}
+	for i, v := range src {
+		dst[i] ^= table[v]
+	}
+}
+
+// cauchyMatrix returns the coefficients of the parity blocks over the data
+// blocks. Any data square matrix of its rows and identity rows is
+// invertible, so any data blocks out of the data and parity blocks rebuild
+// the rest.
+func cauchyMatrix(data, parity int) [][]byte {
+	matrix := make([][]byte, parity)
+	for j := range matrix {
+		matrix[j] = make([]byte, data)
+		for i := range data {
+			matrix[j][i] = gfInv(byte(data+j) ^ byte(i))
+		}
+	}
+	return matrix
+}
+
+// gfInvert inverts the square matrix rows by Gauss-Jordan elimination.
+func gfInvert(rows [][]byte) ([][]byte, error) {
+	n := len(rows)
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+	for col := range n {
+		pivot := col
+		for pivot < n && rows[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular parity matrix")
+		}
+		rows[col], rows[pivot] = rows[pivot], rows[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfInv(rows[col][col])
+		for k := range n {
+			rows[col][k] = gfMul(rows[col][k], scale)
+			inverse[col][k] = gfMul(inverse[col][k], scale)
+		}
+		for r := range n {
+			if r == col || rows[r][col] == 0 {
+				continue
+			}
+			factor := rows[r][col]
+			for k := range n {
+				rows[r][k] ^= gfMul(factor, rows[col][k])
+				inverse[r][k] ^= gfMul(factor, inverse[col][k])
+			}
+		}
+	}
+	return inverse, nil
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parityArchive writes size random bytes as an archive with parity data of
+// percent redundancy and returns its path, content and layout.
+func parityArchive(t *testing.T, size int64, percent int) (string, []byte, parityHeader) {
+	t.Helper()
+	content := make([]byte, size)
+	rand.Read(content)
+	path := filepath.Join(t.TempDir(), "dir.zip")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(t.TempDir(), t.TempDir(), -1, WithParityRedundancy(percent)).writeParity(path); err != nil {
+		t.Fatal(err)
+	}
+
+	par, err := os.Open(ParityPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer par.Close()
+	header, err := readParityHeader(par)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, content, header
+}
+
+// flipBlocks flips a byte in each of the blocks of the file at path.
+func flipBlocks(t *testing.T, path string, blockSize int64, blocks ...int) {
+	t.Helper()
+	for _, block := range blocks {
+		flipByte(t, path, int(int64(block)*blockSize+blockSize/2))
+	}
+}
+
+func TestRepairArchive(t *testing.T) {
+	b := New(t.TempDir(), t.TempDir(), -1)
+	for _, tt := range []struct {
+		name    string
+		size    int64
+		percent int
+		damage  func(t *testing.T, path string, h parityHeader) int
+	}{
+		{"intact", 100 << 10, 20, func(t *testing.T, path string, h parityHeader) int {
+			return 0
+		}},
+		{"one corrupted block", 100 << 10, 20, func(t *testing.T, path string, h parityHeader) int {
+			flipBlocks(t, path, h.BlockSize, 3)
+			return 1
+		}},
+		{"as many corrupted blocks as parity blocks", 100 << 10, 20, func(t *testing.T, path string, h parityHeader) int {
+			blocks := make([]int, h.ParityBlocks)
+			for i := range blocks {
+				blocks[i] = i * 4
+			}
+			flipBlocks(t, path, h.BlockSize, blocks...)
+			return h.ParityBlocks
+		}},
+		{"erased tail", 100 << 10, 20, func(t *testing.T, path string, h parityHeader) int {
+			if err := os.Truncate(path, h.Size-2*h.BlockSize); err != nil {
+				t.Fatal(err)
+			}
+			return 2
+		}},
+		{"corrupted and erased blocks", 100 << 10, 20, func(t *testing.T, path string, h parityHeader) int {
+			flipBlocks(t, path, h.BlockSize, 0, 10)
+			if err := os.Truncate(path, h.Size-3*h.BlockSize); err != nil {
+				t.Fatal(err)
+			}
+			return 5
+		}},
+		{"extended archive", 100 << 10, 20, func(t *testing.T, path string, h parityHeader) int {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			f.Write([]byte("appended"))
+			return 0
+		}},
+		{"single block overwritten", 100, 100, func(t *testing.T, path string, h parityHeader) int {
+			if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			return 1
+		}},
+	} {
+		path, content, header := parityArchive(t, tt.size, tt.percent)
+		want := tt.damage(t, path, header)
+
+		n, err := b.RepairArchive(path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if n != want {
+			t.Errorf("%s: rebuilt %d blocks, want %d", tt.name, n, want)
+		}
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: the repaired archive differs from the original: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRepairArchiveBeyondRedundancy(t *testing.T) {
+	b := New(t.TempDir(), t.TempDir(), -1)
+	for _, tt := range []struct {
+		name   string
+		damage func(t *testing.T, path string, h parityHeader)
+	}{
+		{"one more corrupted block than parity blocks", func(t *testing.T, path string, h parityHeader) {
+			blocks := make([]int, h.ParityBlocks+1)
+			for i := range blocks {
+				blocks[i] = i * 3
+			}
+			flipBlocks(t, path, h.BlockSize, blocks...)
+		}},
+		{"corrupted data and parity blocks", func(t *testing.T, path string, h parityHeader) {
+			flipBlocks(t, path, h.BlockSize, 1, 2, h.ParityBlocks)
+			flipBlocks(t, ParityPath(path), h.BlockSize, 0, 1, 2)
+		}},
+		{"erased beyond the parity", func(t *testing.T, path string, h parityHeader) {
+			if err := os.Truncate(path, h.Size-int64(h.ParityBlocks+1)*h.BlockSize); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		path, _, header := parityArchive(t, 100<<10, 20)
+		tt.damage(t, path, header)
+		damaged, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := b.RepairArchive(path); !errors.Is(err, ErrParityExhausted) {
+			t.Errorf("%s: repair returned %v, want ErrParityExhausted", tt.name, err)
+		}
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, damaged) {
+			t.Errorf("%s: a failed repair changed the archive: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRepairArchiveWithoutParity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir.zip")
+	if err := os.WriteFile(path, []byte("archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(t.TempDir(), t.TempDir(), -1).RepairArchive(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("repairing without parity data returned %v, want ErrNotExist", err)
+	}
+}
+
+func TestGFInvert(t *testing.T) {
+	matrix := cauchyMatrix(5, 3)
+	// Two data blocks replaced by parity blocks.
+	rows := [][]byte{{1, 0, 0, 0, 0}, matrix[0], {0, 0, 1, 0, 0}, matrix[2], {0, 0, 0, 0, 1}}
+	original := make([][]byte, len(rows))
+	for i := range rows {
+		original[i] = append([]byte(nil), rows[i]...)
+	}
+
+	inverse, err := gfInvert(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range original {
+		for j := range original {
+			var sum byte
+			for k := range original {
+				sum ^= gfMul(original[i][k], inverse[k][j])
+			}
+			want := byte(0)
+			if i == j {
+				want = 1
+			}
+			if sum != want {
+				t.Fatalf("matrix times its inverse is not the identity at %d,%d", i, j)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// parallelBlockSize is the amount of input compressed by one goroutine.
+	parallelBlockSize = 1 << 20
+	// flateWindow is the deflate window, the tail of the previous block that
+	// primes the compressor of the next one.
+	flateWindow = 32 << 10
+)
+
+// parallelDeflater compresses its input in blocks on several goroutines, the
+// way pigz does, and writes them in order as one standard deflate stream.
+// Every block but the last ends with a sync flush so the blocks can simply be
+// concatenated, and each block is primed with the tail of the previous block
+// so the compression ratio stays close to a single stream.
+//
+// It is written here rather than taken from klauspost/compress: a zip entry
+// needs a raw deflate stream, and klauspost/compress only compresses zstd in
+// parallel, its flate writer runs on one goroutine. The standard library
+// flate does the compression, so the module needs no new dependency.
+type parallelDeflater struct {
+	out   io.Writer
+	level int
+
+	buf   []byte
+	dict  []byte
+	queue chan chan []byte
+	done  chan error
+}
+
+// newParallelDeflater compresses to out at level with workers goroutines. It
+// fails on a level flate does not take, before any block is compressed.
+func newParallelDeflater(out io.Writer, level, workers int) (*parallelDeflater, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	d := &parallelDeflater{
+		out:   out,
+		level: level,
+		buf:   make([]byte, 0, parallelBlockSize),
+		queue: make(chan chan []byte, workers),
+		done:  make(chan error, 1),
+	}
+
+	go func() {
+		var err error
+		for block := range d.queue {
+			data := <-block
+			if err == nil {
+				_, err = d.out.Write(data)
+			}
+		}
+		d.done <- err
+	}()
+
+	return d, nil
+}
+
+func (d *parallelDeflater) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(d.buf[len(d.buf):cap(d.buf)], p)
+		d.buf = d.buf[:len(d.buf)+n]
+		p = p[n:]
+
+		if len(d.buf) == cap(d.buf) {
+			d.dispatch(false)
+		}
+	}
+
+	return written, nil
+}
+
+// dispatch hands the buffered block to a new goroutine. It blocks while as
+// many blocks as there are workers are still waiting to be written out.
+func (d *parallelDeflater) dispatch(final bool) {
+	block, dict := d.buf, d.dict
+	if len(block) >= flateWindow {
+		d.dict = block[len(block)-flateWindow:]
+	} else {
+		d.dict = append(append([]byte(nil), dict...), block...)
+		if len(d.dict) > flateWindow {
+			d.dict = d.dict[len(d.dict)-flateWindow:]
+		}
+	}
+	d.buf = make([]byte, 0, parallelBlockSize)
+
+	result := make(chan []byte, 1)
+	d.queue <- result
+	go func() {
+		var compressed bytes.Buffer
+		// The level was checked by newParallelDeflater.
+		w, _ := flate.NewWriterDict(&compressed, d.level, dict)
+		w.Write(block)
+		if final {
+			w.Close()
+		} else {
+			w.Flush()
+		}
+		result <- compressed.Bytes()
+	}()
+}
+
+// Close compresses the remaining input as the final block and waits until
+// everything has been written.
+func (d *parallelDeflater) Close() error {
+	d.dispatch(true)
+	close(d.queue)
+
+	return <-d.done
+}
+
+// parallelGzip writes a gzip stream compressed by a parallelDeflater, for
+// tar.gz archives, which are compressed as a single stream. It reuses
+// parallelDeflater instead of pgzip, which splits the input the same way but
+// is a further module.
+type parallelGzip struct {
+	out      io.Writer
+	deflater *parallelDeflater
+	digest   hash.Hash32
+	size     uint32 // Input size modulo 2^32, as the trailer keeps it
+}
+
+func newParallelGzip(out io.Writer, level, workers int) (*parallelGzip, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	// Deflate, no name or time, unknown OS.
+	if _, err := out.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}); err != nil {
+		return nil, err
+	}
+
+	deflater, err := newParallelDeflater(out, level, workers)
+	if err != nil {
+		return nil, err
+	}
+	return &parallelGzip{out: out, deflater: deflater, digest: crc32.NewIEEE()}, nil
+}
+
+func (g *parallelGzip) Write(p []byte) (int, error) {
+	g.digest.Write(p)
+	g.size += uint32(len(p))
+	return g.deflater.Write(p)
+}
+
+// Close finishes the deflate stream and writes the gzip trailer. Closing it
+// again does nothing, like gzip.Writer.
+func (g *parallelGzip) Close() error {
+	if g.deflater == nil {
+		return nil
+	}
+	deflater := g.deflater
+	g.deflater = nil
+	if err := deflater.Close(); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer, g.digest.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+	_, err := g.out.Write(trailer)
+	return err
+}
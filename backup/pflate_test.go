@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// compressible returns n bytes of text-like data, repetitive enough to
+// compress but not uniform.
+func compressible(n int) []byte {
+	words := []string{"backup ", "archive ", "manifest ", "chunk ", "restore ", "volume\n"}
+	r := rand.New(rand.NewSource(1))
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		buf.WriteString(words[r.Intn(len(words))])
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestParallelDeflaterRejectsInvalidLevel(t *testing.T) {
+	if _, err := newParallelDeflater(io.Discard, 42, 4); err == nil {
+		t.Error("level 42 was accepted")
+	}
+	if _, err := newParallelGzip(io.Discard, 42, 4); err == nil {
+		t.Error("level 42 was accepted for gzip")
+	}
+}
+
+// incompressible returns n random bytes.
+func incompressible(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(2)).Read(data)
+	return data
+}
+
+// TestParallelDeflaterRoundTrip decompresses the output of the parallel
+// deflater with the standard library, for inputs ending on, just before and
+// just after block boundaries, written in pieces that straddle them.
+func TestParallelDeflaterRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, flateWindow - 1, flateWindow + 1, parallelBlockSize - 1, parallelBlockSize, parallelBlockSize + 1, 3 * parallelBlockSize, 2*parallelBlockSize + flateWindow/2}
+	for _, input := range []struct {
+		name string
+		data func(int) []byte
+	}{
+		{"compressible", compressible},
+		{"incompressible", incompressible},
+	} {
+		for _, level := range []int{flate.HuffmanOnly, flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+			for _, size := range sizes {
+				data := input.data(size)
+				var compressed bytes.Buffer
+				d, err := newParallelDeflater(&compressed, level, 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for rest := data; len(rest) > 0; {
+					n := min(len(rest), 777_777)
+					if _, err := d.Write(rest[:n]); err != nil {
+						t.Fatal(err)
+					}
+					rest = rest[n:]
+				}
+				if err := d.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := io.ReadAll(flate.NewReader(&compressed))
+				if err != nil {
+					t.Errorf("%s, level %d, %d bytes: %v", input.name, level, size, err)
+					continue
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("%s, level %d: decompressed %d bytes differing from the %d written", input.name, level, len(got), size)
+				}
+			}
+		}
+	}
+}
+
+func TestParallelGzipRoundTrip(t *testing.T) {
+	data := compressible(5*parallelBlockSize + 123)
+	var compressed bytes.Buffer
+	gz, err := newParallelGzip(&compressed, flate.DefaultCompression, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decompressed %d bytes differing from the %d written", len(got), len(data))
+	}
+}
+
+// BenchmarkDeflate compares a single flate stream with the parallel deflater.
+// The parallel one uses a worker per CPU, run with -cpu to see how it
+// scales.
+func BenchmarkDeflate(b *testing.B) {
+	data := compressible(16 * parallelBlockSize)
+	b.Run("single", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			w, err := flate.NewWriter(io.Discard, flate.DefaultCompression)
+			if err != nil {
+				b.Fatal(err)
+			}
+			w.Write(data)
+			w.Close()
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			d, err := newParallelDeflater(io.Discard, flate.DefaultCompression, runtime.GOMAXPROCS(0))
+			if err != nil {
+				b.Fatal(err)
+			}
+			d.Write(data)
+			d.Close()
+		}
+	})
+}
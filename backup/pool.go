@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// memoryAvailable returns the free memory in bytes, see availableMemory. It is
+// a variable so tests can fake a low-memory host.
+var memoryAvailable = availableMemory
+
+// workerCount returns how many workers should be used to archive n directories.
+// The pool is capped by MaxWorkers and, when MemoryPerWorker is set, reduced so
+// that every worker fits in the memory that is currently available.
+func (b *backup) workerCount(n int) int {
+	workers := n
+	if b.MaxWorkers > 0 && workers > b.MaxWorkers {
+		workers = b.MaxWorkers
+	}
+
+	if b.MemoryPerWorker > 0 {
+		if avail, ok := memoryAvailable(); ok {
+			fit := int(avail / b.MemoryPerWorker)
+			if fit < 1 {
+				fit = 1
+			}
+			if fit < workers {
+				fmt.Printf("Low memory (%d MiB available), reducing workers from %d to %d\n", avail>>20, workers, fit)
+				workers = fit
+			}
+		}
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	return workers
+}
+
+// Parallel calls fn for every index in [0, n) using a bounded pool of workers
+// and waits for all of them to finish. With RampUp set, the pool starts with a
+// single worker and grows evenly over the RampUp interval up to its full size
+// instead of starting every worker at once.
+func (b *backup) Parallel(n int, fn func(i int)) {
+	if n == 0 {
+		return
+	}
+
+	jobs := make(chan int)
+	fed := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			jobs <- i
+		}
+		close(jobs)
+		close(fed)
+	}()
+
+	workers := b.workerCount(n)
+	var step time.Duration
+	if workers > 1 {
+		step = b.RampUp / time.Duration(workers-1)
+	}
+
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		if w > 0 && step > 0 {
+			select {
+			case <-fed:
+				// Every job has been picked up, more workers wouldn't help.
+				w = workers
+				continue
+			case <-time.After(step):
+			}
+			fmt.Printf("Ramping up: %d/%d workers\n", w+1, workers)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerCountShrinksOnLowMemory(t *testing.T) {
+	defer func(f func() (uint64, bool)) { memoryAvailable = f }(memoryAvailable)
+	memoryAvailable = func() (uint64, bool) { return 3 << 20, true }
+
+	b := New(t.TempDir(), t.TempDir(), -1, WithMaxWorkers(8), WithMemoryPerWorker(1<<20))
+	if got := b.workerCount(10); got != 3 {
+		t.Errorf("workerCount(10) = %d, want 3", got)
+	}
+
+	memoryAvailable = func() (uint64, bool) { return 512 << 10, true }
+	if got := b.workerCount(10); got != 1 {
+		t.Errorf("workerCount(10) with less than one worker's memory = %d, want 1", got)
+	}
+}
+
+func TestWorkerCountIgnoresMemoryWhenUnknown(t *testing.T) {
+	defer func(f func() (uint64, bool)) { memoryAvailable = f }(memoryAvailable)
+	memoryAvailable = func() (uint64, bool) { return 0, false }
+
+	b := New(t.TempDir(), t.TempDir(), -1, WithMaxWorkers(4), WithMemoryPerWorker(1<<20))
+	if got := b.workerCount(10); got != 4 {
+		t.Errorf("workerCount(10) = %d, want MaxWorkers 4", got)
+	}
+}
+
+func TestParallelRunsEveryJobOnLowMemory(t *testing.T) {
+	defer func(f func() (uint64, bool)) { memoryAvailable = f }(memoryAvailable)
+	memoryAvailable = func() (uint64, bool) { return 1 << 20, true }
+
+	b := New(t.TempDir(), t.TempDir(), -1, WithMemoryPerWorker(1<<20))
+	var running, peak, done atomic.Int32
+	b.Parallel(20, func(int) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		running.Add(-1)
+		done.Add(1)
+	})
+	if done.Load() != 20 {
+		t.Errorf("ran %d jobs, want 20", done.Load())
+	}
+	if peak.Load() != 1 {
+		t.Errorf("%d jobs ran at once, want 1", peak.Load())
+	}
+}
+
+func TestParallelRampsUpWorkers(t *testing.T) {
+	const workers, rampUp = 4, 300 * time.Millisecond
+	b := New(t.TempDir(), t.TempDir(), -1, WithMaxWorkers(workers), WithRampUp(rampUp))
+
+	// Every job blocks until the pool is full, so each worker takes one.
+	start := time.Now()
+	var mu sync.Mutex
+	var started []time.Duration
+	full := make(chan struct{})
+	b.Parallel(8, func(int) {
+		mu.Lock()
+		started = append(started, time.Since(start))
+		if len(started) == workers {
+			close(full)
+		}
+		mu.Unlock()
+		<-full
+	})
+
+	step := rampUp / (workers - 1)
+	for i, at := range started[:workers] {
+		if earliest := time.Duration(i) * step; at < earliest {
+			t.Errorf("worker %d started after %s, want at least %s", i+1, at, earliest)
+		}
+	}
+	if len(started) != 8 {
+		t.Errorf("ran %d jobs, want 8", len(started))
+	}
+}
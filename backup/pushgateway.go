@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PushMetrics pushes the metrics of a finished run to a Prometheus Pushgateway
+// at gatewayURL, grouped under the given job label, and the instance label
+// unless it is empty. Scrape based monitoring can't observe one-shot runs
+// because the process exits right after.
+func PushMetrics(ctx context.Context, gatewayURL, job, instance string, r *Report) error {
+	r.mu.Lock()
+	success := 1
+	if r.Error != "" || r.Failed > 0 || len(r.Corrupt) > 0 {
+		success = 0
+	}
+
+	var body bytes.Buffer
+	for _, m := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"backup_last_run_timestamp_seconds", "Unix time the last backup run finished.", float64(time.Now().Unix())},
+		{"backup_last_run_duration_seconds", "Duration of the last backup run.", time.Since(r.started).Seconds()},
+		{"backup_last_run_success", "Whether the last backup run finished without errors.", float64(success)},
+		{"backup_directories_processed", "Directories that needed a backup in the last run.", float64(r.Processed)},
+		{"backup_directories_failed", "Directories whose archive failed in the last run.", float64(r.Failed)},
+		{"backup_archived_bytes", "Bytes of archives written in the last run.", float64(r.ArchivedBytes)},
+		{"backup_missing_copies", "Archive copies found missing by the last 3-2-1 verification.", float64(len(r.MissingCopies))},
+		{"backup_corrupt_archives", "Archive copies found corrupt by the last scrub.", float64(len(r.Corrupt))},
+	} {
+		fmt.Fprintf(&body, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", m.name, m.help, m.name, m.name, m.value)
+	}
+	if len(r.Destinations) > 0 {
+		destinations := make([]string, 0, len(r.Destinations))
+		for destination := range r.Destinations {
+			destinations = append(destinations, destination)
+		}
+		sort.Strings(destinations)
+
+		body.WriteString("# HELP backup_upload_failures Files that failed to upload to a destination in the last run.\n# TYPE backup_upload_failures gauge\n")
+		for _, destination := range destinations {
+			fmt.Fprintf(&body, "backup_upload_failures{destination=%q} %d\n", destination, r.Destinations[destination].Failed)
+		}
+	}
+	r.mu.Unlock()
+
+	endpoint := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	if instance != "" {
+		endpoint += "/instance/" + url.PathEscape(instance)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics to %q: %w", gatewayURL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to push metrics to %q: %s", gatewayURL, res.Status)
+	}
+
+	return nil
+}
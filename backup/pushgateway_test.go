@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, contentType, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		method, path, contentType, body = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type"), string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	r := New(t.TempDir(), t.TempDir(), -1).Report()
+	r.Processed, r.Failed, r.ArchivedBytes = 3, 1, 2048
+	r.recordUpload("s3", nil)
+	if err := PushMetrics(context.Background(), gateway.URL+"/", "backup-tools-go", "nas/01", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("pushed with %s, want PUT", method)
+	}
+	if want := "/metrics/job/backup-tools-go/instance/nas%2F01"; path != want {
+		t.Errorf("pushed to %s, want %s", path, want)
+	}
+	if !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("pushed %q, want the text format", contentType)
+	}
+	for _, line := range []string{
+		"# TYPE backup_last_run_success gauge",
+		"backup_last_run_success 0",
+		"backup_directories_processed 3",
+		"backup_directories_failed 1",
+		"backup_archived_bytes 2048",
+		`backup_upload_failures{destination="s3"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("pushed metrics lack %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestPushMetricsRejected(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad metrics", http.StatusBadRequest)
+	}))
+	defer gateway.Close()
+
+	r := New(t.TempDir(), t.TempDir(), -1).Report()
+	if err := PushMetrics(context.Background(), gateway.URL, "backup", "", r); err == nil {
+		t.Error("a rejected push succeeded")
+	}
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterBackend("rclone", func(config func(string) string) (StorageBackend, error) {
+		remote := config("RCLONE_REMOTE")
+		if remote == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		return NewRcloneBackend(remote, strings.Fields(config("RCLONE_FLAGS"))...), nil
+	})
+}
+
+// RcloneBackend stores files on any rclone remote by running the rclone
+// binary, which must be installed in the image. rclone reads its own
+// configuration, e.g. from RCLONE_CONFIG or RCLONE_CONFIG_<REMOTE>_* variables.
+type RcloneBackend struct {
+	remote string   // e.g. "myremote:bucket/backups"
+	flags  []string // Passed to every rclone command
+}
+
+// NewRcloneBackend creates a backend storing files below remote.
+func NewRcloneBackend(remote string, flags ...string) *RcloneBackend {
+	return &RcloneBackend{remote: strings.TrimSuffix(remote, "/"), flags: flags}
+}
+
+// String names the destination in logs.
+func (r *RcloneBackend) String() string {
+	return "rclone:" + r.remote
+}
+
+// target returns the rclone path of key.
+func (r *RcloneBackend) target(key string) string {
+	if key == "" {
+		return r.remote
+	}
+	if strings.HasSuffix(r.remote, ":") {
+		return r.remote + key
+	}
+	return r.remote + "/" + key
+}
+
+// run executes an rclone command, writing its output to stdout.
+func (r *RcloneBackend) run(ctx context.Context, stdout io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, "rclone", append(args, r.flags...)...)
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rclone %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// Put copies the file at localPath to key.
+func (r *RcloneBackend) Put(ctx context.Context, localPath, key string) error {
+	args := []string{"copyto", localPath, r.target(key)}
+	if rate := uploadLimit(ctx); rate > 0 {
+		args = append(args, "--bwlimit", strconv.FormatInt(rate, 10)+"B")
+	}
+	if err := r.run(ctx, io.Discard, args...); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, r, err)
+	}
+	return nil
+}
+
+// Get writes the file stored under key to w.
+func (r *RcloneBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	if err := r.run(ctx, w, "cat", r.target(key)); err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, r, err)
+	}
+	return nil
+}
+
+// List returns the files whose key starts with prefix.
+func (r *RcloneBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	// The "x" stops a prefix ending in "/" from naming its parent.
+	dir := path.Dir(prefix + "x")
+	if dir == "." {
+		dir = ""
+	}
+
+	var out bytes.Buffer
+	if err := r.run(ctx, &out, "lsjson", "--recursive", "--files-only", r.target(dir)); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", r, err)
+	}
+
+	var entries []struct {
+		Path    string    `json:"Path"`
+		Size    int64     `json:"Size"`
+		ModTime time.Time `json:"ModTime"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil {
+		return nil, fmt.Errorf("invalid listing from %s: %w", r, err)
+	}
+
+	var objects []StoredObject
+	for _, entry := range entries {
+		key := path.Join(dir, entry.Path)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, StoredObject{Key: key, Size: entry.Size, ModTime: entry.ModTime})
+		}
+	}
+
+	return objects, nil
+}
+
+// Delete removes the file stored under key.
+func (r *RcloneBackend) Delete(ctx context.Context, key string) error {
+	if err := r.run(ctx, io.Discard, "deletefile", r.target(key)); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, r, err)
+	}
+	return nil
+}
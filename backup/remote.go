@@ -0,0 +1,168 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RemoteTimeouts bounds how long a single remote storage operation may take,
+// so a stalled connection fails fast instead of blocking the whole run.
+// A zero duration disables the limit for that kind of operation.
+type RemoteTimeouts struct {
+	// Upload bounds every request of an upload sent in parts, such as a
+	// multipart or resumable upload, and other uploads as a whole.
+	Upload time.Duration
+	// Download bounds how long a download may go without receiving data,
+	// so a stalled one fails while a large archive takes as long as it
+	// needs, see downloadContext.
+	Download time.Duration
+	List     time.Duration
+	Delete   time.Duration
+}
+
+// DefaultRemoteTimeouts are used for operations without a configured timeout.
+var DefaultRemoteTimeouts = RemoteTimeouts{
+	Upload:   30 * time.Minute,
+	Download: 5 * time.Minute,
+	List:     time.Minute,
+	Delete:   time.Minute,
+}
+
+type deleteTimeoutKey struct{}
+
+// withDeleteTimeout records the configured RemoteTimeouts.Delete in ctx for
+// backends cleaning up after a failed upload, see cleanupContext.
+func withDeleteTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, deleteTimeoutKey{}, d)
+}
+
+// cleanupContext derives the context for discarding what a failed upload in
+// ctx left behind. It keeps the values of ctx but not its cancellation,
+// which may be why the upload failed, and is bounded by the delete timeout
+// recorded with withDeleteTimeout, DefaultRemoteTimeouts.Delete without one.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := ctx.Value(deleteTimeoutKey{}).(time.Duration)
+	if !ok {
+		d = DefaultRemoteTimeouts.Delete
+	}
+	return withTimeout(context.WithoutCancel(ctx), d)
+}
+
+type requestTimeoutKey struct{}
+
+// withRequestTimeout records the configured RemoteTimeouts.Upload in ctx for
+// backends sending an upload in many requests, which bound each of them with
+// it instead of the whole upload, see requestContext.
+func withRequestTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey{}, d)
+}
+
+// requestContext derives the context of one request of an upload in ctx,
+// bounded by the timeout recorded with withRequestTimeout, if any.
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, _ := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return withTimeout(ctx, d)
+}
+
+// downloadContext derives the context of a download into w from ctx, which
+// is cancelled once d passes without w receiving data, and returns the writer
+// to download into. A zero d disables the limit. A download failing once
+// cancelled so reports it with downloadError.
+func downloadContext(ctx context.Context, d time.Duration, w io.Writer) (context.Context, io.Writer, context.CancelFunc) {
+	if d <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, w, cancel
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	stall := &stallWriter{w: w, d: d}
+	stall.timer = time.AfterFunc(d, func() {
+		cancel(fmt.Errorf("no data received for %s: %w", d, context.DeadlineExceeded))
+	})
+	return ctx, stall, func() {
+		stall.timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// downloadError returns err of a download in ctx, wrapping why ctx was
+// cancelled, such as a stall, see downloadContext.
+func downloadError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); err != nil && cause != nil && !errors.Is(err, cause) {
+		return fmt.Errorf("%w: %w", err, cause)
+	}
+	return err
+}
+
+// stallWriter restarts the timer of a download on every write. A write
+// blocked on a slow reader is not a stall, the timer is stopped meanwhile.
+type stallWriter struct {
+	w     io.Writer
+	d     time.Duration
+	timer *time.Timer
+}
+
+func (s *stallWriter) Write(p []byte) (int, error) {
+	if !s.timer.Stop() {
+		// The download was cancelled already.
+		return 0, context.DeadlineExceeded
+	}
+	n, err := s.w.Write(p)
+	s.timer.Reset(s.d)
+	return n, err
+}
+
+// withTimeout derives the context of a single remote operation from ctx.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// transientError marks a remote failure that is worth retrying, such as a
+// dropped connection, throttling or a 5xx response.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// responseError describes a failed HTTP response, marking throttling and
+// server errors as transient.
+func responseError(op string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err := fmt.Errorf("%s: %s: %s", op, res.Status, body)
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return &transientError{err}
+	}
+
+	return err
+}
+
+// retryTransient calls fn up to attempts times, backing off exponentially
+// from one second while it fails with a transient error.
+func retryTransient(ctx context.Context, attempts int, fn func() error) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var transient *transientError
+		if err == nil || !errors.As(err, &transient) || attempt >= attempts {
+			return err
+		}
+
+		fmt.Printf("Warning: %v, retrying in %s\n", err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	cancel()
+
+	ctx, done := cleanupContext(withDeleteTimeout(parent, 5*time.Second))
+	defer done()
+	if err := ctx.Err(); err != nil {
+		t.Errorf("the cleanup was cancelled with the upload: %v", err)
+	}
+	if ctx.Value(key{}) != "value" {
+		t.Error("the cleanup lost the values of the upload context")
+	}
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > 5*time.Second {
+		t.Errorf("the cleanup deadline is %v, %v, want the configured 5s", deadline, ok)
+	}
+
+	ctx, done = cleanupContext(context.Background())
+	defer done()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > DefaultRemoteTimeouts.Delete {
+		t.Errorf("without a configured timeout the deadline is %v, %v, want the default", deadline, ok)
+	}
+}
+
+// slowBackend takes delay to store an object, or until its context is done,
+// and sends an object in pieces of piece bytes, taking delay before each.
+type slowBackend struct {
+	shallowBackend
+	delay time.Duration
+	piece int
+}
+
+func (s *slowBackend) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *slowBackend) Put(ctx context.Context, localPath, key string) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.shallowBackend.Put(ctx, localPath, key)
+}
+
+func (s *slowBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	data, ok := s.objects[key]
+	if !ok {
+		return os.ErrNotExist
+	}
+	for len(data) > 0 {
+		if err := s.wait(ctx); err != nil {
+			return err
+		}
+		n := len(data)
+		if s.piece > 0 {
+			n = min(n, s.piece)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func TestRemoteKey(t *testing.T) {
+	out, staging := t.TempDir(), t.TempDir()
+	b := New(t.TempDir(), out, -1, WithRemoteOnly(true, staging, 0))
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(out, "app", "app.zip"), "app/app.zip"},
+		{filepath.Join(out, "..cache", "x.zip"), "..cache/x.zip"},
+		{filepath.Join(staging, "app.zip"), "app.zip"},
+		{filepath.Join(filepath.Dir(out), "elsewhere", "app.zip"), "app.zip"},
+	} {
+		if got := b.remoteKey(tt.path); got != tt.want {
+			t.Errorf("remoteKey(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteTimeouts(t *testing.T) {
+	path, _ := randomFile(t, 100)
+	for _, tt := range []struct {
+		name     string
+		timeouts RemoteTimeouts
+		timeout  bool
+	}{
+		{"below the delay", RemoteTimeouts{Upload: 20 * time.Millisecond}, true},
+		{"above the delay", RemoteTimeouts{Upload: time.Minute}, false},
+		{"disabled", RemoteTimeouts{}, false},
+	} {
+		slow := &slowBackend{shallowBackend: shallowBackend{objects: map[string][]byte{}}, delay: 200 * time.Millisecond}
+		b := New(t.TempDir(), t.TempDir(), -1, WithBackends(slow), WithRemoteTimeouts(tt.timeouts))
+		if b.RemoteTimeouts != tt.timeouts {
+			t.Errorf("%s: timeouts are %+v, want %+v", tt.name, b.RemoteTimeouts, tt.timeouts)
+		}
+
+		start := time.Now()
+		err := b.Upload(context.Background(), path)[destinationName(slow)]
+		if tt.timeout && (!errors.Is(err, context.DeadlineExceeded) || time.Since(start) >= slow.delay) {
+			t.Errorf("%s: the upload returned %v after %s, want a timeout", tt.name, err, time.Since(start))
+		}
+		if !tt.timeout && err != nil {
+			t.Errorf("%s: the upload failed: %v", tt.name, err)
+		}
+	}
+}
+
+// TestUploadTimeoutPerPart uploads a file in parts that together take longer
+// than the upload timeout, which bounds each of them.
+func TestUploadTimeoutPerPart(t *testing.T) {
+	f, srv := newFakeS3(t)
+	f.delay = 100 * time.Millisecond
+	s := f.backend(srv, S3Config{PartSize: s3MinPartSize})
+	path, content := randomFile(t, 4*s3MinPartSize)
+	b := New(t.TempDir(), t.TempDir(), -1, WithBackends(s), WithRemoteTimeouts(RemoteTimeouts{Upload: 300 * time.Millisecond}))
+
+	start := time.Now()
+	if err := b.Upload(context.Background(), path)[s.String()]; err != nil {
+		t.Fatalf("the upload failed after %s: %v", time.Since(start), err)
+	}
+	if elapsed := time.Since(start); elapsed < b.RemoteTimeouts.Upload {
+		t.Fatalf("the upload took %s, below the timeout it should exceed", elapsed)
+	}
+	if !bytes.Equal(f.objects[b.remoteKey(path)], content) {
+		t.Error("the parts were assembled into different content")
+	}
+
+	// A single part taking longer than the timeout still fails.
+	f.delay = 600 * time.Millisecond
+	if err := b.Upload(context.Background(), path)[s.String()]; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a slow part returned %v, want a timeout", err)
+	}
+}
+
+// TestDownloadTimeoutOnStall downloads a file in pieces that together take
+// longer than the download timeout, which only bounds the wait for each.
+func TestDownloadTimeoutOnStall(t *testing.T) {
+	content := bytes.Repeat([]byte("archive "), 100)
+	for _, tt := range []struct {
+		name     string
+		delay    time.Duration
+		download time.Duration
+		timeout  bool
+	}{
+		{"slow but steady", 40 * time.Millisecond, 100 * time.Millisecond, false},
+		{"stalled", 300 * time.Millisecond, 100 * time.Millisecond, true},
+		{"disabled", 40 * time.Millisecond, 0, false},
+	} {
+		slow := &slowBackend{shallowBackend: shallowBackend{objects: map[string][]byte{}}, delay: tt.delay, piece: 160}
+		// The upload timeout has no say over downloads.
+		timeouts := RemoteTimeouts{Upload: time.Millisecond, Download: tt.download}
+		b := New(t.TempDir(), t.TempDir(), -1, WithBackends(slow), WithRemoteTimeouts(timeouts))
+		path := filepath.Join(b.OutputPath, "app.zip")
+		slow.objects[b.remoteKey(path)] = content
+
+		start := time.Now()
+		data, err := b.readRemote(path)
+		elapsed := time.Since(start)
+		if tt.timeout && (!errors.Is(err, context.DeadlineExceeded) || elapsed >= tt.delay) {
+			t.Errorf("%s: readRemote returned %v after %s, want a timeout", tt.name, err, elapsed)
+		}
+		if !tt.timeout && (err != nil || !bytes.Equal(data, content)) {
+			t.Errorf("%s: readRemote returned %d bytes, %v, want the whole file", tt.name, len(data), err)
+		}
+		if !tt.timeout && elapsed < tt.download {
+			t.Errorf("%s: readRemote took %s, below the timeout it should outlast", tt.name, elapsed)
+		}
+
+		r, err := b.openRemote(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, err = io.ReadAll(r)
+		r.Close()
+		if tt.timeout && !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: the streamed download returned %v, want a timeout", tt.name, err)
+		}
+		if !tt.timeout && (err != nil || !bytes.Equal(data, content)) {
+			t.Errorf("%s: the streamed download returned %d bytes, %v, want the whole file", tt.name, len(data), err)
+		}
+	}
+}
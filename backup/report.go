@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Report summarises a single backup run.
+type Report struct {
+	RunID         string                  `json:"run_id"`
+	StartedAt     string                  `json:"started_at"`
+	FinishedAt    string                  `json:"finished_at,omitempty"`
+	Processed     int                     `json:"processed"`
+	Failed        int                     `json:"failed"`
+	ArchivedBytes int64                   `json:"archived_bytes"`
+	Error         string                  `json:"error,omitempty"`
+	Excluded      map[string]*ExcludeStat `json:"excluded,omitempty"` // Keyed by exclude pattern
+	Duplicates    []DuplicateSet          `json:"duplicates,omitempty"`
+	Destinations  map[string]*UploadStat  `json:"destinations,omitempty"` // Keyed by storage backend
+	MissingCopies []MissingCopy           `json:"missing_copies,omitempty"`
+	Pruned        []PrunedArchive         `json:"pruned,omitempty"`
+	WouldPrune    []PrunedArchive         `json:"would_prune,omitempty"`
+	Scrubbed      int                     `json:"scrubbed,omitempty"` // Archive copies read back by Scrub
+	Corrupt       []CorruptArchive        `json:"corrupt,omitempty"`
+	Repaired      int                     `json:"repaired,omitempty"`      // Local copies Scrub rebuilt from their parity data
+	NewChunks     int                     `json:"new_chunks,omitempty"`    // Added to the chunk store, see FormatDedup
+	DedupedBytes  int64                   `json:"deduped_bytes,omitempty"` // Of file content already in the chunk store
+
+	contents map[string]*DuplicateSet // Files seen in this run keyed by content hash
+	started  time.Time
+	mu       sync.Mutex
+}
+
+// ExcludeStat counts what a single exclude pattern removed from the backup.
+type ExcludeStat struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// PrunedArchive is an archive deleted by retention in this run.
+type PrunedArchive struct {
+	Source    string `json:"source"`
+	Path      string `json:"path"`
+	CreatedAt string `json:"created_at"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// UploadStat counts the files copied to a single storage backend.
+type UploadStat struct {
+	Uploaded int `json:"uploaded"`
+	Failed   int `json:"failed"`
+}
+
+// DuplicateSet lists files that have identical content.
+type DuplicateSet struct {
+	SHA256      string   `json:"sha256"`
+	Size        int64    `json:"size"`
+	WastedBytes int64    `json:"wasted_bytes"` // Size of every copy but one
+	Paths       []string `json:"paths"`
+}
+
+// Report returns the report of the run performed with this backup.
+func (b *backup) Report() *Report {
+	return b.report
+}
+
+// RecordArchive counts an archive of size bytes that was written.
+func (r *Report) RecordArchive(size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ArchivedBytes += size
+}
+
+// recordChunk counts a chunk of size bytes written to a dedup archive, added
+// to the chunk store when stored is set.
+func (r *Report) recordChunk(stored bool, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored {
+		r.NewChunks++
+	} else {
+		r.DedupedBytes += size
+	}
+}
+
+// recordPruned adds the archive of record, pruned from the directory named
+// source, with the size it had to the report.
+func (r *Report) recordPruned(source string, record ArchiveRecord, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Pruned = append(r.Pruned, PrunedArchive{Source: source, Path: record.Path, CreatedAt: record.CreatedAt, Bytes: size})
+}
+
+// recordWouldPrune adds the archive of record, which a retention dry run
+// would prune from the directory named source, to the report. It reports
+// whether the archive was not listed yet, as several policies may drop it.
+func (r *Report) recordWouldPrune(source string, record ArchiveRecord) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, archive := range r.WouldPrune {
+		if archive.Source == source && archive.Path == record.Path {
+			return false
+		}
+	}
+	r.WouldPrune = append(r.WouldPrune, PrunedArchive{Source: source, Path: record.Path, CreatedAt: record.CreatedAt, Bytes: record.Size()})
+	return true
+}
+
+// recordUpload counts a file copied, or failed to be copied, to destination.
+func (r *Report) recordUpload(destination string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Destinations == nil {
+		r.Destinations = map[string]*UploadStat{}
+	}
+	stat, ok := r.Destinations[destination]
+	if !ok {
+		stat = &UploadStat{}
+		r.Destinations[destination] = stat
+	}
+	if err != nil {
+		stat.Failed++
+	} else {
+		stat.Uploaded++
+	}
+}
+
+// RecordFailure counts a directory whose archive could not be produced.
+func (r *Report) RecordFailure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Failed++
+}
+
+// recordExclude adds the file or directory at path to the stats of pattern.
+// Excluded directories count once, with the size of everything below them.
+func (r *Report) recordExclude(pattern, path string, d fs.DirEntry) {
+	var size int64
+	if d.IsDir() {
+		filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					size += info.Size()
+				}
+			}
+			return nil
+		})
+	} else if info, err := d.Info(); err == nil {
+		size = info.Size()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Excluded == nil {
+		r.Excluded = make(map[string]*ExcludeStat)
+	}
+	stat, ok := r.Excluded[pattern]
+	if !ok {
+		stat = &ExcludeStat{}
+		r.Excluded[pattern] = stat
+	}
+	stat.Count++
+	stat.Bytes += size
+}
+
+// recordContent remembers that the file at path has the given content hash.
+func (r *Report) recordContent(sum string, size int64, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.contents == nil {
+		r.contents = make(map[string]*DuplicateSet)
+	}
+	set, ok := r.contents[sum]
+	if !ok {
+		set = &DuplicateSet{SHA256: sum, Size: size}
+		r.contents[sum] = set
+	}
+	set.Paths = append(set.Paths, path)
+}
+
+// CollectDuplicates fills Duplicates with the n sets of identical files that
+// waste the most space, largest first.
+func (r *Report) CollectDuplicates(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Duplicates = nil
+	for _, set := range r.contents {
+		if len(set.Paths) < 2 {
+			continue
+		}
+		set.WastedBytes = set.Size * int64(len(set.Paths)-1)
+		sort.Strings(set.Paths)
+		r.Duplicates = append(r.Duplicates, *set)
+	}
+
+	sort.Slice(r.Duplicates, func(i, j int) bool {
+		if r.Duplicates[i].WastedBytes != r.Duplicates[j].WastedBytes {
+			return r.Duplicates[i].WastedBytes > r.Duplicates[j].WastedBytes
+		}
+		return r.Duplicates[i].SHA256 < r.Duplicates[j].SHA256
+	})
+	if len(r.Duplicates) > n {
+		r.Duplicates = r.Duplicates[:n]
+	}
+}
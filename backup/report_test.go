@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReportExcludeStatsPerPattern(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"app.txt":       "kept",
+		"app.log":       "12345",
+		"sub/debug.log": "1234567890",
+		"cache/a.bin":   "123",
+		"cache/b/c.bin": "1234",
+	})
+
+	b := New(src, t.TempDir(), -1, WithExcludes("*.log", "cache/"))
+	if err := b.ZipDirectory(src, filepath.Join(t.TempDir(), "src.zip")); err != nil {
+		t.Fatal(err)
+	}
+
+	excluded := b.Report().Excluded
+	for pattern, want := range map[string]ExcludeStat{
+		"*.log":  {Count: 2, Bytes: 15},
+		"cache/": {Count: 1, Bytes: 7}, // The directory counts once, with all below it
+	} {
+		if got := excluded[pattern]; got == nil || *got != want {
+			t.Errorf("pattern %q excluded %+v, want %+v", pattern, got, want)
+		}
+	}
+	if len(excluded) != 2 {
+		t.Errorf("report lists %d patterns, want 2", len(excluded))
+	}
+}
+
+func TestReportDuplicatesAcrossUnchangedDirectories(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"archived/a.txt":  "same content",
+		"archived/b.txt":  "other",
+		"unchanged/c.txt": "same content",
+		"unchanged/d.txt": "unique",
+	})
+
+	b := New(src, t.TempDir(), -1, WithDetectDuplicates(true))
+	if err := b.ZipDirectory(filepath.Join(src, "archived"), filepath.Join(t.TempDir(), "archived.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RecordContents(&DirectoryEntry{Name: "unchanged"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := b.Report()
+	r.CollectDuplicates(10)
+	if len(r.Duplicates) != 1 {
+		t.Fatalf("report lists %d duplicate sets, want 1: %+v", len(r.Duplicates), r.Duplicates)
+	}
+	set := r.Duplicates[0]
+	want := []string{filepath.Join(src, "archived/a.txt"), filepath.Join(src, "unchanged/c.txt")}
+	if !slices.Equal(set.Paths, want) || set.Size != 12 || set.WastedBytes != 12 {
+		t.Errorf("duplicates %+v, want %q of 12 bytes wasting 12", set, want)
+	}
+}
+
+func TestReportDuplicatesOfUnchangedFilesInPartialArchive(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "same content", "b.txt": "same content"})
+	out := t.TempDir()
+	full := filepath.Join(out, "app-full.zip")
+	if _, err := New(src, out, -1, WithIncrementalBackups(true, 0)).ZipDirectoryChanged(src, full, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(src, out, -1, WithIncrementalBackups(true, 0), WithDetectDuplicates(true))
+	catalog, err := b.loadCatalog(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ZipDirectoryChanged(src, filepath.Join(out, "app-incr.zip"), catalog); err != nil {
+		t.Fatal(err)
+	}
+
+	r := b.Report()
+	r.CollectDuplicates(10)
+	if len(r.Duplicates) != 1 || len(r.Duplicates[0].Paths) != 2 {
+		t.Errorf("duplicates %+v, want a.txt and b.txt", r.Duplicates)
+	}
+}
@@ -0,0 +1,22 @@
+package backup
+
+import (
+	"io/fs"
+	"time"
+)
+
+// defaultReproducibleTime is the time of every entry in reproducible
+// archives without a configured one, the earliest time zip can hold.
+var defaultReproducibleTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// reproducibleInfo hides what differs between two copies of the same content
+// from the archive writers: the modification time is fixed and the owner and
+// access times, which tar reads from Sys, are dropped. Names and permissions
+// are kept.
+type reproducibleInfo struct {
+	fs.FileInfo
+	modTime time.Time
+}
+
+func (i reproducibleInfo) ModTime() time.Time { return i.modTime }
+func (i reproducibleInfo) Sys() any           { return nil }
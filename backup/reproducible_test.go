@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReproducibleArchivesAreIdentical(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"readme.txt":        "hello",
+		"docs/guide.md":     "# Guide",
+		"docs/img/logo.svg": "<svg/>",
+		"empty.txt":         "",
+	}
+	writeTree(t, src, files)
+
+	for _, ext := range []string{".zip", ".tar", ".tar.gz"} {
+		b := New(src, t.TempDir(), 6, WithReproducible(true, time.Time{}))
+		var sums [2][sha256.Size]byte
+		for run := range sums {
+			// Every run sees other times on the same content. Changing the
+			// modification time changes the inode change time too.
+			touched := time.Now().Add(time.Duration(run-2) * time.Hour)
+			for name := range files {
+				if err := os.Chtimes(filepath.Join(src, filepath.FromSlash(name)), touched, touched); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, dir := range []string{"docs", "docs/img"} {
+				if err := os.Chtimes(filepath.Join(src, filepath.FromSlash(dir)), touched, touched); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			archive := filepath.Join(b.OutputPath, "app"+ext)
+			if err := b.ZipDirectory(src, archive); err != nil {
+				t.Fatalf("%s: %v", ext, err)
+			}
+			data, err := os.ReadFile(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sums[run] = sha256.Sum256(data)
+			if err := os.Remove(archive); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sums[0] != sums[1] {
+			t.Errorf("%s: two runs over the same tree wrote archives with SHA-256 %x and %x", ext, sums[0], sums[1])
+		}
+	}
+}
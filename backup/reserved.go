@@ -0,0 +1,37 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// reservedPaths returns the paths that are never backed up: the output
+// directory holding archives, manifest and report, the staging directory in
+// remote-only mode, the append-only log and any extra ReservedPaths, such as
+// the output roots of other jobs sharing the same storage.
+func (b *backup) reservedPaths() []string {
+	paths := []string{b.OutputPath}
+	if b.RemoteOnly {
+		paths = append(paths, b.StagingDir)
+	}
+	if b.AppendLogPath != "" {
+		log := normalizePath(b.AppendLogPath)
+		paths = append(paths, log, logIndexPath(log), log+".ckpt")
+	}
+	for _, path := range b.ReservedPaths {
+		paths = append(paths, normalizePath(path))
+	}
+
+	return paths
+}
+
+// isReserved reports whether path is, or is inside, a reserved path.
+func (b *backup) isReserved(path string) bool {
+	for _, reserved := range b.reserved {
+		if path == reserved || strings.HasPrefix(path, reserved+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestJobsSharingAnOutputRootSkipEachOther(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"app/file.txt":            "",
+		"backups/a/manifest.json": "[]",
+		"backups/a/report.json":   "{}",
+		"backups/a/app.zip":       "",
+		"backups/b/manifest.json": "[]",
+		"backups/b/report.json":   "{}",
+		"backups/b/app.zip":       "",
+	})
+	outA, outB := filepath.Join(src, "backups/a"), filepath.Join(src, "backups/b")
+
+	for _, b := range []*backup{
+		New(src, outA, -1, WithReservedPaths(outB)),
+		New(src, outB, -1, WithReservedPaths(outA)),
+	} {
+		if got, want := zipEntries(t, b, src), []string{"app/file.txt"}; !slices.Equal(got, want) {
+			t.Errorf("job writing to %s archived %q, want %q", b.OutputPath, got, want)
+		}
+		manifest, err := b.BuildHybridOneLevelNestedJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range manifest {
+			if entry.Name == "backups" && len(entry.Children) != 0 {
+				t.Errorf("job writing to %s lists %d directories of the outputs", b.OutputPath, len(entry.Children))
+			}
+		}
+	}
+}
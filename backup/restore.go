@@ -0,0 +1,1130 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FindArchives returns the archives in manifest selected by selector, keyed
+// by the name of their directory: every archive written by the run with that
+// ID, the archive with that path or file name, or the latest archive of the
+// directory with that name or source path created at or before asOf. Every
+// archive holds the whole directory, so that is the directory as it was then.
+// A selected archive whose path was written again by a later run no longer
+// holds what it did then, it fails with ErrChainOverwritten.
+func (b *backup) FindArchives(manifest []*DirectoryEntry, selector string, asOf time.Time) (map[string]ArchiveRecord, error) {
+	found := make(map[string]ArchiveRecord)
+	var errs []error
+	for _, entry := range manifest {
+		if selector != "" && (entry.Name == selector || b.SourceDir(entry) == filepath.Clean(selector)) {
+			r, err := entry.recordAsOf(asOf)
+			if err == nil {
+				found[entry.Name] = r
+			} else if !errors.Is(err, ErrNoArchive) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, r := range entry.History {
+			if selector != "" && (r.RunID == selector || r.Path == selector || filepath.Base(r.Path) == selector) {
+				if err := entry.overwritten(r); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				found[entry.Name] = r
+			}
+		}
+	}
+
+	return found, errors.Join(errs...)
+}
+
+// RestoreAll restores every directory in manifest as it was at asOf, the
+// latest backup set when asOf is now, for recovering onto a fresh volume. A
+// directory is restored to where it was backed up from below target, see
+// restoreDir. Overwriting existing files is confirmed once for every
+// directory, see RestoreRecords. A failing directory does not stop the
+// others, the failures are returned joined together. It returns the number
+// of files restored.
+func (b *backup) RestoreAll(manifest []*DirectoryEntry, target string, asOf time.Time) (int, error) {
+	var targets []RestoreTarget
+	var names []string
+	var errs []error
+	for _, entry := range manifest {
+		record, err := entry.recordAsOf(asOf)
+		if errors.Is(err, ErrNoArchive) {
+			fmt.Printf("No archive of %q as of %s, skipping it\n", entry.Name, asOf.In(jkt).Format(time.RFC3339))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		targets = append(targets, RestoreTarget{Record: record, Dir: b.restoreDir(entry, target)})
+		names = append(names, entry.Name)
+	}
+
+	planned, err := b.confirmRestore(targets)
+	if err != nil {
+		return 0, errors.Join(append(errs, err)...)
+	}
+	files, restored := 0, 0
+	for i, t := range targets {
+		err := planned[i]
+		if err == nil {
+			var n int
+			n, err = b.restoreRecord(t.Record, t.Dir)
+			files += n
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", names[i], err))
+			continue
+		}
+		restored++
+	}
+	if b.RestoreDryRun {
+		fmt.Printf("Dry run: would restore %d of %d directories, %d file(s)\n", restored, len(manifest), files)
+	} else {
+		fmt.Printf("Restored %d of %d directories, %d file(s)\n", restored, len(manifest), files)
+	}
+
+	return files, errors.Join(errs...)
+}
+
+// restoreDir returns where RestoreAll restores entry: the directory it was
+// backed up from moved from the source path to target, or below target by
+// its name when it is outside of the source path. Restoring to the source
+// path puts every directory back where it was.
+func (b *backup) restoreDir(entry *DirectoryEntry, target string) string {
+	dir := b.SourceDir(entry)
+	if rel, err := filepath.Rel(b.SourcePath, dir); err == nil && filepath.IsLocal(rel) {
+		return filepath.Join(target, rel)
+	}
+	if filepath.Clean(target) == filepath.Clean(b.SourcePath) {
+		return dir
+	}
+	return filepath.Join(target, filepath.FromSlash(entry.Name))
+}
+
+// recordAsOf returns the latest record of e created at or before asOf. It
+// fails with ErrNoArchive when there is none, and with ErrChainOverwritten
+// when a later run wrote its path again, see overwritten.
+func (e *DirectoryEntry) recordAsOf(asOf time.Time) (ArchiveRecord, error) {
+	var latest ArchiveRecord
+	var latestTime time.Time
+	for _, r := range e.History {
+		created, err := time.Parse(time.RFC3339, r.CreatedAt)
+		if err == nil && !created.After(asOf) && !created.Before(latestTime) {
+			latest, latestTime = r, created
+		}
+	}
+	if latestTime.IsZero() {
+		return latest, fmt.Errorf("%w for %q as of %s", ErrNoArchive, e.Name, asOf.In(jkt).Format(time.RFC3339))
+	}
+	return latest, e.overwritten(latest)
+}
+
+// overwritten fails with ErrChainOverwritten when a record of e created after
+// r has its path. Unlabelled archives are written to the same path by every
+// run, the file then holds the latest run and its sidecar matches it, so
+// restoring it as r would silently restore something else.
+func (e *DirectoryEntry) overwritten(r ArchiveRecord) error {
+	for _, later := range e.History {
+		if later.Path == r.Path && later.CreatedAt > r.CreatedAt {
+			return fmt.Errorf("%w: %q of %q was written at %s and again at %s", ErrChainOverwritten, r.Path, e.Name, r.CreatedAt, later.CreatedAt)
+		}
+	}
+	return nil
+}
+
+// ParseAsOf parses the time of a point-in-time restore, RFC 3339 or
+// "2006-01-02 15:04" in the local time of the archives. A date alone means
+// the end of that day, so the last backup of the day is restored.
+func ParseAsOf(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, jkt); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, jkt); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use e.g. 2024-05-01 or 2024-05-01 15:04", value)
+}
+
+// RestoreTarget is an archive record to restore and the directory to
+// restore it to.
+type RestoreTarget struct {
+	Record ArchiveRecord
+	Dir    string
+}
+
+// RestoreRecord extracts the archive of record and its group archives into
+// the directory target, see RestoreArchive, and verifies the restored files
+// with VerifyRestore. An incremental archive is restored with the archives
+// it builds on, each file from the newest one holding it, see
+// IncrementalBackups. It returns the number of files restored, or that would
+// be with RestoreDryRun.
+func (b *backup) RestoreRecord(record ArchiveRecord, target string) (int, error) {
+	return b.RestoreRecords([]RestoreTarget{{Record: record, Dir: target}})
+}
+
+// RestoreRecords restores the record of every target to its directory, see
+// RestoreRecord. Overwriting existing files is confirmed once, before
+// anything is restored, with the number of files all of them would
+// overwrite, see RestoreConfirm. A failing record does not stop the others,
+// the failures are returned joined together. It returns the number of files
+// restored.
+func (b *backup) RestoreRecords(targets []RestoreTarget) (int, error) {
+	errs, err := b.confirmRestore(targets)
+	if err != nil {
+		return 0, err
+	}
+	files := 0
+	for i, t := range targets {
+		if errs[i] != nil {
+			continue
+		}
+		n, err := b.restoreRecord(t.Record, t.Dir)
+		files += n
+		errs[i] = err
+	}
+	return files, errors.Join(errs...)
+}
+
+// confirmRestore asks RestoreConfirm, when overwrites need confirming, with
+// the number of existing files restoring every target would overwrite,
+// listing their archives without writing anything. It fails with
+// ErrRestoreAborted when that is not confirmed. The targets that cannot be
+// listed are not counted, their errors are returned by index, so they are
+// not restored either.
+func (b *backup) confirmRestore(targets []RestoreTarget) ([]error, error) {
+	errs := make([]error, len(targets))
+	if !b.confirmsOverwrites() {
+		return errs, nil
+	}
+	existing := 0
+	for i, t := range targets {
+		chain, only, err := b.restoreChain(t.Record, true)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		for _, r := range chain {
+			for _, path := range append([]string{r.Path}, slices.Sorted(maps.Values(r.GroupArchives))...) {
+				n, err := b.existingFiles(path, t.Dir, only)
+				if err != nil {
+					errs[i] = fmt.Errorf("failed to list %q: %w", path, err)
+					break
+				}
+				existing += n
+			}
+		}
+	}
+	return errs, b.confirmOverwrites(existing)
+}
+
+// confirmsOverwrites reports whether overwriting existing files needs
+// confirming, see RestoreConfirm.
+func (b *backup) confirmsOverwrites() bool {
+	return b.RestoreConfirm != nil && !b.RestoreDryRun && firstNonEmpty(b.RestoreConflict, ConflictOverwrite) == ConflictOverwrite
+}
+
+// confirmOverwrites asks RestoreConfirm to overwrite existing files, failing
+// with ErrRestoreAborted when that is not confirmed.
+func (b *backup) confirmOverwrites(existing int) error {
+	if existing > 0 && !b.RestoreConfirm(existing) {
+		return fmt.Errorf("%w: %d file(s) exist already", ErrRestoreAborted, existing)
+	}
+	return nil
+}
+
+// existingFiles returns the number of files of the archive at path that
+// exist in target, limited to RestorePatterns and to what only wants.
+func (b *backup) existingFiles(path, target string, only *chainFilter) (int, error) {
+	lw := &listWriter{target: target, conflict: ConflictOverwrite, quiet: true}
+	if err := b.readArchive(path, only.wrap(b.withPatterns(lw), true)); err != nil {
+		return 0, err
+	}
+	return lw.existing, nil
+}
+
+// restoreChain returns the archives a restore of record reads, newest first,
+// see recordChain, and the filter limiting them to the files of record, nil
+// unless it is partial. quiet leaves the chain unmentioned.
+func (b *backup) restoreChain(record ArchiveRecord, quiet bool) ([]ArchiveRecord, *chainFilter, error) {
+	if !record.Partial {
+		return []ArchiveRecord{record}, nil, nil
+	}
+	chain, err := b.recordChain(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	catalog, err := b.loadCatalog(record.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the catalog of %q: %w", record.Path, err)
+	}
+	if !quiet {
+		fmt.Printf("Restoring %q from a chain of %d archive(s)\n", record.Path, len(chain))
+	}
+	return chain, newChainFilter(catalog), nil
+}
+
+// restoreRecord is RestoreRecord without confirming overwrites.
+func (b *backup) restoreRecord(record ArchiveRecord, target string) (int, error) {
+	defer func() { b.restoreSums = nil }()
+
+	chain, only, err := b.restoreChain(record, false)
+	if err != nil {
+		return 0, err
+	}
+
+	files, verified := 0, 0
+	var problems []string
+	placed := make(map[string]string)
+	for _, r := range chain {
+		b.restoreSums = r.SHA256
+		var took map[string]bool
+		if only != nil {
+			took = make(map[string]bool)
+			only.took = took
+		}
+		for _, path := range append([]string{r.Path}, slices.Sorted(maps.Values(r.GroupArchives))...) {
+			n, err := b.restoreArchive(path, target, placed, only)
+			files += n
+			if err != nil {
+				return files, err
+			}
+		}
+		if b.RestoreDryRun {
+			continue
+		}
+
+		n, p, err := b.verifyRestore(r, target, placed, took)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Printf("No checksums recorded for %q, the restore is not verified\n", r.Path)
+		case err != nil:
+			return files, fmt.Errorf("failed to verify the restore of %q: %w", r.Path, err)
+		}
+		verified += n
+		problems = append(problems, p...)
+	}
+
+	if b.RestoreDryRun {
+		return files, nil
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Printf("Restore mismatch: %s\n", problem)
+		}
+		return files, fmt.Errorf("%w: %d file(s) of %q", ErrRestoreMismatch, len(problems), record.Path)
+	}
+	if verified > 0 {
+		fmt.Printf("Verified %d restored file(s) of %q against their checksums\n", verified, record.Path)
+	}
+
+	return files, nil
+}
+
+// ErrRestoreMismatch means restored files differ from the files backed up.
+var ErrRestoreMismatch = errors.New("restored files differ from the backup")
+
+// VerifyRestore compares the files of record restored to target with the
+// SHA-256 checksums recorded at backup time in the metadata sidecar of the
+// record, see MetadataSidecar, limited to RestorePatterns. It returns the
+// number of files that match and a description of every file missing or
+// different. The error wraps fs.ErrNotExist when no sidecar was written.
+func (b *backup) VerifyRestore(record ArchiveRecord, target string) (int, []string, error) {
+	return b.verifyRestore(record, target, nil, nil)
+}
+
+// verifyRestore is VerifyRestore for a restore that put the files named in
+// placed elsewhere, see restoreWriter.placed, and took only the files in
+// took from the archive when it is not nil, see chainFilter.
+func (b *backup) verifyRestore(record ArchiveRecord, target string, placed map[string]string, took map[string]bool) (int, []string, error) {
+	data, err := os.ReadFile(SidecarPath(record.Path))
+	if errors.Is(err, fs.ErrNotExist) && len(b.Backends) > 0 {
+		data, err = b.readRemote(SidecarPath(record.Path))
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	var files []FileMetadata
+	if err := json.Unmarshal(data, &files); err != nil {
+		return 0, nil, fmt.Errorf("invalid metadata sidecar: %w", err)
+	}
+
+	verified := 0
+	var problems []string
+	for _, file := range files {
+		if file.SHA256 == "" || (len(b.RestorePatterns) > 0 && !matchesPatterns(file.Path, b.RestorePatterns)) || (took != nil && !took[file.Path]) {
+			continue
+		}
+		name, ok := placed[file.Path]
+		switch {
+		case !ok:
+			name = file.Path
+		case name == "":
+			// Skipped as the file existed, see ConflictSkip.
+			continue
+		}
+		sum, err := fileHash(filepath.Join(target, filepath.FromSlash(name)), sha256.New())
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			problems = append(problems, fmt.Sprintf("%q is missing", name))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%q cannot be read: %v", name, err))
+		case hex.EncodeToString(sum) != file.SHA256:
+			problems = append(problems, fmt.Sprintf("%q has SHA-256 %x, %s when backed up", name, sum, file.SHA256))
+		default:
+			verified++
+		}
+	}
+
+	return verified, problems, nil
+}
+
+// RestoreArchive extracts the archive at path into the directory target,
+// recreating its directories, symlinks, permissions and modification times.
+// Split archives are read from their volumes and encrypted ones decrypted
+// with the configured encryption. Archives no longer in the output path are
+// streamed from the configured backends. Existing files are overwritten,
+// skipped, kept or fail the restore after RestoreConflict, nothing is ever
+// written outside of target. The entry MetadataEntryName is skipped. With
+// RestorePatterns only the matching files are restored, with RestoreDryRun
+// nothing is and the files are listed instead. It returns the number of
+// files restored. Overwriting existing files is confirmed first, see
+// RestoreConfirm.
+func (b *backup) RestoreArchive(path, target string) (int, error) {
+	if b.confirmsOverwrites() {
+		existing, err := b.existingFiles(path, target, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list %q: %w", path, err)
+		}
+		if err := b.confirmOverwrites(existing); err != nil {
+			return 0, err
+		}
+	}
+	return b.restoreArchive(path, target, nil, nil)
+}
+
+// restoreArchive is RestoreArchive, adding the files restored under another
+// name to placed, see restoreWriter.placed, and restoring only the files
+// only still wants when it is not nil.
+func (b *backup) restoreArchive(path, target string, placed map[string]string, only *chainFilter) (int, error) {
+	conflict := firstNonEmpty(b.RestoreConflict, ConflictOverwrite)
+	// Under ConflictFail the archive is listed first, so nothing is written
+	// when any of its files exists.
+	if b.RestoreDryRun || conflict == ConflictFail {
+		lw := &listWriter{target: target, conflict: conflict, quiet: !b.RestoreDryRun}
+		if err := b.readArchive(path, only.wrap(b.withPatterns(lw), b.RestoreDryRun)); err != nil {
+			return 0, fmt.Errorf("failed to list %q: %w", path, err)
+		}
+		if b.RestoreDryRun {
+			fmt.Printf("Dry run: would restore %d file(s) of %q to %q, %d bytes, %d existing file(s) %s\n", lw.files, path, target, lw.bytes, lw.existing, conflictVerbs[conflict])
+		}
+		if conflict == ConflictFail && lw.existing > 0 {
+			return 0, fmt.Errorf("%w: %d file(s) of %q exist in %q, e.g. %q", ErrRestoreConflict, lw.existing, path, target, lw.first)
+		}
+		if b.RestoreDryRun {
+			return lw.files, nil
+		}
+	}
+
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return 0, err
+	}
+	rw, err := newRestoreWriter(target, conflict)
+	if err != nil {
+		return 0, err
+	}
+	if placed != nil {
+		rw.placed = placed
+	}
+
+	err = b.readArchive(path, only.wrap(b.withPatterns(rw), true))
+	if err = errors.Join(err, rw.Close()); err != nil {
+		return rw.files, fmt.Errorf("failed to restore %q: %w", path, err)
+	}
+	if rw.skipped > 0 {
+		fmt.Printf("Restored %d file(s) of %q to %q, skipped %d existing file(s)\n", rw.files, path, target, rw.skipped)
+	} else {
+		fmt.Printf("Restored %d file(s) of %q to %q\n", rw.files, path, target)
+	}
+
+	return rw.files, nil
+}
+
+// withPatterns limits w to RestorePatterns, see patternWriter.
+func (b *backup) withPatterns(w ArchiveWriter) ArchiveWriter {
+	if len(b.RestorePatterns) == 0 {
+		return w
+	}
+	return patternWriter{ArchiveWriter: w, patterns: b.RestorePatterns}
+}
+
+// Policies for files a restore finds in the target directory already.
+const (
+	ConflictOverwrite = "overwrite" // Replace the existing file
+	ConflictSkip      = "skip"      // Keep the existing file, not restoring it
+	ConflictKeepBoth  = "keep-both" // Restore next to it, see keepBothName
+	ConflictFail      = "fail"      // Restore nothing from an archive with such files
+)
+
+// conflictVerbs describe what happens to existing files under each policy.
+var conflictVerbs = map[string]string{
+	ConflictOverwrite: "overwritten",
+	ConflictSkip:      "skipped",
+	ConflictKeepBoth:  "kept next to the restored ones",
+	ConflictFail:      "failing the restore",
+}
+
+// ErrRestoreConflict means files to restore exist in the target directory
+// under ConflictFail.
+var ErrRestoreConflict = errors.New("restored files exist already")
+
+// ErrRestoreAborted means overwriting existing files was not confirmed, see
+// RestoreConfirm.
+var ErrRestoreAborted = errors.New("overwriting existing files was not confirmed")
+
+// ParseRestoreConflict parses the policy for existing files of a restore,
+// ConflictOverwrite when empty. "keep" is accepted for keep-both.
+func ParseRestoreConflict(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", ConflictOverwrite:
+		return ConflictOverwrite, nil
+	case ConflictSkip:
+		return ConflictSkip, nil
+	case ConflictKeepBoth, "keep":
+		return ConflictKeepBoth, nil
+	case ConflictFail:
+		return ConflictFail, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q, use overwrite, skip, keep-both or fail", value)
+	}
+}
+
+// keepBothName returns the name a file restored next to the existing file
+// name is written under, "report.restored.pdf" or "report.restored-2.pdf"
+// and so on when that exists as well. exists reports whether a name is
+// taken.
+func keepBothName(name string, exists func(string) bool) string {
+	dir, base := filepath.Split(name)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	candidate := dir + stem + ".restored" + ext
+	for i := 2; exists(candidate); i++ {
+		candidate = fmt.Sprintf("%s%s.restored-%d%s", dir, stem, i, ext)
+	}
+	return candidate
+}
+
+// ParseRestorePatterns checks the glob patterns of a selective restore, see
+// patternWriter.
+func ParseRestorePatterns(patterns []string) ([]string, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+// patternWriter passes on only the entries matching one of patterns, slash
+// separated globs such as "configs/*.yaml" matched against the path of an
+// entry in the archive. Everything below a matching directory matches as
+// well, so "configs" restores the whole directory. Parents of a matching
+// entry are created without their own mode and time.
+type patternWriter struct {
+	ArchiveWriter
+	patterns []string
+}
+
+func (w patternWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	if !matchesPatterns(name, w.patterns) {
+		return nil, nil
+	}
+	return w.ArchiveWriter.Add(name, info, link)
+}
+
+// matchesPatterns reports whether the entry name or a directory it is in
+// matches one of patterns, see patternWriter.
+func matchesPatterns(name string, patterns []string) bool {
+	for dir := path.Clean(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.Trim(pattern, "/"), dir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readArchive adds every entry of the archive at path to w, with its
+// content.
+func (b *backup) readArchive(path string, w ArchiveWriter) error {
+	format := archiveFormat(path)
+	if format == FormatMirror {
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) && len(b.Backends) > 0 {
+			return fmt.Errorf("mirror %q is only restored from a local copy", path)
+		}
+		return readMirror(path, w)
+	}
+
+	in, err := b.openArchive(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return b.readOpenArchive(path, in, w)
+}
+
+// readOpenArchive adds every entry of the archive read from in to w, in is
+// read as the archive at path.
+func (b *backup) readOpenArchive(path string, in io.Reader, w ArchiveWriter) error {
+	var err error
+	var r io.Reader = in
+	switch archiveFormat(path) {
+	case FormatZip:
+		return b.readZip(in, w)
+	case FormatDedup:
+		return b.readDedup(path, in, w)
+	case FormatTarGz:
+		r, err = gzip.NewReader(in)
+	case FormatTarZst:
+		r, err = newCommandReader(in, "zstd", "-q", "-d", "-c")
+	case FormatTarXz:
+		r, err = newCommandReader(in, "xz", "-q", "-d", "-c")
+	}
+	if err != nil {
+		return err
+	}
+	if err := readTarEntries(r, w); err != nil {
+		return err
+	}
+	// Read the padding after the end of the tar so the checksum of the
+	// compression is checked.
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// openArchive opens the content of the archive at path, joined from its
+// volumes when it was split and decrypted when it is encrypted. An archive
+// gone from the output path is streamed from remote storage, see openRemote.
+func (b *backup) openArchive(path string) (io.ReadCloser, error) {
+	open := func() (io.ReadCloser, error) {
+		in, err := openVolumes(path)
+		if errors.Is(err, fs.ErrNotExist) && len(b.Backends) > 0 {
+			return b.openRemote(path)
+		}
+		return in, err
+	}
+	ext := encryptionExt(path)
+	if ext == "" {
+		return open()
+	}
+
+	// The source an archive belongs to, and so its key, is not known from
+	// the path alone, see verifyEncryptedFile.
+	var errs []error
+	for _, e := range b.encryptions() {
+		if e.Extension() != ext {
+			continue
+		}
+		in, err := open()
+		if err != nil {
+			return nil, err
+		}
+		plain, err := e.Decrypt(in)
+		if err != nil {
+			in.Close()
+			errs = append(errs, err)
+			continue
+		}
+		return readCloser{plain, in}, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no encryption configured for %s archives", ext)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// openVolumes opens the file at path, or the volumes it was split into when
+// it is gone, see VolumePath.
+func openVolumes(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	if _, statErr := os.Stat(VolumePath(path, 1)); statErr != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for i := 1; ; i++ {
+		volume, err := os.Open(VolumePath(path, i))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, volume)
+	}
+
+	readers := make([]io.Reader, len(files))
+	for i, f := range files {
+		readers[i] = f
+	}
+	return readCloser{io.MultiReader(readers...), closerFunc(func() error { closeAll(); return nil })}, nil
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closerFunc closes by calling itself.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// readTarEntries adds every entry of the tar archive r to w.
+func readTarEntries(r io.Reader, w ArchiveWriter) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if header.Typeflag == tar.TypeSymlink {
+			link = header.Linkname
+		}
+		writer, err := w.Add(strings.TrimSuffix(header.Name, "/"), header.FileInfo(), link)
+		if err != nil {
+			return err
+		}
+		if writer != nil {
+			if _, err := io.Copy(writer, tr); err != nil {
+				return fmt.Errorf("failed to read %q: %w", header.Name, err)
+			}
+		}
+	}
+}
+
+// readZip adds every entry of the zip archive in to w. zip needs random
+// access, so archives that are not a plain local file are copied to a
+// temporary file first.
+func (b *backup) readZip(in io.Reader, w ArchiveWriter) error {
+	file, ok := in.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "restore-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, in); err != nil {
+			return err
+		}
+		file = tmp
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		// Symlinks are written with the content of their target, see
+		// zipWriter, so they come back as regular files.
+		info := f.FileInfo()
+		if info.Mode()&fs.ModeSymlink != 0 {
+			info = modeInfo{FileInfo: info, mode: 0o644}
+		}
+		info = zipEntryAttrs(info, f.Extra)
+		writer, err := w.Add(strings.TrimSuffix(f.Name, "/"), info, "")
+		if err != nil {
+			return err
+		}
+		if writer == nil {
+			continue
+		}
+
+		var content io.ReadCloser
+		if f.Method == aesMethod {
+			content, err = openAESEntry(f, b.ZipPassword)
+		} else {
+			content, err = f.Open()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open %q: %w", f.Name, err)
+		}
+		_, err = io.Copy(writer, content)
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// modeInfo overrides the mode of a FileInfo.
+type modeInfo struct {
+	fs.FileInfo
+	mode fs.FileMode
+}
+
+func (i modeInfo) Mode() fs.FileMode { return i.mode }
+func (i modeInfo) IsDir() bool       { return i.mode.IsDir() }
+
+// readMirror adds every file of the mirror at root to w.
+func readMirror(root string, w ArchiveWriter) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if xattrs, err := readXattrs(path); err != nil {
+			return err
+		} else if len(xattrs) > 0 {
+			info = attrInfo{FileInfo: info, xattrs: xattrs}
+		}
+		writer, err := w.Add(filepath.ToSlash(rel), info, link)
+		if err != nil || writer == nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(writer, file)
+		return err
+	})
+}
+
+// listWriter prints the path, size and modification time of every file and
+// symlink a restore below target would write, and what the conflict policy
+// does with the ones that exist, without touching target. Quiet, it only
+// counts them.
+type listWriter struct {
+	target   string
+	conflict string
+	quiet    bool
+	files    int
+	bytes    int64
+	existing int
+	first    string // Name of the first existing file
+}
+
+func (w *listWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	name = path.Clean(name)
+	if name == MetadataEntryName || info.IsDir() || (link == "" && !info.Mode().IsRegular()) {
+		return nil, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return nil, fmt.Errorf("refusing to restore %q outside of the target directory", name)
+	}
+
+	dest := filepath.Join(w.target, filepath.FromSlash(name))
+	note := ""
+	if _, err := os.Lstat(dest); err == nil {
+		w.existing++
+		if w.first == "" {
+			w.first = name
+		}
+		switch w.conflict {
+		case ConflictSkip:
+			w.printf("Dry run: would skip %q, it exists\n", dest)
+			return nil, nil
+		case ConflictKeepBoth:
+			dest = keepBothName(dest, func(name string) bool { _, err := os.Lstat(name); return err == nil })
+			note = ", keeping the existing file"
+		case ConflictFail:
+			note = ", which exists"
+		default:
+			note = ", overwriting the existing file"
+		}
+	}
+	if link != "" {
+		w.printf("Dry run: would restore %q as a symlink to %q%s\n", dest, link, note)
+		return nil, nil
+	}
+	w.printf("Dry run: would restore %q, %d bytes, modified %s%s\n", dest, info.Size(), info.ModTime().In(jkt).Format(time.RFC3339), note)
+	w.files++
+	w.bytes += info.Size()
+	return nil, nil
+}
+
+func (w *listWriter) printf(format string, args ...any) {
+	if !w.quiet {
+		fmt.Printf(format, args...)
+	}
+}
+
+func (w *listWriter) Close() error { return nil }
+
+// restoreWriter extracts the entries of an archive below a directory. Every
+// file is created through an os.Root, so neither names like "../x" nor
+// symlinks in the archive lead outside of it.
+type restoreWriter struct {
+	root     *os.Root
+	conflict string      // Policy for existing files, see ConflictOverwrite
+	file     *os.File    // Regular file being written
+	name     string      // Of file below the root
+	info     fs.FileInfo // Of the entry of file
+	dirs     []restoredDir
+	files    int
+	skipped  int
+	attrErrs int   // Files whose owner or extended attributes were not restored
+	attrErr  error // The first of them
+	// placed maps the slash separated names of files not restored under
+	// their own name to the one they were, "" when skipped.
+	placed map[string]string
+}
+
+// restoredDir is a directory whose mode and time are set once its content is
+// written, as writing the content changes them.
+type restoredDir struct {
+	name string
+	info fs.FileInfo
+}
+
+func newRestoreWriter(target, conflict string) (*restoreWriter, error) {
+	root, err := os.OpenRoot(target)
+	if err != nil {
+		return nil, err
+	}
+	return &restoreWriter{root: root, conflict: conflict, placed: make(map[string]string)}, nil
+}
+
+func (w *restoreWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	if err := w.finishFile(); err != nil {
+		return nil, err
+	}
+
+	name = path.Clean(name)
+	if name == MetadataEntryName {
+		return nil, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return nil, fmt.Errorf("refusing to restore %q outside of the target directory", name)
+	}
+	entry := name
+	name = filepath.FromSlash(name)
+	if err := w.mkdirAll(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() && w.conflict != ConflictOverwrite && w.exists(name) {
+		switch w.conflict {
+		case ConflictSkip:
+			w.placed[entry] = ""
+			w.skipped++
+			return nil, nil
+		case ConflictKeepBoth:
+			name = keepBothName(name, w.exists)
+			w.placed[entry] = filepath.ToSlash(name)
+		case ConflictFail:
+			return nil, fmt.Errorf("%w: %q", ErrRestoreConflict, entry)
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		if err := w.mkdirAll(name); err != nil {
+			return nil, err
+		}
+		w.dirs = append(w.dirs, restoredDir{name: name, info: info})
+		return nil, nil
+	case link != "":
+		// An existing file is replaced, the parent was resolved within the
+		// root above.
+		if err := w.root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to replace %q: %w", name, err)
+		}
+		if err := w.root.Symlink(link, name); err != nil {
+			return nil, fmt.Errorf("failed to create %q: %w", name, err)
+		}
+		w.restoreOwner(name, info)
+		return nil, nil
+	case info.Mode().IsRegular():
+		file, err := w.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %q: %w", name, err)
+		}
+		w.file, w.name, w.info = file, name, info
+		w.files++
+		return file, nil
+	default:
+		// Devices, sockets and pipes have no content to restore.
+		return nil, nil
+	}
+}
+
+// exists reports whether there is a file named name below the root.
+func (w *restoreWriter) exists(name string) bool {
+	_, err := w.root.Lstat(name)
+	return err == nil
+}
+
+// mkdirAll creates the directory name below the root with its parents.
+func (w *restoreWriter) mkdirAll(name string) error {
+	if name == "." {
+		return nil
+	}
+	if err := w.mkdirAll(filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := w.root.Mkdir(name, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("failed to create %q: %w", name, err)
+	}
+	return nil
+}
+
+// finishFile sets the owner, extended attributes, mode and time of the
+// file being written and closes it.
+func (w *restoreWriter) finishFile() error {
+	if w.file == nil {
+		return nil
+	}
+	file, info := w.file, w.info
+	w.file, w.info = nil, nil
+
+	err := w.restoreAttrs(w.name, file, info)
+	return errors.Join(err, file.Close())
+}
+
+// restoreDir sets the owner, extended attributes, mode and time of the
+// directory name, unless a later entry replaced it with something else,
+// such as a symlink pointing out of the target.
+func (w *restoreWriter) restoreDir(dir restoredDir) error {
+	info, err := w.root.Lstat(dir.name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		w.attrFailed(dir.name, errors.New("no longer a directory"))
+		return nil
+	}
+	f, err := w.root.Open(dir.name)
+	if err != nil {
+		return err
+	}
+	err = w.restoreAttrs(dir.name, f, dir.info)
+	return errors.Join(err, f.Close())
+}
+
+// restoreAttrs sets the attributes recorded in info on f, the open file
+// name. It goes through the handle and the root so that nothing outside of
+// the target is changed by following a symlink. The owner comes before the
+// mode, which changing the owner clears the setuid and setgid bits of.
+func (w *restoreWriter) restoreAttrs(name string, f *os.File, info fs.FileInfo) error {
+	if uid, gid, ok := entryOwner(info); ok && os.Geteuid() == 0 {
+		if err := f.Chown(uid, gid); err != nil {
+			w.attrFailed(name, err)
+		}
+	}
+	if err := writeFileXattrs(f, entryXattrs(info)); err != nil {
+		w.attrFailed(name, err)
+	}
+	if err := f.Chmod(restoredMode(info)); err != nil {
+		return err
+	}
+	return w.root.Chtimes(name, time.Time{}, info.ModTime())
+}
+
+// restoredMode returns the permissions and the setuid, setgid and sticky
+// bits of info.
+func restoredMode(info fs.FileInfo) fs.FileMode {
+	return info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
+
+// restoreOwner gives the symlink name the owner recorded in info when
+// running as root, as only root may give files away.
+func (w *restoreWriter) restoreOwner(name string, info fs.FileInfo) {
+	uid, gid, ok := entryOwner(info)
+	if !ok || os.Geteuid() != 0 {
+		return
+	}
+	if err := w.root.Lchown(name, uid, gid); err != nil {
+		w.attrFailed(name, err)
+	}
+}
+
+// attrFailed counts a file whose owner or extended attributes could not be
+// restored, which Close warns about, as the content is restored anyway.
+func (w *restoreWriter) attrFailed(name string, err error) {
+	if w.attrErrs == 0 {
+		w.attrErr = fmt.Errorf("%s: %w", name, err)
+	}
+	w.attrErrs++
+}
+
+// Close finishes the last file and the directories, innermost first.
+func (w *restoreWriter) Close() error {
+	err := w.finishFile()
+	for i := len(w.dirs) - 1; i >= 0; i-- {
+		err = errors.Join(err, w.restoreDir(w.dirs[i]))
+	}
+	w.dirs = nil
+	if w.attrErrs > 0 {
+		fmt.Printf("Warning: failed to restore the owner or extended attributes of %d file(s), e.g. %v\n", w.attrErrs, w.attrErr)
+	}
+
+	return errors.Join(err, w.root.Close())
+}
@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTarGz writes a tar.gz archive named name in dir with the headers,
+// which have no content, and returns its path.
+func writeTarGz(t *testing.T, dir, name string, headers ...*tar.Header) string {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestRestoreDoesNotFollowSymlinkReplacingDir(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.Chmod(outside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := writeTarGz(t, t.TempDir(), "crafted.tar.gz",
+		&tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0o700, ModTime: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "d", Linkname: outside, Mode: 0o777},
+	)
+	target := t.TempDir()
+	b := New(t.TempDir(), t.TempDir(), -1)
+	if _, err := b.RestoreArchive(archive, target); err != nil {
+		t.Fatal(err)
+	}
+
+	if link, err := os.Readlink(filepath.Join(target, "d")); err != nil || link != outside {
+		t.Errorf("d was restored as %q, %v, want a symlink to %q", link, err, outside)
+	}
+	after, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() {
+		t.Errorf("mode of the symlink target changed from %v to %v", before.Mode(), after.Mode())
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("time of the symlink target changed from %v to %v", before.ModTime(), after.ModTime())
+	}
+}
+
+func TestRestoreRefusesFileBelowSymlink(t *testing.T) {
+	outside := t.TempDir()
+	archive := writeTarGz(t, t.TempDir(), "crafted.tar.gz",
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "d", Linkname: outside, Mode: 0o777},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "d/f", Mode: 0o644},
+	)
+	b := New(t.TempDir(), t.TempDir(), -1)
+	if _, err := b.RestoreArchive(archive, t.TempDir()); err == nil {
+		t.Error("restoring a file below a symlink out of the target succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "f")); err == nil {
+		t.Error("a file was written out of the target")
+	}
+}
+
+func TestRestoreSetsDirAttributes(t *testing.T) {
+	mtime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	archive := writeTarGz(t, t.TempDir(), "dirs.tar.gz",
+		&tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0o700, ModTime: mtime},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "d/f", Mode: 0o600, ModTime: mtime},
+	)
+	target := t.TempDir()
+	b := New(t.TempDir(), t.TempDir(), -1)
+	if _, err := b.RestoreArchive(archive, target); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"d", "d/f"} {
+		info, err := os.Lstat(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s has time %v, want %v", name, info.ModTime(), mtime)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(target, "d")); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("d has mode %v, %v, want 0700", info.Mode().Perm(), err)
+	}
+}
+
+func TestFindArchivesRefusesOverwrittenArchive(t *testing.T) {
+	manifest := []*DirectoryEntry{{Name: "app", History: []ArchiveRecord{
+		{Path: "/backups/app.zip", Kind: KindFull, RunID: "run-1", CreatedAt: "2026-10-01T00:00:00+07:00"},
+		{Path: "/backups/app.zip", Kind: KindFull, RunID: "run-2", CreatedAt: "2026-10-02T00:00:00+07:00"},
+	}}}
+	b := New(t.TempDir(), t.TempDir(), -1)
+
+	for _, tt := range []struct {
+		selector string
+		asOf     time.Time
+	}{
+		{"app", time.Date(2026, 10, 1, 12, 0, 0, 0, jkt)},
+		{"run-1", time.Now()},
+	} {
+		if found, err := b.FindArchives(manifest, tt.selector, tt.asOf); !errors.Is(err, ErrChainOverwritten) || len(found) != 0 {
+			t.Errorf("FindArchives(%q, %s) = %v, %v, want ErrChainOverwritten", tt.selector, tt.asOf, found, err)
+		}
+	}
+
+	// The latest run still holds what its archive does.
+	found, err := b.FindArchives(manifest, "run-2", time.Now())
+	if err != nil || found["app"].RunID != "run-2" {
+		t.Errorf("FindArchives(run-2) = %v, %v, want the latest archive", found, err)
+	}
+	if _, err := b.RestoreAll(manifest, t.TempDir(), time.Date(2026, 10, 1, 12, 0, 0, 0, jkt)); !errors.Is(err, ErrChainOverwritten) {
+		t.Errorf("RestoreAll as of the first day returned %v, want ErrChainOverwritten", err)
+	}
+}
+
+func TestRestoreConflictPolicies(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "restored a", "sub/b.txt": "restored b"})
+	archive := filepath.Join(t.TempDir(), "app.zip")
+	if err := New(src, t.TempDir(), -1).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		policy string
+		err    error
+		files  int
+		want   map[string]string // Content of the target afterwards, "" for missing files
+	}{
+		{ConflictOverwrite, nil, 2, map[string]string{"a.txt": "restored a", "sub/b.txt": "restored b", "c.txt": "mine"}},
+		{ConflictSkip, nil, 1, map[string]string{"a.txt": "existing a", "sub/b.txt": "restored b", "c.txt": "mine"}},
+		{ConflictKeepBoth, nil, 2, map[string]string{"a.txt": "existing a", "a.restored.txt": "restored a", "sub/b.txt": "restored b", "c.txt": "mine"}},
+		{ConflictFail, ErrRestoreConflict, 0, map[string]string{"a.txt": "existing a", "sub/b.txt": "", "c.txt": "mine"}},
+	} {
+		target := t.TempDir()
+		writeTree(t, target, map[string]string{"a.txt": "existing a", "c.txt": "mine"})
+		b := New(t.TempDir(), t.TempDir(), -1, WithRestoreConflict(tt.policy))
+
+		n, err := b.RestoreArchive(archive, target)
+		if !errors.Is(err, tt.err) || n != tt.files {
+			t.Errorf("%s: RestoreArchive = %d, %v, want %d, %v", tt.policy, n, err, tt.files, tt.err)
+		}
+		for name, want := range tt.want {
+			got, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(name)))
+			if want == "" && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s: %s was restored: %q, %v", tt.policy, name, got, err)
+			}
+			if want != "" && string(got) != want {
+				t.Errorf("%s: %s holds %q, %v, want %q", tt.policy, name, got, err, want)
+			}
+		}
+	}
+}
+
+func TestRestoreKeepBothTwice(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "restored a"})
+	archive := filepath.Join(t.TempDir(), "app.zip")
+	if err := New(src, t.TempDir(), -1).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	writeTree(t, target, map[string]string{"a.txt": "existing a"})
+
+	b := New(t.TempDir(), t.TempDir(), -1, WithRestoreConflict(ConflictKeepBoth))
+	for range 2 {
+		if _, err := b.RestoreArchive(archive, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"a.txt": "existing a", "a.restored.txt": "restored a", "a.restored-2.txt": "restored a"} {
+		if got, err := os.ReadFile(filepath.Join(target, name)); err != nil || string(got) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestRestoreOverwriteNotConfirmed(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "restored a", "b.txt": "restored b"})
+	archive := filepath.Join(t.TempDir(), "app.zip")
+	if err := New(src, t.TempDir(), -1).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	writeTree(t, target, map[string]string{"a.txt": "existing a"})
+
+	asked := 0
+	b := New(t.TempDir(), t.TempDir(), -1, WithRestoreConfirm(func(existing int) bool {
+		asked = existing
+		return false
+	}))
+	if _, err := b.RestoreArchive(archive, target); !errors.Is(err, ErrRestoreAborted) {
+		t.Errorf("RestoreArchive = %v, want ErrRestoreAborted", err)
+	}
+	if asked != 1 {
+		t.Errorf("confirmation asked for %d existing file(s), want 1", asked)
+	}
+	if got, _ := os.ReadFile(filepath.Join(target, "a.txt")); string(got) != "existing a" {
+		t.Errorf("a.txt holds %q after declining to overwrite it", got)
+	}
+	if _, err := os.Stat(filepath.Join(target, "b.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("b.txt was restored after declining the restore: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultCheckpointInterval is how many bytes are copied between checkpoints
+// when no interval is configured.
+const defaultCheckpointInterval = 64 << 20
+
+// copyCheckpoint records how far a resumable copy into a destination file got.
+type copyCheckpoint struct {
+	Key     string `json:"key"`     // Identifies the data being copied
+	Start   int64  `json:"start"`   // Destination size before anything of this copy was written
+	Offset  int64  `json:"offset"`  // Destination position where the copied bytes begin
+	Written int64  `json:"written"` // Bytes copied and synced so far
+}
+
+func loadCheckpoint(path string) (*copyCheckpoint, error) {
+	var ckpt copyCheckpoint
+	if err := loadState(path, &ckpt); err != nil {
+		return nil, err
+	}
+
+	return &ckpt, nil
+}
+
+func saveCheckpoint(path string, ckpt *copyCheckpoint) error {
+	return saveState(path, ckpt)
+}
+
+// loadState reads progress saved by saveState into v.
+func loadState(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to read checkpoint %q: %w", path, err)
+	}
+	return nil
+}
+
+// saveState atomically replaces the progress saved at path with v.
+func saveState(path string, v any) error {
+	data, _ := json.Marshal(v)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint %q: %w", path, err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// resumableCopy copies src into dst starting at ckpt.Offset+ckpt.Written,
+// syncing dst and saving the checkpoint every interval bytes. If the copy is
+// interrupted, calling it again with the saved checkpoint continues where the
+// last checkpoint left off instead of starting from zero.
+func resumableCopy(dst *os.File, src io.ReadSeeker, ckptPath string, ckpt *copyCheckpoint, interval int64) error {
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+
+	// Drop anything written after the last checkpoint, it may be incomplete.
+	if err := dst.Truncate(ckpt.Offset + ckpt.Written); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(ckpt.Offset+ckpt.Written, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := src.Seek(ckpt.Written, io.SeekStart); err != nil {
+		return err
+	}
+
+	if ckpt.Written > 0 {
+		fmt.Printf("Resuming copy of %q at byte %d\n", ckpt.Key, ckpt.Written)
+	}
+
+	for {
+		n, err := io.CopyN(dst, src, interval)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if n > 0 {
+			if err := dst.Sync(); err != nil {
+				return err
+			}
+			ckpt.Written += n
+			if err := saveCheckpoint(ckptPath, ckpt); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			return nil
+		}
+	}
+}
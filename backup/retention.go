@@ -0,0 +1,493 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnforceArchiveCap deletes the oldest archives of entry as soon as it has
+// more than MaxArchivesPerSource, independent of any scheduled pruning. Held
+// archives don't count, and the latest archive and those it builds on stay.
+// Safe mode keeps them all, see pruneHistory.
+func (b *backup) EnforceArchiveCap(entry *DirectoryEntry) []ArchiveRecord {
+	excess := len(entry.History) - b.MaxArchivesPerSource
+	for _, r := range entry.History {
+		if r.Held {
+			excess--
+		}
+	}
+	if b.MaxArchivesPerSource <= 0 || excess <= 0 {
+		return nil
+	}
+
+	drop := make(map[int]bool)
+	for i := 0; i < len(entry.History)-1 && len(drop) < excess; i++ {
+		if i != entry.latestBase() && !entry.History[i].Held {
+			drop[i] = true
+		}
+	}
+
+	return b.pruneHistory(entry, drop)
+}
+
+// ErrStoreFull means the archives in the output path leave no room for the
+// next backups within MaxStoreSize, even after evicting every archive that
+// may go.
+var ErrStoreFull = errors.New("backup store is full")
+
+// EnforceStoreCap evicts the oldest archives across manifest, locally and on
+// the backends, until the local archives plus room for the next archive of
+// every directory in pending fit in MaxStoreSize. A directory needs as much
+// room as its latest archive takes, and a file shared by several records
+// counts once. The latest archive of a directory and the
+// full backup it builds on are never evicted: when the store doesn't fit
+// without them, nothing is evicted and ErrStoreFull is returned.
+func (b *backup) EnforceStoreCap(manifest, pending []*DirectoryEntry) error {
+	if b.MaxStoreSize <= 0 {
+		return nil
+	}
+
+	var need int64
+	for _, entry := range pending {
+		if n := len(entry.History); n > 0 {
+			need += entry.History[n-1].Size()
+		}
+	}
+
+	type candidate struct {
+		entry   *DirectoryEntry
+		index   int
+		created time.Time
+		size    int64
+	}
+	used := storeSize(manifest)
+	var candidates []candidate
+	for _, entry := range manifest {
+		for i, r := range entry.History {
+			size := entry.ownSize(i)
+			if i == len(entry.History)-1 || i == entry.latestBase() || r.Held || size == 0 {
+				continue
+			}
+			// Archives of an unknown age are never evicted, as in retention.
+			if t, err := time.Parse(time.RFC3339, r.CreatedAt); err == nil {
+				candidates = append(candidates, candidate{entry, i, t, size})
+			}
+		}
+	}
+	if used+need <= b.MaxStoreSize {
+		return nil
+	}
+
+	slices.SortStableFunc(candidates, func(x, y candidate) int { return x.created.Compare(y.created) })
+	drop := make(map[*DirectoryEntry]map[int]bool)
+	freed := int64(0)
+	for _, c := range candidates {
+		if used-freed+need <= b.MaxStoreSize {
+			break
+		}
+		if drop[c.entry] == nil {
+			drop[c.entry] = make(map[int]bool)
+		}
+		drop[c.entry][c.index] = true
+		freed += c.size
+	}
+	if used-freed+need > b.MaxStoreSize {
+		return fmt.Errorf("%w: %d bytes of archives that must stay and %d bytes for the next backups exceed %d bytes", ErrStoreFull, used-freed, need, b.MaxStoreSize)
+	}
+
+	fmt.Printf("Store holds %d bytes, evicting %d bytes of the oldest archives to stay below %d bytes\n", used, freed, b.MaxStoreSize)
+	for _, entry := range manifest {
+		if drop[entry] != nil {
+			b.pruneHistory(entry, drop[entry])
+		}
+	}
+
+	// Archives that failed to be deleted, or were kept in safe mode, still
+	// take their room. A dry run assumes the eviction went through.
+	if b.RetentionDryRun {
+		return nil
+	}
+	if used = storeSize(manifest); used+need > b.MaxStoreSize {
+		return fmt.Errorf("%w: %d bytes of archives could not be evicted", ErrStoreFull, used+need-b.MaxStoreSize)
+	}
+
+	return nil
+}
+
+// Prune applies MaxArchivesPerSource, Retention and MaxStoreSize to every
+// directory in manifest outside of a backup run. The archives are deleted
+// from the backends along with their local copies, which may be gone already,
+// e.g. in remote-only mode, as the manifest tells what is stored where. The
+// pruned archives are listed in the report.
+func (b *backup) Prune(manifest []*DirectoryEntry) error {
+	for _, entry := range manifest {
+		b.EnforceArchiveCap(entry)
+		b.ApplyRetention(entry)
+	}
+
+	return b.EnforceStoreCap(manifest, nil)
+}
+
+// RetentionPolicy keeps archives in grandfather-father-son rotation: the
+// newest archive of each of the last Daily days, Weekly ISO weeks and Monthly
+// months that have one. An archive kept by any of them stays, unless it is
+// older than MaxAge. Without a rotation every archive up to MaxAge is kept.
+type RetentionPolicy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+	MaxAge  time.Duration
+}
+
+// Enabled reports whether p prunes anything.
+func (p RetentionPolicy) Enabled() bool {
+	return p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.MaxAge > 0
+}
+
+// rotates reports whether p keeps archives in rotation.
+func (p RetentionPolicy) rotates() bool {
+	return p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0
+}
+
+// ParseAge parses a duration such as "90d", "12w" or "36h", days and weeks
+// in addition to the units of time.ParseDuration.
+func ParseAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.ParseFloat(n, 64)
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid age %q", value)
+			}
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// ApplyRetention deletes the archives of entry that Retention doesn't keep,
+// locally and on the backends, and returns what was pruned. The latest
+// archive and the full backup it builds on always stay.
+func (b *backup) ApplyRetention(entry *DirectoryEntry) []ArchiveRecord {
+	if !b.Retention.Enabled() || len(entry.History) == 0 {
+		return nil
+	}
+
+	keep := b.Retention.keep(entry.History, time.Now())
+	keep[len(entry.History)-1] = true
+	if base := entry.latestBase(); base >= 0 {
+		keep[base] = true
+	}
+
+	drop := make(map[int]bool)
+	for i := range entry.History {
+		if !keep[i] {
+			drop[i] = true
+		}
+	}
+	return b.pruneHistory(entry, drop)
+}
+
+// keep returns the indexes of the records in history p keeps at now. Records
+// with an unknown creation time are always kept.
+func (p RetentionPolicy) keep(history []ArchiveRecord, now time.Time) map[int]bool {
+	keep := make(map[int]bool)
+	created := make(map[int]time.Time)
+	for i, r := range history {
+		t, err := time.Parse(time.RFC3339, r.CreatedAt)
+		if err != nil {
+			keep[i] = true
+			continue
+		}
+		if p.MaxAge > 0 && now.Sub(t) > p.MaxAge {
+			continue
+		}
+		created[i] = t.In(jkt)
+		if !p.rotates() {
+			keep[i] = true
+		}
+	}
+	newest := slices.SortedFunc(maps.Keys(created), func(i, j int) int {
+		return created[j].Compare(created[i])
+	})
+
+	periods := []struct {
+		keep   int
+		period func(time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for _, i := range newest {
+			if len(seen) >= period.keep {
+				break
+			}
+			if name := period.period(created[i]); !seen[name] {
+				seen[name] = true
+				keep[i] = true
+			}
+		}
+	}
+
+	return keep
+}
+
+// latestBase returns the index of the full backup the latest archive of entry
+// builds on, or -1. It is never pruned, so the latest chain stays restorable.
+func (e *DirectoryEntry) latestBase() int {
+	for i := len(e.History) - 1; i >= 0; i-- {
+		if e.History[i].Kind == KindFull {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// pruneHistory deletes the archives at the drop indexes of entry's history,
+// along with their group archives and sidecars, from the backends and then
+// locally, and returns what was pruned. Held archives stay, as do the
+// archives a kept partial archive builds on, and files still
+// referenced by a kept record are left alone. A record whose remote copies
+// could not be deleted is kept, so the next run tries again. In safe mode
+// nothing is deleted and the history is kept as it is, as in a retention dry
+// run, which lists the archives in the report instead.
+func (b *backup) pruneHistory(entry *DirectoryEntry, drop map[int]bool) []ArchiveRecord {
+	// A kept partial archive needs the archives it builds on back to its
+	// full backup, see IncrementalBackups.
+	drop = maps.Clone(drop)
+	for i := len(entry.History) - 1; i > 0; i-- {
+		if (!drop[i] || entry.History[i].Held) && entry.History[i].Partial {
+			if j := entry.buildsOn(i); j >= 0 {
+				delete(drop, j)
+			}
+		}
+	}
+
+	inUse := make(map[string]bool)
+	for i, r := range entry.History {
+		if !drop[i] {
+			for _, path := range r.files() {
+				inUse[path] = true
+			}
+		}
+	}
+
+	var kept, pruned []ArchiveRecord
+	for i, r := range entry.History {
+		if !drop[i] {
+			kept = append(kept, r)
+			continue
+		}
+
+		if r.Held {
+			fmt.Printf("Keeping archive %q of %q, it is under a legal hold\n", r.Path, entry.Name)
+			kept = append(kept, r)
+			continue
+		}
+
+		if b.RetentionDryRun {
+			if b.report.recordWouldPrune(entry.Name, r) {
+				var files []string
+				for _, path := range r.archives() {
+					if !inUse[path] {
+						files = append(files, path)
+					}
+				}
+				fmt.Printf("Dry run: would prune archive %q of %q created at %s, %d bytes: %s\n", r.Path, entry.Name, r.CreatedAt, r.Size(), strings.Join(files, ", "))
+			}
+			kept = append(kept, r)
+			continue
+		}
+		if b.SafeMode {
+			fmt.Printf("Safe mode: would prune archive %q of %q\n", r.Path, entry.Name)
+			kept = append(kept, r)
+			continue
+		}
+
+		size := r.Size()
+		if err := b.pruneRemote(context.Background(), r, inUse); err != nil {
+			fmt.Printf("Failed to prune archive %q from remote storage: %v\n", r.Path, err)
+			kept = append(kept, r)
+			continue
+		}
+
+		var err error
+		for _, path := range r.files() {
+			if inUse[path] {
+				continue
+			}
+			if rmErr := b.removeFile(path); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+				err = rmErr
+			}
+		}
+		if err != nil {
+			fmt.Printf("Failed to prune archive %q: %v\n", r.Path, err)
+			kept = append(kept, r)
+			continue
+		}
+
+		fmt.Printf("Pruned archive %q of %q\n", r.Path, entry.Name)
+		b.report.recordPruned(entry.Name, r, size)
+		pruned = append(pruned, r)
+	}
+
+	entry.History = kept
+	return pruned
+}
+
+// pruneRemote deletes the files of r that are not inUse from every backend
+// holding them. Backends are listed first, as some fail to delete what they
+// don't have.
+func (b *backup) pruneRemote(ctx context.Context, r ArchiveRecord, inUse map[string]bool) error {
+	keys := make(map[string]bool)
+	for _, path := range r.files() {
+		if !inUse[path] {
+			keys[b.remoteKey(path)] = true
+		}
+	}
+	// Volumes, group archives and sidecars all start with the archive's name.
+	base, _ := splitArchiveExt(r.Path)
+	prefix := b.remoteKey(base)
+
+	var errs []error
+	for _, s := range b.Backends {
+		listCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.List)
+		objects, err := s.List(listCtx, prefix)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, object := range objects {
+			if !keys[object.Key] {
+				continue
+			}
+			deleteCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.Delete)
+			err := s.Delete(deleteCtx, object.Key)
+			cancel()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", destinationName(s), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// files lists every file belonging to the archive of r, followed by the
+// directory of a mirror.
+func (r ArchiveRecord) files() []string {
+	files := r.archives()
+	if archiveFormat(r.Path) == FormatMirror {
+		files = append(files, r.Path)
+	} else {
+		for _, path := range r.archives() {
+			files = append(files, ParityPath(path))
+		}
+	}
+	files = append(files, SidecarPath(r.Path), CatalogPath(r.Path))
+	for _, path := range r.GroupArchives {
+		files = append(files, SidecarPath(path))
+	}
+
+	return files
+}
+
+// archives lists the archive and group archives of r, or their volumes when
+// they were split. A mirror is listed as the regular files it holds.
+func (r ArchiveRecord) archives() []string {
+	var archives []string
+	for _, path := range append([]string{r.Path}, slices.Sorted(maps.Values(r.GroupArchives))...) {
+		if n := r.Volumes[path]; n > 0 {
+			for i := 1; i <= n; i++ {
+				archives = append(archives, VolumePath(path, i))
+			}
+			continue
+		}
+		if archiveFormat(path) == FormatMirror {
+			filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+				if err == nil && d.Type().IsRegular() {
+					archives = append(archives, file)
+				}
+				return nil
+			})
+			continue
+		}
+		archives = append(archives, path)
+	}
+
+	return archives
+}
+
+// Size returns the bytes taken by the archives of r.
+func (r ArchiveRecord) Size() int64 {
+	var size int64
+	for _, path := range r.archives() {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// ownSize returns the bytes taken by the archives of the record at index i
+// of e that no other record of e shares, those evicting it frees. Unlabelled
+// archives share the path of the directory's latest archive.
+func (e *DirectoryEntry) ownSize(i int) int64 {
+	shared := make(map[string]bool)
+	for j, r := range e.History {
+		if j != i {
+			for _, path := range r.archives() {
+				shared[path] = true
+			}
+		}
+	}
+
+	var size int64
+	for _, path := range e.History[i].archives() {
+		if info, err := os.Stat(path); err == nil && !shared[path] {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// storeSize returns the bytes taken by the local archives of manifest, each
+// file counted once however many records share it.
+func storeSize(manifest []*DirectoryEntry) int64 {
+	var size int64
+	seen := make(map[string]bool)
+	for _, entry := range manifest {
+		for _, r := range entry.History {
+			for _, path := range r.archives() {
+				if seen[path] {
+					continue
+				}
+				seen[path] = true
+				if info, err := os.Stat(path); err == nil {
+					size += info.Size()
+				}
+			}
+		}
+	}
+
+	return size
+}
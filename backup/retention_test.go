@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEnforceArchiveCapAfterEachWrite(t *testing.T) {
+	out := t.TempDir()
+	b := New(t.TempDir(), out, -1, WithSafeMode(false), WithMaxArchivesPerSource(2))
+	entry := &DirectoryEntry{Name: "app"}
+	start := time.Now().AddDate(0, 0, -5)
+	var written []string
+	for i := range 5 {
+		at := start.AddDate(0, 0, i)
+		written = append(written, writeHistory(t, out, "app", at).History[0].Path)
+		entry.Kind = KindFull
+		entry.RecordArchive(written[i], nil, at)
+		b.EnforceArchiveCap(entry)
+
+		if len(entry.History) > 2 {
+			t.Fatalf("after archive %d the history holds %d archives, want at most 2", i+1, len(entry.History))
+		}
+		for j, path := range written {
+			_, err := os.Stat(path)
+			if kept := j >= i-1; kept != (err == nil) {
+				t.Errorf("after archive %d, %s exists %v, want %v", i+1, filepath.Base(path), err == nil, kept)
+			}
+		}
+	}
+	if got := len(b.Report().Pruned); got != 3 {
+		t.Errorf("report lists %d pruned archives, want 3", got)
+	}
+}
+
+func TestEnforceStoreCapCountsSharedArchivesOnce(t *testing.T) {
+	out := t.TempDir()
+	now := time.Now()
+	app := writeHistory(t, out, "app", now.AddDate(0, 0, -3), now.AddDate(0, 0, -2), now.AddDate(0, 0, -1))
+	// Unlabelled archives of every run share one file.
+	db := &DirectoryEntry{Name: "db", Kind: KindFull}
+	dbPath := filepath.Join(out, "db.zip")
+	for i := 3; i > 0; i-- {
+		db.RecordArchive(dbPath, nil, now.AddDate(0, 0, -i))
+	}
+	content := make([]byte, 100)
+	for _, path := range []string{app.History[0].Path, app.History[1].Path, app.History[2].Path, dbPath} {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := []*DirectoryEntry{app, db}
+	if used := storeSize(manifest); used != 400 {
+		t.Errorf("storeSize = %d, want 400", used)
+	}
+
+	oldest, next := app.History[0].Path, app.History[1].Path
+	b := New(t.TempDir(), out, -1, WithSafeMode(false), WithMaxStoreSize(350))
+	if err := b.EnforceStoreCap(manifest, nil); err != nil {
+		t.Fatalf("EnforceStoreCap = %v", err)
+	}
+	if _, err := os.Stat(oldest); err == nil {
+		t.Errorf("the oldest archive %s was not evicted", filepath.Base(oldest))
+	}
+	for _, path := range []string{next, dbPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was evicted although the store fits without it: %v", filepath.Base(path), err)
+		}
+	}
+	if len(app.History) != 2 || len(db.History) != 3 {
+		t.Errorf("histories hold %d and %d archives, want 2 and 3", len(app.History), len(db.History))
+	}
+}
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, jkt) // A Friday of ISO week 42
+	var history []ArchiveRecord
+	for _, created := range []time.Time{
+		time.Date(2026, 7, 20, 10, 0, 0, 0, jkt),  // 0: July
+		time.Date(2026, 8, 10, 10, 0, 0, 0, jkt),  // 1: August, week 33
+		time.Date(2026, 8, 25, 10, 0, 0, 0, jkt),  // 2: August, week 35
+		time.Date(2026, 9, 28, 10, 0, 0, 0, jkt),  // 3: September, week 40
+		time.Date(2026, 10, 2, 10, 0, 0, 0, jkt),  // 4: October, week 40
+		time.Date(2026, 10, 9, 9, 0, 0, 0, jkt),   // 5: week 41
+		time.Date(2026, 10, 9, 18, 0, 0, 0, jkt),  // 6: week 41, the same day
+		time.Date(2026, 10, 12, 10, 0, 0, 0, jkt), // 7: Monday of week 42
+		time.Date(2026, 10, 14, 10, 0, 0, 0, jkt), // 8: no archive the day before
+		time.Date(2026, 10, 16, 8, 0, 0, 0, jkt),  // 9: today
+		time.Date(2026, 10, 16, 11, 0, 0, 0, jkt), // 10: today, later
+	} {
+		// Stored in UTC, the days, weeks and months are those of jkt.
+		history = append(history, ArchiveRecord{Kind: KindFull, CreatedAt: created.UTC().Format(time.RFC3339)})
+	}
+	history = append(history, ArchiveRecord{Kind: KindFull, CreatedAt: "unknown"}) // 11
+
+	for _, tt := range []struct {
+		name   string
+		policy RetentionPolicy
+		want   []int
+	}{
+		{"days with an archive, newest of each", RetentionPolicy{Daily: 3}, []int{7, 8, 10, 11}},
+		{"weeks with an archive, newest of each", RetentionPolicy{Weekly: 3}, []int{4, 6, 10, 11}},
+		{"months with an archive, newest of each", RetentionPolicy{Monthly: 3}, []int{2, 3, 10, 11}},
+		{"more periods than archives", RetentionPolicy{Monthly: 12}, []int{0, 2, 3, 10, 11}},
+		{"periods combined", RetentionPolicy{Daily: 2, Weekly: 2, Monthly: 2}, []int{3, 6, 8, 10, 11}},
+		{"max age alone", RetentionPolicy{MaxAge: 60 * 24 * time.Hour}, []int{2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{"max age over months", RetentionPolicy{Monthly: 12, MaxAge: 60 * 24 * time.Hour}, []int{2, 3, 10, 11}},
+		{"max age over days", RetentionPolicy{Daily: 7, MaxAge: 3 * 24 * time.Hour}, []int{8, 10, 11}},
+	} {
+		got := slices.Sorted(maps.Keys(tt.policy.keep(history, now)))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: keeps %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
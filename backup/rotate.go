@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+// ReencryptArchives re-encrypts the local archives of every record in
+// manifest written with a key other than the one their source is encrypted
+// with now, see EncryptionFor, so a retired key can be dropped once nothing
+// depends on it. The encryption must still be able to decrypt them, e.g. a
+// keyring listing the old keys. Each archive is replaced once its new copy is
+// complete, so it refuses to run in safe mode. Split archives are split again
+// afterwards and every migrated record is uploaded again. It returns the
+// number of records migrated, a failing record does not stop the others.
+func (b *backup) ReencryptArchives(ctx context.Context, manifest []*DirectoryEntry) (int, error) {
+	if len(b.encryptions()) == 0 {
+		return 0, errors.New("no encryption configured")
+	}
+	if b.SafeMode {
+		return 0, errors.New("re-encrypting replaces archives, which safe mode never does")
+	}
+
+	migrated := 0
+	var errs []error
+	for _, entry := range manifest {
+		encryption := b.EncryptionFor(entry)
+		if encryption == nil {
+			continue
+		}
+		for i := range entry.History {
+			record := &entry.History[i]
+			if record.KeyID == "" || record.KeyID == encryption.KeyID() {
+				continue
+			}
+			if encryptionExt(record.Path) != encryption.Extension() {
+				fmt.Printf("Warning: %q is not encrypted the way archives are now, skipping it\n", record.Path)
+				continue
+			}
+			if record.LocalMissing {
+				fmt.Printf("Warning: %q has no local copy to re-encrypt, skipping it\n", record.Path)
+				continue
+			}
+
+			if err := b.reencryptRecord(record, encryption); err != nil {
+				errs = append(errs, fmt.Errorf("failed to re-encrypt %q: %w", record.Path, err))
+				continue
+			}
+			fmt.Printf("Re-encrypted %q with key %q\n", record.Path, record.KeyID)
+			migrated++
+
+			if err := b.UploadArchive(ctx, record); err != nil {
+				errs = append(errs, fmt.Errorf("failed to upload %q: %w", record.Path, err))
+			}
+		}
+	}
+
+	return migrated, errors.Join(errs...)
+}
+
+// reencryptRecord re-encrypts the archive and group archives of record with
+// e.
+func (b *backup) reencryptRecord(record *ArchiveRecord, e Encryptor) error {
+	for _, path := range record.archives() {
+		b.removeFile(ParityPath(path)) // Written again for the new archives
+	}
+	for _, path := range append([]string{record.Path}, slices.Sorted(maps.Values(record.GroupArchives))...) {
+		n := record.Volumes[path]
+		if n > 0 {
+			if err := JoinVolumes(path); err != nil {
+				return err
+			}
+		}
+		if err := reencryptFile(path, e); err != nil {
+			if n > 0 {
+				os.Remove(path) // The volumes are still there
+			}
+			return err
+		}
+		if n > 0 {
+			removeVolumes(path, n)
+			delete(record.Volumes, path)
+		}
+	}
+	record.KeyID = e.KeyID()
+
+	if err := b.SplitArchives(record); err != nil {
+		return err
+	}
+	if err := b.WriteParity(record); err != nil {
+		return err
+	}
+	return b.RecordChecksums(record)
+}
+
+// reencryptFile decrypts the file at path and encrypts it again in place
+// with e.
+func reencryptFile(path string, e Encryptor) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	plain, err := e.Decrypt(in)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	encrypter, err := e.Encrypt(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encrypter, plain); err != nil {
+		encrypter.Close()
+		return err
+	}
+	if err := errors.Join(encrypter.Close(), out.Close()); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
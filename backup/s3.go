@@ -0,0 +1,582 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex encoded SHA-256 of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3MinPartSize is the smallest part S3 accepts in a multipart upload, except
+// for the last one.
+const s3MinPartSize = 5 << 20
+
+func init() {
+	RegisterBackend("s3", func(config func(string) string) (StorageBackend, error) {
+		bucket := config("S3_BUCKET")
+		if bucket == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		partSize, _ := ParseSize(config("S3_PART_SIZE"))
+		sse := config("S3_SSE")
+		if sse == "" && config("S3_SSE_KMS_KEY_ID") != "" {
+			sse = "aws:kms"
+		}
+		if sse != "" && sse != "AES256" && sse != "aws:kms" {
+			return nil, fmt.Errorf("invalid S3_SSE %q, expected AES256 or aws:kms", sse)
+		}
+		return NewS3Backend(S3Config{
+			Endpoint:     config("S3_ENDPOINT"),
+			Region:       config("S3_REGION"),
+			Bucket:       bucket,
+			Prefix:       config("S3_PREFIX"),
+			AccessKey:    firstNonEmpty(config("S3_ACCESS_KEY_ID"), config("AWS_ACCESS_KEY_ID")),
+			SecretKey:    firstNonEmpty(config("S3_SECRET_ACCESS_KEY"), config("AWS_SECRET_ACCESS_KEY")),
+			SessionToken: config("AWS_SESSION_TOKEN"),
+			PathStyle:    config("S3_PATH_STYLE") == "true",
+			PartSize:     partSize,
+			SSE:          sse,
+			SSEKMSKeyID:  config("S3_SSE_KMS_KEY_ID"),
+			StorageClass: config("S3_STORAGE_CLASS"),
+		}), nil
+	})
+}
+
+// S3Config configures an S3 compatible bucket.
+type S3Config struct {
+	Endpoint     string // Defaults to AWS, set it for MinIO and other S3 compatible stores
+	Region       string
+	Bucket       string
+	Prefix       string // Prepended to every object key
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool   // Address the bucket in the path instead of the host name
+	PartSize     int64  // Files larger than this are sent as a resumable multipart upload
+	SSE          string // Server-side encryption of uploads: "AES256" (SSE-S3) or "aws:kms" (SSE-KMS)
+	SSEKMSKeyID  string // KMS key ARN or ID for SSE-KMS, the bucket default when empty
+	StorageClass string // e.g. STANDARD_IA, GLACIER_IR or DEEP_ARCHIVE, the bucket default when empty
+}
+
+// S3Backend stores files in an S3 compatible bucket.
+type S3Backend struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+// NewS3Backend creates a backend for the bucket described by cfg.
+func NewS3Backend(cfg S3Config) *S3Backend {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	if cfg.PartSize < s3MinPartSize {
+		cfg.PartSize = 64 << 20
+	}
+
+	return &S3Backend{cfg: cfg, client: remoteClient}
+}
+
+// String names the destination in logs.
+func (s *S3Backend) String() string {
+	return "s3://" + s.cfg.Bucket + "/" + s.cfg.Prefix
+}
+
+// objectURL returns the URL of the object stored under key, or of the bucket
+// itself when key is empty.
+func (s *S3Backend) objectURL(key string) (*url.URL, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(s.cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", s.cfg.Endpoint, err)
+	}
+
+	if key != "" {
+		key = strings.TrimPrefix(s.cfg.Prefix+key, "/")
+	}
+	if s.cfg.PathStyle {
+		endpoint.Path += "/" + s.cfg.Bucket + "/" + key
+	} else {
+		endpoint.Host = s.cfg.Bucket + "." + endpoint.Host
+		endpoint.Path += "/" + key
+	}
+	// The path is sent escaped as it is signed, Go leaves characters such
+	// as + and = unescaped that AWS escapes.
+	endpoint.RawPath = awsEscapePath(endpoint.Path)
+
+	return endpoint, nil
+}
+
+// send signs and performs a request with the extra header, returning the
+// response when its status is 2xx.
+func (s *S3Backend) send(ctx context.Context, method string, target *url.URL, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	creds := awsCredentials{AccessKey: s.cfg.AccessKey, SecretKey: s.cfg.SecretKey, SessionToken: s.cfg.SessionToken}
+	signV4(req, creds, s.cfg.Region, "s3", payloadHash, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		return nil, responseError(method+" "+s.String()+target.Path, res)
+	}
+
+	return res, nil
+}
+
+// objectHeader returns the headers setting the server-side encryption and
+// storage class of a new object.
+func (s *S3Backend) objectHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	if s.cfg.SSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", s.cfg.SSE)
+	}
+	if s.cfg.SSE == "aws:kms" && s.cfg.SSEKMSKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.cfg.SSEKMSKeyID)
+	}
+	if s.cfg.StorageClass != "" && useStorageClass(ctx) {
+		header.Set("X-Amz-Storage-Class", s.cfg.StorageClass)
+	}
+	return header
+}
+
+// Put stores the file at localPath as the object key.
+func (s *S3Backend) Put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %q: %w", localPath, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	target, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.send(ctx, http.MethodPut, target, s.objectHeader(ctx), file, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, s, err)
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// PutResumable stores the file at localPath as the object key. Files larger
+// than the part size are sent as a multipart upload whose upload ID and
+// finished parts are saved to statePath, so an interrupted upload continues
+// with the first missing part when it is retried.
+func (s *S3Backend) PutResumable(ctx context.Context, localPath, key, statePath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= s.cfg.PartSize {
+		ctx, cancel := requestContext(ctx)
+		defer cancel()
+		return s.Put(ctx, localPath, key)
+	}
+
+	state := loadUploadState(statePath, key, info)
+	err = s.putMultipart(ctx, localPath, key, info.Size(), state, statePath)
+	var missing *s3UploadGone
+	if errors.As(err, &missing) {
+		// The upload expired or was aborted on the server, start over.
+		fmt.Printf("Warning: multipart upload of %q to %s is gone, restarting it\n", key, s)
+		state = &uploadState{Identity: state.Identity}
+		err = s.putMultipart(ctx, localPath, key, info.Size(), state, statePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, s, err)
+	}
+
+	return os.Remove(statePath)
+}
+
+// s3UploadGone reports that S3 no longer knows a saved multipart upload.
+type s3UploadGone struct{ err error }
+
+func (e *s3UploadGone) Error() string { return e.err.Error() }
+func (e *s3UploadGone) Unwrap() error { return e.err }
+
+func (s *S3Backend) putMultipart(ctx context.Context, localPath, key string, size int64, state *uploadState, statePath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	target, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	if state.UploadID == "" {
+		if state.UploadID, err = s.createMultipart(ctx, target); err != nil {
+			return err
+		}
+		state.Parts = nil
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Resuming upload of %q to %s at part %d\n", key, s, len(state.Parts)+1)
+	}
+
+	for offset := int64(len(state.Parts)) * s.cfg.PartSize; offset < size; offset += s.cfg.PartSize {
+		number := len(state.Parts) + 1
+		etag, err := s.putPart(ctx, target, state.UploadID, number, io.NewSectionReader(file, offset, min(s.cfg.PartSize, size-offset)))
+		if err != nil {
+			return err
+		}
+
+		state.Parts = append(state.Parts, uploadPart{Number: number, ETag: etag})
+		if err := saveState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	return s.completeMultipart(ctx, target, state.UploadID, state.Parts)
+}
+
+// PutStream stores what is read from r as the object key, see
+// StreamingBackend. Up to one part is held in memory: a stream shorter than
+// the part size is sent with a single request, a longer one as a multipart
+// upload, which is aborted when reading r or sending a part fails.
+func (s *S3Backend) PutStream(ctx context.Context, key string, r io.Reader) error {
+	target, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, s.cfg.PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		sum := sha256.Sum256(buf[:n])
+		ctx, cancel := requestContext(ctx)
+		defer cancel()
+		res, err := s.send(ctx, http.MethodPut, target, s.objectHeader(ctx), bytes.NewReader(buf[:n]), int64(n), hex.EncodeToString(sum[:]))
+		if err != nil {
+			return fmt.Errorf("failed to upload %q to %s: %w", key, s, err)
+		}
+		res.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.createMultipart(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", key, s, err)
+	}
+	var parts []uploadPart
+	for n > 0 {
+		etag, err := s.putPart(ctx, target, uploadID, len(parts)+1, bytes.NewReader(buf[:n]))
+		if err != nil {
+			s.abortMultipart(ctx, target, uploadID)
+			return fmt.Errorf("failed to upload %q to %s: %w", key, s, err)
+		}
+		parts = append(parts, uploadPart{Number: len(parts) + 1, ETag: etag})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abortMultipart(ctx, target, uploadID)
+			return err
+		}
+	}
+
+	if err := s.completeMultipart(ctx, target, uploadID, parts); err != nil {
+		s.abortMultipart(ctx, target, uploadID)
+		return fmt.Errorf("failed to upload %q to %s: %w", key, s, err)
+	}
+	return nil
+}
+
+// createMultipart starts a multipart upload to target and returns its ID.
+func (s *S3Backend) createMultipart(ctx context.Context, target *url.URL) (string, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	target.RawQuery = "uploads="
+	res, err := s.send(ctx, http.MethodPost, target, s.objectHeader(ctx), nil, 0, emptySHA256)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&created); err != nil || created.UploadID == "" {
+		return "", fmt.Errorf("invalid response creating multipart upload: %v", err)
+	}
+	return created.UploadID, nil
+}
+
+// putPart sends part as the given part number of a multipart upload and
+// returns its ETag.
+func (s *S3Backend) putPart(ctx context.Context, target *url.URL, uploadID string, number int, part io.ReadSeeker) (string, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, part)
+	if err != nil {
+		return "", fmt.Errorf("failed to checksum part %d: %w", number, err)
+	}
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	target.RawQuery = url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}.Encode()
+	res, err := s.send(ctx, http.MethodPut, target, nil, io.NopCloser(part), size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return "", s.uploadError(err)
+	}
+	res.Body.Close()
+
+	return res.Header.Get("ETag"), nil
+}
+
+// completeMultipart assembles the object from the uploaded parts.
+func (s *S3Backend) completeMultipart(ctx context.Context, target *url.URL, uploadID string, parts []uploadPart) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for _, part := range parts {
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: part.Number, ETag: part.ETag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	target.RawQuery = url.Values{"uploadId": {uploadID}}.Encode()
+	res, err := s.send(ctx, http.MethodPost, target, nil, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return s.uploadError(err)
+	}
+	defer res.Body.Close()
+
+	// S3 may report a failed completion in the body of a 200 response.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("failed to complete multipart upload: %s: %s", result.Code, result.Message)
+	}
+
+	return nil
+}
+
+// abortMultipart discards an unfinished multipart upload so its parts are
+// not billed, see cleanupContext, as the upload's ctx may be cancelled.
+func (s *S3Backend) abortMultipart(ctx context.Context, target *url.URL, uploadID string) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	target.RawQuery = url.Values{"uploadId": {uploadID}}.Encode()
+	if res, err := s.send(ctx, http.MethodDelete, target, nil, nil, 0, emptySHA256); err != nil {
+		fmt.Printf("Warning: failed to abort multipart upload to %s: %v\n", s, err)
+	} else {
+		res.Body.Close()
+	}
+}
+
+// uploadError marks errors about an unknown upload ID so the upload is
+// restarted instead of retried with the same ID.
+func (s *S3Backend) uploadError(err error) error {
+	if strings.Contains(err.Error(), "NoSuchUpload") {
+		return &s3UploadGone{err}
+	}
+	return err
+}
+
+// VerifyChecksum compares the ETag of the object stored under key with the
+// MD5 of the file at localPath. Objects uploaded in parts have the MD5 of the
+// part MD5s followed by the part count as ETag. SSE-KMS objects have no MD5
+// based ETag and are not verified.
+func (s *S3Backend) VerifyChecksum(ctx context.Context, localPath, key string) error {
+	if s.cfg.SSE == "aws:kms" {
+		return errNoChecksum
+	}
+
+	target, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	res, err := s.send(ctx, http.MethodHead, target, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	etag := strings.Trim(res.Header.Get("ETag"), `"`)
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var local string
+	if strings.Contains(etag, "-") {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		digests := md5.New()
+		count := 0
+		for offset := int64(0); offset < info.Size(); offset += s.cfg.PartSize {
+			part := md5.New()
+			if _, err := io.Copy(part, io.NewSectionReader(file, offset, min(s.cfg.PartSize, info.Size()-offset))); err != nil {
+				return fmt.Errorf("failed to checksum %q: %w", localPath, err)
+			}
+			digests.Write(part.Sum(nil))
+			count++
+		}
+		local = fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), count)
+	} else {
+		digest := md5.New()
+		if _, err := io.Copy(digest, file); err != nil {
+			return fmt.Errorf("failed to checksum %q: %w", localPath, err)
+		}
+		local = hex.EncodeToString(digest.Sum(nil))
+	}
+
+	if etag != local {
+		return checksumMismatch("ETag", etag, local)
+	}
+	return nil
+}
+
+// Get writes the object stored under key to w.
+func (s *S3Backend) Get(ctx context.Context, key string, w io.Writer) error {
+	target, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.send(ctx, http.MethodGet, target, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, s, err)
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// List returns the objects whose key starts with prefix.
+func (s *S3Backend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	var objects []StoredObject
+	token := ""
+	for {
+		target, err := s.objectURL("")
+		if err != nil {
+			return nil, err
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {strings.TrimPrefix(s.cfg.Prefix+prefix, "/")}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		// AWS expects %20 rather than + for spaces in the query.
+		target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+		res, err := s.send(ctx, http.MethodGet, target, nil, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", s, err)
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing from %s: %w", s, err)
+		}
+
+		for _, object := range page.Contents {
+			objects = append(objects, StoredObject{
+				Key:     strings.TrimPrefix(object.Key, strings.TrimPrefix(s.cfg.Prefix, "/")),
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !page.IsTruncated {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Delete removes the object stored under key.
+func (s *S3Backend) Delete(ctx context.Context, key string) error {
+	target, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.send(ctx, http.MethodDelete, target, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, s, err)
+	}
+	res.Body.Close()
+
+	return nil
+}
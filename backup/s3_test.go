@@ -0,0 +1,356 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3 bucket served over HTTP, path style, that checks every
+// request is signed the way AWS checks it.
+type fakeS3 struct {
+	t       *testing.T
+	bucket  string
+	creds   awsCredentials
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	uploads map[string]map[int][]byte
+	nextID  int
+	aborted int
+	delay   time.Duration // Taken by every request before it is answered
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+	f := &fakeS3{
+		t:       t,
+		bucket:  "bucket",
+		creds:   awsCredentials{AccessKey: "AKID", SecretKey: "secret"},
+		objects: map[string][]byte{},
+		etags:   map[string]string{},
+		uploads: map[string]map[int][]byte{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// backend returns a backend for the bucket at srv with cfg's part size and
+// prefix.
+func (f *fakeS3) backend(srv *httptest.Server, cfg S3Config) *S3Backend {
+	cfg.Endpoint, cfg.Bucket, cfg.PathStyle = srv.URL, f.bucket, true
+	cfg.AccessKey, cfg.SecretKey = f.creds.AccessKey, f.creds.SecretKey
+	return NewS3Backend(cfg)
+}
+
+// checkSignature signs a copy of the request as received and compares the
+// signatures, the canonical path being the path as sent.
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	rawPath, _, _ := strings.Cut(r.RequestURI, "?")
+	if canonical := awsEscapePath(r.URL.Path); rawPath != canonical {
+		return fmt.Errorf("path sent as %s, signed as %s", rawPath, canonical)
+	}
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != sha256Hex(body) {
+		return fmt.Errorf("payload hash %s does not match the body", got)
+	}
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.RequestURI, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range r.Header {
+		if name != "Authorization" {
+			req.Header[name] = values
+		}
+	}
+	signV4(req, f.creds, "us-east-1", "s3", sha256Hex(body), date)
+	if got, want := r.Header.Get("Authorization"), req.Header.Get("Authorization"); got != want {
+		return fmt.Errorf("authorization %s, want %s", got, want)
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.delay)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := f.checkSignature(r, body); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.RequestURI, err)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		type content struct {
+			Key  string
+			Size int64
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for _, name := range slices.Sorted(maps.Keys(f.objects)) {
+			if strings.HasPrefix(name, query.Get("prefix")) {
+				result.Contents = append(result.Contents, content{name, int64(len(f.objects[name]))})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case uploadID != "" && f.uploads[uploadID] == nil:
+		http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+	case r.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[uploadID][number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && uploadID != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		digests := md5.New()
+		for i, part := range complete.Parts {
+			data, ok := f.uploads[uploadID][part.PartNumber]
+			sum := md5.Sum(data)
+			if !ok || part.PartNumber != i+1 || part.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+				http.Error(w, "<Error><Code>InvalidPart</Code></Error>", http.StatusBadRequest)
+				return
+			}
+			object = append(object, data...)
+			digests.Write(sum[:])
+		}
+		delete(f.uploads, uploadID)
+		f.objects[key] = object
+		f.etags[key] = fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), len(complete.Parts))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		sum := md5.Sum(body)
+		f.objects[key], f.etags[key] = body, hex.EncodeToString(sum[:])
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+f.etags[key]+`"`)
+		w.Write(object)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// randomFile writes size random bytes to a new file and returns its path and
+// content.
+func randomFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	content := make([]byte, size)
+	rand.Read(content)
+	path := filepath.Join(t.TempDir(), "archive.zip")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, content
+}
+
+func TestS3Backend(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := f.backend(srv, S3Config{Prefix: "backups/"})
+	ctx := context.Background()
+	path, content := randomFile(t, 1000)
+
+	for _, key := range []string{"dir.zip", "2026/a b+c=d,e(1).zip"} {
+		if err := s.Put(ctx, path, key); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(f.objects["backups/"+key], content) {
+			t.Errorf("%q was stored as %q", key, slices.Sorted(maps.Keys(f.objects)))
+		}
+		if err := s.VerifyChecksum(ctx, path, key); err != nil {
+			t.Errorf("%q: %v", key, err)
+		}
+		var got bytes.Buffer
+		if err := s.Get(ctx, key, &got); err != nil || !bytes.Equal(got.Bytes(), content) {
+			t.Errorf("%q: downloading returned %d bytes, %v", key, got.Len(), err)
+		}
+	}
+
+	objects, err := s.List(ctx, "2026/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "2026/a b+c=d,e(1).zip" || objects[0].Size != 1000 {
+		t.Errorf("listing returned %+v", objects)
+	}
+
+	f.objects["backups/dir.zip"][0] ^= 1
+	sum := md5.Sum(f.objects["backups/dir.zip"])
+	f.etags["backups/dir.zip"] = hex.EncodeToString(sum[:])
+	if err := s.VerifyChecksum(ctx, path, "dir.zip"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("verifying a changed object returned %v, want ErrChecksumMismatch", err)
+	}
+
+	if err := s.Delete(ctx, "dir.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Get(ctx, "dir.zip", io.Discard); err == nil {
+		t.Error("downloading a deleted object succeeded")
+	}
+}
+
+func TestS3BackendMultipart(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := f.backend(srv, S3Config{PartSize: s3MinPartSize})
+	ctx := context.Background()
+	path, content := randomFile(t, 2*s3MinPartSize+1000)
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+
+	if err := s.PutResumable(ctx, path, "dir.zip", statePath); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["dir.zip"], content) {
+		t.Error("the parts were assembled into different content")
+	}
+	if !strings.HasSuffix(f.etags["dir.zip"], "-3") {
+		t.Errorf("ETag %q is not the one of a three part upload", f.etags["dir.zip"])
+	}
+	if err := s.VerifyChecksum(ctx, path, "dir.zip"); err != nil {
+		t.Errorf("verifying the multipart upload failed: %v", err)
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the upload state was kept: %v", err)
+	}
+
+	if err := s.PutStream(ctx, "stream.zip", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["stream.zip"], content) {
+		t.Error("the streamed parts were assembled into different content")
+	}
+	if err := s.VerifyChecksum(ctx, path, "stream.zip"); err != nil {
+		t.Errorf("verifying the streamed upload failed: %v", err)
+	}
+}
+
+func TestS3BackendResumesMultipart(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := f.backend(srv, S3Config{PartSize: s3MinPartSize})
+	ctx := context.Background()
+	path, content := randomFile(t, 2*s3MinPartSize+1000)
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+
+	// The first part was sent before the upload was interrupted.
+	target, err := s.objectURL("dir.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.createMultipart(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag, err := s.putPart(ctx, target, id, 1, bytes.NewReader(content[:s3MinPartSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loadUploadState(statePath, "dir.zip", info)
+	state.UploadID, state.Parts = id, []uploadPart{{Number: 1, ETag: etag}}
+	if err := saveState(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PutResumable(ctx, path, "dir.zip", statePath); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["dir.zip"], content) {
+		t.Error("the resumed upload was assembled into different content")
+	}
+
+	// An upload the server no longer knows starts over.
+	state.UploadID = "gone"
+	if err := saveState(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+	delete(f.objects, "dir.zip")
+	if err := s.PutResumable(ctx, path, "dir.zip", statePath); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.objects["dir.zip"], content) {
+		t.Error("the restarted upload was assembled into different content")
+	}
+}
+
+func TestS3BackendAbortsFailedStream(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := f.backend(srv, S3Config{PartSize: s3MinPartSize})
+	failing := io.MultiReader(bytes.NewReader(make([]byte, s3MinPartSize+10)), errorReader{errors.New("archive failed")})
+
+	if err := s.PutStream(context.Background(), "dir.zip", failing); err == nil {
+		t.Fatal("a failed stream was uploaded")
+	}
+	if f.aborted != 1 || len(f.uploads) != 0 {
+		t.Errorf("%d uploads aborted, %d left, want the failed one aborted", f.aborted, len(f.uploads))
+	}
+	if _, ok := f.objects["dir.zip"]; ok {
+		t.Error("the failed stream was stored")
+	}
+}
+
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,20 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+)
+
+// removeFile deletes path, or the directory tree of a mirror. In safe mode
+// nothing is deleted, the deletion is only logged.
+func (b *backup) removeFile(path string) error {
+	if b.SafeMode {
+		fmt.Printf("Safe mode: would delete %q\n", path)
+		return nil
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return os.RemoveAll(path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeHistory writes an archive with a sidecar for every creation time to
+// dir and returns the entry named name holding them, oldest first.
+func writeHistory(t *testing.T, dir, name string, created ...time.Time) *DirectoryEntry {
+	t.Helper()
+	entry := &DirectoryEntry{Name: name}
+	for _, at := range created {
+		path := filepath.Join(dir, name+"-full-"+at.In(jkt).Format("20060102T150405")+".zip")
+		writeTree(t, dir, map[string]string{
+			filepath.Base(path):              "archive of " + name,
+			filepath.Base(SidecarPath(path)): "{}",
+		})
+		entry.Kind = KindFull
+		entry.RecordArchive(path, nil, at)
+	}
+	return entry
+}
+
+func TestSafeModeDeletesNothing(t *testing.T) {
+	out := t.TempDir()
+	now := time.Now()
+	entry := writeHistory(t, out, "app", now.AddDate(0, 0, -30), now.AddDate(0, 0, -20), now.AddDate(0, 0, -10), now)
+	b := New(t.TempDir(), out, -1, WithMaxArchivesPerSource(1), WithRetention(RetentionPolicy{MaxAge: 24 * time.Hour}), WithMaxStoreSize(1))
+	if !b.SafeMode {
+		t.Fatal("safe mode is off by default")
+	}
+
+	if pruned := b.EnforceArchiveCap(entry); len(pruned) != 0 {
+		t.Errorf("EnforceArchiveCap pruned %d archives in safe mode", len(pruned))
+	}
+	if pruned := b.ApplyRetention(entry); len(pruned) != 0 {
+		t.Errorf("ApplyRetention pruned %d archives in safe mode", len(pruned))
+	}
+	b.EnforceStoreCap([]*DirectoryEntry{entry}, nil)
+
+	if len(entry.History) != 4 {
+		t.Errorf("history holds %d archives, want all 4", len(entry.History))
+	}
+	for _, r := range entry.History {
+		for _, path := range []string{r.Path, SidecarPath(r.Path)} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s was deleted in safe mode: %v", filepath.Base(path), err)
+			}
+		}
+	}
+	if pruned := b.Report().Pruned; len(pruned) != 0 {
+		t.Errorf("report lists %d pruned archives in safe mode", len(pruned))
+	}
+}
+
+func TestSafeModeNeverReplacesArchives(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"file.txt": "first"})
+	out := t.TempDir()
+	b := New(src, out, -1, WithMetadataSidecar(true))
+	if !b.LabelArchives {
+		t.Error("safe mode leaves archives unlabelled")
+	}
+	archive := filepath.Join(out, "dir.zip")
+	if _, err := b.ZipDirectoryGrouped(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTree(t, src, map[string]string{"file.txt": "second"})
+	if _, err := b.ZipDirectoryGrouped(src, archive); err == nil {
+		t.Error("safe mode replaced an archive")
+	}
+	target := t.TempDir()
+	if _, err := b.RestoreArchive(archive, target); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "file.txt")); err != nil || string(data) != "first" {
+		t.Errorf("the first archive holds %q, %v, want \"first\"", data, err)
+	}
+
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 {
+		t.Errorf("output holds %q, want only the archive and its sidecar", names)
+	}
+
+	b.SafeMode = false
+	if _, err := b.ZipDirectoryGrouped(src, archive); err != nil {
+		t.Errorf("replacing an archive without safe mode failed: %v", err)
+	}
+}
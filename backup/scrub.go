@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"time"
+)
+
+// CorruptArchive is a copy of an archive file whose content no longer
+// matches the SHA-256 recorded when it was written, see RecordChecksums.
+type CorruptArchive struct {
+	Source   string `json:"source"`
+	Archive  string `json:"archive"`
+	Location string `json:"location"` // "local" or the storage backend
+	Error    string `json:"error"`
+}
+
+// Scrub reads back every copy of every archive in the history of manifest,
+// in the output directory and on every backend, and compares it with the
+// SHA-256 in its record to find bit rot and truncation. Copies that are gone
+// are left to VerifyCopies, archives written before checksums were recorded
+// are skipped. A damaged local copy with parity data is repaired, see
+// ParityRedundancy. Every corrupt copy is logged as an alert, recorded in the
+// report and returned, and recorded in manifest with RecordCorruption, which
+// the caller saves.
+func (b *backup) Scrub(ctx context.Context, manifest []*DirectoryEntry) []CorruptArchive {
+	stored := make(map[StorageBackend]map[string]bool, len(b.Backends))
+	for _, s := range b.Backends {
+		listCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.List)
+		objects, err := s.List(listCtx, "")
+		cancel()
+		if err != nil {
+			fmt.Printf("Warning: cannot scrub the archives on %s: %v\n", destinationName(s), err)
+			continue
+		}
+		keys := make(map[string]bool, len(objects))
+		for _, object := range objects {
+			keys[object.Key] = true
+		}
+		stored[s] = keys
+	}
+
+	var corrupt []CorruptArchive
+	checked, unchecked, repaired := 0, 0, 0
+	now := time.Now()
+	report := func(entry *DirectoryEntry, record *ArchiveRecord, path, location string, err error) {
+		if err == nil {
+			checked++
+			return
+		}
+		fmt.Printf("ALERT: archive %q on %s is corrupt: %v\n", path, location, err)
+		corrupt = append(corrupt, CorruptArchive{Source: entry.Name, Archive: path, Location: location, Error: err.Error()})
+		entry.RecordCorruption(record, path, location, err, b.report.RunID, now)
+	}
+	for _, entry := range manifest {
+		for i := range entry.History {
+			record := &entry.History[i]
+			if len(record.SHA256) == 0 {
+				unchecked++
+				continue
+			}
+			for _, path := range slices.Sorted(maps.Keys(record.SHA256)) {
+				want := record.SHA256[path]
+				sum, err := fileHash(path, sha256.New())
+				if !errors.Is(err, fs.ErrNotExist) {
+					err = sumError(sum, want, err)
+					if err != nil && b.repairCopy(path, want) {
+						err = nil
+						repaired++
+					}
+					report(entry, record, path, "local", err)
+				}
+
+				for _, s := range b.Backends {
+					if keys, ok := stored[s]; !ok || !keys[b.remoteKey(path)] {
+						continue
+					}
+					sum, err := b.remoteHash(ctx, s, path)
+					if err != nil {
+						// Likely the connection rather than the copy.
+						fmt.Printf("Warning: cannot scrub %q on %s: %v\n", path, destinationName(s), err)
+						continue
+					}
+					report(entry, record, path, destinationName(s), sumError(sum, want, nil))
+				}
+			}
+		}
+	}
+
+	if unchecked > 0 {
+		fmt.Printf("Warning: %d archive(s) have no recorded checksum and were not scrubbed\n", unchecked)
+	}
+	fmt.Printf("Scrubbed %d archive copies, %d corrupt, %d repaired\n", checked+len(corrupt), len(corrupt), repaired)
+	b.report.mu.Lock()
+	b.report.Scrubbed = checked + len(corrupt)
+	b.report.Repaired = repaired
+	b.report.Corrupt = corrupt
+	b.report.mu.Unlock()
+
+	return corrupt
+}
+
+// repairCopy rebuilds the damaged blocks of the local copy of path from its
+// parity data, see RepairArchive, and reports whether it has the SHA-256
+// want afterwards.
+func (b *backup) repairCopy(path, want string) bool {
+	n, err := b.RepairArchive(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		fmt.Printf("Warning: cannot repair %q: %v\n", path, err)
+		return false
+	}
+	sum, err := fileHash(path, sha256.New())
+	if err := sumError(sum, want, err); err != nil {
+		fmt.Printf("Warning: %q is still corrupt after rebuilding %d block(s) from its parity data: %v\n", path, n, err)
+		return false
+	}
+	fmt.Printf("Repaired %d damaged block(s) of %q from its parity data\n", n, path)
+	return true
+}
+
+// remoteHash returns the SHA-256 of the copy of the file at path on s.
+func (b *backup) remoteHash(ctx context.Context, s StorageBackend, path string) ([]byte, error) {
+	digest := sha256.New()
+	getCtx, w, cancel := downloadContext(ctx, b.RemoteTimeouts.Download, digest)
+	defer cancel()
+	if err := s.Get(getCtx, b.remoteKey(path), w); err != nil {
+		return nil, downloadError(getCtx, err)
+	}
+	return digest.Sum(nil), nil
+}
+
+// sumError describes how sum, read with err, differs from the hex digest
+// want, nil when it matches.
+func sumError(sum []byte, want string, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case hex.EncodeToString(sum) != want:
+		return fmt.Errorf("%w: SHA-256 is %x, %s when written", ErrChecksumMismatch, sum, want)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScrubReportsCorruptCopies(t *testing.T) {
+	out := t.TempDir()
+	remote := &shallowBackend{objects: map[string][]byte{}}
+	b := New(t.TempDir(), out, -1, WithBackends(remote))
+	now := time.Now()
+	entry := writeHistory(t, out, "app", now.AddDate(0, 0, -2), now.AddDate(0, 0, -1))
+	for i := range entry.History {
+		record := &entry.History[i]
+		if err := b.RecordChecksums(record); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(record.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote.objects[b.remoteKey(record.Path)] = data
+	}
+	older, latest := entry.History[0].Path, entry.History[1].Path
+	// The local copy of the older archive rots, the remote copy of the
+	// latest one is truncated.
+	flipByte(t, older, 3)
+	remote.objects[b.remoteKey(latest)] = remote.objects[b.remoteKey(latest)][:5]
+
+	corrupt := b.Scrub(context.Background(), []*DirectoryEntry{entry})
+	want := map[string]string{older: "local", latest: destinationName(remote)}
+	if len(corrupt) != len(want) {
+		t.Fatalf("Scrub found %+v, want the two damaged copies", corrupt)
+	}
+	for _, c := range corrupt {
+		if c.Source != "app" || want[c.Archive] != c.Location {
+			t.Errorf("Scrub reported %+v, want %v", c, want)
+		}
+	}
+	for i, record := range entry.History {
+		if len(record.Corruption) != 1 || record.Corruption[0].Location != want[record.Path] {
+			t.Errorf("record %d holds corruption %+v, want one event on %s", i, record.Corruption, want[record.Path])
+		}
+	}
+	if !entry.IsNeedBackup {
+		t.Error("a directory with corrupt archives is not marked for backup")
+	}
+	if report := b.Report(); report.Scrubbed != 4 || len(report.Corrupt) != 2 {
+		t.Errorf("report lists %d scrubbed and %d corrupt copies, want 4 and 2", report.Scrubbed, len(report.Corrupt))
+	}
+}
+
+func TestScrubRepairsLocalCopyFromParity(t *testing.T) {
+	out := t.TempDir()
+	b := New(t.TempDir(), out, -1, WithParityRedundancy(10))
+	entry := writeHistory(t, out, "app", time.Now())
+	record := &entry.History[0]
+	content := make([]byte, 64<<10)
+	rand.Read(content)
+	if err := os.WriteFile(record.Path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.writeParity(record.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RecordChecksums(record); err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, record.Path, 1000)
+
+	if corrupt := b.Scrub(context.Background(), []*DirectoryEntry{entry}); len(corrupt) != 0 {
+		t.Errorf("Scrub reported %+v for a copy its parity data repairs", corrupt)
+	}
+	if report := b.Report(); report.Repaired != 1 {
+		t.Errorf("report lists %d repaired copies, want 1", report.Repaired)
+	}
+	sum, err := fileHash(record.Path, sha256.New())
+	if err != nil || hex.EncodeToString(sum) != record.SHA256[record.Path] {
+		t.Errorf("the repaired copy has SHA-256 %x, %v, want %s", sum, err, record.SHA256[record.Path])
+	}
+	if entry.IsNeedBackup || len(record.Corruption) != 0 {
+		t.Errorf("a repaired copy was recorded as corrupt: %+v", record.Corruption)
+	}
+}
@@ -0,0 +1,32 @@
+package backup
+
+// CompressionSettings records how an archive was produced, so archives made
+// with older settings can be found after the configuration changes.
+type CompressionSettings struct {
+	Format    string `json:"format"`
+	Level     int    `json:"level"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// CompressionSettings returns the settings new archives of entry are written
+// with.
+func (b *backup) CompressionSettings(entry *DirectoryEntry) *CompressionSettings {
+	format := b.FormatFor(entry)
+	return &CompressionSettings{
+		Format: format,
+		Level:  b.archiveLevel(format),
+		// A zip password is refused for other formats, mirrors are never
+		// encrypted.
+		Encrypted: format == FormatZip && b.ZipPassword != "" || format != FormatMirror && b.EncryptionFor(entry) != nil,
+	}
+}
+
+// NeedsRecompression reports whether the latest archive of entry was written
+// with settings different from the current ones.
+func (b *backup) NeedsRecompression(entry *DirectoryEntry) bool {
+	if entry.ZipPath == "" || entry.Compression == nil {
+		return false
+	}
+
+	return *entry.Compression != *b.CompressionSettings(entry)
+}
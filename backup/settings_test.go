@@ -0,0 +1,37 @@
+package backup
+
+import "testing"
+
+func TestNeedsRecompressionAfterLevelChange(t *testing.T) {
+	rules := WithFormatRules([]FormatRule{{Pattern: "logs", Format: FormatTarXz}})
+	before := New(t.TempDir(), t.TempDir(), 6, rules)
+	app := &DirectoryEntry{Name: "app", ZipPath: "/backups/app.zip"}
+	logs := &DirectoryEntry{Name: "logs", ZipPath: "/backups/logs.tar.xz"}
+	for _, entry := range []*DirectoryEntry{app, logs} {
+		entry.Compression = before.CompressionSettings(entry)
+	}
+	if want := (CompressionSettings{Format: FormatZip, Level: 6}); *app.Compression != want {
+		t.Errorf("recorded %+v for app, want %+v", *app.Compression, want)
+	}
+
+	if before.NeedsRecompression(app) || before.NeedsRecompression(logs) {
+		t.Error("archives written with the current settings need recompression")
+	}
+
+	// The zip level changed, the tar.xz archive uses its own level.
+	after := New(t.TempDir(), t.TempDir(), 9, rules)
+	if !after.NeedsRecompression(app) {
+		t.Error("app, written with level 6, doesn't need recompression at level 9")
+	}
+	if after.NeedsRecompression(logs) {
+		t.Error("logs needs recompression although its xz level did not change")
+	}
+
+	encrypted := New(t.TempDir(), t.TempDir(), 6, rules, WithZipPassword("secret"))
+	if !encrypted.NeedsRecompression(app) {
+		t.Error("app, written without a password, doesn't need recompression once one is set")
+	}
+	if after.NeedsRecompression(&DirectoryEntry{Name: "new"}) {
+		t.Error("a directory without an archive needs recompression")
+	}
+}
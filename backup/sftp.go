@@ -0,0 +1,210 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterBackend("sftp", func(config func(string) string) (StorageBackend, error) {
+		host := config("SFTP_HOST")
+		if host == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		port, _ := strconv.Atoi(config("SFTP_PORT"))
+		return NewSFTPBackend(SFTPConfig{
+			Host:           host,
+			Port:           port,
+			User:           config("SFTP_USER"),
+			KeyFile:        config("SFTP_KEY_FILE"),
+			KnownHostsFile: config("SFTP_KNOWN_HOSTS_FILE"),
+			RemoteDir:      config("SFTP_REMOTE_DIR"),
+		}), nil
+	})
+}
+
+// SFTPConfig configures a host reached over SFTP. Transfers run the OpenSSH
+// sftp client, which must be installed in the image.
+type SFTPConfig struct {
+	Host           string
+	Port           int
+	User           string
+	KeyFile        string // Private key used to log in
+	KnownHostsFile string // Verifies the host key, ~/.ssh/known_hosts when empty
+	RemoteDir      string // Directory the archives are uploaded to
+}
+
+// SFTPBackend stores files on a host over SFTP.
+type SFTPBackend struct {
+	cfg SFTPConfig
+}
+
+// NewSFTPBackend creates a backend for the host described by cfg.
+func NewSFTPBackend(cfg SFTPConfig) *SFTPBackend {
+	if cfg.Port == 0 {
+		cfg.Port = 22
+	}
+
+	return &SFTPBackend{cfg: cfg}
+}
+
+// String names the destination in logs.
+func (s *SFTPBackend) String() string {
+	return "sftp://" + s.target() + "/" + strings.TrimPrefix(s.cfg.RemoteDir, "/")
+}
+
+// target returns the [user@]host argument of ssh.
+func (s *SFTPBackend) target() string {
+	if s.cfg.User != "" {
+		return s.cfg.User + "@" + s.cfg.Host
+	}
+	return s.cfg.Host
+}
+
+// args returns the sftp command line, reading commands from stdin. Transfers
+// are limited to the upload rate of ctx.
+func (s *SFTPBackend) args(ctx context.Context) []string {
+	args := []string{"-b", "-", "-P", strconv.Itoa(s.cfg.Port), "-o", "BatchMode=yes"}
+	if rate := uploadLimit(ctx); rate > 0 {
+		// sftp takes the limit in Kbit/s.
+		args = append(args, "-l", strconv.FormatInt(max(rate*8/1000, 1), 10))
+	}
+	if s.cfg.KeyFile != "" {
+		args = append(args, "-i", s.cfg.KeyFile)
+	}
+	if s.cfg.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.cfg.KnownHostsFile)
+	}
+	// An unknown or changed host key fails the transfer.
+	args = append(args, "-o", "StrictHostKeyChecking=yes")
+
+	return append(args, s.target())
+}
+
+// sftpQuote quotes an argument of an sftp batch command.
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// run executes batch commands and returns the output of the session.
+func (s *SFTPBackend) run(ctx context.Context, batch string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sftp", s.args(ctx)...)
+	cmd.Stdin = strings.NewReader(batch)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return out, nil
+}
+
+// Put copies the file at localPath to key below the remote directory,
+// creating missing directories first.
+func (s *SFTPBackend) Put(ctx context.Context, localPath, key string) error {
+	remotePath := path.Join(s.cfg.RemoteDir, key)
+
+	var dirs []string
+	for dir := path.Dir(remotePath); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	// A leading "-" lets mkdir fail for directories that already exist.
+	var batch strings.Builder
+	for _, dir := range dirs {
+		fmt.Fprintf(&batch, "-mkdir %s\n", sftpQuote(dir))
+	}
+	fmt.Fprintf(&batch, "put %s %s\n", sftpQuote(localPath), sftpQuote(remotePath))
+
+	if _, err := s.run(ctx, batch.String()); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, s, err)
+	}
+
+	return nil
+}
+
+// Get writes the file stored under key to w, downloading it to a temporary
+// file first.
+func (s *SFTPBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	tmp, err := os.CreateTemp("", "sftp-get-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	batch := fmt.Sprintf("get %s %s\n", sftpQuote(path.Join(s.cfg.RemoteDir, key)), sftpQuote(tmp.Name()))
+	if _, err := s.run(ctx, batch); err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, s, err)
+	}
+
+	_, err = io.Copy(w, tmp)
+	return err
+}
+
+// List returns the files whose key starts with prefix. Only the directory
+// holding the prefix is listed, not its subdirectories.
+func (s *SFTPBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	// The "x" stops a prefix ending in "/" from naming its parent.
+	dir := path.Dir(path.Join(s.cfg.RemoteDir, prefix+"x"))
+	out, err := s.run(ctx, fmt.Sprintf("ls -ln %s\n", sftpQuote(dir)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", s, err)
+	}
+
+	var objects []StoredObject
+	for _, line := range strings.Split(string(out), "\n") {
+		// -rw-r--r--  1 1000  1000  518 Oct 16 00:16 /dir/name
+		fields := strings.Fields(line)
+		if len(fields) < 9 || !strings.HasPrefix(fields[0], "-") {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		name := path.Base(strings.Join(fields[8:], " "))
+		key := strings.TrimPrefix(path.Join(dir, name), strings.TrimSuffix(s.cfg.RemoteDir, "/")+"/")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		objects = append(objects, StoredObject{Key: key, Size: size, ModTime: parseListTime(fields[5], fields[6], fields[7])})
+	}
+
+	return objects, nil
+}
+
+// Delete removes the file stored under key.
+func (s *SFTPBackend) Delete(ctx context.Context, key string) error {
+	if _, err := s.run(ctx, fmt.Sprintf("rm %s\n", sftpQuote(path.Join(s.cfg.RemoteDir, key)))); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, s, err)
+	}
+	return nil
+}
+
+// parseListTime parses the date columns of an ls -l listing, which show the
+// time of day for recent files and the year for older ones.
+func parseListTime(month, day, timeOrYear string) time.Time {
+	if t, err := time.Parse("Jan 2 2006", month+" "+day+" "+timeOrYear); err == nil {
+		return t
+	}
+
+	t, err := time.Parse("Jan 2 15:04", month+" "+day+" "+timeOrYear)
+	if err != nil {
+		return time.Time{}
+	}
+	now := time.Now().UTC()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.AddDate(0, 0, 1)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
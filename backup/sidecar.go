@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FileMetadata is the state of a single file or directory captured at the
+// moment it was written to an archive.
+type FileMetadata struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mod_time"`
+	Mode    string `json:"mode"`
+	UID     *int   `json:"uid,omitempty"`
+	GID     *int   `json:"gid,omitempty"`
+	SHA256  string `json:"sha256,omitempty"` // Only for regular files
+}
+
+// SidecarPath returns where the metadata sidecar of archivePath is stored.
+func SidecarPath(archivePath string) string {
+	return archivePath + ".meta.json"
+}
+
+func newFileMetadata(rel string, info fs.FileInfo) FileMetadata {
+	meta := FileMetadata{
+		Path:    rel,
+		Size:    info.Size(),
+		ModTime: info.ModTime().In(jkt).Format(time.RFC3339Nano),
+		Mode:    info.Mode().String(),
+	}
+	if info.IsDir() {
+		meta.Size = 0
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		meta.UID, meta.GID = &uid, &gid
+	}
+
+	return meta
+}
+
+// writeSidecar stores the metadata of every archived file next to the archive
+// at archivePath.
+func (b *backup) writeSidecar(archivePath string, files []FileMetadata) error {
+	data, _ := json.MarshalIndent(files, "", "\t")
+
+	path := SidecarPath(archivePath)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("failed to write metadata sidecar %q: %w", path, err)
+	}
+
+	return os.Rename(path+".tmp", path)
+}
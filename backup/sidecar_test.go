@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataSidecarMatchesArchivedFiles(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"a.txt":     "first file",
+		"sub/b.txt": "second",
+	})
+	modTime := time.Date(2026, 10, 1, 8, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "sub/b.txt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "src.zip")
+	if err := New(src, t.TempDir(), -1, WithMetadataSidecar(true)).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(SidecarPath(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []FileMetadata
+	if err := json.Unmarshal(data, &files); err != nil {
+		t.Fatal(err)
+	}
+
+	byPath := make(map[string]FileMetadata)
+	for _, meta := range files {
+		byPath[meta.Path] = meta
+	}
+	if len(byPath) != 3 {
+		t.Errorf("sidecar lists %d entries, want a.txt, sub and sub/b.txt", len(byPath))
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(content)
+
+		meta := byPath[name]
+		if meta.Size != info.Size() || meta.Mode != info.Mode().String() || meta.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s is recorded as %+v, want size %d, mode %s and its checksum", name, meta, info.Size(), info.Mode())
+		}
+		if recorded, err := time.Parse(time.RFC3339Nano, meta.ModTime); err != nil || !recorded.Equal(info.ModTime()) {
+			t.Errorf("%s is recorded modified at %q, want %s", name, meta.ModTime, info.ModTime())
+		}
+		if uid, gid, ok := fileOwner(info); ok && (meta.UID == nil || *meta.UID != uid || meta.GID == nil || *meta.GID != gid) {
+			t.Errorf("%s is recorded owned by %v:%v, want %d:%d", name, meta.UID, meta.GID, uid, gid)
+		}
+	}
+	if dir := byPath["sub"]; dir.Size != 0 || dir.SHA256 != "" {
+		t.Errorf("directory sub is recorded as %+v, want no size or checksum", dir)
+	}
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrManifestSignature is returned when the manifest is not signed with
+// ManifestSigningKey, or was changed after it was.
+var ErrManifestSignature = errors.New("manifest signature is missing or invalid")
+
+// SignaturePath returns where the signature of the manifest at path is
+// stored, see ManifestSigningKey.
+func SignaturePath(path string) string {
+	return path + ".sig"
+}
+
+// pendingSignaturePath returns where SaveManifest writes the signature of
+// the manifest at path before the manifest is replaced, see verifyManifest.
+func pendingSignaturePath(path string) string {
+	return SignaturePath(path) + ".tmp"
+}
+
+// signManifest writes the HMAC-SHA256 of the manifest file at path to the
+// file signature, hex encoded.
+func (b *backup) signManifest(path, signature string) error {
+	sum, err := fileHash(path, hmac.New(sha256.New, b.ManifestSigningKey))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(signature, []byte(hex.EncodeToString(sum)+"\n"), 0o644)
+}
+
+// verifyManifest checks the manifest file at path against its signature
+// when ManifestSigningKey is set. The error wraps ErrManifestSignature when
+// the signature is missing or does not match. A save stopped between
+// replacing the manifest and its signature leaves the signature of the new
+// manifest pending, the manifest is accepted with it and the signature put
+// in place.
+func (b *backup) verifyManifest(path string) error {
+	if len(b.ManifestSigningKey) == 0 {
+		return nil
+	}
+
+	err := b.checkSignature(path, SignaturePath(path))
+	if !errors.Is(err, ErrManifestSignature) || b.checkSignature(path, pendingSignaturePath(path)) != nil {
+		return err
+	}
+	if err := os.Rename(pendingSignaturePath(path), SignaturePath(path)); err != nil {
+		fmt.Printf("Warning: failed to put the pending manifest signature in place: %v\n", err)
+	}
+	return nil
+}
+
+// checkSignature checks the manifest file at path against the signature
+// file signature, see verifyManifest.
+func (b *backup) checkSignature(path, signature string) error {
+	data, err := os.ReadFile(signature)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %q has no signature", ErrManifestSignature, path)
+	}
+	if err != nil {
+		return err
+	}
+	want, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrManifestSignature, signature, err)
+	}
+	sum, err := fileHash(path, hmac.New(sha256.New, b.ManifestSigningKey))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sum, want) {
+		return fmt.Errorf("%w: %q was changed or signed with another key", ErrManifestSignature, path)
+	}
+	return nil
+}
+
+// UploadManifest sends the manifest, and its signature when it is signed, to
+// every backend, see Upload.
+func (b *backup) UploadManifest(ctx context.Context) map[string]error {
+	if len(b.ManifestSigningKey) == 0 {
+		return b.Upload(ctx, b.ManifestPath())
+	}
+	return b.Upload(ctx, b.ManifestPath(), SignaturePath(b.ManifestPath()))
+}
+
+// fetchSignature downloads the signature of the manifest from s to the
+// signature file of path, when the manifest is signed.
+func (b *backup) fetchSignature(ctx context.Context, s StorageBackend, path string) error {
+	if len(b.ManifestSigningKey) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	getCtx, w, cancel := downloadContext(ctx, b.RemoteTimeouts.Download, &buf)
+	defer cancel()
+	if err := s.Get(getCtx, b.remoteKey(SignaturePath(b.ManifestPath())), w); err != nil {
+		return downloadError(getCtx, err)
+	}
+	return os.WriteFile(SignaturePath(path), buf.Bytes(), 0o644)
+}
@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// flipByte flips the byte at offset in the file at path.
+func flipByte(t *testing.T, path string, offset int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 1
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestSignature(t *testing.T) {
+	manifest := []*DirectoryEntry{{Name: "dir", Type: "directory", ZipPath: "dir.zip"}}
+	for _, tt := range []struct {
+		name   string
+		change func(t *testing.T, path string)
+		valid  bool
+	}{
+		{"unchanged", func(t *testing.T, path string) {}, true},
+		{"changed manifest byte", func(t *testing.T, path string) { flipByte(t, path, 10) }, false},
+		{"changed signature byte", func(t *testing.T, path string) { flipByte(t, SignaturePath(path), 0) }, false},
+		{"truncated signature", func(t *testing.T, path string) {
+			if err := os.Truncate(SignaturePath(path), 10); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"missing signature", func(t *testing.T, path string) {
+			if err := os.Remove(SignaturePath(path)); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	} {
+		b := New(t.TempDir(), t.TempDir(), -1, WithManifestSigningKey([]byte("signing key")))
+		if err := b.SaveManifest(manifest); err != nil {
+			t.Fatal(err)
+		}
+		tt.change(t, b.ManifestPath())
+
+		_, err := b.LoadManifest()
+		if tt.valid && err != nil {
+			t.Errorf("%s: loading the manifest failed: %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrManifestSignature) {
+			t.Errorf("%s: loading the manifest returned %v, want ErrManifestSignature", tt.name, err)
+		}
+	}
+}
+
+func TestManifestSignatureOtherKey(t *testing.T) {
+	out := t.TempDir()
+	signer := New(t.TempDir(), out, -1, WithManifestSigningKey([]byte("signing key")))
+	if err := signer.SaveManifest([]*DirectoryEntry{{Name: "dir", Type: "directory"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := New(t.TempDir(), out, -1, WithManifestSigningKey([]byte("other key")))
+	if _, err := other.LoadManifest(); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("loading with another key returned %v, want ErrManifestSignature", err)
+	}
+	if _, err := New(t.TempDir(), out, -1).LoadManifest(); err != nil {
+		t.Errorf("loading without a key failed: %v", err)
+	}
+}
+
+func TestManifestSignatureAfterInterruptedSave(t *testing.T) {
+	b := New(t.TempDir(), t.TempDir(), -1, WithManifestSigningKey([]byte("signing key")))
+	if err := b.SaveManifest([]*DirectoryEntry{{Name: "old"}}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(SignaturePath(b.ManifestPath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SaveManifest([]*DirectoryEntry{{Name: "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Stopped between renaming the manifest and its signature: the new
+	// manifest is in place, its signature still pending.
+	if err := os.Rename(SignaturePath(b.ManifestPath()), pendingSignaturePath(b.ManifestPath())); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(SignaturePath(b.ManifestPath()), old, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := b.LoadManifest()
+	if err != nil || len(manifest) != 1 || manifest[0].Name != "new" {
+		t.Fatalf("LoadManifest = %v, %v, want the new manifest", manifest, err)
+	}
+	if _, err := os.Stat(pendingSignaturePath(b.ManifestPath())); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the pending signature was not put in place: %v", err)
+	}
+	if err := b.verifyManifest(b.ManifestPath()); err != nil {
+		t.Errorf("the manifest does not verify against its signature: %v", err)
+	}
+
+	// A pending signature of a manifest that never replaced the old one
+	// changes nothing.
+	pending := []byte("0123456789abcdef\n")
+	if err := os.WriteFile(pendingSignaturePath(b.ManifestPath()), pending, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err := b.LoadManifest(); err != nil || manifest[0].Name != "new" {
+		t.Errorf("LoadManifest with a stale pending signature = %v, %v, want the new manifest", manifest, err)
+	}
+	flipByte(t, b.ManifestPath(), 10)
+	if _, err := b.LoadManifest(); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("loading a changed manifest returned %v, want ErrManifestSignature", err)
+	}
+}
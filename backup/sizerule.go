@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SizeRule selects the compression used for files up to MaxSize bytes.
+type SizeRule struct {
+	MaxSize int64  // Inclusive upper bound, 0 means no upper bound
+	Method  uint16 // zip.Store, zip.Deflate or zstdMethod
+	Level   int    // Deflate or zstd level, ignored for zip.Store
+}
+
+// defaultStoreExtensions are formats that are compressed already, deflating
+// them again costs time for next to no gain.
+var defaultStoreExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".avif",
+	".mp3", ".aac", ".ogg", ".flac", ".mp4", ".m4v", ".mkv", ".mov", ".avi", ".webm",
+	".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar",
+	".docx", ".xlsx", ".pptx", ".odt", ".jar", ".apk",
+}
+
+// compressionFor returns the zip method and its level to use for the file
+// name of the given size. Files with an extension in StoreExtensions are
+// stored, others go by the size rules. Without a matching rule the configured
+// CompressionLevel is used, where level 0 means storing the file uncompressed.
+func (b *backup) compressionFor(name string, size int64) (uint16, int) {
+	if b.StoreExtensions[strings.ToLower(path.Ext(name))] {
+		return zip.Store, flate.NoCompression
+	}
+
+	for _, r := range b.SizeRules {
+		if r.MaxSize == 0 || size <= r.MaxSize {
+			return r.Method, r.Level
+		}
+	}
+
+	if b.CompressionLevel == flate.NoCompression {
+		return zip.Store, b.CompressionLevel
+	}
+
+	return zip.Deflate, b.CompressionLevel
+}
+
+// ParseSizeRules parses rules in the form "4KB=store,100MB=deflate:6,*=zstd:19".
+// The size is the largest file the rule applies to and "*" matches any size.
+// zstd entries use zip method 93 and need the zstd binary to write and read,
+// every entry runs it once, so it suits rules for larger files.
+func ParseSizeRules(value string) ([]SizeRule, error) {
+	var rules []SizeRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		size, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid size rule %q", item)
+		}
+
+		var rule SizeRule
+		if size = strings.TrimSpace(size); size != "*" {
+			n, err := ParseSize(size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size rule %q: %w", item, err)
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("invalid size rule %q: size must be greater than zero", item)
+			}
+			rule.MaxSize = n
+		}
+
+		method, level, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		switch strings.ToLower(method) {
+		case "store":
+			rule.Method = zip.Store
+		case "deflate":
+			rule.Method = zip.Deflate
+			rule.Level = 9
+			if level != "" {
+				n, err := strconv.Atoi(level)
+				if err != nil || n < 1 || n > 9 {
+					return nil, fmt.Errorf("invalid deflate level in size rule %q", item)
+				}
+				rule.Level = n
+			}
+		case "zstd":
+			rule.Method = zstdMethod
+			rule.Level = defaultZstdLevel
+			if level != "" {
+				n, err := strconv.Atoi(level)
+				if err != nil || n < 1 || n > 22 {
+					return nil, fmt.Errorf("invalid zstd level in size rule %q", item)
+				}
+				rule.Level = n
+			}
+		default:
+			return nil, fmt.Errorf("invalid compression method in size rule %q", item)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	// Check the smallest bounds first, the catch-all rule goes last.
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].MaxSize == 0 || rules[j].MaxSize == 0 {
+			return rules[j].MaxSize == 0 && rules[i].MaxSize != 0
+		}
+		return rules[i].MaxSize < rules[j].MaxSize
+	})
+
+	return rules, nil
+}
+
+// ParseStoreExtensions parses a list of extensions like ".jpg .mp4 gz" into
+// a set of lower case extensions. "none" disables storing by extension, an
+// empty value keeps the defaults by returning nil.
+func ParseStoreExtensions(value string) map[string]bool {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	exts := make(map[string]bool)
+	if strings.EqualFold(value, "none") {
+		return exts
+	}
+	for _, ext := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[strings.ToLower(ext)] = true
+	}
+
+	return exts
+}
+
+// ParseSize parses a byte size such as "512", "4KB", "1.5GB" or "10MiB".
+// Units are powers of 1024.
+func ParseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
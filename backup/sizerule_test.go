@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSizeRules(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  []SizeRule
+	}{
+		{"", nil},
+		{"4KB=store,*=deflate", []SizeRule{{MaxSize: 4 << 10, Method: zip.Store}, {Method: zip.Deflate, Level: 9}}},
+		{"*=zstd:19, 1MB=deflate:6", []SizeRule{{MaxSize: 1 << 20, Method: zip.Deflate, Level: 6}, {Method: zstdMethod, Level: 19}}},
+		{"100MB=zstd", []SizeRule{{MaxSize: 100 << 20, Method: zstdMethod, Level: defaultZstdLevel}}},
+	} {
+		got, err := ParseSizeRules(tt.value)
+		if err != nil {
+			t.Errorf("ParseSizeRules(%q): %v", tt.value, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseSizeRules(%q) = %v, want %v", tt.value, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseSizeRules(%q) = %v, want %v", tt.value, got, tt.want)
+				break
+			}
+		}
+	}
+
+	for _, value := range []string{"4KB", "0=store", "*=zstd:0", "*=zstd:23", "*=zstd:x", "*=deflate:10", "*=brotli"} {
+		if _, err := ParseSizeRules(value); err == nil {
+			t.Errorf("ParseSizeRules(%q) succeeded", value)
+		}
+	}
+}
+
+func TestCompressionForSizeRules(t *testing.T) {
+	rules, err := ParseSizeRules("4KB=store,1MB=deflate:6,*=zstd:19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(t.TempDir(), t.TempDir(), 5, WithSizeRules(rules))
+	for _, tt := range []struct {
+		name   string
+		size   int64
+		method uint16
+		level  int
+	}{
+		{"small.txt", 100, zip.Store, 0},
+		{"medium.txt", 4<<10 + 1, zip.Deflate, 6},
+		{"large.txt", 2 << 20, zstdMethod, 19},
+		{"photo.jpg", 2 << 20, zip.Store, 0},
+	} {
+		method, level := b.compressionFor(tt.name, tt.size)
+		if method != tt.method || (method != zip.Store && level != tt.level) {
+			t.Errorf("compressionFor(%q, %d) = %d, %d, want %d, %d", tt.name, tt.size, method, level, tt.method, tt.level)
+		}
+	}
+
+	if method, level := New(t.TempDir(), t.TempDir(), 5).compressionFor("file.txt", 1<<20); method != zip.Deflate || level != 5 {
+		t.Errorf("without rules compressionFor = %d, %d, want deflate at the compression level", method, level)
+	}
+}
+
+func TestZstdSizeRuleRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	src := t.TempDir()
+	content := []byte(strings.Repeat("zstd compressed entry ", 10000))
+	if err := os.WriteFile(filepath.Join(src, "large.txt"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseSizeRules("*=zstd:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	archive := filepath.Join(out, "dir.zip")
+	b := New(src, out, -1, WithSizeRules(rules), WithVerifyArchiveContent(true))
+	if err := b.ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != 1 || r.File[0].Method != zstdMethod {
+		t.Fatalf("archive holds %d entries, want large.txt written with zstd", len(r.File))
+	}
+
+	target := t.TempDir()
+	if _, err := b.RestoreArchive(archive, target); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(target, "large.txt")); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("restored large.txt differs: %v", err)
+	}
+}
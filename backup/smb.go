@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterBackend("smb", func(config func(string) string) (StorageBackend, error) {
+		share := config("SMB_SHARE")
+		if share == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		if _, err := exec.LookPath("smbclient"); err != nil {
+			return nil, fmt.Errorf("SMB_SHARE is set but smbclient is not installed, install samba-client: %w", err)
+		}
+		return NewSMBBackend(SMBConfig{
+			Share:     share,
+			User:      config("SMB_USER"),
+			Password:  config("SMB_PASSWORD"),
+			Domain:    config("SMB_DOMAIN"),
+			Kerberos:  config("SMB_KERBEROS") == "true",
+			CCache:    config("SMB_KERBEROS_CCACHE"),
+			RemoteDir: config("SMB_REMOTE_DIR"),
+		}), nil
+	})
+}
+
+// SMBConfig configures an SMB/CIFS share. Transfers run smbclient from the
+// samba-client package, which the Dockerfile installs; outside the image it
+// must be on PATH, or the backend refuses to start. smbclient is used rather
+// than go-smb2, which only authenticates with NTLM, so Kerberos works.
+type SMBConfig struct {
+	Share     string // e.g. //nas.local/backups
+	User      string
+	Password  string
+	Domain    string
+	Kerberos  bool   // Authenticate with the Kerberos ticket cache instead of a password
+	CCache    string // Kerberos ticket cache, such as FILE:/tmp/krb5cc_backup; the default cache when empty
+	RemoteDir string // Directory inside the share the archives are uploaded to
+}
+
+// SMBBackend stores files on an SMB/CIFS share.
+type SMBBackend struct {
+	cfg SMBConfig
+}
+
+// NewSMBBackend creates a backend for the share described by cfg.
+func NewSMBBackend(cfg SMBConfig) *SMBBackend {
+	cfg.RemoteDir = strings.Trim(cfg.RemoteDir, "/")
+	return &SMBBackend{cfg: cfg}
+}
+
+// String names the destination in logs.
+func (s *SMBBackend) String() string {
+	return "smb:" + path.Join(s.cfg.Share, s.cfg.RemoteDir)
+}
+
+// smbQuote quotes an argument of an smbclient command. smbclient has no
+// escapes, it ends a command at any semicolon, quoted or not, and a quote
+// ends the argument, so arguments holding either are refused.
+func smbQuote(arg string) (string, error) {
+	if strings.ContainsAny(arg, "\";\r\n\x00") {
+		return "", fmt.Errorf("%q cannot be passed to smbclient, it holds a quote, semicolon or line break", arg)
+	}
+	return `"` + arg + `"`, nil
+}
+
+// smbPath converts a path inside the share to a quoted smbclient argument,
+// see smbQuote.
+func smbPath(p string) (string, error) {
+	return smbQuote(strings.ReplaceAll(p, "/", `\`))
+}
+
+// run executes smbclient commands, separated by semicolons, and returns
+// their output. stdin feeds "put -" commands and may be nil. The password is
+// passed in the environment so it does not show up in the process list, and
+// not at all with Kerberos, so smbclient cannot fall back to it.
+func (s *SMBBackend) run(ctx context.Context, commands string, stdin io.Reader) ([]byte, error) {
+	args := []string{s.cfg.Share, "-m", "SMB3", "-c", commands}
+	if s.cfg.Kerberos {
+		args = append(args, "--use-kerberos=required")
+		if s.cfg.CCache != "" {
+			args = append(args, "--use-krb5-ccache="+s.cfg.CCache)
+		}
+	} else if s.cfg.User != "" {
+		args = append(args, "-U", s.cfg.User)
+	} else {
+		args = append(args, "-N")
+	}
+	if s.cfg.Domain != "" {
+		args = append(args, "-W", s.cfg.Domain)
+	}
+
+	cmd := exec.CommandContext(ctx, "smbclient", args...)
+	cmd.Env = os.Environ()
+	if !s.cfg.Kerberos {
+		cmd.Env = append(cmd.Env, "PASSWD="+s.cfg.Password)
+	}
+	cmd.Stdin = stdin
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(out.String()))
+	}
+
+	return out.Bytes(), nil
+}
+
+// Put copies the file at localPath to key below the remote directory,
+// creating missing directories first.
+func (s *SMBBackend) Put(ctx context.Context, localPath, key string) error {
+	remotePath := path.Join(s.cfg.RemoteDir, key)
+	remote, err := smbPath(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, s, err)
+	}
+
+	// mkdir fails for directories that already exist, so the directories are
+	// created one call each, ignoring only that error.
+	var dirs []string
+	for dir := path.Dir(remotePath); dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		arg, _ := smbPath(dir) // A prefix of remotePath, which could be quoted
+		if _, err := s.run(ctx, "mkdir "+arg, nil); err != nil && !strings.Contains(err.Error(), "NT_STATUS_OBJECT_NAME_COLLISION") {
+			return fmt.Errorf("failed to create %q on %s: %w", dir, s, err)
+		}
+	}
+
+	// smbclient cannot limit its rate, so a limited upload is fed through
+	// stdin instead.
+	if uploadLimit(ctx) > 0 {
+		var file *os.File
+		if file, err = os.Open(localPath); err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = s.run(ctx, "put - "+remote, throttle(ctx, file))
+	} else {
+		var local string
+		if local, err = smbQuote(localPath); err == nil {
+			_, err = s.run(ctx, "put "+local+" "+remote, nil)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, s, err)
+	}
+
+	return nil
+}
+
+// Get writes the file stored under key to w, downloading it to a temporary
+// file first.
+func (s *SMBBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	tmp, err := os.CreateTemp("", "smb-get-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	remote, err := smbPath(path.Join(s.cfg.RemoteDir, key))
+	if err == nil {
+		var local string
+		if local, err = smbQuote(tmp.Name()); err == nil {
+			_, err = s.run(ctx, "get "+remote+" "+local, nil)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, s, err)
+	}
+
+	_, err = io.Copy(w, tmp)
+	return err
+}
+
+// List returns the files whose key starts with prefix. Only the directory
+// holding the prefix is listed, not its subdirectories.
+func (s *SMBBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	// The "x" stops a prefix ending in "/" from naming its parent.
+	dir := path.Dir(path.Join(s.cfg.RemoteDir, prefix+"x"))
+	pattern := "*"
+	if dir != "." {
+		pattern = dir + "/*"
+	}
+
+	arg, err := smbPath(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", s, err)
+	}
+	out, err := s.run(ctx, "ls "+arg, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", s, err)
+	}
+
+	var objects []StoredObject
+	for _, line := range strings.Split(string(out), "\n") {
+		//   name.zip      A      518  Fri Oct 16 00:16:00 2026
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		n := len(fields)
+		modTime, err := time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[n-5:], " "))
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[n-6], 10, 64)
+		if err != nil || strings.Contains(fields[n-7], "D") {
+			continue
+		}
+
+		key := strings.TrimPrefix(path.Join(dir, strings.Join(fields[:n-7], " ")), s.cfg.RemoteDir+"/")
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, StoredObject{Key: key, Size: size, ModTime: modTime})
+		}
+	}
+
+	return objects, nil
+}
+
+// Delete removes the file stored under key.
+func (s *SMBBackend) Delete(ctx context.Context, key string) error {
+	arg, err := smbPath(path.Join(s.cfg.RemoteDir, key))
+	if err == nil {
+		_, err = s.run(ctx, "del "+arg, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, s, err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSMBPath(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"backups/dir.zip", `"backups\dir.zip"`},
+		{"my backups/a b.zip", `"my backups\a b.zip"`},
+	} {
+		if got, err := smbPath(tt.path); err != nil || got != tt.want {
+			t.Errorf("smbPath(%q) = %s, %v, want %s", tt.path, got, err, tt.want)
+		}
+	}
+	for _, path := range []string{`a".zip`, "a;rm b.zip", "a\nb.zip"} {
+		if got, err := smbPath(path); err == nil {
+			t.Errorf("smbPath(%q) = %s, want an error", path, got)
+		}
+	}
+}
+
+// fakeSMBClient puts an smbclient on PATH that appends its commands to a log
+// and fails mkdir with the given status, and returns the log path. Its
+// arguments and the password it was given are appended to the log path
+// with ".args".
+func fakeSMBClient(t *testing.T, mkdirStatus string) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "commands")
+	script := `#!/bin/sh
+printf '%s PASSWD=%s\n' "$*" "$PASSWD" >> ` + log + `.args
+while [ $# -gt 0 ]; do
+	if [ "$1" = -c ]; then
+		printf '%s\n' "$2" >> ` + log + `
+		case "$2" in mkdir*) [ -n "` + mkdirStatus + `" ] && echo "` + mkdirStatus + ` making remote directory" && exit 1 ;; esac
+	fi
+	shift
+done
+`
+	if err := os.WriteFile(filepath.Join(dir, "smbclient"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestSMBPutCreatesDirectories(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "dir.zip")
+	if err := os.WriteFile(local, []byte("archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSMBBackend(SMBConfig{Share: "//nas/share", RemoteDir: "backups"})
+
+	log := fakeSMBClient(t, "NT_STATUS_OBJECT_NAME_COLLISION")
+	if err := s.Put(context.Background(), local, "2026/dir.zip"); err != nil {
+		t.Fatalf("existing directories failed the upload: %v", err)
+	}
+	commands, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `put "` + local + `" "backups\2026\dir.zip"`; !strings.Contains(string(commands), want) {
+		t.Errorf("commands were\n%s\nwant %s", commands, want)
+	}
+
+	fakeSMBClient(t, "NT_STATUS_ACCESS_DENIED")
+	if err := s.Put(context.Background(), local, "2026/dir.zip"); err == nil || !strings.Contains(err.Error(), "NT_STATUS_ACCESS_DENIED") {
+		t.Errorf("a denied mkdir returned %v, want the error", err)
+	}
+}
+
+func TestSMBBackendNeedsSMBClient(t *testing.T) {
+	config := func(key string) string {
+		if key == "SMB_SHARE" {
+			return "//nas/share"
+		}
+		return ""
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := NewBackend("smb", config); err == nil || !strings.Contains(err.Error(), "smbclient") {
+		t.Errorf("without smbclient NewBackend returned %v, want an error naming it", err)
+	}
+
+	fakeSMBClient(t, "")
+	if _, err := NewBackend("smb", config); err != nil {
+		t.Errorf("with smbclient NewBackend returned %v", err)
+	}
+}
+
+func TestSMBKerberos(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "dir.zip")
+	if err := os.WriteFile(local, []byte("archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PASSWD", "")
+
+	for _, tt := range []struct {
+		cfg     SMBConfig
+		want    []string
+		notWant []string
+	}{
+		{
+			SMBConfig{Share: "//nas/share", User: "backup", Password: "secret", Domain: "OFFICE"},
+			[]string{"-U backup", "-W OFFICE", "PASSWD=secret"},
+			[]string{"--use-kerberos"},
+		},
+		{
+			SMBConfig{Share: "//nas/share", User: "backup", Password: "secret", Domain: "OFFICE", Kerberos: true},
+			[]string{"--use-kerberos=required", "-W OFFICE"},
+			[]string{"-U ", "-N", "--use-krb5-ccache", "secret"},
+		},
+		{
+			SMBConfig{Share: "//nas/share", Kerberos: true, CCache: "FILE:/krb5/cc_backup"},
+			[]string{"--use-kerberos=required", "--use-krb5-ccache=FILE:/krb5/cc_backup"},
+			[]string{"-U ", "-N"},
+		},
+	} {
+		log := fakeSMBClient(t, "")
+		if err := NewSMBBackend(tt.cfg).Put(context.Background(), local, "dir.zip"); err != nil {
+			t.Fatal(err)
+		}
+		args, err := os.ReadFile(log + ".args")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(string(args), want) {
+				t.Errorf("%+v: smbclient ran with\n%s\nwant %s", tt.cfg, args, want)
+			}
+		}
+		for _, notWant := range tt.notWant {
+			if strings.Contains(string(args), notWant) {
+				t.Errorf("%+v: smbclient ran with\n%s\nwant no %s", tt.cfg, args, notWant)
+			}
+		}
+	}
+}
+
+func TestSMBBackendKerberosConfig(t *testing.T) {
+	fakeSMBClient(t, "")
+	config := map[string]string{"SMB_SHARE": "//nas/share", "SMB_KERBEROS": "true", "SMB_KERBEROS_CCACHE": "FILE:/krb5/cc_backup"}
+	s, err := NewBackend("smb", func(key string) string { return config[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := s.(*SMBBackend).cfg; !cfg.Kerberos || cfg.CCache != "FILE:/krb5/cc_backup" {
+		t.Errorf("SMB_KERBEROS and SMB_KERBEROS_CCACHE configured %+v", cfg)
+	}
+}
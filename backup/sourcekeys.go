@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptionRule encrypts the archives of the source directories matching
+// Pattern with their own keys, so tenants sharing a backup host can't
+// decrypt each other's archives.
+type EncryptionRule struct {
+	Pattern    string // Glob matched against the directory name, or its full path when absolute
+	Encryption Encryptor
+}
+
+// ParseEncryptionRules parses rules in the form
+// "tenant-a=<key>;tenant-b=age1...,age1...;/data/shared=2026:<key>,2025:<key>",
+// separated by semicolons or newlines. A rule encrypts to age recipients when
+// its value starts with "age1", with a keyring as in NewGCMKeyring when it
+// lists "id:key" pairs and with a single AES-256-GCM key otherwise. The first
+// matching rule wins.
+func ParseEncryptionRules(value string) ([]EncryptionRule, error) {
+	var rules []EncryptionRule
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		// Errors name the pattern only, never the key.
+		pattern, key, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errors.New(`encryption rules must be given as "pattern=key"`)
+		}
+		pattern, key = strings.TrimSpace(pattern), strings.TrimSpace(key)
+		if pattern == "" || key == "" {
+			return nil, fmt.Errorf("invalid encryption rule for %q", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid encryption rule for %q: %w", pattern, err)
+		}
+
+		var e Encryptor
+		var err error
+		switch {
+		case strings.HasPrefix(key, "age1"):
+			e, err = NewAgeEncryptor(strings.Split(key, ","), "")
+		case strings.Contains(key, ":"):
+			e, err = NewGCMKeyring(key, "")
+		default:
+			e, err = NewGCMEncryptor(key, "")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption rule for %q: %w", pattern, err)
+		}
+
+		rules = append(rules, EncryptionRule{Pattern: pattern, Encryption: e})
+	}
+
+	return rules, nil
+}
+
+// EncryptionFor returns the encryption of the archives of entry, see
+// encryptionForSource.
+func (b *backup) EncryptionFor(entry *DirectoryEntry) Encryptor {
+	return b.encryptionForSource(b.SourceDir(entry))
+}
+
+// encryptionForSource returns the encryption of the first rule in
+// EncryptionRules matching the directory dir, Encryption otherwise. It is nil
+// when the archives of dir are not encrypted.
+func (b *backup) encryptionForSource(dir string) Encryptor {
+	for _, rule := range b.EncryptionRules {
+		name := filepath.Base(dir)
+		if filepath.IsAbs(rule.Pattern) {
+			name = dir
+		}
+		if ok, _ := filepath.Match(rule.Pattern, name); ok {
+			return rule.Encryption
+		}
+	}
+	return b.Encryption
+}
+
+// encryptions returns every configured encryption, Encryption first.
+func (b *backup) encryptions() []Encryptor {
+	var all []Encryptor
+	if b.Encryption != nil {
+		all = append(all, b.Encryption)
+	}
+	for _, rule := range b.EncryptionRules {
+		all = append(all, rule.Encryption)
+	}
+	return all
+}
@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultStagingDir is where remote-only mode writes archives when no
+// staging directory is configured.
+var defaultStagingDir = filepath.Join(os.TempDir(), "backup-staging")
+
+// stagingBudget tracks the bytes reserved in the staging directory.
+type stagingBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+// ArchiveDir returns the directory new archives are written to: the staging
+// directory in remote-only mode, the output directory otherwise.
+func (b *backup) ArchiveDir() string {
+	if b.RemoteOnly {
+		return b.StagingDir
+	}
+	return b.OutputPath
+}
+
+// ReserveStaging blocks until the archive of entry fits in MaxStagingSize
+// next to the archives already staged, and returns a function releasing the
+// reservation. The archive is assumed to be as large as its source directory,
+// but never more than MaxStagingSize, so a directory larger than the limit is
+// still staged, just on its own. Outside of remote-only mode, or without a
+// limit, it returns immediately.
+func (b *backup) ReserveStaging(entry *DirectoryEntry) func() {
+	if !b.RemoteOnly || b.MaxStagingSize <= 0 {
+		return func() {}
+	}
+
+	var size int64
+	filepath.WalkDir(b.SourceDir(entry), func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	size = min(size, b.MaxStagingSize)
+
+	b.staging.mu.Lock()
+	defer b.staging.mu.Unlock()
+	if b.staging.cond == nil {
+		b.staging.cond = sync.NewCond(&b.staging.mu)
+	}
+	for b.staging.used > 0 && b.staging.used+size > b.MaxStagingSize {
+		b.staging.cond.Wait()
+	}
+	b.staging.used += size
+
+	return func() {
+		b.staging.mu.Lock()
+		b.staging.used -= size
+		b.staging.mu.Unlock()
+		b.staging.cond.Broadcast()
+	}
+}
+
+// Unstage deletes the staged files of record once every backend holds them
+// at their local size. The files are deleted even when that check fails, the
+// archive then has to be written again by the next run.
+func (b *backup) Unstage(ctx context.Context, record *ArchiveRecord) error {
+	sizes := make(map[string]int64)
+	for _, file := range record.files() {
+		if info, err := os.Stat(file); err == nil {
+			if !info.IsDir() {
+				sizes[b.remoteKey(file)] = info.Size()
+			}
+			defer os.RemoveAll(file)
+		}
+	}
+
+	if len(b.Backends) == 0 {
+		return errors.New("no storage backend to hold the archive")
+	}
+
+	var errs []error
+	for _, s := range b.Backends {
+		name := destinationName(s)
+		if status, ok := record.Destinations[name]; !ok || !status.OK {
+			errs = append(errs, fmt.Errorf("archive not uploaded to %s", name))
+			continue
+		}
+
+		// Group archives and sidecars share the name of the archive up to
+		// its extension.
+		key := b.remoteKey(record.Path)
+		listCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.List)
+		prefix, _ := splitArchiveExt(key)
+		objects, err := s.List(listCtx, prefix)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stored := make(map[string]int64, len(objects))
+		for _, object := range objects {
+			stored[object.Key] = object.Size
+		}
+		for key, size := range sizes {
+			if remoteSize, ok := stored[key]; !ok || remoteSize != size {
+				errs = append(errs, fmt.Errorf("%s holds %q with %d bytes instead of %d", name, key, remoteSize, size))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,328 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StorageBackend stores backup files under slash separated keys, locally or
+// remotely. Keys are relative to whatever prefix or directory the backend was
+// configured with.
+type StorageBackend interface {
+	Put(ctx context.Context, localPath, key string) error
+	Get(ctx context.Context, key string, w io.Writer) error
+	List(ctx context.Context, prefix string) ([]StoredObject, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// ResumableBackend is implemented by backends that can continue an
+// interrupted upload. Progress is kept in the file at statePath, which is
+// removed once the upload completes.
+type ResumableBackend interface {
+	PutResumable(ctx context.Context, localPath, key, statePath string) error
+}
+
+// StreamingBackend is implemented by backends that can store an object read
+// from a stream of unknown length, so archives can be written straight to
+// them without a local copy, see StreamUploads. The object must only appear
+// once r is read to the end, a failing r leaves no object behind.
+type StreamingBackend interface {
+	PutStream(ctx context.Context, key string, r io.Reader) error
+}
+
+// uploadState is the progress of a resumable upload.
+type uploadState struct {
+	Identity string       `json:"identity"`            // Key, size and modification time of the file
+	UploadID string       `json:"upload_id,omitempty"` // S3 multipart upload ID
+	Session  string       `json:"session,omitempty"`   // GCS resumable session URI
+	Parts    []uploadPart `json:"parts,omitempty"`     // Parts uploaded so far
+}
+
+// uploadPart is one finished part of a multipart upload.
+type uploadPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// loadUploadState returns the saved progress of uploading info as key, or a
+// fresh state when there is none or it belongs to a different file.
+func loadUploadState(statePath, key string, info os.FileInfo) *uploadState {
+	identity := fmt.Sprintf("%s|%d|%d", key, info.Size(), info.ModTime().UnixNano())
+
+	var state uploadState
+	if err := loadState(statePath, &state); err != nil || state.Identity != identity {
+		return &uploadState{Identity: identity}
+	}
+	return &state
+}
+
+// StoredObject describes a file held by a StorageBackend.
+type StoredObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BackendFactory creates a backend from configuration values looked up by
+// name, usually os.Getenv. It returns ErrBackendNotConfigured when the values
+// it needs are not set.
+type BackendFactory func(config func(key string) string) (StorageBackend, error)
+
+// ErrBackendNotConfigured means the configuration of a backend is missing.
+var ErrBackendNotConfigured = errors.New("backend not configured")
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes a backend available under name. It panics when the
+// name is already taken.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, ok := backends[name]; ok {
+		panic("backup: RegisterBackend called twice for " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of all registered backends, sorted.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend creates the backend registered under name.
+func NewBackend(name string, config func(key string) string) (StorageBackend, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+	return factory(config)
+}
+
+// remoteKey returns the key a local file is stored under remotely: its path
+// relative to the output or staging directory, or its base name for files
+// outside of both.
+func (b *backup) remoteKey(localPath string) string {
+	for _, dir := range []string{b.OutputPath, b.StagingDir} {
+		if rel, err := filepath.Rel(dir, localPath); err == nil && filepath.IsLocal(rel) {
+			return filepath.ToSlash(rel)
+		}
+	}
+
+	return filepath.Base(localPath)
+}
+
+// destinationName names a backend in the manifest, the report and logs.
+func destinationName(s StorageBackend) string {
+	if stringer, ok := s.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+// Upload sends every file in paths to every configured backend. A failing
+// backend does not stop the others; the result holds the outcome per
+// backend, nil on success. Uploads are bounded by the upload timeout, see put,
+// and all of them share the upload bandwidth limit.
+func (b *backup) Upload(ctx context.Context, paths ...string) map[string]error {
+	ctx = withUploadLimit(ctx, b.UploadBandwidthLimit)
+	results := make(map[string]error, len(b.Backends))
+	for _, s := range b.Backends {
+		name := destinationName(s)
+		for _, path := range paths {
+			err := b.put(ctx, s, path, b.remoteKey(path))
+			b.report.recordUpload(name, err)
+			if err != nil {
+				results[name] = err
+				break
+			}
+			fmt.Printf("Uploaded %q to %s\n", path, name)
+		}
+		if _, failed := results[name]; !failed {
+			results[name] = nil
+		}
+	}
+
+	return results
+}
+
+// put uploads a file to s, resumably when s supports it, and verifies its
+// checksum afterwards. A resumable upload is sent in parts, each bounded by
+// the upload timeout, so a large file is not cut off however long it takes as
+// a whole. Other uploads are bounded as a whole.
+func (b *backup) put(ctx context.Context, s StorageBackend, localPath, key string) error {
+	ctx = withDeleteTimeout(ctx, b.RemoteTimeouts.Delete)
+	if localPath == b.ManifestPath() || localPath == SignaturePath(b.ManifestPath()) {
+		ctx = context.WithValue(ctx, defaultStorageClassKey{}, true)
+	}
+
+	resumable, ok := s.(ResumableBackend)
+	if !ok {
+		ctx, cancel := withTimeout(ctx, b.RemoteTimeouts.Upload)
+		defer cancel()
+		if err := s.Put(ctx, localPath, key); err != nil {
+			return err
+		}
+		return b.verifyUpload(ctx, s, localPath, key)
+	}
+
+	stateDir := filepath.Join(b.OutputPath, ".uploads")
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(destinationName(s) + "\x00" + key))
+	if err := resumable.PutResumable(withRequestTimeout(ctx, b.RemoteTimeouts.Upload), localPath, key, filepath.Join(stateDir, hex.EncodeToString(sum[:8])+".json")); err != nil {
+		return err
+	}
+	verifyCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.Upload)
+	defer cancel()
+	return b.verifyUpload(verifyCtx, s, localPath, key)
+}
+
+type defaultStorageClassKey struct{}
+
+// useStorageClass reports whether uploads in ctx go to the configured storage
+// class. The manifest always uses the default class so it stays readable.
+func useStorageClass(ctx context.Context) bool {
+	return ctx.Value(defaultStorageClassKey{}) == nil
+}
+
+// UploadArchive uploads an archive together with its group archives and
+// metadata sidecars, after the chunks of dedup archives the backends lack,
+// recording the outcome per backend in record and a copy
+// that fails its checksum as corruption. It returns the failures joined
+// together.
+func (b *backup) UploadArchive(ctx context.Context, record *ArchiveRecord) error {
+	var paths []string
+	for _, path := range record.files() {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+	}
+
+	chunkResults := b.uploadChunks(ctx, record)
+	results := b.Upload(ctx, paths...)
+	if len(results) == 0 {
+		return nil
+	}
+	for name, err := range chunkResults {
+		if err != nil {
+			results[name] = err
+		}
+	}
+
+	var errs []error
+	record.Destinations = make(map[string]DestinationStatus, len(results))
+	for name, err := range results {
+		if err != nil {
+			record.Destinations[name] = DestinationStatus{Error: err.Error()}
+			if errors.Is(err, ErrChecksumMismatch) {
+				record.recordCorruption(record.Path, name, err, b.report.RunID, time.Now())
+			}
+			errs = append(errs, err)
+			continue
+		}
+		record.Destinations[name] = DestinationStatus{OK: true, UploadedAt: time.Now().In(jkt).Format(time.RFC3339)}
+	}
+
+	return errors.Join(errs...)
+}
+
+// FetchManifest restores a missing local manifest from the backends, so a
+// fresh output directory continues from the last uploaded manifest instead
+// of backing up everything again. The newest copy wins. It returns the
+// destination the manifest came from, or "" when the local manifest exists
+// or no backend has one.
+func (b *backup) FetchManifest(ctx context.Context) (string, error) {
+	if _, err := os.Stat(b.ManifestPath()); !errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	key := b.remoteKey(b.ManifestPath())
+	var newest StorageBackend
+	var newestTime time.Time
+	for _, s := range b.Backends {
+		listCtx, cancel := withTimeout(ctx, b.RemoteTimeouts.List)
+		objects, err := s.List(listCtx, key)
+		cancel()
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			continue
+		}
+		for _, object := range objects {
+			if object.Key == key && (newest == nil || object.ModTime.After(newestTime)) {
+				newest, newestTime = s, object.ModTime
+			}
+		}
+	}
+	if newest == nil {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(b.OutputPath, 0o755); err != nil {
+		return "", err
+	}
+	tmp := b.ManifestPath() + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	getCtx, w, cancel := downloadContext(ctx, b.RemoteTimeouts.Download, file)
+	defer cancel()
+	if err := newest.Get(getCtx, key, w); err != nil {
+		return "", downloadError(getCtx, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := b.fetchSignature(ctx, newest, tmp); err != nil {
+		return "", fmt.Errorf("failed to fetch the manifest signature from %s: %w", destinationName(newest), err)
+	}
+	defer os.Remove(SignaturePath(tmp))
+	if _, err := b.loadManifest(tmp); err != nil {
+		return "", fmt.Errorf("invalid manifest on %s: %w", destinationName(newest), err)
+	}
+
+	if len(b.ManifestSigningKey) > 0 {
+		if err := os.Rename(SignaturePath(tmp), SignaturePath(b.ManifestPath())); err != nil {
+			return "", err
+		}
+	}
+	return destinationName(newest), os.Rename(tmp, b.ManifestPath())
+}
+
+// firstNonEmpty returns the first of values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// checkStreaming reports settings that need the local copy of an archive,
+// which StreamUploads does without.
+func (b *backup) checkStreaming() error {
+	if len(b.Backends) == 0 {
+		return errors.New("streaming uploads need a storage backend")
+	}
+	for _, s := range b.Backends {
+		if _, ok := s.(StreamingBackend); !ok {
+			return fmt.Errorf("streaming uploads are not supported by %s", destinationName(s))
+		}
+	}
+
+	switch {
+	case b.ThreeTwoOne:
+		return errors.New("3-2-1 mode keeps a local copy of every archive and cannot be combined with streaming uploads")
+	case b.VolumeSize > 0:
+		return errors.New("streamed archives cannot be split into volumes")
+	case b.ForceZip64:
+		return errors.New("forcing Zip64 rewrites the finished archive and cannot be combined with streaming uploads")
+	case b.AppendLogPath != "":
+		return errors.New("the backup log is appended from the local archive and cannot be combined with streaming uploads")
+	case b.ArchiveFormat == FormatMirror:
+		return errors.New("mirrors cannot be streamed")
+	case b.ArchiveFormat == FormatDedup:
+		return errors.New("dedup archives keep their chunks in the local chunk store and cannot be streamed")
+	}
+
+	return nil
+}
+
+// uploadStream sends what is written to it to every backend at once, each
+// reading from a pipe of its own. The slowest backend sets the pace.
+type uploadStream struct {
+	b       *backup
+	path    string // Local path the archive would have, the key is derived from it
+	pipes   []*io.PipeWriter
+	out     io.Writer
+	results []chan error
+	size    int64
+	done    bool
+}
+
+// newUploadStream starts storing the archive at path on every backend.
+func (b *backup) newUploadStream(ctx context.Context, path string) (*uploadStream, error) {
+	ctx = withUploadLimit(ctx, b.UploadBandwidthLimit)
+	ctx = withDeleteTimeout(ctx, b.RemoteTimeouts.Delete)
+	// The archive is written while it is sent, only its requests are bounded.
+	ctx = withRequestTimeout(ctx, b.RemoteTimeouts.Upload)
+	key := b.remoteKey(path)
+
+	u := &uploadStream{b: b, path: path}
+	var writers []io.Writer
+	for _, s := range b.Backends {
+		streaming, ok := s.(StreamingBackend)
+		if !ok {
+			u.Abort(errors.ErrUnsupported)
+			return nil, fmt.Errorf("streaming uploads are not supported by %s", destinationName(s))
+		}
+
+		r, w := io.Pipe()
+		result := make(chan error, 1)
+		go func() {
+			err := streaming.PutStream(ctx, key, r)
+			// Fail the writes to a backend that stopped reading early.
+			r.CloseWithError(errors.Join(err, io.ErrClosedPipe))
+			result <- err
+		}()
+		u.pipes = append(u.pipes, w)
+		u.results = append(u.results, result)
+		writers = append(writers, w)
+	}
+	u.out = io.MultiWriter(writers...)
+
+	return u, nil
+}
+
+func (u *uploadStream) Write(p []byte) (int, error) {
+	n, err := u.out.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// Close ends the stream and waits for every backend to store the archive,
+// counting it in the report. A backend failing fails the whole archive, as
+// there is no local copy to upload again.
+func (u *uploadStream) Close() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+
+	for _, w := range u.pipes {
+		w.Close()
+	}
+	var errs []error
+	for i, result := range u.results {
+		name := destinationName(u.b.Backends[i])
+		err := <-result
+		u.b.report.recordUpload(name, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		fmt.Printf("Streamed %q to %s\n", u.path, name)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	u.b.report.RecordArchive(u.size)
+	return nil
+}
+
+// Abort stops the stream with err, so the backends discard what they got.
+func (u *uploadStream) Abort(err error) {
+	if u.done {
+		return
+	}
+	u.done = true
+
+	for _, w := range u.pipes {
+		w.CloseWithError(err)
+	}
+	for _, result := range u.results {
+		<-result
+	}
+}
+
+// streamArchive starts an archive of the directory src in format that is
+// uploaded to the key of path while it is written.
+func (b *backup) streamArchive(format, src, path string) (*streamWriter, error) {
+	if format == FormatMirror {
+		return nil, errors.New("mirrors cannot be streamed")
+	}
+
+	stream, err := b.newUploadStream(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	w := &streamWriter{stream: stream}
+	var out io.Writer = stream
+	if encryption := b.encryptionForSource(src); encryption != nil {
+		if w.encrypter, err = encryption.Encrypt(stream); err != nil {
+			stream.Abort(err)
+			return nil, err
+		}
+		out = w.encrypter
+	}
+	if w.ArchiveWriter, err = b.newStreamWriter(format, out); err != nil {
+		stream.Abort(err)
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// streamWriter finishes the upload of an archive with the archive.
+type streamWriter struct {
+	ArchiveWriter
+	encrypter io.WriteCloser // Between the archive and stream when encrypting
+	stream    *uploadStream
+}
+
+func (w *streamWriter) Close() error {
+	err := w.ArchiveWriter.Close()
+	if err == nil && w.encrypter != nil {
+		err = w.encrypter.Close()
+	}
+	if err != nil {
+		w.stream.Abort(err)
+		return err
+	}
+	return w.stream.Close()
+}
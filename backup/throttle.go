@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter paces uploads to at most rate bytes per second. It is
+// shared by every upload of a run so the limit holds for the run as a whole.
+type bandwidthLimiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time // When the bytes reserved so far have been sent at rate
+}
+
+// wait blocks until n more bytes may be sent.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+type bandwidthLimiterKey struct{}
+
+// withUploadLimit returns a context whose uploads are limited to rate bytes
+// per second, or ctx itself when rate is not positive.
+func withUploadLimit(ctx context.Context, rate int64) context.Context {
+	if rate <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, bandwidthLimiterKey{}, &bandwidthLimiter{rate: rate})
+}
+
+// uploadLimit returns the upload rate limit of ctx in bytes per second, 0 when
+// uploads are not limited. Backends running an external client pass it on as
+// a command line flag.
+func uploadLimit(ctx context.Context) int64 {
+	if l, ok := ctx.Value(bandwidthLimiterKey{}).(*bandwidthLimiter); ok {
+		return l.rate
+	}
+	return 0
+}
+
+// throttle returns r limited to the upload rate of ctx.
+func throttle(ctx context.Context, r io.Reader) io.Reader {
+	l, ok := ctx.Value(bandwidthLimiterKey{}).(*bandwidthLimiter)
+	if !ok {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: l}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the pace smooth instead of sending bursts.
+	if burst := int(max(t.limiter.rate/10, 1)); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if err := t.limiter.wait(t.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// throttledTransport limits request bodies to the upload rate of the request
+// context. The HTTP based backends send through it.
+type throttledTransport struct {
+	base http.RoundTripper
+}
+
+func (t throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || uploadLimit(req.Context()) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	throttled := req.Clone(req.Context())
+	throttled.Body = struct {
+		io.Reader
+		io.Closer
+	}{throttle(req.Context(), req.Body), req.Body}
+	return t.base.RoundTrip(throttled)
+}
+
+// remoteClient is the HTTP client of the remote backends.
+var remoteClient = &http.Client{Transport: throttledTransport{http.DefaultTransport}}
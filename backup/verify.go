@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// VerifyArchiveReadable checks the archive at path with the Verify of the
+// Archiver of its format, or by reading back every entry with
+// VerifyArchiveContent. Encrypted archives are decrypted to the end instead,
+// which shows they are complete and unmodified.
+func (b *backup) VerifyArchiveReadable(path string) error {
+	return b.verifyArchiveFile(path, path)
+}
+
+// verifyArchiveFile works like VerifyArchiveReadable for the archive at path
+// written to file, such as the temporary file it is written to first.
+func (b *backup) verifyArchiveFile(file, path string) error {
+	if ext := encryptionExt(path); ext != "" {
+		if err := b.verifyEncryptedFile(file, ext); err != nil {
+			return fmt.Errorf("archive %q is not readable: %w", path, err)
+		}
+		return nil
+	}
+	if b.VerifyArchiveContent {
+		if err := b.readArchiveFile(file, path, discardWriter{}); err != nil {
+			return fmt.Errorf("archive %q is corrupt: %w", path, err)
+		}
+		return nil
+	}
+	if err := b.ArchiverFor(archiveFormat(path)).Verify(file); err != nil {
+		return fmt.Errorf("archive %q is not readable: %w", path, err)
+	}
+
+	return nil
+}
+
+// readArchiveFile adds every entry of the local file to w, read as the
+// archive at path.
+func (b *backup) readArchiveFile(file, path string, w ArchiveWriter) error {
+	if archiveFormat(path) == FormatMirror {
+		return readMirror(file, w)
+	}
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return b.readOpenArchive(path, in, w)
+}
+
+// discardWriter takes the content of every file of an archive and keeps
+// nothing, so reading the archive into it checks the CRC of every entry.
+type discardWriter struct{}
+
+func (discardWriter) Add(name string, info fs.FileInfo, link string) (io.Writer, error) {
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	return io.Discard, nil
+}
+
+func (discardWriter) Close() error { return nil }
+
+func verifyTarGz(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	if err := readTar(gz); err != nil {
+		return err
+	}
+	// Read the padding after the end of the tar so the gzip checksum is checked.
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func verifyTar(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return readTar(file)
+}
+
+// readTar reads every entry of the tar archive r.
+func readTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// verifyEncryptedFile decrypts the archive at path with every configured
+// encryption of the extension ext until one succeeds, as the source it
+// belongs to, and so its key, is not known from the path alone.
+func (b *backup) verifyEncryptedFile(path, ext string) error {
+	var errs []error
+	for _, e := range b.encryptions() {
+		if e.Extension() != ext {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = verifyEncrypted(e, file)
+		file.Close()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("no encryption configured for %s archives", ext)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// maxVolumes is the number of volumes the three digit suffix allows.
+const maxVolumes = 999
+
+// VolumePath returns the path of the nth volume, counting from 1, of the
+// archive at archivePath, e.g. "photos.zip.002".
+func VolumePath(archivePath string, n int) string {
+	return fmt.Sprintf("%s.%03d", archivePath, n)
+}
+
+// SplitArchives splits every archive of record larger than VolumeSize into
+// volumes of VolumeSize bytes, recording their number in record.Volumes. An
+// archive is only deleted once all of its volumes are written, an archive
+// that could not be split is kept whole.
+func (b *backup) SplitArchives(record *ArchiveRecord) error {
+	if b.VolumeSize <= 0 {
+		return nil
+	}
+
+	archives := []string{record.Path}
+	for _, path := range record.GroupArchives {
+		archives = append(archives, path)
+	}
+	for _, path := range archives {
+		n, err := b.splitArchive(path)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if record.Volumes == nil {
+				record.Volumes = make(map[string]int)
+			}
+			record.Volumes[path] = n
+		}
+	}
+
+	return nil
+}
+
+// splitArchive splits the archive at path and returns the number of volumes
+// written, 0 when it fits into a single volume.
+func (b *backup) splitArchive(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() || info.Size() <= b.VolumeSize {
+		return 0, nil
+	}
+
+	n := int((info.Size() + b.VolumeSize - 1) / b.VolumeSize)
+	if n > maxVolumes {
+		return 0, fmt.Errorf("%q would need %d volumes, at most %d are supported", path, n, maxVolumes)
+	}
+	for i := 1; i <= n; i++ {
+		volume := VolumePath(path, i)
+		if err := writeVolume(volume+".tmp", io.LimitReader(file, b.VolumeSize)); err != nil {
+			os.Remove(volume + ".tmp")
+			removeVolumes(path, i-1)
+			return 0, fmt.Errorf("failed to split %q: %w", path, err)
+		}
+		if err := os.Rename(volume+".tmp", volume); err != nil {
+			removeVolumes(path, i-1)
+			return 0, fmt.Errorf("failed to split %q: %w", path, err)
+		}
+	}
+	file.Close()
+
+	// Every byte of the archive is in its volumes now.
+	if err := os.Remove(path); err != nil {
+		return 0, fmt.Errorf("failed to remove %q after splitting it: %w", path, err)
+	}
+	fmt.Printf("Split %q into %d volumes\n", path, n)
+
+	return n, nil
+}
+
+func writeVolume(path string, r io.Reader) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeVolumes deletes the first n volumes of the archive at path.
+func removeVolumes(path string, n int) {
+	for i := 1; i <= n; i++ {
+		os.Remove(VolumePath(path, i))
+	}
+}
+
+// JoinVolumes writes the archive at archivePath from its volumes next to it,
+// which must be numbered from 001 without gaps. The volumes are kept.
+func JoinVolumes(archivePath string) error {
+	volumes, _ := filepath.Glob(glob(archivePath) + ".[0-9][0-9][0-9]")
+	if len(volumes) == 0 {
+		return fmt.Errorf("no volumes of %q found", archivePath)
+	}
+	sort.Strings(volumes)
+	for i, volume := range volumes {
+		if volume != VolumePath(archivePath, i+1) {
+			return fmt.Errorf("volume %q of %q is missing", VolumePath(archivePath, i+1), archivePath)
+		}
+	}
+
+	out, err := os.Create(archivePath + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	for _, volume := range volumes {
+		in, err := os.Open(volume)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("failed to join %q: %w", volume, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), archivePath)
+}
+
+// glob escapes the glob metacharacters of a literal path.
+func glob(path string) string {
+	var escaped []byte
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '*', '?', '[', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, path[i])
+	}
+	return string(escaped)
+}
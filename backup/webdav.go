@@ -0,0 +1,287 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("webdav", func(config func(string) string) (StorageBackend, error) {
+		webdavURL := config("WEBDAV_URL")
+		if webdavURL == "" {
+			return nil, ErrBackendNotConfigured
+		}
+		chunkSize, _ := ParseSize(config("WEBDAV_CHUNK_SIZE"))
+		return NewWebDAVBackend(WebDAVConfig{
+			URL:       webdavURL,
+			User:      config("WEBDAV_USER"),
+			Password:  config("WEBDAV_PASSWORD"),
+			ChunkSize: chunkSize,
+		})
+	})
+}
+
+// WebDAVConfig configures a WebDAV share.
+type WebDAVConfig struct {
+	URL       string // Directory the archives are uploaded to
+	User      string
+	Password  string
+	ChunkSize int64 // Nextcloud chunk size, defaults to 50MiB
+	Retries   int   // Attempts per request on transient errors
+}
+
+// WebDAVBackend stores files on a WebDAV share. Nextcloud and ownCloud
+// shares (URLs below /remote.php/dav/files/<user>) get files larger than the
+// chunk size through the chunked upload API.
+type WebDAVBackend struct {
+	cfg    WebDAVConfig
+	client *http.Client
+	base   *url.URL
+	// uploads is the Nextcloud chunked upload collection, nil for other
+	// servers.
+	uploads *url.URL
+}
+
+// NewWebDAVBackend creates a backend for the share described by cfg.
+func NewWebDAVBackend(cfg WebDAVConfig) (*WebDAVBackend, error) {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 50 << 20
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebDAV URL %q: %w", cfg.URL, err)
+	}
+
+	d := &WebDAVBackend{cfg: cfg, client: remoteClient, base: base}
+	if prefix, rest, ok := strings.Cut(base.Path, "/remote.php/dav/files/"); ok {
+		user, _, _ := strings.Cut(rest, "/")
+		uploads := *base
+		uploads.Path = prefix + "/remote.php/dav/uploads/" + user
+		d.uploads = &uploads
+	}
+
+	return d, nil
+}
+
+// String names the destination in logs.
+func (d *WebDAVBackend) String() string {
+	return d.base.Redacted()
+}
+
+// resolve returns the URL of name below base.
+func resolve(base *url.URL, name string) string {
+	target := *base
+	target.Path = path.Join(base.Path, name)
+	return target.String()
+}
+
+// do sends a request, retrying transient failures, and hands a successful
+// response to handle. Besides 2xx, any status in accept counts as success.
+// body is called once per attempt.
+func (d *WebDAVBackend) do(ctx context.Context, method, target string, header http.Header, size int64, body func() (io.Reader, error), handle func(*http.Response) error, accept ...int) error {
+	return retryTransient(ctx, d.cfg.Retries, func() error {
+		var reader io.Reader
+		if body != nil {
+			var err error
+			if reader, err = body(); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if d.cfg.User != "" {
+			req.SetBasicAuth(d.cfg.User, d.cfg.Password)
+		}
+
+		res, err := d.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return &transientError{fmt.Errorf("%s %s: %w", method, target, err)}
+		}
+		defer res.Body.Close()
+
+		for _, status := range accept {
+			if res.StatusCode == status {
+				return nil
+			}
+		}
+		if res.StatusCode/100 != 2 {
+			return responseError(method+" "+target, res)
+		}
+		if handle != nil {
+			return handle(res)
+		}
+
+		return nil
+	})
+}
+
+// Put stores the file at localPath as key below the share URL, creating
+// missing collections first.
+func (d *WebDAVBackend) Put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	// MKCOL answers 405 for collections that already exist.
+	for _, dir := range dirs {
+		if err := d.do(ctx, "MKCOL", resolve(d.base, dir), nil, 0, nil, nil, http.StatusMethodNotAllowed); err != nil {
+			return fmt.Errorf("failed to create %q on %s: %w", dir, d, err)
+		}
+	}
+
+	target := resolve(d.base, key)
+	if d.uploads == nil || info.Size() <= d.cfg.ChunkSize {
+		header := http.Header{"Content-Type": {"application/octet-stream"}}
+		err := d.do(ctx, http.MethodPut, target, header, info.Size(), func() (io.Reader, error) {
+			_, err := file.Seek(0, io.SeekStart)
+			return io.NopCloser(file), err
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to upload %q to %s: %w", localPath, d, err)
+		}
+		return nil
+	}
+
+	if err := d.uploadChunked(ctx, file, info.Size(), target); err != nil {
+		return fmt.Errorf("failed to upload %q to %s: %w", localPath, d, err)
+	}
+	return nil
+}
+
+// uploadChunked sends file in chunks to a fresh Nextcloud upload collection
+// and assembles them at target.
+func (d *WebDAVBackend) uploadChunked(ctx context.Context, file *os.File, size int64, target string) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	collection := resolve(d.uploads, "backup-"+hex.EncodeToString(id))
+	header := http.Header{"Destination": {target}, "Oc-Total-Length": {strconv.FormatInt(size, 10)}}
+
+	if err := d.do(ctx, "MKCOL", collection, header, 0, nil, nil); err != nil {
+		return err
+	}
+
+	chunk := 1
+	for offset := int64(0); offset < size; offset += d.cfg.ChunkSize {
+		length := min(d.cfg.ChunkSize, size-offset)
+		err := d.do(ctx, http.MethodPut, fmt.Sprintf("%s/%05d", collection, chunk), header, length, func() (io.Reader, error) {
+			return io.NopCloser(io.NewSectionReader(file, offset, length)), nil
+		}, nil)
+		if err != nil {
+			d.do(ctx, http.MethodDelete, collection, nil, 0, nil, nil)
+			return err
+		}
+		chunk++
+	}
+
+	if err := d.do(ctx, "MOVE", collection+"/.file", header, 0, nil, nil); err != nil {
+		d.do(ctx, http.MethodDelete, collection, nil, 0, nil, nil)
+		return err
+	}
+
+	return nil
+}
+
+// Get writes the file stored under key to w.
+func (d *WebDAVBackend) Get(ctx context.Context, key string, w io.Writer) error {
+	err := d.do(ctx, http.MethodGet, resolve(d.base, key), nil, 0, nil, func(res *http.Response) error {
+		_, err := io.Copy(w, res.Body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download %q from %s: %w", key, d, err)
+	}
+	return nil
+}
+
+// List returns the files whose key starts with prefix. Only the collection
+// holding the prefix is listed, not its subcollections.
+func (d *WebDAVBackend) List(ctx context.Context, prefix string) ([]StoredObject, error) {
+	// The "x" stops a prefix ending in "/" from naming its parent.
+	dir := path.Dir(prefix + "x")
+	collection := resolve(d.base, dir) + "/"
+
+	var listing struct {
+		Responses []struct {
+			Href string `xml:"href"`
+			Prop struct {
+				ContentLength int64     `xml:"getcontentlength"`
+				LastModified  string    `xml:"getlastmodified"`
+				Collection    *struct{} `xml:"resourcetype>collection"`
+			} `xml:"propstat>prop"`
+		} `xml:"response"`
+	}
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}
+	const body = `<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/><d:getlastmodified/><d:resourcetype/></d:prop></d:propfind>`
+	err := d.do(ctx, "PROPFIND", collection, header, int64(len(body)), func() (io.Reader, error) {
+		return strings.NewReader(body), nil
+	}, func(res *http.Response) error {
+		return xml.NewDecoder(res.Body).Decode(&listing)
+	}, http.StatusNotFound)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", d, err)
+	}
+
+	var objects []StoredObject
+	for _, response := range listing.Responses {
+		if response.Prop.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(response.Href)
+		if err != nil {
+			continue
+		}
+
+		key := path.Join(dir, path.Base(href))
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		modTime, _ := http.ParseTime(response.Prop.LastModified)
+		objects = append(objects, StoredObject{Key: key, Size: response.Prop.ContentLength, ModTime: modTime})
+	}
+
+	return objects, nil
+}
+
+// Delete removes the file stored under key.
+func (d *WebDAVBackend) Delete(ctx context.Context, key string) error {
+	if err := d.do(ctx, http.MethodDelete, resolve(d.base, key), nil, 0, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete %q from %s: %w", key, d, err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Zip extra fields holding what zip itself has no place for.
+const (
+	unixOwnerExtraID = 0x7875 // Info-ZIP "ux" field, the uid and gid, as read by unzip and libarchive
+	xattrExtraID     = 0x7861 // Extended attributes, private to this tool
+)
+
+// tarXattrPrefix prefixes the PAX records of extended attributes, as written
+// by GNU tar and libarchive.
+const tarXattrPrefix = "SCHILY.xattr."
+
+// attrInfo carries the owner and extended attributes of an entry next to its
+// FileInfo, from the source to the archive writers and from the archive
+// readers to the restore.
+type attrInfo struct {
+	fs.FileInfo
+	uid, gid int
+	hasOwner bool
+	xattrs   map[string][]byte
+}
+
+// entryOwner returns the uid and gid owning the file described by info, read
+// from the file system or an archive.
+func entryOwner(info fs.FileInfo) (int, int, bool) {
+	if a, ok := info.(attrInfo); ok && a.hasOwner {
+		return a.uid, a.gid, true
+	}
+	if header, ok := info.Sys().(*tar.Header); ok {
+		return header.Uid, header.Gid, true
+	}
+	return fileOwner(info)
+}
+
+// entryXattrs returns the extended attributes recorded for info, see
+// PreserveXattrs.
+func entryXattrs(info fs.FileInfo) map[string][]byte {
+	if a, ok := info.(attrInfo); ok {
+		return a.xattrs
+	}
+	header, ok := info.Sys().(*tar.Header)
+	if !ok {
+		return nil
+	}
+	var xattrs map[string][]byte
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, tarXattrPrefix); ok {
+			if xattrs == nil {
+				xattrs = make(map[string][]byte)
+			}
+			xattrs[name] = []byte(value)
+		}
+	}
+	return xattrs
+}
+
+// unixOwnerExtra returns the Info-ZIP extra field recording uid and gid.
+func unixOwnerExtra(uid, gid int) []byte {
+	extra := make([]byte, 15)
+	binary.LittleEndian.PutUint16(extra[0:], unixOwnerExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 11)
+	extra[4] = 1 // Version
+	extra[5] = 4
+	binary.LittleEndian.PutUint32(extra[6:], uint32(uid))
+	extra[10] = 4
+	binary.LittleEndian.PutUint32(extra[11:], uint32(gid))
+	return extra
+}
+
+// xattrExtra returns the extra field recording xattrs, each as the length
+// and bytes of its name followed by the length and bytes of its value, or an
+// error when they are too large for a zip header.
+func xattrExtra(xattrs map[string][]byte) ([]byte, error) {
+	data := []byte{}
+	for _, name := range slices.Sorted(maps.Keys(xattrs)) {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(name)))
+		data = append(data, name...)
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(xattrs[name])))
+		data = append(data, xattrs[name]...)
+	}
+	// archive/zip refuses headers whose extra fields reach 64KiB.
+	if len(data) > math.MaxUint16/2 {
+		return nil, fmt.Errorf("extended attributes of %d bytes do not fit a zip header", len(data))
+	}
+
+	extra := binary.LittleEndian.AppendUint16(nil, xattrExtraID)
+	extra = binary.LittleEndian.AppendUint16(extra, uint16(len(data)))
+	return append(extra, data...), nil
+}
+
+// zipEntryAttrs reads the owner and extended attributes from the extra
+// fields of a zip entry, see unixOwnerExtra and xattrExtra.
+func zipEntryAttrs(info fs.FileInfo, extra []byte) fs.FileInfo {
+	a := attrInfo{FileInfo: info}
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		field := extra[4 : 4+size]
+		switch id {
+		case unixOwnerExtraID:
+			a.uid, a.gid, a.hasOwner = parseUnixOwner(field)
+		case xattrExtraID:
+			a.xattrs = parseXattrs(field)
+		}
+		extra = extra[4+size:]
+	}
+
+	if !a.hasOwner && a.xattrs == nil {
+		return info
+	}
+	return a
+}
+
+// parseUnixOwner parses the field written by unixOwnerExtra, which other
+// tools write with ids of 1 to 8 bytes.
+func parseUnixOwner(field []byte) (int, int, bool) {
+	if len(field) < 2 || field[0] != 1 {
+		return 0, 0, false
+	}
+	var ids [2]int
+	field = field[1:]
+	for i := range ids {
+		if len(field) < 1 || int(field[0]) > 8 || len(field) < 1+int(field[0]) {
+			return 0, 0, false
+		}
+		var id uint64
+		for j := int(field[0]); j > 0; j-- {
+			id = id<<8 | uint64(field[j])
+		}
+		ids[i] = int(id)
+		field = field[1+int(field[0]):]
+	}
+	return ids[0], ids[1], true
+}
+
+// parseXattrs parses the field written by xattrExtra.
+func parseXattrs(field []byte) map[string][]byte {
+	xattrs := make(map[string][]byte)
+	for len(field) >= 2 {
+		n := int(binary.LittleEndian.Uint16(field))
+		if len(field) < 2+n+2 {
+			break
+		}
+		name := string(field[2 : 2+n])
+		field = field[2+n:]
+		m := int(binary.LittleEndian.Uint16(field))
+		if len(field) < 2+m {
+			break
+		}
+		xattrs[name] = field[2 : 2+m]
+		field = field[2+m:]
+	}
+	return xattrs
+}
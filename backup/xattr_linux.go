@@ -0,0 +1,108 @@
+//go:build linux
+
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// readXattrs returns the extended attributes of the file at path, following
+// symlinks, or none when the file system has no support for them.
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrCall(func(dest []byte) (int, error) { return syscall.Listxattr(path, dest) })
+	if errors.Is(err, syscall.ENOTSUP) || len(names) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(bytes.TrimSuffix(names, []byte{0}), []byte{0}) {
+		value, err := xattrCall(func(dest []byte) (int, error) { return syscall.Getxattr(path, string(name), dest) })
+		if errors.Is(err, syscall.ENODATA) {
+			continue // Removed since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs, nil
+}
+
+// writeXattrs sets the extended attributes xattrs on the file at path,
+// following symlinks. Attributes outside of the user namespace need root.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	var errs []error
+	for name, value := range xattrs {
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeFileXattrs sets the extended attributes xattrs on the open file f,
+// which unlike a path cannot be swapped for a symlink in between.
+func writeFileXattrs(f *os.File, xattrs map[string][]byte) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for name, value := range xattrs {
+		err := conn.Control(func(fd uintptr) {
+			if err := fsetxattr(int(fd), name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fsetxattr calls fsetxattr(2), which the syscall package has no wrapper for.
+func fsetxattr(fd int, name string, value []byte) error {
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd), uintptr(unsafe.Pointer(namePtr)), uintptr(valuePtr), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// xattrCall calls one of the xattr syscalls filling dest, first asking for
+// the size needed, and returns what it filled. It retries when the value
+// grew in between.
+func xattrCall(call func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		dest := make([]byte, size)
+		n, err := call(dest)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dest[:n], nil
+	}
+}
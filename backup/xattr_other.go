@@ -0,0 +1,20 @@
+//go:build !linux
+
+package backup
+
+import "os"
+
+// readXattrs is not available on this platform.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs is not available on this platform.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	return nil
+}
+
+// writeFileXattrs is not available on this platform.
+func writeFileXattrs(f *os.File, xattrs map[string][]byte) error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Records of the zip format rewritten by forceZip64, see APPNOTE.TXT.
+const (
+	centralHeaderSignature = 0x02014b50
+	centralHeaderLen       = 46
+	eocdSignature          = 0x06054b50
+	eocdLen                = 22
+	zip64EOCDSignature     = 0x06064b50
+	zip64EOCDLen           = 56
+	zip64LocatorSignature  = 0x07064b50
+	zip64LocatorLen        = 20
+	zip64ExtraID           = 0x0001
+	zip64Version           = 45
+
+	uint16max = 1<<16 - 1
+	uint32max = 1<<32 - 1
+)
+
+// forceZip64 rewrites the central directory of the finished zip archive at
+// path so every entry has a Zip64 extra field and the archive ends with the
+// Zip64 end of central directory records, as some tools expect regardless of
+// the archive size. archive/zip only writes them where sizes or offsets need
+// them. The entries themselves are left untouched.
+func forceZip64(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dirOffset, dirSize, records, err := readDirectoryEnd(file)
+	if err != nil {
+		return fmt.Errorf("failed to read the end of %q: %w", path, err)
+	}
+
+	dir := make([]byte, dirSize)
+	if _, err := file.ReadAt(dir, int64(dirOffset)); err != nil {
+		return fmt.Errorf("failed to read the central directory of %q: %w", path, err)
+	}
+
+	var out []byte
+	for i := uint64(0); i < records; i++ {
+		var err error
+		if out, dir, err = appendZip64Header(out, dir); err != nil {
+			return fmt.Errorf("invalid central directory in %q: %w", path, err)
+		}
+	}
+
+	le := binary.LittleEndian
+	end := dirOffset + uint64(len(out))
+
+	record := make([]byte, zip64EOCDLen)
+	le.PutUint32(record[0:], zip64EOCDSignature)
+	le.PutUint64(record[4:], zip64EOCDLen-12) // Size of the rest of the record
+	le.PutUint16(record[12:], zip64Version)
+	le.PutUint16(record[14:], zip64Version)
+	le.PutUint64(record[24:], records)
+	le.PutUint64(record[32:], records)
+	le.PutUint64(record[40:], uint64(len(out)))
+	le.PutUint64(record[48:], dirOffset)
+	out = append(out, record...)
+
+	locator := make([]byte, zip64LocatorLen)
+	le.PutUint32(locator[0:], zip64LocatorSignature)
+	le.PutUint64(locator[8:], end)
+	le.PutUint32(locator[16:], 1) // Total number of disks
+	out = append(out, locator...)
+
+	eocd := make([]byte, eocdLen)
+	le.PutUint32(eocd[0:], eocdSignature)
+	le.PutUint16(eocd[8:], uint16max)
+	le.PutUint16(eocd[10:], uint16max)
+	le.PutUint32(eocd[12:], uint32max)
+	le.PutUint32(eocd[16:], uint32max)
+	out = append(out, eocd...)
+
+	if _, err := file.WriteAt(out, int64(dirOffset)); err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(dirOffset) + int64(len(out))); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// readDirectoryEnd returns the offset, size and number of records of the
+// central directory of a zip archive without a comment.
+func readDirectoryEnd(file *os.File) (offset, size, records uint64, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	le := binary.LittleEndian
+	eocd := make([]byte, eocdLen)
+	if _, err := file.ReadAt(eocd, info.Size()-eocdLen); err != nil {
+		return 0, 0, 0, err
+	}
+	if le.Uint32(eocd) != eocdSignature || le.Uint16(eocd[20:]) != 0 {
+		return 0, 0, 0, errors.New("no end of central directory record")
+	}
+	records, size, offset = uint64(le.Uint16(eocd[10:])), uint64(le.Uint32(eocd[12:])), uint64(le.Uint32(eocd[16:]))
+	if records != uint16max && size != uint32max && offset != uint32max {
+		return offset, size, records, nil
+	}
+
+	// The archive already has Zip64 end records, which hold the real values.
+	locator := make([]byte, zip64LocatorLen)
+	if _, err := file.ReadAt(locator, info.Size()-eocdLen-zip64LocatorLen); err != nil {
+		return 0, 0, 0, err
+	}
+	if le.Uint32(locator) != zip64LocatorSignature {
+		return 0, 0, 0, errors.New("no zip64 end of central directory locator")
+	}
+	record := make([]byte, zip64EOCDLen)
+	if _, err := file.ReadAt(record, int64(le.Uint64(locator[8:]))); err != nil {
+		return 0, 0, 0, err
+	}
+	if le.Uint32(record) != zip64EOCDSignature {
+		return 0, 0, 0, errors.New("no zip64 end of central directory record")
+	}
+
+	return le.Uint64(record[48:]), le.Uint64(record[40:]), le.Uint64(record[32:]), nil
+}
+
+// appendZip64Header appends the first central directory header of dir to out
+// with its sizes and offset moved into a Zip64 extra field, and returns the
+// rest of dir.
+func appendZip64Header(out, dir []byte) ([]byte, []byte, error) {
+	le := binary.LittleEndian
+	if len(dir) < centralHeaderLen || le.Uint32(dir) != centralHeaderSignature {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	nameLen, extraLen, commentLen := int(le.Uint16(dir[28:])), int(le.Uint16(dir[30:])), int(le.Uint16(dir[32:]))
+	total := centralHeaderLen + nameLen + extraLen + commentLen
+	if len(dir) < total {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	header, name := dir[:centralHeaderLen], dir[centralHeaderLen:centralHeaderLen+nameLen]
+	extra, comment := dir[centralHeaderLen+nameLen:centralHeaderLen+nameLen+extraLen], dir[centralHeaderLen+nameLen+extraLen:total]
+
+	compressed, uncompressed, offset := uint64(le.Uint32(header[20:])), uint64(le.Uint32(header[24:])), uint64(le.Uint32(header[42:]))
+
+	// Keep every extra field but an existing Zip64 one, taking the values
+	// it holds for the fields set to their maximum.
+	var others []byte
+	for len(extra) >= 4 {
+		id, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		field := extra[4 : 4+size]
+		if id != zip64ExtraID {
+			others = append(others, extra[:4+size]...)
+		} else {
+			for _, value := range []*uint64{&uncompressed, &compressed, &offset} {
+				if *value == uint32max && len(field) >= 8 {
+					*value, field = le.Uint64(field), field[8:]
+				}
+			}
+		}
+		extra = extra[4+size:]
+	}
+
+	zip64 := make([]byte, 28)
+	le.PutUint16(zip64[0:], zip64ExtraID)
+	le.PutUint16(zip64[2:], 24)
+	le.PutUint64(zip64[4:], uncompressed)
+	le.PutUint64(zip64[12:], compressed)
+	le.PutUint64(zip64[20:], offset)
+	if len(zip64)+len(others) > uint16max {
+		return nil, nil, errors.New("extra field too long")
+	}
+
+	h := append([]byte(nil), header...)
+	madeBy := le.Uint16(h[4:])
+	le.PutUint16(h[4:], madeBy&0xff00|max(madeBy&0xff, zip64Version))
+	le.PutUint16(h[6:], max(le.Uint16(h[6:]), zip64Version))
+	le.PutUint32(h[20:], uint32max)
+	le.PutUint32(h[24:], uint32max)
+	le.PutUint16(h[30:], uint16(len(zip64)+len(others)))
+	le.PutUint32(h[42:], uint32max)
+
+	out = append(out, h...)
+	out = append(out, name...)
+	out = append(out, zip64...)
+	out = append(out, others...)
+	out = append(out, comment...)
+
+	return out, dir[total:], nil
+}
@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hasZip64Extra reports whether extra holds a Zip64 extended information
+// field.
+func hasZip64Extra(extra []byte) bool {
+	le := binary.LittleEndian
+	for len(extra) >= 4 {
+		id, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if id == zip64ExtraID {
+			return true
+		}
+		if len(extra) < 4+size {
+			return false
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
+
+// hasZip64End reports whether the zip at path ends with a Zip64 end of
+// central directory record and its locator in front of the classic record.
+func hasZip64End(t *testing.T, path string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	if len(data) < eocdLen+zip64LocatorLen {
+		return false
+	}
+	locator := data[len(data)-eocdLen-zip64LocatorLen:]
+	if le.Uint32(locator) != zip64LocatorSignature {
+		return false
+	}
+	offset := le.Uint64(locator[8:])
+	return offset+zip64EOCDLen <= uint64(len(data)) && le.Uint32(data[offset:]) == zip64EOCDSignature
+}
+
+// checkZip64Archive opens the zip at path, reads every file back so
+// archive/zip checks its CRC against want, which maps names to the CRC and
+// size of their content, and returns the entries that carry a Zip64 extra
+// field.
+func checkZip64Archive(t *testing.T, path string, want map[string][2]uint64) map[string]bool {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("archive/zip cannot open %q: %v", path, err)
+	}
+	defer r.Close()
+
+	zip64 := map[string]bool{}
+	seen := 0
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		w, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry %q", f.Name)
+			continue
+		}
+		seen++
+		if uint64(f.CRC32) != w[0] || f.UncompressedSize64 != w[1] {
+			t.Errorf("%s: CRC %08x and size %d, want %08x and %d", f.Name, f.CRC32, f.UncompressedSize64, w[0], w[1])
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Errorf("%s: reading back failed: %v", f.Name, err)
+		}
+		rc.Close()
+		zip64[f.Name] = hasZip64Extra(f.Extra)
+	}
+	if seen != len(want) {
+		t.Errorf("archive holds %d files, want %d", seen, len(want))
+	}
+	return zip64
+}
+
+func TestForceZip64(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":     "first file",
+		"sub/b.txt": "second file, in a subdirectory",
+		"empty.txt": "",
+	}
+	writeTree(t, src, files)
+	want := map[string][2]uint64{}
+	for name, content := range files {
+		want[name] = [2]uint64{uint64(crc32.ChecksumIEEE([]byte(content))), uint64(len(content))}
+	}
+
+	for _, force := range []bool{false, true} {
+		archive := filepath.Join(t.TempDir(), "src.zip")
+		b := New(src, t.TempDir(), -1, WithForceZip64(force))
+		if err := b.ZipDirectory(src, archive); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, got := range checkZip64Archive(t, archive, want) {
+			if got != force {
+				t.Errorf("force %v: %s has a Zip64 extra field: %v", force, name, got)
+			}
+		}
+		if got := hasZip64End(t, archive); got != force {
+			t.Errorf("force %v: archive ends with Zip64 records: %v", force, got)
+		}
+		if err := b.VerifyArchiveReadable(archive); err != nil {
+			t.Errorf("force %v: %v", force, err)
+		}
+	}
+}
+
+func TestForceZip64IsIdempotent(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "content"})
+	archive := filepath.Join(t.TempDir(), "src.zip")
+	if err := New(src, t.TempDir(), -1, WithForceZip64(true)).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	once, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := forceZip64(archive); err != nil {
+		t.Fatalf("rewriting an archive with Zip64 records failed: %v", err)
+	}
+	twice, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(once) != string(twice) {
+		t.Error("rewriting an archive that already has Zip64 records changed it")
+	}
+}
+
+// sparseFile creates a file of size bytes at path without writing them, the
+// file system reads the hole back as zeros.
+func sparseFile(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// zerosCRC returns the CRC-32 of size zero bytes.
+func zerosCRC(size int64) uint32 {
+	zeros := make([]byte, 1<<20)
+	crc := uint32(0)
+	for ; size > 0; size -= int64(len(zeros)) {
+		crc = crc32.Update(crc, crc32.IEEETable, zeros[:min(size, int64(len(zeros)))])
+	}
+	return crc
+}
+
+// TestZipDirectoryHugeFiles archives zeros past 4GiB, in a single file and
+// spread over a tree, which archive/zip can only describe with Zip64 fields.
+func TestZipDirectoryHugeFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compresses more than 8GiB of zeros")
+	}
+	const huge = 1<<32 + 1
+	const part = 1<<31 + 1
+	src := t.TempDir()
+	sparseFile(t, filepath.Join(src, "huge.bin"), huge)
+	sparseFile(t, filepath.Join(src, "tree/one.bin"), part)
+	sparseFile(t, filepath.Join(src, "tree/two.bin"), part)
+	writeTree(t, src, map[string]string{"small.txt": "small"})
+
+	want := map[string][2]uint64{
+		"huge.bin":     {uint64(zerosCRC(huge)), huge},
+		"tree/one.bin": {uint64(zerosCRC(part)), part},
+		"tree/two.bin": {uint64(zerosCRC(part)), part},
+		"small.txt":    {uint64(crc32.ChecksumIEEE([]byte("small"))), 5},
+	}
+
+	for _, force := range []bool{false, true} {
+		archive := filepath.Join(t.TempDir(), "src.zip")
+		if err := New(src, t.TempDir(), 1, WithForceZip64(force)).ZipDirectory(src, archive); err != nil {
+			t.Fatal(err)
+		}
+
+		zip64 := checkZip64Archive(t, archive, want)
+		if !zip64["huge.bin"] {
+			t.Errorf("force %v: the entry over 4GiB has no Zip64 extra field", force)
+		}
+		if force {
+			for name, got := range zip64 {
+				if !got {
+					t.Errorf("force %v: %s has no Zip64 extra field", force, name)
+				}
+			}
+			if !hasZip64End(t, archive) {
+				t.Errorf("force %v: archive does not end with Zip64 records", force)
+			}
+		}
+		os.Remove(archive)
+	}
+}
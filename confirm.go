@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// confirmOverwrite asks for an explicit "y" before a restore overwrites
+// existing files. assumeYes (--yes) skips the question. When in is not a
+// terminal nobody can answer, so only assumeYes lets the restore proceed.
+func confirmOverwrite(overwrites int, assumeYes bool, in io.Reader, out io.Writer) bool {
+	if overwrites == 0 || assumeYes {
+		return true
+	}
+
+	if !isTerminal(in) {
+		fmt.Fprintf(out, "Restore would overwrite %d file(s), pass --yes to confirm in non-interactive mode\n", overwrites)
+		return false
+	}
+
+	fmt.Fprintf(out, "Restore will overwrite %d existing file(s). Continue? [y/N] ", overwrites)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// isTerminal reports whether someone can answer a question on r. It is a
+// variable so tests can answer from any reader.
+var isTerminal = func(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
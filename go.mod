@@ -1,6 +1,6 @@
 module github.com/nicodwik/backup-tools-go
 
-go 1.24.3
+go 1.25.0
 
 require (
 	github.com/robfig/cron v1.2.0 // indirect
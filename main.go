@@ -1,13 +1,20 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,23 +26,168 @@ var (
 	sourcePath       = "/data"
 	backupOutputPath = "/backups"
 	jkt, _           = time.LoadLocation("Asia/Jakarta")
+
+	// errManifestNotSaved means every archive was written but the manifest
+	// could not be saved afterwards.
+	errManifestNotSaved = errors.New("manifest not saved")
+)
+
+// Exit codes of a one-shot run.
+const (
+	exitFailed           = 1
+	exitManifestNotSaved = 3
 )
 
 func main() {
+	if maxWait, _ := time.ParseDuration(os.Getenv("STARTUP_MAX_WAIT")); maxWait > 0 {
+		if err := waitUntilReady(maxWait); err != nil {
+			log.Fatalf("ERROR when waiting for storage: %s", err.Error())
+		}
+	}
+
+	warnSafeMode(os.Stdout)
+
+	// "reencrypt" migrates the existing archives to the current encryption
+	// key after a key rotation and exits.
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		if err := doReencrypt(); err != nil {
+			log.Fatalf("ERROR when re-encrypting archives: %s", err.Error())
+		}
+		return
+	}
+
+	// "prune" deletes the archives the retention settings no longer keep,
+	// locally and on the backends, without backing anything up, and exits.
+	// "prune --dry-run" only lists them.
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		if err := doPrune(slices.Contains(os.Args[2:], "--dry-run")); err != nil {
+			log.Fatalf("ERROR when pruning archives: %s", err.Error())
+		}
+		return
+	}
+
+	// "scrub" reads back every archive locally and on the backends and
+	// compares it with its recorded checksum, and exits.
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		if err := doScrub(); err != nil {
+			log.Fatalf("ERROR when scrubbing archives: %s", err.Error())
+		}
+		return
+	}
+
+	// "hold" places archives under a legal hold so pruning never deletes
+	// them, "release" lifts it, see backup.SetHold.
+	if len(os.Args) > 1 && (os.Args[1] == "hold" || os.Args[1] == "release") {
+		if err := doHold(os.Args[1] == "hold", os.Args[2:]); err != nil {
+			log.Fatalf("ERROR when changing legal holds: %s", err.Error())
+		}
+		return
+	}
+
+	// "restore <archive|run ID|source> <target> [--as-of <time>]
+	// [--on-conflict <policy>] [--dry-run] [--yes] [pattern...]" extracts an
+	// archive, every archive of a run into a directory per source, or a
+	// source as it was at the given time, below target and exits. Patterns
+	// restore only the matching files, --on-conflict overrides
+	// RESTORE_CONFLICT and --dry-run lists the files instead of writing them.
+	// Overwriting existing files is confirmed first, or with --yes.
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if len(os.Args) < 4 {
+			log.Fatalf("usage: %s restore <archive|run ID|source> <target> [--as-of <time>] [--on-conflict <policy>] [--dry-run] [--yes] [pattern...]", os.Args[0])
+		}
+		if err := doRestore(os.Args[2], os.Args[3], os.Args[4:]); err != nil {
+			log.Fatalf("ERROR when restoring: %s", err.Error())
+		}
+		return
+	}
+
+	// "restore-all [target] [--as-of <time>] [--on-conflict <policy>]
+	// [--dry-run] [--yes] [pattern...]" restores every directory in the manifest to
+	// where it was backed up from, below target instead of the source path
+	// when given, e.g. onto a fresh volume, and exits.
+	if len(os.Args) > 1 && os.Args[1] == "restore-all" {
+		target, args := sourcePath, os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+			target, args = args[0], args[1:]
+		}
+		if err := doRestoreAll(target, args); err != nil {
+			log.Fatalf("ERROR when restoring: %s", err.Error())
+		}
+		return
+	}
+
+	// "verify [source...]" compares the current files of the given sources,
+	// by name or path, or of every directory in the manifest with their
+	// latest archives, lists the added, removed and modified files, and
+	// exits with an error when any differ.
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := doVerify(os.Args[2:]); err != nil {
+			log.Fatalf("ERROR when verifying sources: %s", err.Error())
+		}
+		return
+	}
+
+	// One-shot mode for schedulers such as a Kubernetes CronJob.
+	if os.Getenv("RUN_ONCE") == "true" {
+		fmt.Println("Backup is running at:", time.Now().In(jkt).Format(time.DateTime))
+		if err := doBackup(); err != nil {
+			log.Printf("ERROR when doing backup: %s", err.Error())
+			if errors.Is(err, errManifestNotSaved) {
+				os.Exit(exitManifestNotSaved)
+			}
+			os.Exit(exitFailed)
+		}
+		return
+	}
+
 	cronExpression := os.Getenv("CRON_EXPRESSION")
 	if cronExpression == "" {
 		cronExpression = "0 15 * * * *"
 	}
 	cr := cron.New()
 
+	var running sync.Mutex
 	cr.AddFunc(cronExpression, func() {
+		running.Lock()
+		defer running.Unlock()
 		fmt.Println("Backup s running at:", time.Now().In(jkt).Format(time.DateTime))
 		if err := doBackup(); err != nil {
+			// Both leave the archives consistent, later runs may succeed.
+			if errors.Is(err, errManifestNotSaved) || errors.Is(err, backup.ErrStoreFull) {
+				log.Printf("ERROR when doing backup: %s", err.Error())
+				return
+			}
 			log.Fatalf("ERROR when doing backup: %s", err.Error())
 			return
 		}
 	})
 
+	// Pruning may run on its own schedule, e.g. daily while backups run
+	// hourly. It never overlaps a backup.
+	if pruneExpression := os.Getenv("PRUNE_CRON_EXPRESSION"); pruneExpression != "" {
+		cr.AddFunc(pruneExpression, func() {
+			running.Lock()
+			defer running.Unlock()
+			fmt.Println("Prune is running at:", time.Now().In(jkt).Format(time.DateTime))
+			if err := doPrune(false); err != nil {
+				log.Printf("ERROR when pruning archives: %s", err.Error())
+			}
+		})
+	}
+
+	// Scrubbing reads every archive back, which takes long and may cost
+	// egress, so it runs on its own, rarer schedule.
+	if scrubExpression := os.Getenv("SCRUB_CRON_EXPRESSION"); scrubExpression != "" {
+		cr.AddFunc(scrubExpression, func() {
+			running.Lock()
+			defer running.Unlock()
+			fmt.Println("Scrub is running at:", time.Now().In(jkt).Format(time.DateTime))
+			if err := doScrub(); err != nil {
+				log.Printf("ERROR when scrubbing archives: %s", err.Error())
+			}
+		})
+	}
+
 	cr.Start()
 
 	fmt.Println("CRON STARTED")
@@ -43,75 +195,229 @@ func main() {
 	select {}
 }
 
-func doBackup() error {
-	compressionLevel, _ := strconv.Atoi(os.Getenv("COMPRESSION_LEVEL"))
+// warnSafeMode warns on out when settings that delete archives are set while
+// safe mode is on, as it is by default. Safe mode only logs what they would
+// delete, so the archives pile up, and once MAX_STORE_SIZE is reached every
+// backup is refused.
+func warnSafeMode(out io.Writer) {
+	if os.Getenv("SAFE_MODE") == "false" || os.Getenv("RETENTION_DRY_RUN") == "true" {
+		return
+	}
+
+	var settings []string
+	for _, name := range []string{"MAX_ARCHIVES_PER_SOURCE", "RETENTION_DAILY", "RETENTION_WEEKLY", "RETENTION_MONTHLY", "RETENTION_MAX_AGE", "MAX_STORE_SIZE"} {
+		if value := os.Getenv(name); value != "" && value != "0" {
+			settings = append(settings, name)
+		}
+	}
+	if len(settings) > 0 {
+		fmt.Fprintf(out, "WARNING: %s delete nothing while safe mode is on, which it is by default; set SAFE_MODE=false to let them delete archives\n", strings.Join(settings, ", "))
+	}
+}
+
+func doBackup() (err error) {
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+
+	if err := b.CheckStorage(); err != nil {
+		return fmt.Errorf("ERROR when configuring storage backends: %s", err.Error())
+	}
+	if err := os.MkdirAll(b.ArchiveDir(), 0o755); err != nil {
+		return fmt.Errorf("ERROR when creating archive directory: %s", err.Error())
+	}
 
-	backup := backup.New(sourcePath, backupOutputPath, compressionLevel)
+	defer func() { pushMetrics(b.Report(), "", err) }()
 
-	newManifest, err := backup.BuildHybridOneLevelNestedJSON() // Use the recursive builder
+	newManifest, err := b.BuildHybridOneLevelNestedJSON() // Use the recursive builder
 	if err != nil {
 		fmt.Printf("Error building file system JSON: %v\n", err)
 		return err
 	}
 
-	oldManifest, err := openManifest()
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+
+	oldManifest, err := b.LoadManifest()
+	if errors.Is(err, backup.ErrManifestSignature) {
+		// An untrusted manifest could mark changed directories as backed
+		// up, or point retention at other files, so it is not used at all.
+		fmt.Printf("WARNING: ignoring the manifest, creating a full backup of every directory: %v\n", err)
+		err = nil
+	}
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			for _, fst := range newManifest {
-				fst.ModTime = time.Now().In(jkt).Format(time.RFC3339)
-				for _, c := range fst.Children {
-					c.ModTime = time.Now().In(jkt).Format(time.RFC3339)
-				}
-			}
-			if err := saveManifest(newManifest); err != nil {
-				return fmt.Errorf("ERROR when saving manifest: %s", err.Error())
-			}
-			fmt.Println("First manifest created")
-			return nil
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
 		}
 
-		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+		// Without a manifest every directory gets its first, full backup.
+		fmt.Println("No manifest found, creating a full backup of every directory")
 	}
 
+	if b.ContentChangeDetection {
+		b.Parallel(len(newManifest), func(i int) {
+			if err := b.HashContent(newManifest[i]); err != nil {
+				fmt.Printf("Warning: comparing %q by modification time, failed to hash its content: %v\n", newManifest[i].Name, err)
+			}
+		})
+	}
+
+	previous := make(map[string]*backup.DirectoryEntry)
 	for _, nm := range newManifest {
 		nm.IsNeedBackup = true
+		nm.Kind = backup.KindFull
 		for _, om := range oldManifest {
-			if nm.Name == om.Name && nm.ModTime == om.ModTime && !isChildModified(nm, om) {
+			if nm.Name != om.Name {
+				continue
+			}
+
+			previous[nm.Name] = om
+			nm.CarryArchiveFrom(om)
+			modified := nm.ModTime != om.ModTime || isChildModified(nm, om)
+			if nm.ContentHash != "" && om.ContentHash != "" {
+				modified = nm.ContentHash != om.ContentHash
+			}
+			// A directory whose last backup failed stays marked for backup.
+			if !modified && !om.IsNeedBackup {
 				nm.IsNeedBackup = false
-				break
+			} else if om.ZipPath != "" {
+				nm.Kind = backup.KindIncremental
+			} else {
+				nm.Kind = backup.KindFull
 			}
+			break
 		}
 	}
 
-	processedBackup := 0
-	// Iterate through the parent directories in the JSON response
-	// and create a zip file for each.
-	wg := new(sync.WaitGroup)
+	var pending []*backup.DirectoryEntry
+	recompress := 0
 	for _, nm := range newManifest {
 		if nm.IsNeedBackup {
-			processedBackup++
-			wg.Add(1)
-
-			go func() {
-				defer wg.Done()
-				parent := nm // Get a pointer to modify the original struct in the slice
-				parentDirFullPath := filepath.Join(sourcePath, parent.Name)
-				zipFileName := parent.Name + ".zip"
-				destZipPath := filepath.Join(backupOutputPath, zipFileName)
-				sourcePath := filepath.Join(sourcePath, parent.Name)
-
-				err := backup.ZipDirectory(sourcePath, destZipPath)
-				if err != nil {
-					fmt.Printf("Failed to zip directory %q: %v\n", parentDirFullPath, err)
-					return
-				}
+			pending = append(pending, nm)
+		} else if b.NeedsRecompression(nm) {
+			recompress++
+		}
+	}
+	if recompress > 0 {
+		fmt.Printf("%d unchanged archive(s) were written with different compression settings\n", recompress)
+	}
+
+	// A full store takes no new archives, the directories stay marked for
+	// backup and the next run tries again.
+	storeErr := b.EnforceStoreCap(newManifest, pending)
+	if storeErr != nil {
+		fmt.Printf("Refusing to back up %d directories: %v\n", len(pending), storeErr)
+		for _, parent := range pending {
+			parent.Kind = ""
+		}
+		pending = nil
+	}
+	processedBackup := len(pending)
 
-				fmt.Printf("Successfully zipped %q to %q\n", parentDirFullPath, destZipPath)
-				parent.ZipPath = destZipPath // Add zip path to JSON response
-			}()
+	// Create a zip file for each parent directory that needs a backup,
+	// using a bounded pool of workers.
+	b.Parallel(len(pending), func(i int) {
+		parent := pending[i] // Get a pointer to modify the original struct in the slice
+		parentDirFullPath := b.SourceDir(parent)
+		since := b.PlanIncremental(parent)
+		zipFileName := b.ArchiveName(parent, time.Now())
+		destZipPath := filepath.Join(b.ArchiveDir(), zipFileName)
+		sourcePath := parentDirFullPath
+
+		// On failure the directory keeps IsNeedBackup and its previous
+		// archive, so the next run tries again.
+		fail := func() {
+			parent.Kind = ""
+			if prev, ok := previous[parent.Name]; ok {
+				parent.CarryArchiveFrom(prev)
+			}
+			b.Report().RecordFailure()
+		}
+
+		release := b.ReserveStaging(parent)
+		defer release()
+
+		// Archives are verified before they replace the previous ones.
+		groupArchives, err := b.ZipDirectoryChanged(sourcePath, destZipPath, since)
+		if err != nil {
+			fmt.Printf("Failed to zip directory %q: %v\n", parentDirFullPath, err)
+			fail()
+			return
+		}
+
+		fmt.Printf("Successfully zipped %q to %q\n", parentDirFullPath, destZipPath)
+		parent.IsNeedBackup = false
+		parent.ZipPath = destZipPath // Add zip path to JSON response
+		parent.Compression = b.CompressionSettings(parent)
+		parent.GroupArchives = nil
+		if len(groupArchives) > 0 {
+			parent.GroupArchives = groupArchives
+		}
+		parent.RecordArchive(destZipPath, parent.GroupArchives, time.Now())
+		record := &parent.History[len(parent.History)-1]
+		record.RunID = b.Report().RunID
+		record.Partial = since != nil
+		if encryption := b.EncryptionFor(parent); encryption != nil {
+			record.KeyID = encryption.KeyID()
+		}
+		b.Report().RecordArchive(record.Size())
+		if b.AppendLogPath != "" {
+			// The log holds the whole archive, so it is appended before the
+			// archive is split into volumes.
+			if _, err := b.AppendToLog(parent.Name, destZipPath); err != nil {
+				fmt.Printf("Failed to append %q to backup log: %v\n", destZipPath, err)
+			}
+		}
+		if err := b.SplitArchives(record); err != nil {
+			fmt.Printf("Warning: keeping the archive of %q whole: %v\n", parentDirFullPath, err)
+		}
+		if err := b.RecordChecksums(record); err != nil {
+			fmt.Printf("Warning: failed to checksum the archive of %q: %v\n", parentDirFullPath, err)
+		}
+		if err := b.WriteParity(record); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+		if err := b.UploadArchive(context.Background(), record); err != nil {
+			fmt.Printf("Failed to upload archive of %q: %v\n", parentDirFullPath, err)
+			if errors.Is(err, backup.ErrChecksumMismatch) {
+				// A corrupted remote copy fails the backup, the next run
+				// writes and uploads the directory again.
+				parent.IsNeedBackup = true
+				b.Report().RecordFailure()
+			}
+		}
+		if b.RemoteOnly {
+			// Without a local copy the archive only counts once every
+			// backend holds it.
+			if err := b.Unstage(context.Background(), record); err != nil {
+				fmt.Printf("Failed to store archive of %q remotely: %v\n", parentDirFullPath, err)
+				parent.IsNeedBackup = true
+				parent.ZipPath, parent.GroupArchives = "", nil
+				parent.History = parent.History[:len(parent.History)-1]
+				fail()
+				return
+			}
+		}
+		b.EnforceArchiveCap(parent)
+		if parent.Kind == backup.KindFull {
+			parent.BaseArchive = destZipPath
+		}
+	})
+
+	// Retention also ages out archives of directories that were unchanged.
+	for _, entry := range newManifest {
+		b.ApplyRetention(entry)
+	}
+	if storeErr == nil {
+		if err := b.EnforceStoreCap(newManifest, nil); err != nil {
+			fmt.Printf("Warning: %v\n", err)
 		}
 	}
-	wg.Wait()
 
 	if processedBackup == 0 {
 		fmt.Println("There's nothing to backup")
@@ -119,15 +425,708 @@ func doBackup() error {
 		fmt.Println("Total processed backups:", processedBackup)
 	}
 
-	if err := saveManifest(newManifest); err != nil {
-		return fmt.Errorf("ERROR when saving manifest: %s", err.Error())
+	report := b.Report()
+	report.Processed = processedBackup
+	if storeErr != nil {
+		report.Error = storeErr.Error()
+	}
+	for pattern, stat := range report.Excluded {
+		fmt.Printf("Exclude %q matched %d item(s), %d bytes\n", pattern, stat.Count, stat.Bytes)
+	}
+	if b.DetectDuplicates {
+		// Archiving hashed the files it read, the directories left alone
+		// are hashed here.
+		b.Parallel(len(newManifest), func(i int) {
+			if !slices.Contains(pending, newManifest[i]) {
+				if err := b.RecordContents(newManifest[i]); err != nil {
+					fmt.Printf("Warning: failed to look for duplicates in %q: %v\n", newManifest[i].Name, err)
+				}
+			}
+		})
+		report.CollectDuplicates(10)
+		for _, set := range report.Duplicates {
+			fmt.Printf("Duplicate content in %d files wastes %d bytes: %s\n", len(set.Paths), set.WastedBytes, strings.Join(set.Paths, ", "))
+		}
+	}
+
+	if b.ThreeTwoOne {
+		b.VerifyCopies(context.Background(), newManifest)
+	}
+
+	// Archiving already succeeded at this point, so failing to save the
+	// manifest (e.g. a read-only output mount) must not fail the whole run.
+	var manifestErr error
+	if err := b.SaveManifest(newManifest); err != nil {
+		fmt.Printf("WARNING: archiving completed but the manifest could not be saved, the next run will redo this work: %v\n", err)
+		manifestErr = fmt.Errorf("%w: %s", errManifestNotSaved, err.Error())
+	} else {
+		for destination, err := range b.UploadManifest(context.Background()) {
+			if err != nil {
+				fmt.Printf("Failed to upload manifest to %s: %v\n", destination, err)
+			}
+		}
+		// Chunks only go once the saved manifest no longer lists the
+		// archives using them.
+		if err := b.PruneChunks(context.Background(), newManifest); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	if err := saveReport(report, "report.json"); err != nil {
+		fmt.Printf("Failed to save run report: %v\n", err)
 	}
 
 	fmt.Println()
 
+	if storeErr != nil {
+		return storeErr
+	}
+	return manifestErr
+}
+
+// doReencrypt re-encrypts every archive in the manifest written with another
+// key than the current one, see ReencryptArchives.
+func doReencrypt() error {
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+	if b.SafeMode {
+		return errors.New("ERROR: re-encrypting replaces archives, set SAFE_MODE=false to allow it")
+	}
+	if err := b.CheckStorage(); err != nil {
+		return fmt.Errorf("ERROR when configuring storage backends: %s", err.Error())
+	}
+
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+
+	migrated, err := b.ReencryptArchives(context.Background(), manifest)
+	fmt.Printf("Re-encrypted %d archive(s)\n", migrated)
+	if migrated > 0 {
+		if err := b.SaveManifest(manifest); err != nil {
+			return fmt.Errorf("ERROR when saving manifest: %s", err.Error())
+		}
+		for destination, err := range b.UploadManifest(context.Background()) {
+			if err != nil {
+				fmt.Printf("Failed to upload manifest to %s: %v\n", destination, err)
+			}
+		}
+	}
+
+	return err
+}
+
+// doPrune applies the retention settings to the archives in the manifest,
+// see Prune, and saves and uploads the manifest afterwards. A dry run only
+// lists what would be pruned.
+func doPrune(dryRun bool) error {
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		opts = append(opts, backup.WithRetentionDryRun(true))
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+	if err := b.CheckStorage(); err != nil {
+		return fmt.Errorf("ERROR when configuring storage backends: %s", err.Error())
+	}
+
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+
+	err = b.Prune(manifest)
+	if b.RetentionDryRun {
+		var size int64
+		for _, archive := range b.Report().WouldPrune {
+			size += archive.Bytes
+		}
+		fmt.Printf("Dry run: would prune %d archive(s), %d bytes\n", len(b.Report().WouldPrune), size)
+		return err
+	}
+	pruned := b.Report().Pruned
+	fmt.Printf("Pruned %d archive(s)\n", len(pruned))
+	if len(pruned) > 0 {
+		if err := b.SaveManifest(manifest); err != nil {
+			return fmt.Errorf("ERROR when saving manifest: %s", err.Error())
+		}
+		for destination, err := range b.UploadManifest(context.Background()) {
+			if err != nil {
+				fmt.Printf("Failed to upload manifest to %s: %v\n", destination, err)
+			}
+		}
+		if err := b.PruneChunks(context.Background(), manifest); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	return err
+}
+
+// doScrub reads back every copy of every archive and compares it with the
+// checksum recorded when it was written, see backup.Scrub. The outcome is
+// saved to scrub-report.json and pushed under the job name with "-scrub".
+func doScrub() (err error) {
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+	if err := b.CheckStorage(); err != nil {
+		return fmt.Errorf("ERROR when configuring storage backends: %s", err.Error())
+	}
+	defer func() { pushMetrics(b.Report(), "-scrub", err) }()
+
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+
+	corrupt := b.Scrub(context.Background(), manifest)
+	if err := saveReport(b.Report(), "scrub-report.json"); err != nil {
+		fmt.Printf("Failed to save the scrub report: %v\n", err)
+	}
+	if len(corrupt) > 0 {
+		// The directories are now marked for backup, the next run writes
+		// them again.
+		if err := b.SaveManifest(manifest); err != nil {
+			return fmt.Errorf("ERROR when saving manifest: %s", err.Error())
+		}
+		for destination, err := range b.UploadManifest(context.Background()) {
+			if err != nil {
+				fmt.Printf("Failed to upload manifest to %s: %v\n", destination, err)
+			}
+		}
+		return fmt.Errorf("%d corrupt archive copies, see scrub-report.json", len(corrupt))
+	}
 	return nil
 }
 
+// doVerify compares the sources selected by name or path, all of them when
+// selectors is empty, with their latest archives, see backup.DiffSource.
+func doVerify(selectors []string) error {
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+
+	var entries []*backup.DirectoryEntry
+	for _, entry := range manifest {
+		if len(selectors) == 0 || slices.Contains(selectors, entry.Name) || slices.Contains(selectors, b.SourceDir(entry)) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no source %s in the manifest", strings.Join(selectors, ", "))
+	}
+
+	differ := 0
+	var errs []error
+	for _, entry := range entries {
+		diff, err := b.DiffSource(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", entry.Name, err))
+			continue
+		}
+		for _, name := range diff.Added {
+			fmt.Printf("Added    %s/%s\n", entry.Name, name)
+		}
+		for _, name := range diff.Removed {
+			fmt.Printf("Removed  %s/%s\n", entry.Name, name)
+		}
+		for _, name := range diff.Modified {
+			fmt.Printf("Modified %s/%s\n", entry.Name, name)
+		}
+		if diff.Empty() {
+			fmt.Printf("%q matches %q\n", b.SourceDir(entry), diff.Archive)
+			continue
+		}
+		differ++
+		fmt.Printf("%q differs from %q: %d added, %d removed, %d modified\n", b.SourceDir(entry), diff.Archive, len(diff.Added), len(diff.Removed), len(diff.Modified))
+	}
+
+	if differ > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d source(s) differ from their latest archive", differ, len(entries)))
+	}
+	return errors.Join(errs...)
+}
+
+// doHold places the archives matching selectors under a legal hold, or
+// releases them, and saves and uploads the manifest.
+func doHold(held bool, selectors []string) error {
+	if len(selectors) == 0 {
+		return errors.New("no archives given, name them by path, file name or creation time")
+	}
+
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+	if err := b.CheckStorage(); err != nil {
+		return fmt.Errorf("ERROR when configuring storage backends: %s", err.Error())
+	}
+
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+
+	changed, err := backup.SetHold(manifest, selectors, held)
+	if held {
+		fmt.Printf("Placed %d archive(s) under a legal hold\n", changed)
+	} else {
+		fmt.Printf("Released %d archive(s) from a legal hold\n", changed)
+	}
+	if changed > 0 {
+		if err := b.SaveManifest(manifest); err != nil {
+			return fmt.Errorf("ERROR when saving manifest: %s", err.Error())
+		}
+		for destination, err := range b.UploadManifest(context.Background()) {
+			if err != nil {
+				fmt.Printf("Failed to upload manifest to %s: %v\n", destination, err)
+			}
+		}
+	}
+
+	return err
+}
+
+// doRestore restores the archive, run or source selected by selector, see
+// FindArchives, to target. The archives of a run go to a directory per
+// source below target. An archive missing from the manifest is restored from
+// its path. args hold "--as-of <time>" and the patterns of the files to
+// restore.
+func doRestore(selector, target string, args []string) error {
+	opts, asOf, patterns, err := restoreOptions(args)
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+
+	files := 0
+	var errs []error
+	archives, err := b.FindArchives(manifest, selector, asOf)
+	if err != nil {
+		return err
+	}
+	if len(archives) == 0 {
+		if _, err := os.Stat(selector); err != nil {
+			return fmt.Errorf("no archive, run or source %q as of %s in the manifest", selector, asOf.Format(time.RFC3339))
+		}
+		files, err = b.RestoreArchive(selector, target)
+		errs = append(errs, err)
+	}
+	var targets []backup.RestoreTarget
+	for _, name := range slices.Sorted(maps.Keys(archives)) {
+		record := archives[name]
+		dir := target
+		if record.RunID == selector {
+			dir = filepath.Join(target, name)
+		}
+		targets = append(targets, backup.RestoreTarget{Record: record, Dir: dir})
+	}
+	if len(targets) > 0 {
+		n, err := b.RestoreRecords(targets)
+		files += n
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if files == 0 && len(patterns) > 0 {
+		return fmt.Errorf("no file matches %s", strings.Join(patterns, ", "))
+	}
+	return nil
+}
+
+// doRestoreAll restores every directory in the manifest below target, see
+// backup.RestoreAll.
+func doRestoreAll(target string, args []string) error {
+	opts, asOf, patterns, err := restoreOptions(args)
+	if err != nil {
+		return err
+	}
+	b := backup.New(sourcePath, backupOutputPath, compressionLevelFromEnv(), opts...)
+
+	if source, err := b.FetchManifest(context.Background()); err != nil {
+		fmt.Printf("Warning: failed to fetch the manifest from remote storage: %v\n", err)
+	} else if source != "" {
+		fmt.Printf("Restored the manifest from %s\n", source)
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ERROR when opening manifest: %s", err.Error())
+	}
+	if len(manifest) == 0 {
+		return errors.New("the manifest holds no directories to restore")
+	}
+
+	files, err := b.RestoreAll(manifest, target, asOf)
+	if err != nil {
+		return err
+	}
+	if files == 0 && len(patterns) > 0 {
+		return fmt.Errorf("no file matches %s", strings.Join(patterns, ", "))
+	}
+	return nil
+}
+
+// restoreOptions configures a restore from the environment and the
+// arguments after its target: --as-of <time>, --on-conflict <policy>,
+// --dry-run, --yes and the patterns of the files to restore. Without --yes
+// overwriting existing files is confirmed first, see confirmOverwrite. It returns the time
+// to restore as of, now unless given, and the patterns.
+func restoreOptions(args []string) ([]backup.Option, time.Time, []string, error) {
+	opts, err := backupOptions()
+	if err != nil {
+		return nil, time.Time{}, nil, err
+	}
+	asOf := time.Now()
+	assumeYes := false
+	var patterns []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--dry-run" {
+			opts = append(opts, backup.WithRestoreDryRun(true))
+			continue
+		}
+		if args[i] == "--yes" {
+			assumeYes = true
+			continue
+		}
+		if args[i] != "--as-of" && args[i] != "--on-conflict" {
+			patterns = append(patterns, args[i])
+			continue
+		}
+		flag := args[i]
+		if i++; i == len(args) {
+			return nil, time.Time{}, nil, fmt.Errorf("%s needs a value", flag)
+		}
+		if flag == "--on-conflict" {
+			conflict, err := backup.ParseRestoreConflict(args[i])
+			if err != nil {
+				return nil, time.Time{}, nil, err
+			}
+			opts = append(opts, backup.WithRestoreConflict(conflict))
+			continue
+		}
+		if asOf, err = backup.ParseAsOf(args[i]); err != nil {
+			return nil, time.Time{}, nil, err
+		}
+	}
+	patterns, err = backup.ParseRestorePatterns(patterns)
+	if err != nil {
+		return nil, time.Time{}, nil, err
+	}
+
+	confirm := func(overwrites int) bool { return confirmOverwrite(overwrites, assumeYes, os.Stdin, os.Stdout) }
+	return append(opts, backup.WithRestorePatterns(patterns...), backup.WithRestoreConfirm(confirm)), asOf, patterns, nil
+}
+
+// backupOptions configures a backup from the environment.
+func backupOptions() ([]backup.Option, error) {
+	maxWorkers, _ := strconv.Atoi(os.Getenv("MAX_WORKERS"))
+	minCompressionLevel, _ := strconv.Atoi(os.Getenv("MIN_COMPRESSION_LEVEL"))
+	memoryPerWorkerMB, _ := strconv.ParseUint(os.Getenv("MEMORY_PER_WORKER_MB"), 10, 64)
+	rampUp, _ := time.ParseDuration(os.Getenv("WORKER_RAMP_UP"))
+	compressionWorkers, _ := strconv.Atoi(os.Getenv("COMPRESSION_WORKERS"))
+	if os.Getenv("COMPRESSION_WORKERS") == "auto" {
+		compressionWorkers = runtime.NumCPU()
+	}
+	maxArchivesPerSource, _ := strconv.Atoi(os.Getenv("MAX_ARCHIVES_PER_SOURCE"))
+	var retention backup.RetentionPolicy
+	retention.Daily, _ = strconv.Atoi(os.Getenv("RETENTION_DAILY"))
+	retention.Weekly, _ = strconv.Atoi(os.Getenv("RETENTION_WEEKLY"))
+	retention.Monthly, _ = strconv.Atoi(os.Getenv("RETENTION_MONTHLY"))
+	zstdLevel, _ := strconv.Atoi(os.Getenv("ZSTD_LEVEL"))
+	zstdWorkers, _ := strconv.Atoi(os.Getenv("ZSTD_WORKERS"))
+	xzLevel, _ := strconv.Atoi(os.Getenv("XZ_LEVEL"))
+	fullBackupEvery, _ := strconv.Atoi(os.Getenv("FULL_BACKUP_EVERY"))
+	// Unset timeouts keep their default, "0" disables one.
+	remoteTimeouts := backup.DefaultRemoteTimeouts
+	for name, timeout := range map[string]*time.Duration{
+		"REMOTE_UPLOAD_TIMEOUT":   &remoteTimeouts.Upload,
+		"REMOTE_DOWNLOAD_TIMEOUT": &remoteTimeouts.Download,
+		"REMOTE_LIST_TIMEOUT":     &remoteTimeouts.List,
+		"REMOTE_DELETE_TIMEOUT":   &remoteTimeouts.Delete,
+	} {
+		if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+			*timeout = d
+		}
+	}
+
+	sizeRules, err := backup.ParseSizeRules(os.Getenv("SIZE_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing SIZE_RULES: %s", err.Error())
+	}
+
+	checkpointInterval, _ := backup.ParseSize(os.Getenv("CHECKPOINT_INTERVAL"))
+
+	maxStagingSize, _ := backup.ParseSize(os.Getenv("MAX_STAGING_SIZE"))
+
+	volumeSize, _ := backup.ParseSize(os.Getenv("VOLUME_SIZE"))
+
+	var reproducibleTime time.Time
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR when parsing SOURCE_DATE_EPOCH: %s", err.Error())
+		}
+		reproducibleTime = time.Unix(seconds, 0).UTC()
+	}
+
+	if value := os.Getenv("RETENTION_MAX_AGE"); value != "" {
+		if retention.MaxAge, err = backup.ParseAge(value); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing RETENTION_MAX_AGE: %s", err.Error())
+		}
+	}
+
+	var maxStoreSize int64
+	if value := os.Getenv("MAX_STORE_SIZE"); value != "" {
+		if maxStoreSize, err = backup.ParseSize(value); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing MAX_STORE_SIZE: %s", err.Error())
+		}
+	}
+
+	var uploadBandwidthLimit int64
+	if value := os.Getenv("UPLOAD_BWLIMIT"); value != "" {
+		if uploadBandwidthLimit, err = backup.ParseSize(strings.TrimSuffix(value, "/s")); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing UPLOAD_BWLIMIT: %s", err.Error())
+		}
+	}
+
+	archiveFormat, err := backup.ParseArchiveFormat(os.Getenv("ARCHIVE_FORMAT"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing ARCHIVE_FORMAT: %s", err.Error())
+	}
+
+	formatRules, err := backup.ParseFormatRules(os.Getenv("ARCHIVE_FORMAT_RULES"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing ARCHIVE_FORMAT_RULES: %s", err.Error())
+	}
+
+	archiveNameTemplate, err := backup.ParseArchiveNameTemplate(os.Getenv("ARCHIVE_NAME_TEMPLATE"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing ARCHIVE_NAME_TEMPLATE: %s", err.Error())
+	}
+
+	parityRedundancy, err := backup.ParseRedundancy(os.Getenv("PARITY_REDUNDANCY"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing PARITY_REDUNDANCY: %s", err.Error())
+	}
+	restoreConflict, err := backup.ParseRestoreConflict(os.Getenv("RESTORE_CONFLICT"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing RESTORE_CONFLICT: %s", err.Error())
+	}
+
+	fileGroups, err := backup.ParseFileGroups(os.Getenv("FILE_GROUPS"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing FILE_GROUPS: %s", err.Error())
+	}
+
+	sources, err := readSourceList(os.Getenv("SOURCE_LIST_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading SOURCE_LIST_FILE: %s", err.Error())
+	}
+
+	zipPassword, err := secretFromEnv("ZIP_PASSWORD")
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading ZIP_PASSWORD_FILE: %s", err.Error())
+	}
+
+	config, err := configFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading secrets: %s", err.Error())
+	}
+
+	encryptionKey, err := secretFromEnv("ENCRYPTION_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading ENCRYPTION_KEY_FILE: %s", err.Error())
+	}
+	encryptionKeys, err := secretFromEnv("ENCRYPTION_KEYS")
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading ENCRYPTION_KEYS_FILE: %s", err.Error())
+	}
+	var encryption backup.Encryptor
+	ageRecipients := splitList(os.Getenv("AGE_RECIPIENTS"))
+	gpgRecipients := splitList(os.Getenv("GPG_RECIPIENTS"))
+	schemes := 0
+	kmsKey := os.Getenv("KMS_KEY")
+	for _, set := range []bool{encryptionKey != "", encryptionKeys != "", len(ageRecipients) > 0, len(gpgRecipients) > 0, kmsKey != ""} {
+		if set {
+			schemes++
+		}
+	}
+	if schemes > 1 {
+		return nil, fmt.Errorf("ERROR when parsing encryption settings: set only one of ENCRYPTION_KEY, ENCRYPTION_KEYS, AGE_RECIPIENTS, GPG_RECIPIENTS and KMS_KEY")
+	}
+	switch {
+	case encryptionKey != "":
+		if encryption, err = backup.NewGCMEncryptor(encryptionKey, os.Getenv("ENCRYPTION_KEY_ID")); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing ENCRYPTION_KEY: %s", err.Error())
+		}
+	case encryptionKeys != "":
+		if encryption, err = backup.NewGCMKeyring(encryptionKeys, os.Getenv("ENCRYPTION_KEY_ID")); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing ENCRYPTION_KEYS: %s", err.Error())
+		}
+	case len(ageRecipients) > 0:
+		if encryption, err = backup.NewAgeEncryptor(ageRecipients, os.Getenv("AGE_IDENTITY_FILE")); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing AGE_RECIPIENTS: %s", err.Error())
+		}
+	case len(gpgRecipients) > 0:
+		if encryption, err = backup.NewGPGEncryptor(gpgRecipients, os.Getenv("GPG_HOMEDIR"), os.Getenv("GPG_VERIFY_DECRYPT") == "true"); err != nil {
+			return nil, fmt.Errorf("ERROR when parsing GPG_RECIPIENTS: %s", err.Error())
+		}
+	case kmsKey != "":
+		wrapper, err := kmsWrapper(kmsKey, config)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR when parsing KMS_KEY: %s", err.Error())
+		}
+		encryption = backup.NewEnvelopeEncryptor(wrapper)
+	}
+	encryptionRulesValue, err := secretFromEnv("ENCRYPTION_KEY_RULES")
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading ENCRYPTION_KEY_RULES_FILE: %s", err.Error())
+	}
+	encryptionRules, err := backup.ParseEncryptionRules(encryptionRulesValue)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when parsing ENCRYPTION_KEY_RULES: %s", err.Error())
+	}
+
+	manifestSigningKey, err := secretFromEnv("MANIFEST_SIGNING_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when reading MANIFEST_SIGNING_KEY_FILE: %s", err.Error())
+	}
+
+	encryptManifest := os.Getenv("ENCRYPT_MANIFEST") == "true"
+	if encryptManifest && encryption == nil {
+		return nil, fmt.Errorf("ERROR when parsing ENCRYPT_MANIFEST: no archive encryption is configured")
+	}
+
+	backends, err := storageBackends(config)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR when configuring storage backends: %s", err.Error())
+	}
+
+	return []backup.Option{
+		backup.WithMinCompressionLevel(minCompressionLevel),
+		backup.WithMaxWorkers(maxWorkers),
+		backup.WithMemoryPerWorker(memoryPerWorkerMB << 20),
+		backup.WithRampUp(rampUp),
+		backup.WithAppendLog(os.Getenv("APPEND_LOG_PATH")),
+		backup.WithCheckpointInterval(checkpointInterval),
+		backup.WithExcludes(splitList(os.Getenv("EXCLUDE_PATTERNS"))...),
+		backup.WithFailOnUnreadable(os.Getenv("FAIL_ON_UNREADABLE") == "true"),
+		backup.WithSizeRules(sizeRules),
+		backup.WithStoreExtensions(backup.ParseStoreExtensions(os.Getenv("STORE_EXTENSIONS"))),
+		backup.WithSafeMode(os.Getenv("SAFE_MODE") != "false"),
+		backup.WithSources(sources, os.Getenv("ARCHIVE_NAMING")),
+		backup.WithMetadataSidecar(os.Getenv("METADATA_SIDECAR") == "true"),
+		backup.WithFailOnEmptySource(os.Getenv("FAIL_ON_EMPTY_SOURCE") == "true"),
+		backup.WithCompressionWorkers(compressionWorkers),
+		backup.WithDetectDuplicates(os.Getenv("DETECT_DUPLICATES") == "true"),
+		backup.WithLabelArchives(os.Getenv("LABEL_ARCHIVES") == "true"),
+		backup.WithArchiveNameTemplate(archiveNameTemplate),
+		backup.WithRemoteTimeouts(remoteTimeouts),
+		backup.WithFileGroups(fileGroups),
+		backup.WithReservedPaths(splitList(os.Getenv("RESERVED_PATHS"))...),
+		backup.WithMaxArchivesPerSource(maxArchivesPerSource),
+		backup.WithRetention(retention),
+		backup.WithMaxStoreSize(maxStoreSize),
+		backup.WithRetentionDryRun(os.Getenv("RETENTION_DRY_RUN") == "true"),
+		backup.WithRestoreConflict(restoreConflict),
+		backup.WithPreserveXattrs(os.Getenv("PRESERVE_XATTRS") == "true"),
+		backup.WithBackends(backends...),
+		backup.WithUploadBandwidthLimit(uploadBandwidthLimit),
+		backup.WithVerifyUploads(os.Getenv("VERIFY_UPLOADS") != "false"),
+		backup.WithVerifyArchiveContent(os.Getenv("VERIFY_ARCHIVE_CONTENT") == "true"),
+		backup.WithManifestFileChecksums(os.Getenv("MANIFEST_FILE_CHECKSUMS") == "true"),
+		backup.WithContentChangeDetection(os.Getenv("CONTENT_CHANGE_DETECTION") == "true"),
+		backup.WithParityRedundancy(parityRedundancy),
+		backup.WithIncrementalBackups(os.Getenv("INCREMENTAL_BACKUPS") == "true", fullBackupEvery),
+		backup.WithDifferentialBackups(os.Getenv("DIFFERENTIAL_BACKUPS") == "true"),
+		backup.WithThreeTwoOne(os.Getenv("THREE_TWO_ONE") == "true"),
+		backup.WithRemoteOnly(os.Getenv("REMOTE_ONLY") == "true", os.Getenv("STAGING_DIR"), maxStagingSize),
+		backup.WithStreamUploads(os.Getenv("STREAM_UPLOADS") == "true"),
+		backup.WithEncryption(encryption),
+		backup.WithEncryptManifest(encryptManifest),
+		backup.WithManifestSigningKey([]byte(manifestSigningKey)),
+		backup.WithEncryptionRules(encryptionRules),
+		backup.WithEmbedMetadata(os.Getenv("EMBED_METADATA") == "true"),
+		backup.WithReproducible(os.Getenv("REPRODUCIBLE_ARCHIVES") == "true", reproducibleTime),
+		backup.WithArchiveFormat(archiveFormat),
+		backup.WithZstd(zstdLevel, zstdWorkers),
+		backup.WithXzLevel(xzLevel),
+		backup.WithFormatRules(formatRules),
+		backup.WithVolumeSize(volumeSize),
+		backup.WithForceZip64(os.Getenv("FORCE_ZIP64") == "true"),
+		backup.WithZipPassword(zipPassword),
+	}, nil
+}
+
+// kmsWrapper returns the KeyWrapper of the KMS key: a Google Cloud KMS crypto
+// key when it is a resource name starting with "projects/", an AWS KMS key ID,
+// ARN or alias otherwise.
+func kmsWrapper(key string, config func(string) string) (backup.KeyWrapper, error) {
+	if strings.HasPrefix(key, "projects/") {
+		credentials := config("KMS_CREDENTIALS_FILE")
+		if credentials == "" {
+			credentials = config("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		return backup.NewGCPKMS(key, credentials, config("KMS_ENDPOINT"))
+	}
+
+	region := config("KMS_REGION")
+	if region == "" {
+		region = config("AWS_REGION")
+	}
+	return backup.NewAWSKMS(key, region, config("KMS_ENDPOINT"),
+		config("AWS_ACCESS_KEY_ID"), config("AWS_SECRET_ACCESS_KEY"), config("AWS_SESSION_TOKEN"))
+}
+
 func isChildModified(newManifest, oldManifest *backup.DirectoryEntry) bool {
 	if len(newManifest.Children) != len(oldManifest.Children) {
 		return true
@@ -157,30 +1156,165 @@ func isChildModified(newManifest, oldManifest *backup.DirectoryEntry) bool {
 
 }
 
-func saveManifest(newManifest []*backup.DirectoryEntry) error {
-	m, _ := json.MarshalIndent(newManifest, "", "\t")
-	file, err := os.Create(filepath.Join(backupOutputPath, "manifest.json"))
+// saveReport writes report to the file name in the output path.
+func saveReport(report *backup.Report, name string) error {
+	report.FinishedAt = time.Now().In(jkt).Format(time.RFC3339)
+	r, _ := json.MarshalIndent(report, "", "\t")
+
+	return os.WriteFile(filepath.Join(backupOutputPath, name), r, 0o644)
+}
+
+// pushMetrics pushes report, failed with err, to PUSHGATEWAY_URL when set,
+// under PUSHGATEWAY_JOB followed by suffix and PUSHGATEWAY_INSTANCE.
+func pushMetrics(report *backup.Report, suffix string, err error) {
+	gateway := os.Getenv("PUSHGATEWAY_URL")
+	if gateway == "" {
+		return
+	}
+	job := os.Getenv("PUSHGATEWAY_JOB")
+	if job == "" {
+		job = "backup-tools-go"
+	}
 	if err != nil {
-		return err
+		report.Error = err.Error()
 	}
 
-	file.Write(m)
-	defer file.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := backup.PushMetrics(ctx, gateway, job+suffix, os.Getenv("PUSHGATEWAY_INSTANCE"), report); err != nil {
+		fmt.Printf("Failed to push metrics: %v\n", err)
+	}
+}
 
-	return nil
+// splitList splits a comma separated environment value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
 
-func openManifest() ([]*backup.DirectoryEntry, error) {
-	var fileSystemTree []*backup.DirectoryEntry
+// readSourceList reads one source directory per line from path, skipping
+// blank lines and # comments. An empty path means no source list.
+func readSourceList(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
 
-	m, err := os.Open(filepath.Join(backupOutputPath, "manifest.json"))
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.NewDecoder(m).Decode(&fileSystemTree); err != nil {
-		return nil, err
+	var sources []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			sources = append(sources, line)
+		}
+	}
+
+	return sources, nil
+}
+
+// secretVariables hold passwords, API keys and tokens of the storage backends
+// and KMS. Like ZIP_PASSWORD and ENCRYPTION_KEY, each can be read from the
+// file named by <name>_FILE instead, see secretFromEnv.
+var secretVariables = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY",
+	"AZURE_STORAGE_SAS_TOKEN",
+	"B2_KEY_ID", "B2_APPLICATION_KEY",
+	"DROPBOX_ACCESS_TOKEN", "DROPBOX_APP_KEY", "DROPBOX_APP_SECRET", "DROPBOX_REFRESH_TOKEN",
+	"FTP_PASSWORD",
+	"GDRIVE_CLIENT_SECRET", "GDRIVE_REFRESH_TOKEN",
+	"SMB_PASSWORD",
+	"WEBDAV_PASSWORD",
+}
+
+// configFromEnv returns a lookup of configuration values in the environment
+// that reads secretVariables from their files when <name>_FILE is set.
+func configFromEnv() (func(string) string, error) {
+	secrets := make(map[string]string, len(secretVariables))
+	for _, name := range secretVariables {
+		value, err := secretFromEnv(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		secrets[name] = value
+	}
+
+	return func(name string) string {
+		if value, ok := secrets[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	}, nil
+}
+
+// secretFromEnv returns the value of the variable name, or the content of the
+// file named by name_FILE, e.g. a Docker secret, without its final newline.
+func secretFromEnv(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// compressionLevelFromEnv reads COMPRESSION_LEVEL. Unset or empty means the
+// deflate default, an explicit 0 stores files without compression.
+func compressionLevelFromEnv() int {
+	value := strings.TrimSpace(os.Getenv("COMPRESSION_LEVEL"))
+	if value == "" {
+		fmt.Println("Using default compression level")
+		return flate.DefaultCompression
+	}
+
+	level, err := strconv.Atoi(value)
+	if err != nil || level < flate.HuffmanOnly || level > flate.BestCompression {
+		fmt.Printf("Invalid COMPRESSION_LEVEL %q, using default compression level\n", value)
+		return flate.DefaultCompression
+	}
+
+	if level == flate.NoCompression {
+		fmt.Println("Compression level 0, files are stored without compression")
+	} else {
+		fmt.Println("Using compression level", level)
+	}
+
+	return level
+}
+
+// storageBackends creates the backends named in STORAGE_BACKENDS or, when it
+// is unset, every registered backend that has its settings configured.
+func storageBackends(config func(string) string) ([]backup.StorageBackend, error) {
+	names := splitList(os.Getenv("STORAGE_BACKENDS"))
+	explicit := len(names) > 0
+	if !explicit {
+		names = backup.Backends()
+	}
+
+	var backends []backup.StorageBackend
+	for _, name := range names {
+		s, err := backup.NewBackend(name, config)
+		if errors.Is(err, backup.ErrBackendNotConfigured) && !explicit {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		backends = append(backends, s)
 	}
 
-	return fileSystemTree, nil
+	return backends, nil
 }
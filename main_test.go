@@ -0,0 +1,670 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicodwik/backup-tools-go/backup"
+)
+
+// withStdin replaces os.Stdin with a file holding input, which is not a
+// terminal, until the test ends.
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = f
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		f.Close()
+	})
+}
+
+func TestRestoreOverwriteNeedsConfirmation(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("backed up"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "dir.zip")
+	if err := backup.New(src, filepath.Dir(archive), -1).ZipDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	existing := filepath.Join(target, "file.txt")
+	if err := os.WriteFile(existing, []byte("current"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	withStdin(t, "y\n")
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "current"},
+		{[]string{"--yes"}, "backed up"},
+	} {
+		opts, _, _, err := restoreOptions(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = backup.New(src, t.TempDir(), -1, opts...).RestoreArchive(archive, target)
+		if tt.args == nil && !errors.Is(err, backup.ErrRestoreAborted) {
+			t.Errorf("restore without --yes and no terminal returned %v, want it aborted", err)
+		}
+		if tt.args != nil && err != nil {
+			t.Errorf("restore with --yes: %v", err)
+		}
+		if got, _ := os.ReadFile(existing); string(got) != tt.want {
+			t.Errorf("restore with %q left %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestConfirmOverwrite(t *testing.T) {
+	withStdin(t, "y\n")
+	if !confirmOverwrite(0, false, os.Stdin, os.Stdout) {
+		t.Error("a restore overwriting nothing was not confirmed")
+	}
+	if confirmOverwrite(2, false, os.Stdin, os.Stdout) {
+		t.Error("overwrites were confirmed without a terminal")
+	}
+	if !confirmOverwrite(2, true, os.Stdin, os.Stdout) {
+		t.Error("overwrites were not confirmed with --yes")
+	}
+}
+
+func TestConfirmOverwriteAnswers(t *testing.T) {
+	terminal := isTerminal
+	isTerminal = func(io.Reader) bool { return true }
+	t.Cleanup(func() { isTerminal = terminal })
+
+	for _, tt := range []struct {
+		answer string
+		want   bool
+	}{
+		{"y\n", true},
+		{"Y\n", true},
+		{" yes \n", true},
+		{"N\n", false},
+		{"n\n", false},
+		{"\n", false},
+		{"", false}, // Input closed without an answer
+		{"yep\n", false},
+	} {
+		var out strings.Builder
+		if got := confirmOverwrite(3, false, strings.NewReader(tt.answer), &out); got != tt.want {
+			t.Errorf("answering %q confirmed %v, want %v", tt.answer, got, tt.want)
+		}
+		if !strings.Contains(out.String(), "overwrite 3 existing file(s)") {
+			t.Errorf("answering %q, the question was %q", tt.answer, out.String())
+		}
+	}
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+func TestRestoreRunConfirmsEveryOverwriteOnce(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	writeAt(t, filepath.Join(src, "app"), "a.txt", "a1", 1)
+	writeAt(t, filepath.Join(src, "app"), "b.txt", "b1", 1)
+	writeAt(t, filepath.Join(src, "docs"), "c.txt", "c1", 1)
+	writeAt(t, filepath.Join(src, "docs"), "d.txt", "d1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	run := history(t, out, "app")[0].RunID
+
+	target := t.TempDir()
+	existing := map[string]string{"app/a.txt": "mine", "app/b.txt": "mine", "docs/c.txt": "mine"}
+	for name, content := range existing {
+		writeAt(t, target, name, content, 2)
+	}
+	terminal := isTerminal
+	isTerminal = func(io.Reader) bool { return true }
+	t.Cleanup(func() { isTerminal = terminal })
+	withStdin(t, "n\n")
+
+	var err error
+	printed := captureStdout(t, func() { err = doRestore(run, target, nil) })
+	if !errors.Is(err, backup.ErrRestoreAborted) {
+		t.Errorf("declining the restore returned %v, want ErrRestoreAborted", err)
+	}
+	if n := strings.Count(printed, "Continue?"); n != 1 {
+		t.Errorf("asked %d times, want once for both archives:\n%s", n, printed)
+	}
+	if !strings.Contains(printed, "overwrite 3 existing file(s)") {
+		t.Errorf("the question does not count the files of both archives:\n%s", printed)
+	}
+	if got := treeFiles(t, target); !maps.Equal(got, existing) {
+		t.Errorf("the target holds %q after declining, want it untouched", got)
+	}
+}
+
+// withPaths points the source and output paths at src and out until the test
+// ends.
+func withPaths(t *testing.T, src, out string) {
+	t.Helper()
+	source, output := sourcePath, backupOutputPath
+	sourcePath, backupOutputPath = src, out
+	t.Cleanup(func() { sourcePath, backupOutputPath = source, output })
+}
+
+func TestBrokenArchiveKeepsDirectoryMarkedForBackup(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	writeAt(t, filepath.Join(src, "app"), "a.txt", "a1", 1)
+
+	written := backup.ArchiveWritten
+	t.Cleanup(func() { backup.ArchiveWritten = written })
+	backup.ArchiveWritten = func(tmp string) {
+		// Cut the end of central directory record off.
+		data, err := os.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(tmp, int64(bytes.LastIndex(data, []byte("PK\x05\x06")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report backup.Report
+	if err := json.Unmarshal(data, &report); err != nil || report.Failed != 1 {
+		t.Errorf("report lists %d failed directories, %v, want the broken archive counted", report.Failed, err)
+	}
+
+	manifest, err := backup.New(src, out, -1).LoadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || !manifest[0].IsNeedBackup || len(manifest[0].History) != 0 {
+		t.Fatalf("after a broken archive the manifest holds %+v, want app still marked for backup", manifest)
+	}
+
+	backup.ArchiveWritten = written
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	records := history(t, out, "app")
+	if len(records) != 1 {
+		t.Fatalf("the next run wrote %d archives, want app archived again", len(records))
+	}
+	if got := archiveFiles(t, records[0].Path); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("the archive holds %q, want a.txt", got)
+	}
+}
+
+func TestBackupWithUnwritableManifest(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// manifestDir returns the directory the manifest links into.
+		manifestDir func(t *testing.T) string
+	}{
+		// The case reported: the manifest is a mounted read-only reference.
+		// Root writes to read-only directories, so this cannot fail as root.
+		{"read-only directory", func(t *testing.T) string {
+			if os.Geteuid() == 0 {
+				t.Skip("root writes to read-only directories")
+			}
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "manifest.json"), []byte("[]"), 0o444); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, 0o555); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chmod(dir, 0o755) })
+			return dir
+		}},
+		// A volume that is not mounted fails the same way for every user,
+		// root included, so the case is covered wherever the tests run.
+		{"missing directory", func(t *testing.T) string {
+			return filepath.Join(t.TempDir(), "unmounted")
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src, out := t.TempDir(), t.TempDir()
+			if err := os.MkdirAll(filepath.Join(src, "app"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(src, "app", "file.txt"), []byte("data"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// The manifest is saved next to the file it links to, see
+			// SaveManifest.
+			if err := os.Symlink(filepath.Join(tt.manifestDir(t), "manifest.json"), filepath.Join(out, "manifest.json")); err != nil {
+				t.Fatal(err)
+			}
+			withPaths(t, src, out)
+
+			if err := doBackup(); !errors.Is(err, errManifestNotSaved) {
+				t.Fatalf("doBackup returned %v, want errManifestNotSaved", err)
+			}
+			if archives, _ := filepath.Glob(filepath.Join(out, "app-full-*.zip")); len(archives) != 1 {
+				t.Errorf("the archive was not kept, output holds %q", archives)
+			}
+			data, err := os.ReadFile(filepath.Join(out, "report.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report backup.Report
+			if err := json.Unmarshal(data, &report); err != nil || report.Processed != 1 || report.Failed != 0 {
+				t.Errorf("report lists %d processed and %d failed directories, %v, want the archive counted", report.Processed, report.Failed, err)
+			}
+		})
+	}
+}
+
+func TestCompressionLevelFromEnv(t *testing.T) {
+	t.Setenv("COMPRESSION_LEVEL", "")
+	os.Unsetenv("COMPRESSION_LEVEL")
+	if got := compressionLevelFromEnv(); got != flate.DefaultCompression {
+		t.Errorf("unset COMPRESSION_LEVEL = %d, want the default", got)
+	}
+
+	for value, want := range map[string]int{
+		"":    flate.DefaultCompression,
+		"0":   flate.NoCompression,
+		"9":   flate.BestCompression,
+		" 5 ": 5,
+		"abc": flate.DefaultCompression,
+		"12":  flate.DefaultCompression,
+	} {
+		t.Setenv("COMPRESSION_LEVEL", value)
+		if got := compressionLevelFromEnv(); got != want {
+			t.Errorf("COMPRESSION_LEVEL %q = %d, want %d", value, got, want)
+		}
+	}
+}
+
+// treeFiles returns the content of every file below dir by slash separated
+// path.
+func treeFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// writeAt writes content to the file name below dir, modified the given
+// number of hours after a fixed time, so every change is seen whatever the
+// resolution of the manifest.
+func writeAt(t *testing.T, dir, name, content string, hour int) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 1, 1, hour, 0, 0, 0, time.UTC)
+	for p := path; p != filepath.Dir(dir); p = filepath.Dir(p) {
+		if err := os.Chtimes(p, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// history returns the archives of the directory name, oldest first.
+func history(t *testing.T, out, name string) []backup.ArchiveRecord {
+	t.Helper()
+	manifest, err := backup.New(t.TempDir(), out, -1).LoadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range manifest {
+		if entry.Name == name {
+			return entry.History
+		}
+	}
+	return nil
+}
+
+// kinds returns the kinds of records.
+func kinds(records []backup.ArchiveRecord) []string {
+	var kinds []string
+	for _, record := range records {
+		kinds = append(kinds, record.Kind)
+	}
+	return kinds
+}
+
+// archiveFiles returns the sorted names of the files in the zip at path.
+func archiveFiles(t *testing.T, path string) []string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() {
+			names = append(names, f.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestIncrementalChainRestore(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	t.Setenv("INCREMENTAL_BACKUPS", "true")
+	t.Setenv("FULL_BACKUP_EVERY", "2")
+	t.Setenv("ARCHIVE_NAME_TEMPLATE", "{dir}-{kind}-{runid}")
+	app := filepath.Join(src, "app")
+
+	writeAt(t, app, "a.txt", "a1", 1)
+	writeAt(t, app, "b.txt", "b1", 1)
+	writeAt(t, app, "sub/c.txt", "c1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeAt(t, app, "a.txt", "a2", 2)
+	if err := os.Remove(filepath.Join(app, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, app, "d.txt", "d2", 2)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeAt(t, app, "sub/c.txt", "c3", 3)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	records := history(t, out, "app")
+	if got, want := kinds(records), []string{backup.KindFull, backup.KindIncremental, backup.KindIncremental}; !slices.Equal(got, want) {
+		t.Fatalf("archives are %q, want %q", got, want)
+	}
+	for i, want := range [][]string{{"a.txt", "b.txt", "sub/c.txt"}, {"a.txt", "d.txt"}, {"sub/c.txt"}} {
+		if got := archiveFiles(t, records[i].Path); !slices.Equal(got, want) {
+			t.Errorf("archive %d holds %q, want %q", i, got, want)
+		}
+	}
+
+	want := map[string]string{"a.txt": "a2", "d.txt": "d2", "sub/c.txt": "c3"}
+	target := t.TempDir()
+	if err := doRestore("app", target, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeFiles(t, target); !maps.Equal(got, want) {
+		t.Errorf("restoring the chain gave %q, want %q", got, want)
+	}
+
+	// Two partial archives follow the full backup, the next run starts a new
+	// chain.
+	writeAt(t, app, "a.txt", "a4", 4)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if got := kinds(history(t, out, "app")); len(got) != 4 || got[3] != backup.KindFull {
+		t.Fatalf("archives are %q, want a full backup last", got)
+	}
+	want["a.txt"] = "a4"
+	target = t.TempDir()
+	if err := doRestore("app", target, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeFiles(t, target); !maps.Equal(got, want) {
+		t.Errorf("restoring the new full backup gave %q, want %q", got, want)
+	}
+}
+
+func TestDifferentialArchivesHoldChangesSinceFullBackup(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	t.Setenv("DIFFERENTIAL_BACKUPS", "true")
+	t.Setenv("ARCHIVE_NAME_TEMPLATE", "{dir}-{kind}-{runid}")
+	app := filepath.Join(src, "app")
+
+	writeAt(t, app, "a.txt", "a1", 1)
+	writeAt(t, app, "b.txt", "b1", 1)
+	writeAt(t, app, "c.txt", "c1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, app, "a.txt", "a2", 2)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, app, "b.txt", "b3", 3)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := history(t, out, "app")
+	if got, want := kinds(records), []string{backup.KindFull, backup.KindDifferential, backup.KindDifferential}; !slices.Equal(got, want) {
+		t.Fatalf("archives are %q, want %q", got, want)
+	}
+	// An incremental would only hold b.txt.
+	if got, want := archiveFiles(t, records[2].Path), []string{"a.txt", "b.txt"}; !slices.Equal(got, want) {
+		t.Errorf("the second differential holds %q, want every file changed since the full backup %q", got, want)
+	}
+
+	target := t.TempDir()
+	if err := doRestore("app", target, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := treeFiles(t, target), map[string]string{"a.txt": "a2", "b.txt": "b3", "c.txt": "c1"}; !maps.Equal(got, want) {
+		t.Errorf("restoring the differential gave %q, want %q", got, want)
+	}
+}
+
+func TestSafeModeKeepsEveryRun(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	app := filepath.Join(src, "app")
+
+	writeAt(t, app, "a.txt", "a1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	// Archive names have second resolution.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	writeAt(t, app, "a.txt", "a2", 2)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := history(t, out, "app")
+	if len(records) != 2 || records[0].Path == records[1].Path {
+		t.Fatalf("history holds %v, want an archive for each run", records)
+	}
+	for i, want := range []string{"a1", "a2"} {
+		target := t.TempDir()
+		if _, err := backup.New(t.TempDir(), out, -1).RestoreArchive(records[i].Path, target); err != nil {
+			t.Fatal(err)
+		}
+		if got := treeFiles(t, target)["a.txt"]; got != want {
+			t.Errorf("archive %d holds %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestWarnSafeMode(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string // Settings named by the warning, none when empty
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"RETENTION_DAILY": "7", "MAX_STORE_SIZE": "200GB"}, "RETENTION_DAILY, MAX_STORE_SIZE"},
+		{map[string]string{"MAX_ARCHIVES_PER_SOURCE": "0"}, ""},
+		{map[string]string{"RETENTION_DAILY": "7", "SAFE_MODE": "false"}, ""},
+		{map[string]string{"RETENTION_DAILY": "7", "RETENTION_DRY_RUN": "true"}, ""},
+	} {
+		for _, name := range []string{"SAFE_MODE", "RETENTION_DRY_RUN", "MAX_ARCHIVES_PER_SOURCE", "RETENTION_DAILY", "RETENTION_WEEKLY", "RETENTION_MONTHLY", "RETENTION_MAX_AGE", "MAX_STORE_SIZE"} {
+			t.Setenv(name, tt.env[name])
+		}
+		var out strings.Builder
+		warnSafeMode(&out)
+
+		switch {
+		case tt.want == "" && out.Len() > 0:
+			t.Errorf("%v: warned %q", tt.env, out.String())
+		case tt.want != "" && !strings.HasPrefix(out.String(), "WARNING: "+tt.want+" delete nothing"):
+			t.Errorf("%v: warned %q, want a warning naming %s", tt.env, out.String(), tt.want)
+		}
+	}
+}
+
+func TestScrubFailsOnCorruptArchive(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	writeAt(t, filepath.Join(src, "app"), "a.txt", "a1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := doScrub(); err != nil {
+		t.Fatalf("scrubbing sound archives: %v", err)
+	}
+
+	archive := history(t, out, "app")[0].Path
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(archive, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := doScrub(); err == nil {
+		t.Fatal("scrubbing a corrupt archive succeeded")
+	}
+
+	manifest, err := backup.New(src, out, -1).LoadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || !manifest[0].IsNeedBackup || len(manifest[0].History[0].Corruption) != 1 {
+		t.Errorf("the manifest does not record the corruption and mark app for backup: %+v", manifest)
+	}
+	data, err = os.ReadFile(filepath.Join(out, "scrub-report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report backup.Report
+	if err := json.Unmarshal(data, &report); err != nil || len(report.Corrupt) != 1 || report.Corrupt[0].Archive != archive {
+		t.Errorf("scrub-report.json lists %+v, %v, want %s", report.Corrupt, err, archive)
+	}
+}
+
+func TestContentChangeDetectionIgnoresTouchedFiles(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	t.Setenv("CONTENT_CHANGE_DETECTION", "true")
+	app := filepath.Join(src, "app")
+
+	writeAt(t, app, "a.txt", "a1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	// Touched and rewritten with the same content.
+	writeAt(t, app, "a.txt", "a1", 2)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if records := history(t, out, "app"); len(records) != 1 {
+		t.Fatalf("history holds %d archives after touching a file, want 1", len(records))
+	}
+
+	// Archive names have second resolution.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	writeAt(t, app, "a.txt", "a3", 2)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+	if records := history(t, out, "app"); len(records) != 2 {
+		t.Errorf("history holds %d archives after changing a file with the same time, want 2", len(records))
+	}
+}
+
+func TestVerifyFailsOnChangedSource(t *testing.T) {
+	src, out := t.TempDir(), t.TempDir()
+	withPaths(t, src, out)
+	app := filepath.Join(src, "app")
+	writeAt(t, app, "a.txt", "a1", 1)
+	writeAt(t, filepath.Join(src, "docs"), "b.txt", "b1", 1)
+	if err := doBackup(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, selectors := range [][]string{nil, {"app"}, {app}} {
+		if err := doVerify(selectors); err != nil {
+			t.Errorf("verify %q right after the backup: %v", selectors, err)
+		}
+	}
+	if err := doVerify([]string{"missing"}); err == nil {
+		t.Error("verifying a source not in the manifest succeeded")
+	}
+
+	// Same size and time, only the checksum differs.
+	writeAt(t, app, "a.txt", "a2", 1)
+	if err := doVerify(nil); err == nil {
+		t.Error("verify succeeded with a modified file")
+	}
+	if err := doVerify([]string{"docs"}); err != nil {
+		t.Errorf("verify of an unchanged source failed with another one changed: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// waitUntilReady blocks until the source can be read and the output can be
+// written, retrying with exponential backoff for at most maxWait. Slow
+// booting dependencies such as network mounts would otherwise make the first
+// run fail.
+func waitUntilReady(maxWait time.Duration) error {
+	return waitFor(checkReady, maxWait, time.Second)
+}
+
+// waitFor calls ready until it succeeds, first after delay, doubling it up to
+// 30 seconds, and a last time at maxWait.
+func waitFor(ready func() error, maxWait, delay time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+
+	for {
+		err := ready()
+		if err == nil {
+			return nil
+		}
+
+		wait := min(delay, time.Until(deadline))
+		if wait <= 0 {
+			return fmt.Errorf("not ready after %s: %w", maxWait, err)
+		}
+
+		fmt.Printf("Waiting %s for storage to become ready: %v\n", wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+func checkReady() error {
+	if _, err := os.ReadDir(sourcePath); err != nil {
+		return fmt.Errorf("source %q is not readable: %w", sourcePath, err)
+	}
+
+	probe, err := os.CreateTemp(backupOutputPath, ".ready-*")
+	if err != nil {
+		return fmt.Errorf("output %q is not writable: %w", backupOutputPath, err)
+	}
+	probe.Close()
+
+	return os.Remove(probe.Name())
+}
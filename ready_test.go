@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForDelayedAvailability(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		readyAt int
+		maxWait time.Duration
+		delay   time.Duration
+		want    bool
+	}{
+		{"ready after backoff", 4, time.Second, time.Millisecond, true},
+		// The second delay ends past maxWait, the last check is at maxWait.
+		{"ready at the deadline", 3, 30 * time.Millisecond, 20 * time.Millisecond, true},
+		{"never ready", 1000, 30 * time.Millisecond, 20 * time.Millisecond, false},
+	} {
+		attempts := 0
+		probe := func() error {
+			if attempts++; attempts < tt.readyAt {
+				return errors.New("not mounted")
+			}
+			return nil
+		}
+
+		start := time.Now()
+		err := waitFor(probe, tt.maxWait, tt.delay)
+		if (err == nil) != tt.want {
+			t.Errorf("%s: waitFor returned %v after %d attempts", tt.name, err, attempts)
+		}
+		if !tt.want && time.Since(start) < tt.maxWait {
+			t.Errorf("%s: gave up after %s, before %s", tt.name, time.Since(start), tt.maxWait)
+		}
+	}
+}